@@ -0,0 +1,233 @@
+package cart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ActivityKey is the sorted set of cart IDs scored by the Unix time of their last change
+const ActivityKey = "cart:activity"
+
+// Fields of a cart's abandonment hash. The stage is the number of thresholds already reported and
+// is reset by any change to the cart; the abandonment time is kept until the cart is removed.
+const (
+	abandonmentStageField = "stage"
+	abandonedAtField      = "abandoned_at"
+)
+
+// activityScanBatch is the number of activity entries read per page when scanning for abandoned carts
+const activityScanBatch = 500
+
+// abandonmentKey returns the Redis key of the cart's abandonment hash
+func abandonmentKey(cartID string) string {
+	return fmt.Sprintf("cart:abandonment:%s", cartID)
+}
+
+// activityScore converts a time to its score in the activity set
+func activityScore(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+// Abandonment is a cart that has been idle past one of the abandonment thresholds
+type Abandonment struct {
+	Cart *Cart
+	// Stage is the 1-based index of the longest threshold the cart has been idle past
+	Stage     int
+	Threshold time.Duration
+	IdleSince time.Time
+	previous  int
+}
+
+// claimAbandonmentScript raises the cart's abandonment stage, provided the cart is still at the
+// version that was scanned and the stage has not been reported yet
+var claimAbandonmentScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+local stage = tonumber(redis.call('HGET', KEYS[2], ARGV[3]) or '0')
+if stage >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[3], ARGV[4])
+redis.call('HSETNX', KEYS[2], ARGV[5], ARGV[6])
+redis.call('PEXPIRE', KEYS[2], ARGV[7])
+return 1
+`)
+
+// releaseAbandonmentScript restores the previous stage if the claimed one is still current
+var releaseAbandonmentScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// AbandonedCarts returns up to limit carts that have been idle past a threshold they were not
+// reported for yet. Only the longest threshold passed is returned, so a cart idle for three days is
+// reported once at that stage rather than for every shorter one. Carts that expired, are empty
+// or have passed every threshold are dropped from the activity set so later scans skip them.
+func (s *Store) AbandonedCarts(ctx context.Context, thresholds []time.Duration, now time.Time, limit int) ([]Abandonment, error) {
+	if len(thresholds) == 0 {
+		return nil, nil
+	}
+	thresholds = append([]time.Duration(nil), thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+
+	max := strconv.FormatFloat(activityScore(now.Add(-thresholds[0])), 'f', 3, 64)
+
+	var abandoned []Abandonment
+	var settled []interface{}
+	for offset := int64(0); len(abandoned) < limit; offset += activityScanBatch {
+		entries, err := s.rdb.ZRangeByScoreWithScores(ctx, ActivityKey, &redis.ZRangeBy{
+			Min:    "-inf",
+			Max:    max,
+			Offset: offset,
+			Count:  activityScanBatch,
+		}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan cart activity: %w", err)
+		}
+
+		stages, err := s.abandonmentStages(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, entry := range entries {
+			cartID := entry.Member.(string)
+			idleSince := time.UnixMilli(int64(entry.Score * 1000)).UTC()
+			stage := stageFor(thresholds, now.Sub(idleSince))
+			// Beyond the last threshold too when the thresholds were shortened since the cart was reported
+			if stages[i] >= len(thresholds) {
+				settled = append(settled, cartID)
+				continue
+			}
+			if stage <= stages[i] || len(abandoned) == limit {
+				continue
+			}
+
+			c, err := load(ctx, s.rdb, cartID)
+			if errors.Is(err, ErrCartNotFound) {
+				settled = append(settled, cartID)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(c.Items) == 0 {
+				settled = append(settled, cartID)
+				continue
+			}
+
+			abandoned = append(abandoned, Abandonment{
+				Cart:      c,
+				Stage:     stage,
+				Threshold: thresholds[stage-1],
+				IdleSince: idleSince,
+				previous:  stages[i],
+			})
+		}
+
+		if len(entries) < activityScanBatch {
+			break
+		}
+	}
+
+	if len(settled) > 0 {
+		if err := s.rdb.ZRem(ctx, ActivityKey, settled...).Err(); err != nil {
+			return nil, fmt.Errorf("failed to prune cart activity: %w", err)
+		}
+	}
+	return abandoned, nil
+}
+
+// abandonmentStages reads the reported abandonment stage of every scanned cart
+func (s *Store) abandonmentStages(ctx context.Context, entries []redis.Z) ([]int, error) {
+	cmds := make([]*redis.StringCmd, len(entries))
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			cmds[i] = pipe.HGet(ctx, abandonmentKey(entry.Member.(string)), abandonmentStageField)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read abandonment stages: %w", err)
+	}
+
+	stages := make([]int, len(entries))
+	for i, cmd := range cmds {
+		stages[i], _ = cmd.Int()
+	}
+	return stages, nil
+}
+
+// stageFor returns how many of the ascending thresholds the idle time has passed
+func stageFor(thresholds []time.Duration, idle time.Duration) int {
+	return sort.Search(len(thresholds), func(i int) bool { return thresholds[i] > idle })
+}
+
+// ClaimAbandonment records that the abandonment is being reported. It reports false when the cart
+// changed since it was scanned or another scheduler already reported the stage.
+func (s *Store) ClaimAbandonment(ctx context.Context, a Abandonment, now time.Time) (bool, error) {
+	claimed, err := claimAbandonmentScript.Run(ctx, s.rdb,
+		[]string{cartKey(a.Cart.ID), abandonmentKey(a.Cart.ID)},
+		versionField, a.Cart.Version,
+		abandonmentStageField, a.Stage,
+		abandonedAtField, now.UTC().Format(time.RFC3339),
+		s.ttl.Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim abandonment of cart %s: %w", a.Cart.ID, err)
+	}
+	return claimed == 1, nil
+}
+
+// ReleaseAbandonment undoes a claim whose report could not be delivered, so the next scan retries it
+func (s *Store) ReleaseAbandonment(ctx context.Context, a Abandonment) error {
+	err := releaseAbandonmentScript.Run(ctx, s.rdb,
+		[]string{abandonmentKey(a.Cart.ID)},
+		abandonmentStageField, a.Stage, a.previous,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release abandonment of cart %s: %w", a.Cart.ID, err)
+	}
+	return nil
+}
+
+// Conversion reads a cart that is becoming an order and the time it was first reported abandoned,
+// which is zero if it never was. The cart is left in place, so a recovery can be reported before
+// the cart is removed.
+func (s *Store) Conversion(ctx context.Context, cartID string) (*Cart, time.Time, error) {
+	c, err := load(ctx, s.rdb, cartID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var abandonedAt time.Time
+	value, err := s.rdb.HGet(ctx, abandonmentKey(cartID), abandonedAtField).Result()
+	if err != nil && err != redis.Nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read abandonment of cart %s: %w", cartID, err)
+	}
+	if value != "" {
+		abandonedAt, _ = time.Parse(time.RFC3339, value)
+	}
+	return c, abandonedAt, nil
+}
+
+// Convert removes a cart that became an order from the cart at version. It returns the cart as it
+// was and the time it was first reported abandoned, which is zero if it never was. A cart changed
+// since that version is kept, along with ErrCartChanged, so items added meanwhile are not lost.
+func (s *Store) Convert(ctx context.Context, cartID string, version int64) (*Cart, time.Time, error) {
+	c, abandonedAt, err := s.Conversion(ctx, cartID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return c, abandonedAt, s.DeleteVersion(ctx, cartID, version)
+}
@@ -0,0 +1,210 @@
+package cart
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// testThresholds are the default abandonment thresholds of 1h, 24h and 72h
+var testThresholds = []time.Duration{time.Hour, 24 * time.Hour, 72 * time.Hour}
+
+// newAbandonedCart creates a cart holding a mug
+func newAbandonedCart(t *testing.T, s *Store) *Cart {
+	t.Helper()
+	ctx := context.Background()
+
+	c, err := s.Create(ctx, "example.myshopify.com", "EUR", "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	c, err = s.AddItem(ctx, c.ID, "p1", "v1", 1)
+	if err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	return c
+}
+
+// abandonedStages returns the stage each abandoned cart is reported at, by cart ID
+func abandonedStages(t *testing.T, s *Store, thresholds []time.Duration, now time.Time) map[string]int {
+	t.Helper()
+	abandoned, err := s.AbandonedCarts(context.Background(), thresholds, now, 10)
+	if err != nil {
+		t.Fatalf("AbandonedCarts: %v", err)
+	}
+	stages := make(map[string]int)
+	for _, a := range abandoned {
+		stages[a.Cart.ID] = a.Stage
+	}
+	return stages
+}
+
+// claim scans at now and claims the cart's abandonment, which must be at the stage
+func claim(t *testing.T, s *Store, cartID string, now time.Time, stage int) Abandonment {
+	t.Helper()
+	abandoned, err := s.AbandonedCarts(context.Background(), testThresholds, now, 10)
+	if err != nil {
+		t.Fatalf("AbandonedCarts: %v", err)
+	}
+	for _, a := range abandoned {
+		if a.Cart.ID != cartID {
+			continue
+		}
+		if a.Stage != stage {
+			t.Fatalf("cart abandoned at stage %d, want %d", a.Stage, stage)
+		}
+		claimed, err := s.ClaimAbandonment(context.Background(), a, now)
+		if err != nil || !claimed {
+			t.Fatalf("ClaimAbandonment = %v, %v, want claimed", claimed, err)
+		}
+		return a
+	}
+	t.Fatalf("cart %s is not abandoned at stage %d", cartID, stage)
+	return Abandonment{}
+}
+
+// tracked reports whether the cart is still in the activity set
+func tracked(t *testing.T, rdb *redis.Client, cartID string) bool {
+	t.Helper()
+	err := rdb.ZScore(context.Background(), ActivityKey, cartID).Err()
+	if err != nil && err != redis.Nil {
+		t.Fatalf("ZScore: %v", err)
+	}
+	return err == nil
+}
+
+func TestAbandonedCartsStage(t *testing.T) {
+	tests := []struct {
+		name  string
+		idle  time.Duration
+		stage int
+	}{
+		{name: "active", idle: 30 * time.Minute, stage: 0},
+		{name: "past 1h", idle: 2 * time.Hour, stage: 1},
+		{name: "past 24h", idle: 30 * time.Hour, stage: 2},
+		{name: "past 72h", idle: 80 * time.Hour, stage: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestStore(t)
+			c := newAbandonedCart(t, s)
+
+			// Thresholds in any order are sorted
+			thresholds := []time.Duration{72 * time.Hour, time.Hour, 24 * time.Hour}
+			stages := abandonedStages(t, s, thresholds, c.UpdatedAt.Add(tt.idle))
+			if stages[c.ID] != tt.stage {
+				t.Fatalf("abandoned at stage %d, want %d", stages[c.ID], tt.stage)
+			}
+		})
+	}
+}
+
+func TestAbandonedCartsReportEachStageOnce(t *testing.T) {
+	ctx := context.Background()
+	s, rdb := newTestStore(t)
+	c := newAbandonedCart(t, s)
+	start := c.UpdatedAt
+
+	claim(t, s, c.ID, start.Add(2*time.Hour), 1)
+	if stages := abandonedStages(t, s, testThresholds, start.Add(3*time.Hour)); len(stages) != 0 {
+		t.Fatalf("reported stage 1 again: %v", stages)
+	}
+
+	a := claim(t, s, c.ID, start.Add(25*time.Hour), 2)
+	if claimed, err := s.ClaimAbandonment(ctx, a, start.Add(25*time.Hour)); err != nil || claimed {
+		t.Fatalf("second claim of stage 2 = %v, %v, want not claimed", claimed, err)
+	}
+
+	claim(t, s, c.ID, start.Add(80*time.Hour), 3)
+	if stages := abandonedStages(t, s, testThresholds, start.Add(90*time.Hour)); len(stages) != 0 {
+		t.Fatalf("cart reported past its last stage: %v", stages)
+	}
+	if tracked(t, rdb, c.ID) {
+		t.Fatal("cart reported at every stage is still scanned")
+	}
+}
+
+func TestAbandonedCartsResetOnActivity(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t)
+	c := newAbandonedCart(t, s)
+
+	scanned := claim(t, s, c.ID, c.UpdatedAt.Add(2*time.Hour), 1)
+
+	updated, err := s.AddItem(ctx, c.ID, "p1", "v2", 1)
+	if err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	scanned.Stage = 2
+	if claimed, err := s.ClaimAbandonment(ctx, scanned, c.UpdatedAt.Add(25*time.Hour)); err != nil || claimed {
+		t.Fatalf("claim of the cart as scanned before it changed = %v, %v, want not claimed", claimed, err)
+	}
+
+	if stages := abandonedStages(t, s, testThresholds, updated.UpdatedAt.Add(30*time.Minute)); len(stages) != 0 {
+		t.Fatalf("changed cart reported before it was idle again: %v", stages)
+	}
+	claim(t, s, c.ID, updated.UpdatedAt.Add(2*time.Hour), 1)
+
+	_, abandonedAt, err := s.Conversion(ctx, c.ID)
+	if err != nil {
+		t.Fatalf("Conversion: %v", err)
+	}
+	if want := c.UpdatedAt.Add(2 * time.Hour).Truncate(time.Second); !abandonedAt.Equal(want) {
+		t.Fatalf("abandoned at %s, want the first report at %s", abandonedAt, want)
+	}
+}
+
+func TestReleaseAbandonment(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t)
+	c := newAbandonedCart(t, s)
+	start := c.UpdatedAt
+
+	claim(t, s, c.ID, start.Add(2*time.Hour), 1)
+	a := claim(t, s, c.ID, start.Add(25*time.Hour), 2)
+	if err := s.ReleaseAbandonment(ctx, a); err != nil {
+		t.Fatalf("ReleaseAbandonment: %v", err)
+	}
+
+	if stages := abandonedStages(t, s, testThresholds, start.Add(26*time.Hour)); stages[c.ID] != 2 {
+		t.Fatalf("released cart abandoned at stage %d, want 2 again", stages[c.ID])
+	}
+}
+
+func TestAbandonedCartsPrune(t *testing.T) {
+	ctx := context.Background()
+	s, rdb := newTestStore(t)
+
+	expired := newAbandonedCart(t, s)
+	if err := rdb.Del(ctx, cartKey(expired.ID)).Err(); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	empty, err := s.Create(ctx, "example.myshopify.com", "EUR", "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	reported := newAbandonedCart(t, s)
+	claim(t, s, reported.ID, reported.UpdatedAt.Add(80*time.Hour), 3)
+	idle := newAbandonedCart(t, s)
+
+	// The thresholds were shortened after the reported cart passed the last of the longer ones
+	stages := abandonedStages(t, s, []time.Duration{time.Hour, 24 * time.Hour}, time.Now().Add(90*time.Hour))
+	if len(stages) != 1 || stages[idle.ID] != 2 {
+		t.Fatalf("abandoned carts %v, want only %s at stage 2", stages, idle.ID)
+	}
+	for name, id := range map[string]string{"expired": expired.ID, "empty": empty.ID, "reported": reported.ID} {
+		if tracked(t, rdb, id) {
+			t.Fatalf("%s cart is still scanned", name)
+		}
+	}
+	if !tracked(t, rdb, idle.ID) {
+		t.Fatal("idle cart is no longer scanned")
+	}
+	if _, err := s.Get(ctx, expired.ID); !errors.Is(err, ErrCartNotFound) {
+		t.Fatalf("Get of the expired cart = %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package cart
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"cartloom/order"
+)
+
+var (
+	// ErrCartNotFound is returned when the cart does not exist or has expired
+	ErrCartNotFound = errors.New("cart not found")
+	// ErrItemNotFound is returned when the cart has no line item for the variant
+	ErrItemNotFound = errors.New("line item not found")
+	// ErrVariantNotFound is returned when the variant is missing from the product cache
+	ErrVariantNotFound = errors.New("variant not found in product cache")
+	// ErrInvalidQuantity is returned for quantities below one
+	ErrInvalidQuantity = errors.New("invalid quantity")
+	// ErrCurrencyMismatch is returned when merging carts priced in different currencies
+	ErrCurrencyMismatch = errors.New("cart currencies differ")
+	// ErrConflict is returned when concurrent updates keep invalidating a cart update
+	ErrConflict = errors.New("cart was modified concurrently")
+	// ErrCartChanged is returned when a cart expected at a version was changed since
+	ErrCartChanged = errors.New("cart changed since it was read")
+)
+
+// Cart is a shopping cart. Amounts are in minor units of Currency.
+type Cart struct {
+	ID              string         `json:"id"`
+	Shop            string         `json:"shop"`
+	CustomerID      string         `json:"customer_id,omitempty"`
+	Email           string         `json:"email,omitempty"`
+	Currency        string         `json:"currency"`
+	DiscountCode    string         `json:"discount_code,omitempty"`
+	ShippingAddress *order.Address `json:"shipping_address,omitempty"`
+	Items           []LineItem     `json:"items"`
+	Version         int64          `json:"version"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// LineItem is a variant in the cart with the price it had when it was added
+type LineItem struct {
+	ProductID    string    `json:"product_id"`
+	VariantID    string    `json:"variant_id"`
+	SKU          string    `json:"sku"`
+	Title        string    `json:"title"`
+	VariantTitle string    `json:"variant_title,omitempty"`
+	Quantity     int       `json:"quantity"`
+	UnitPrice    int64     `json:"unit_price"`
+	AddedAt      time.Time `json:"added_at"`
+}
+
+// Subtotal returns the sum of the line items before discounts, shipping and tax
+func (c *Cart) Subtotal() int64 {
+	var subtotal int64
+	for _, item := range c.Items {
+		subtotal += item.UnitPrice * int64(item.Quantity)
+	}
+	return subtotal
+}
+
+// ItemCount returns the total quantity of all line items
+func (c *Cart) ItemCount() int {
+	count := 0
+	for _, item := range c.Items {
+		count += item.Quantity
+	}
+	return count
+}
+
+// Item returns the line item for the variant
+func (c *Cart) Item(variantID string) (*LineItem, bool) {
+	for i := range c.Items {
+		if c.Items[i].VariantID == variantID {
+			return &c.Items[i], true
+		}
+	}
+	return nil, false
+}
+
+// removeItem drops the line item for the variant and reports whether it was present
+func (c *Cart) removeItem(variantID string) bool {
+	for i := range c.Items {
+		if c.Items[i].VariantID == variantID {
+			c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// sortItems orders the line items by the time they were added
+func (c *Cart) sortItems() {
+	sort.SliceStable(c.Items, func(i, j int) bool {
+		if c.Items[i].AddedAt.Equal(c.Items[j].AddedAt) {
+			return c.Items[i].VariantID < c.Items[j].VariantID
+		}
+		return c.Items[i].AddedAt.Before(c.Items[j].AddedAt)
+	})
+}
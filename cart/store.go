@@ -0,0 +1,579 @@
+package cart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"cartloom/order"
+	"cartloom/shopify"
+	"cartloom/utils"
+)
+
+// DefaultTTL is how long a cart lives without activity
+const DefaultTTL = 7 * 24 * time.Hour
+
+// maxUpdateAttempts bounds the optimistic retries of a single cart update
+const maxUpdateAttempts = 20
+
+// retryBackoff is the base of the jittered pause between optimistic retries
+const retryBackoff = 2 * time.Millisecond
+
+// Hash fields of a cart; each line item is stored under itemFieldPrefix + variant ID
+const (
+	metaField       = "meta"
+	versionField    = "version"
+	itemFieldPrefix = "item:"
+)
+
+// Store keeps carts in Redis hashes. Every read and write slides the cart's expiry forward,
+// and updates are applied optimistically under WATCH so concurrent writers never lose changes.
+type Store struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+// NewStore creates a cart store whose carts expire after ttl without activity
+func NewStore(rdb *redis.Client, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{rdb: rdb, ttl: ttl}
+}
+
+// cartKey returns the Redis key of the cart hash
+func cartKey(cartID string) string {
+	return fmt.Sprintf("cart:%s", cartID)
+}
+
+// customerCartKey returns the Redis key pointing at the customer's active cart
+func customerCartKey(shop, customerID string) string {
+	return fmt.Sprintf("cart:customer:%s:%s", shop, customerID)
+}
+
+// Create starts an empty cart. For a signed in customer the active cart is returned instead
+// if there is one.
+func (s *Store) Create(ctx context.Context, shop, currency, customerID string) (*Cart, error) {
+	id, err := utils.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	c := &Cart{
+		ID:         id,
+		Shop:       shop,
+		CustomerID: customerID,
+		Currency:   strings.ToUpper(currency),
+		Version:    1,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if customerID != "" {
+		return s.createForCustomer(ctx, c)
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return s.write(ctx, pipe, c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart: %w", err)
+	}
+	return c, nil
+}
+
+// createForCustomer writes the new cart unless the customer has an active cart, which it returns
+// instead. The customer's cart pointer is watched, so of concurrent creates, as from two tabs
+// signing in at once, only one writes a cart and the others return it.
+func (s *Store) createForCustomer(ctx context.Context, c *Cart) (*Cart, error) {
+	indexKey := customerCartKey(c.Shop, c.CustomerID)
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var created *Cart
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			cartID, err := tx.Get(ctx, indexKey).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			created = c
+			if cartID != "" {
+				existing, err := load(ctx, tx, cartID)
+				if err == nil {
+					created = existing
+				} else if !errors.Is(err, ErrCartNotFound) {
+					return err
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if created != c {
+					s.touch(ctx, pipe, created)
+					return nil
+				}
+				return s.write(ctx, pipe, c)
+			})
+			return err
+		}, indexKey)
+
+		if err == redis.TxFailedErr {
+			if err := backoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cart of customer %s: %w", c.CustomerID, err)
+		}
+		return created, nil
+	}
+	return nil, fmt.Errorf("%w: cart of customer %s", ErrConflict, c.CustomerID)
+}
+
+// Get returns the cart and extends its expiry
+func (s *Store) Get(ctx context.Context, cartID string) (*Cart, error) {
+	c, err := load(ctx, s.rdb, cartID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.touch(ctx, pipe, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend cart %s: %w", cartID, err)
+	}
+	return c, nil
+}
+
+// CustomerCart returns the customer's active cart
+func (s *Store) CustomerCart(ctx context.Context, shop, customerID string) (*Cart, error) {
+	cartID, err := s.rdb.Get(ctx, customerCartKey(shop, customerID)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: customer %s", ErrCartNotFound, customerID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up cart of customer %s: %w", customerID, err)
+	}
+	return s.Get(ctx, cartID)
+}
+
+// AddItem adds quantity of the variant to the cart. A new line item snapshots the variant's
+// current price from the product cache; an existing one keeps its price and grows in quantity.
+func (s *Store) AddItem(ctx context.Context, cartID, productID, variantID string, quantity int) (*Cart, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidQuantity, quantity)
+	}
+
+	current, err := load(ctx, s.rdb, cartID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := s.snapshot(ctx, productID, variantID, current.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.update(ctx, cartID, func(c *Cart) error {
+		if item, ok := c.Item(variantID); ok {
+			item.Quantity += quantity
+			return nil
+		}
+		snapshot.Quantity = quantity
+		snapshot.AddedAt = time.Now().UTC()
+		c.Items = append(c.Items, snapshot)
+		return nil
+	})
+}
+
+// UpdateItem sets the quantity of a line item; a quantity of zero removes it
+func (s *Store) UpdateItem(ctx context.Context, cartID, variantID string, quantity int) (*Cart, error) {
+	if quantity < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidQuantity, quantity)
+	}
+	if quantity == 0 {
+		return s.RemoveItem(ctx, cartID, variantID)
+	}
+
+	return s.update(ctx, cartID, func(c *Cart) error {
+		item, ok := c.Item(variantID)
+		if !ok {
+			return fmt.Errorf("%w: variant %s", ErrItemNotFound, variantID)
+		}
+		item.Quantity = quantity
+		return nil
+	})
+}
+
+// RemoveItem removes the variant's line item from the cart
+func (s *Store) RemoveItem(ctx context.Context, cartID, variantID string) (*Cart, error) {
+	return s.update(ctx, cartID, func(c *Cart) error {
+		if !c.removeItem(variantID) {
+			return fmt.Errorf("%w: variant %s", ErrItemNotFound, variantID)
+		}
+		return nil
+	})
+}
+
+// ApplyDiscount sets the cart's discount code; an empty code removes it.
+// The code is validated and priced at checkout.
+func (s *Store) ApplyDiscount(ctx context.Context, cartID, code string) (*Cart, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return s.update(ctx, cartID, func(c *Cart) error {
+		c.DiscountCode = code
+		return nil
+	})
+}
+
+// SetEmail sets the contact address used to reach the shopper about the cart
+func (s *Store) SetEmail(ctx context.Context, cartID, email string) (*Cart, error) {
+	email = strings.TrimSpace(email)
+	return s.update(ctx, cartID, func(c *Cart) error {
+		c.Email = email
+		return nil
+	})
+}
+
+// SetShippingAddress sets the address the cart ships to
+func (s *Store) SetShippingAddress(ctx context.Context, cartID string, address order.Address) (*Cart, error) {
+	return s.update(ctx, cartID, func(c *Cart) error {
+		c.ShippingAddress = &address
+		return nil
+	})
+}
+
+// Delete removes the cart, for instance after it was converted into an order
+func (s *Store) Delete(ctx context.Context, cartID string) error {
+	c, err := load(ctx, s.rdb, cartID)
+	if errors.Is(err, ErrCartNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.remove(ctx, c)
+}
+
+// DeleteVersion removes the cart only if it is still at version, so changes made after that
+// version was read are not lost. A changed cart is left in place and ErrCartChanged returned.
+func (s *Store) DeleteVersion(ctx context.Context, cartID string, version int64) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			c, err := load(ctx, tx, cartID)
+			if err != nil {
+				return err
+			}
+			if c.Version != version {
+				return fmt.Errorf("%w: cart %s is at version %d, not %d", ErrCartChanged, cartID, c.Version, version)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				removeCart(ctx, pipe, c)
+				return nil
+			})
+			return err
+		}, cartKey(cartID))
+
+		if err == redis.TxFailedErr {
+			if err := backoff(ctx, attempt); err != nil {
+				return err
+			}
+			continue
+		}
+		if errors.Is(err, ErrCartNotFound) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrCartChanged) {
+			return fmt.Errorf("failed to delete cart %s: %w", cartID, err)
+		}
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrConflict, cartID)
+}
+
+// remove deletes the cart together with its customer pointer, activity entry and abandonment state
+func (s *Store) remove(ctx context.Context, c *Cart) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removeCart(ctx, pipe, c)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete cart %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// removeCart queues the deletion of the cart and everything kept about it
+func removeCart(ctx context.Context, pipe redis.Pipeliner, c *Cart) {
+	pipe.Del(ctx, cartKey(c.ID), abandonmentKey(c.ID))
+	pipe.ZRem(ctx, ActivityKey, c.ID)
+	if c.CustomerID != "" {
+		pipe.Del(ctx, customerCartKey(c.Shop, c.CustomerID))
+	}
+}
+
+// Merge moves the guest cart into the customer's active cart when the guest signs in. Quantities
+// of variants in both carts are added up at the customer cart's prices, and the customer cart's
+// discount code and shipping address win over the guest's. Without an active customer cart the
+// guest cart simply becomes the customer's.
+func (s *Store) Merge(ctx context.Context, guestCartID, customerID string) (*Cart, error) {
+	guest, err := load(ctx, s.rdb, guestCartID)
+	if err != nil {
+		return nil, err
+	}
+	if guest.CustomerID == customerID {
+		return guest, nil
+	}
+	indexKey := customerCartKey(guest.Shop, customerID)
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		customerCartID, err := s.rdb.Get(ctx, indexKey).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to look up cart of customer %s: %w", customerID, err)
+		}
+
+		keys := []string{cartKey(guestCartID), indexKey}
+		if customerCartID != "" && customerCartID != guestCartID {
+			keys = append(keys, cartKey(customerCartID))
+		}
+
+		var merged *Cart
+		err = s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := tx.Get(ctx, indexKey).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if current != customerCartID {
+				return redis.TxFailedErr
+			}
+
+			guest, err := load(ctx, tx, guestCartID)
+			if err != nil {
+				return err
+			}
+
+			target := guest
+			if customerCartID != "" && customerCartID != guestCartID {
+				target, err = load(ctx, tx, customerCartID)
+				if errors.Is(err, ErrCartNotFound) {
+					target = guest
+				} else if err != nil {
+					return err
+				}
+			}
+
+			if target != guest {
+				if target.Currency != guest.Currency {
+					return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, guest.Currency, target.Currency)
+				}
+				mergeInto(target, guest)
+			}
+			target.CustomerID = customerID
+			target.Version++
+			target.UpdatedAt = time.Now().UTC()
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if target != guest {
+					pipe.Del(ctx, cartKey(guestCartID), abandonmentKey(guestCartID))
+					pipe.ZRem(ctx, ActivityKey, guestCartID)
+				}
+				return s.write(ctx, pipe, target)
+			})
+			merged = target
+			return err
+		}, keys...)
+
+		if err == redis.TxFailedErr {
+			if err := backoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge cart %s for customer %s: %w", guestCartID, customerID, err)
+		}
+		return merged, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrConflict, guestCartID)
+}
+
+// mergeInto adds the guest cart's line items and missing contact and checkout details to the target cart
+func mergeInto(target, guest *Cart) {
+	for _, item := range guest.Items {
+		if existing, ok := target.Item(item.VariantID); ok {
+			existing.Quantity += item.Quantity
+			continue
+		}
+		target.Items = append(target.Items, item)
+	}
+	if target.Email == "" {
+		target.Email = guest.Email
+	}
+	if target.DiscountCode == "" {
+		target.DiscountCode = guest.DiscountCode
+	}
+	if target.ShippingAddress == nil {
+		target.ShippingAddress = guest.ShippingAddress
+	}
+}
+
+// update applies fn to the cart under WATCH and writes the result in a MULTI/EXEC transaction,
+// retrying from a fresh read when another writer changed the cart in between
+func (s *Store) update(ctx context.Context, cartID string, fn func(c *Cart) error) (*Cart, error) {
+	key := cartKey(cartID)
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var updated *Cart
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			c, err := load(ctx, tx, cartID)
+			if err != nil {
+				return err
+			}
+			if err := fn(c); err != nil {
+				return err
+			}
+			c.Version++
+			c.UpdatedAt = time.Now().UTC()
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return s.write(ctx, pipe, c)
+			})
+			updated = c
+			return err
+		}, key)
+
+		if err == redis.TxFailedErr {
+			if err := backoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return updated, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrConflict, cartID)
+}
+
+// backoff pauses before the next optimistic retry for a random time that grows with the attempt,
+// so writers that collided do not collide again
+func backoff(ctx context.Context, attempt int) error {
+	pause := time.Duration(mathrand.Int63n(int64(retryBackoff) * int64(attempt+1)))
+	select {
+	case <-time.After(pause):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write replaces the cart hash with the cart's current contents and extends its expiry
+func (s *Store) write(ctx context.Context, pipe redis.Pipeliner, c *Cart) error {
+	meta := *c
+	meta.Items = nil
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode cart %s: %w", c.ID, err)
+	}
+
+	fields := []interface{}{metaField, metaJSON, versionField, c.Version}
+	for _, item := range c.Items {
+		itemJSON, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("failed to encode line item %s: %w", item.VariantID, err)
+		}
+		fields = append(fields, itemFieldPrefix+item.VariantID, itemJSON)
+	}
+
+	key := cartKey(c.ID)
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, fields...)
+	pipe.ZAdd(ctx, ActivityKey, &redis.Z{Score: activityScore(c.UpdatedAt), Member: c.ID})
+	pipe.HDel(ctx, abandonmentKey(c.ID), abandonmentStageField)
+	s.touch(ctx, pipe, c)
+	return nil
+}
+
+// touch slides the expiry of the cart and of the customer's pointer to it
+func (s *Store) touch(ctx context.Context, pipe redis.Pipeliner, c *Cart) {
+	pipe.Expire(ctx, cartKey(c.ID), s.ttl)
+	pipe.Expire(ctx, abandonmentKey(c.ID), s.ttl)
+	if c.CustomerID != "" {
+		pipe.Set(ctx, customerCartKey(c.Shop, c.CustomerID), c.ID, s.ttl)
+	}
+}
+
+// snapshot builds a line item from the cached product, with the variant's price in minor units
+func (s *Store) snapshot(ctx context.Context, productID, variantID, currency string) (LineItem, error) {
+	data, err := s.rdb.Get(ctx, shopify.ProductCacheKey(productID)).Bytes()
+	if err == redis.Nil {
+		return LineItem{}, fmt.Errorf("%w: product %s", ErrVariantNotFound, productID)
+	}
+	if err != nil {
+		return LineItem{}, fmt.Errorf("failed to read product %s from cache: %w", productID, err)
+	}
+
+	var product shopify.ProductRecord
+	if err := json.Unmarshal(data, &product); err != nil {
+		return LineItem{}, fmt.Errorf("invalid cached product %s: %w", productID, err)
+	}
+
+	for _, variant := range product.Variants {
+		if variant.VariantID != variantID {
+			continue
+		}
+		price, err := shopify.ParseAmount(variant.Price, currency)
+		if err != nil {
+			return LineItem{}, fmt.Errorf("invalid price of variant %s: %w", variantID, err)
+		}
+		return LineItem{
+			ProductID:    productID,
+			VariantID:    variantID,
+			SKU:          variant.SKU,
+			Title:        product.Title,
+			VariantTitle: variant.Title,
+			UnitPrice:    price,
+		}, nil
+	}
+	return LineItem{}, fmt.Errorf("%w: variant %s of product %s", ErrVariantNotFound, variantID, productID)
+}
+
+// load reads the cart hash
+func load(ctx context.Context, rdb redis.Cmdable, cartID string) (*Cart, error) {
+	fields, err := rdb.HGetAll(ctx, cartKey(cartID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cart %s: %w", cartID, err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCartNotFound, cartID)
+	}
+
+	var c Cart
+	if err := json.Unmarshal([]byte(fields[metaField]), &c); err != nil {
+		return nil, fmt.Errorf("invalid cart %s: %w", cartID, err)
+	}
+	if version, err := strconv.ParseInt(fields[versionField], 10, 64); err == nil {
+		c.Version = version
+	}
+
+	for field, value := range fields {
+		if !strings.HasPrefix(field, itemFieldPrefix) {
+			continue
+		}
+		var item LineItem
+		if err := json.Unmarshal([]byte(value), &item); err != nil {
+			return nil, fmt.Errorf("invalid line item %s of cart %s: %w", field, cartID, err)
+		}
+		c.Items = append(c.Items, item)
+	}
+	c.sortItems()
+	return &c, nil
+}
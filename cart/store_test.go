@@ -0,0 +1,161 @@
+package cart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"cartloom/shopify"
+)
+
+// newTestStore creates a store on miniredis with a cached product p1 whose variants v1 and v2 cost 12.50
+func newTestStore(t *testing.T) (*Store, *redis.Client) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	product, err := json.Marshal(shopify.ProductRecord{
+		ProductID: "p1",
+		Title:     "Mug",
+		Variants: []shopify.VariantRecord{
+			{VariantID: "v1", SKU: "MUG-1", Price: "12.50"},
+			{VariantID: "v2", SKU: "MUG-2", Price: "12.50"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := rdb.Set(context.Background(), shopify.ProductCacheKey("p1"), product, 0).Err(); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	return NewStore(rdb, time.Hour), rdb
+}
+
+// quantity returns the quantity of the variant in the cart, or 0 without a line item
+func quantity(c *Cart, variantID string) int {
+	if item, ok := c.Item(variantID); ok {
+		return item.Quantity
+	}
+	return 0
+}
+
+func TestConcurrentCreatesShareCustomerCart(t *testing.T) {
+	ctx := context.Background()
+	s, rdb := newTestStore(t)
+
+	const creates = 20
+	ids := make([]string, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := s.Create(ctx, "example.myshopify.com", "eur", "c1")
+			if err != nil {
+				t.Errorf("Create: %v", err)
+				return
+			}
+			ids[i] = c.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("Create returned carts %s and %s for one customer", ids[0], id)
+		}
+	}
+	active, err := s.CustomerCart(ctx, "example.myshopify.com", "c1")
+	if err != nil {
+		t.Fatalf("CustomerCart: %v", err)
+	}
+	if active.ID != ids[0] {
+		t.Fatalf("active cart = %s, want %s", active.ID, ids[0])
+	}
+	if carts := rdb.ZCard(ctx, ActivityKey).Val(); carts != 1 {
+		t.Fatalf("%d carts stored, want 1", carts)
+	}
+}
+
+func TestConcurrentAddItemAndMergeKeepItems(t *testing.T) {
+	ctx := context.Background()
+	s, rdb := newTestStore(t)
+
+	customer, err := s.Create(ctx, "example.myshopify.com", "EUR", "c1")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.AddItem(ctx, customer.ID, "p1", "v1", 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	guest, err := s.Create(ctx, "example.myshopify.com", "EUR", "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.AddItem(ctx, guest.ID, "p1", "v2", 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+
+	const adds = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	guestAdds := 0
+	for i := 0; i < adds; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := s.AddItem(ctx, customer.ID, "p1", "v1", 1); err != nil {
+				t.Errorf("AddItem to customer cart: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// Adds that lose the race with the merge find the guest cart gone
+			_, err := s.AddItem(ctx, guest.ID, "p1", "v2", 1)
+			switch {
+			case err == nil:
+				mu.Lock()
+				guestAdds++
+				mu.Unlock()
+			case !errors.Is(err, ErrCartNotFound):
+				t.Errorf("AddItem to guest cart: %v", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := s.Merge(ctx, guest.ID, "c1"); err != nil {
+			t.Errorf("Merge: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	merged, err := s.CustomerCart(ctx, "example.myshopify.com", "c1")
+	if err != nil {
+		t.Fatalf("CustomerCart: %v", err)
+	}
+	if merged.ID != customer.ID {
+		t.Fatalf("customer cart = %s, want %s", merged.ID, customer.ID)
+	}
+	if got := quantity(merged, "v1"); got != 1+adds {
+		t.Fatalf("v1 quantity = %d, want %d", got, 1+adds)
+	}
+	if got := quantity(merged, "v2"); got != 1+guestAdds {
+		t.Fatalf("v2 quantity = %d, want %d from the guest cart's %d successful adds", got, 1+guestAdds, guestAdds)
+	}
+	if _, err := s.Get(ctx, guest.ID); !errors.Is(err, ErrCartNotFound) {
+		t.Fatalf("guest cart still readable after merge: %v", err)
+	}
+	if carts := rdb.ZCard(ctx, ActivityKey).Val(); carts != 1 {
+		t.Fatalf("%d carts stored, want 1", carts)
+	}
+}
@@ -0,0 +1,563 @@
+package checkout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	kafka_go "github.com/segmentio/kafka-go"
+
+	"cartloom/cart"
+	"cartloom/kafka"
+	"cartloom/order"
+	"cartloom/utils"
+)
+
+var (
+	// ErrInvalidCart is returned when the cart cannot be checked out as it is
+	ErrInvalidCart = errors.New("cart cannot be checked out")
+	// ErrOutOfStock is returned by InventoryReserver.Reserve when the items cannot all be reserved
+	ErrOutOfStock = errors.New("items are out of stock")
+	// ErrReservationLost is returned by InventoryReserver.Commit when the reservation was released,
+	// typically because it expired, before it could be committed
+	ErrReservationLost = errors.New("inventory reservation was released")
+	// ErrPaymentTokenUnavailable is returned when a resumed saga reaches payment authorization
+	// without the payment token, which is never persisted, and no authorization was made before
+	ErrPaymentTokenUnavailable = errors.New("payment token is not available to a resumed checkout")
+)
+
+// ReservationItem is a quantity of a variant held for a checkout
+type ReservationItem struct {
+	VariantID string
+	SKU       string
+	Quantity  int
+}
+
+// InventoryReserver holds stock for a checkout and commits it to the order once the order exists.
+// Calls are keyed by the reservation ID and must be idempotent, since a resumed saga repeats the
+// step it was interrupted in. Reserve fails with ErrOutOfStock when there is not enough stock, and
+// Commit with ErrReservationLost when the reservation was released first.
+type InventoryReserver interface {
+	Reserve(ctx context.Context, reservationID string, items []ReservationItem) error
+	Commit(ctx context.Context, reservationID, orderID string) error
+	Release(ctx context.Context, reservationID string) error
+}
+
+// AuthorizationRequest asks for a payment authorization. Processors must treat requests with the
+// same idempotency key as one authorization.
+type AuthorizationRequest struct {
+	IdempotencyKey string
+	OrderID        string
+	Shop           string
+	CustomerID     string
+	PaymentToken   string
+	Amount         int64
+	Currency       string
+}
+
+// PaymentAuthorizer authorizes and voids payments with a payment processor. FindAuthorization
+// returns the ID of the authorization made with an idempotency key, or "" when there is none, so
+// an authorization whose outcome was never seen can still be completed or voided.
+type PaymentAuthorizer interface {
+	Authorize(ctx context.Context, req AuthorizationRequest) (authorizationID string, err error)
+	FindAuthorization(ctx context.Context, idempotencyKey string) (authorizationID string, err error)
+	Void(ctx context.Context, authorizationID string) error
+}
+
+// Config holds the collaborators of the checkout orchestrator
+type Config struct {
+	DB        *dynamodb.Client
+	Carts     *cart.Store
+	Inventory InventoryReserver
+	Payments  PaymentAuthorizer
+	// Pricer computes totals; defaults to a FlatRatePricer without tax, shipping or discounts
+	Pricer Pricer
+	// Orders publishes order.created events with Codec, which defaults to JSON
+	Orders *kafka_go.Writer
+	Codec  kafka.OrderEventCodec
+	// CartEvents, if set, receives cart.recovered when an abandoned cart is checked out
+	CartEvents *kafka_go.Writer
+}
+
+// Request starts a checkout of a cart
+type Request struct {
+	CartID       string
+	PaymentToken string
+}
+
+// Orchestrator runs checkout sagas. Every step is recorded in DynamoDB before the next one starts,
+// so a saga interrupted by a crash can be resumed by any instance: a saga that had not reached order
+// creation yet is rolled forward from its last step or compensated, one that had is always completed.
+type Orchestrator struct {
+	config Config
+}
+
+// New creates a checkout orchestrator
+func New(config Config) *Orchestrator {
+	if config.Pricer == nil {
+		config.Pricer = FlatRatePricer{}
+	}
+	if config.Codec == nil {
+		config.Codec = kafka.JSONCodec{}
+	}
+	return &Orchestrator{config: config}
+}
+
+// Checkout runs a new saga for the cart. When a step before order creation fails, the steps done
+// so far are compensated and the step's error is returned along with the compensated saga. A cart
+// already being checked out, or checked out, is not checked out again: its saga is returned as it
+// stands instead, so a checkout submitted twice places one order.
+func (o *Orchestrator) Checkout(ctx context.Context, req Request) (*Saga, error) {
+	sagaID, err := utils.NewID()
+	if err != nil {
+		return nil, err
+	}
+	orderID, err := utils.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Saga{
+		SagaID:       sagaID,
+		Status:       SagaRunning,
+		Step:         steps[0],
+		CartID:       req.CartID,
+		OrderID:      orderID,
+		PaymentToken: req.PaymentToken,
+	}
+
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		started, err := startSaga(ctx, o.config.DB, s)
+		if err != nil {
+			return nil, err
+		}
+		if started {
+			log.Printf("Checkout %s started for cart %s", s.SagaID, s.CartID)
+			return o.execute(ctx, s)
+		}
+
+		claimant, err := cartClaimant(ctx, o.config.DB, s.CartID)
+		if err != nil {
+			return nil, err
+		}
+		if claimant == "" {
+			// Released since the claim failed
+			continue
+		}
+		existing, err := loadSaga(ctx, o.config.DB, claimant)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Status != SagaCompensated {
+			log.Printf("Cart %s is already checked out by %s", s.CartID, existing.SagaID)
+			return existing, nil
+		}
+		// A rolled back checkout whose claim was not released holds the cart no longer
+		if err := releaseCart(ctx, o.config.DB, existing); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: cart %s", ErrSagaConflict, s.CartID)
+}
+
+// Resume continues an unfinished saga, running its remaining steps or finishing its compensation
+func (o *Orchestrator) Resume(ctx context.Context, sagaID string) (*Saga, error) {
+	s, err := loadSaga(ctx, o.config.DB, sagaID)
+	if err != nil {
+		return nil, err
+	}
+	return o.execute(ctx, s)
+}
+
+// ResumeStalled resumes the unfinished sagas that have not progressed for stalledAfter, which
+// should comfortably exceed the time a live checkout takes, and returns how many it resumed
+func (o *Orchestrator) ResumeStalled(ctx context.Context, stalledAfter time.Duration) (int, error) {
+	before := time.Now().Add(-stalledAfter)
+
+	resumed := 0
+	for _, status := range []SagaStatus{SagaRunning, SagaCompensating} {
+		ids, err := stalledSagas(ctx, o.config.DB, status, before)
+		if err != nil {
+			return resumed, err
+		}
+		for _, id := range ids {
+			if _, err := o.Resume(ctx, id); err != nil {
+				if ctx.Err() != nil {
+					return resumed, ctx.Err()
+				}
+				log.Printf("Resumed checkout %s failed: %v", id, err)
+			}
+			resumed++
+		}
+	}
+	return resumed, nil
+}
+
+// RunRecovery resumes stalled sagas every interval until the context is cancelled
+func (o *Orchestrator) RunRecovery(ctx context.Context, interval, stalledAfter time.Duration) error {
+	return utils.Poll(ctx, "Checkout recovery", interval, 0, func(ctx context.Context) (int, error) {
+		resumed, err := o.ResumeStalled(ctx, stalledAfter)
+		if resumed > 0 {
+			log.Printf("Checkout recovery resumed %d sagas", resumed)
+		}
+		return resumed, err
+	})
+}
+
+// execute runs the saga's remaining steps, recording each, and compensates on failure
+func (o *Orchestrator) execute(ctx context.Context, s *Saga) (*Saga, error) {
+	for s.Status == SagaRunning {
+		step := s.Step
+		err := o.run(ctx, s, step)
+		if err != nil {
+			if ctx.Err() != nil || s.pastPivot() {
+				// Left running for a later resume, which retries the step
+				return s, fmt.Errorf("checkout %s failed at %s: %w", s.SagaID, step, err)
+			}
+
+			log.Printf("Checkout %s failed at %s, compensating: %v", s.SagaID, step, err)
+			s.Status = SagaCompensating
+			s.Error = fmt.Sprintf("%s: %v", step, err)
+			if saveErr := saveSaga(ctx, o.config.DB, s); saveErr != nil {
+				return s, saveErr
+			}
+			if compErr := o.compensate(ctx, s); compErr != nil {
+				return s, compErr
+			}
+			return s, fmt.Errorf("checkout %s failed at %s: %w", s.SagaID, step, err)
+		}
+
+		s.Completed = append(s.Completed, step)
+		s.Step = nextStep(step)
+		if s.Step == "" {
+			s.Status = SagaCompleted
+		}
+		if err := saveSaga(ctx, o.config.DB, s); err != nil {
+			return s, err
+		}
+	}
+
+	if s.Status == SagaCompensating {
+		return s, o.compensate(ctx, s)
+	}
+	if s.Status == SagaCompleted {
+		log.Printf("Checkout %s completed as order %s", s.SagaID, s.OrderID)
+	}
+	return s, nil
+}
+
+// compensate undoes the completed steps in reverse order, after voiding a payment authorization
+// that was attempted but never confirmed. Each undone step is recorded, so a compensation
+// interrupted halfway resumes where it stopped.
+func (o *Orchestrator) compensate(ctx context.Context, s *Saga) error {
+	if s.Authorizing {
+		if err := o.voidAttempt(ctx, s); err != nil {
+			return fmt.Errorf("failed to compensate %s of checkout %s: %w", StepAuthorizePayment, s.SagaID, err)
+		}
+		s.Authorizing = false
+		if err := saveSaga(ctx, o.config.DB, s); err != nil {
+			return err
+		}
+	}
+
+	for len(s.Completed) > 0 {
+		step := s.Completed[len(s.Completed)-1]
+		if err := o.undo(ctx, s, step); err != nil {
+			return fmt.Errorf("failed to compensate %s of checkout %s: %w", step, s.SagaID, err)
+		}
+
+		s.Completed = s.Completed[:len(s.Completed)-1]
+		if err := saveSaga(ctx, o.config.DB, s); err != nil {
+			return err
+		}
+	}
+
+	s.Status = SagaCompensated
+	s.Step = ""
+	if err := saveSaga(ctx, o.config.DB, s); err != nil {
+		return err
+	}
+	log.Printf("Checkout %s rolled back", s.SagaID)
+
+	// The next checkout of the cart releases a claim left behind
+	if err := releaseCart(ctx, o.config.DB, s); err != nil {
+		log.Printf("Failed to release cart of checkout %s: %v", s.SagaID, err)
+	}
+	return nil
+}
+
+// run performs a step, storing what later steps and compensations need in the saga
+func (o *Orchestrator) run(ctx context.Context, s *Saga, step Step) error {
+	switch step {
+	case StepValidateCart:
+		return o.validateCart(ctx, s)
+	case StepReserveInventory:
+		s.ReservationID = s.SagaID
+		err := o.config.Inventory.Reserve(ctx, s.ReservationID, reservationItems(s.Cart))
+		if err != nil && ctx.Err() == nil {
+			// The reservation may have been made before the call failed
+			if releaseErr := o.config.Inventory.Release(ctx, s.ReservationID); releaseErr != nil {
+				log.Printf("Failed to release reservation %s: %v", s.ReservationID, releaseErr)
+			}
+		}
+		return err
+	case StepComputeTotals:
+		totals, err := o.config.Pricer.Price(ctx, s.Cart)
+		s.Totals = totals
+		return err
+	case StepAuthorizePayment:
+		return o.authorizePayment(ctx, s)
+	case StepCreateOrder:
+		return o.createOrder(ctx, s)
+	case StepCommitInventory:
+		return o.commitInventory(ctx, s)
+	case StepPublishOrderCreated:
+		event, err := orderCreatedEvent(s)
+		if err != nil {
+			return err
+		}
+		return kafka.PublishOrderEvent(ctx, o.config.Orders, o.config.Codec, event)
+	case StepConvertCart:
+		return o.convertCart(ctx, s)
+	default:
+		return fmt.Errorf("unknown checkout step %q", step)
+	}
+}
+
+// undo compensates a completed step; steps without side effects need nothing
+func (o *Orchestrator) undo(ctx context.Context, s *Saga, step Step) error {
+	switch step {
+	case StepReserveInventory:
+		return o.config.Inventory.Release(ctx, s.ReservationID)
+	case StepAuthorizePayment:
+		return o.config.Payments.Void(ctx, s.AuthorizationID)
+	default:
+		return nil
+	}
+}
+
+// authorizePayment places the hold for the order total. The saga is marked as authorizing before
+// the gateway is called, so a hold whose response was lost, or whose instance crashed before
+// recording it, is found again by the idempotency key: a resumed saga completes the step with it,
+// and a compensated one voids it.
+func (o *Orchestrator) authorizePayment(ctx context.Context, s *Saga) error {
+	if s.Authorizing {
+		authorizationID, err := o.config.Payments.FindAuthorization(ctx, s.SagaID)
+		if err != nil {
+			return err
+		}
+		if authorizationID != "" {
+			s.AuthorizationID = authorizationID
+			s.Authorizing = false
+			return nil
+		}
+	}
+	if s.PaymentToken == "" {
+		return ErrPaymentTokenUnavailable
+	}
+
+	if !s.Authorizing {
+		s.Authorizing = true
+		if err := saveSaga(ctx, o.config.DB, s); err != nil {
+			return err
+		}
+	}
+
+	authorizationID, err := o.config.Payments.Authorize(ctx, AuthorizationRequest{
+		IdempotencyKey: s.SagaID,
+		OrderID:        s.OrderID,
+		Shop:           s.Shop,
+		CustomerID:     s.Cart.CustomerID,
+		PaymentToken:   s.PaymentToken,
+		Amount:         s.Totals.Total,
+		Currency:       s.Cart.Currency,
+	})
+	if err != nil {
+		return err
+	}
+	s.AuthorizationID = authorizationID
+	s.Authorizing = false
+	return nil
+}
+
+// voidAttempt voids the authorization made by an attempt whose outcome was not recorded, if the
+// gateway has one under the saga's idempotency key
+func (o *Orchestrator) voidAttempt(ctx context.Context, s *Saga) error {
+	authorizationID, err := o.config.Payments.FindAuthorization(ctx, s.SagaID)
+	if err != nil || authorizationID == "" {
+		return err
+	}
+	return o.config.Payments.Void(ctx, authorizationID)
+}
+
+// validateCart snapshots the cart, which later steps work from, and checks it can be ordered
+func (o *Orchestrator) validateCart(ctx context.Context, s *Saga) error {
+	c, err := o.config.Carts.Get(ctx, s.CartID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(c.Items) == 0:
+		return fmt.Errorf("%w: cart %s is empty", ErrInvalidCart, c.ID)
+	case c.Currency == "":
+		return fmt.Errorf("%w: cart %s has no currency", ErrInvalidCart, c.ID)
+	case c.ShippingAddress == nil:
+		return fmt.Errorf("%w: cart %s has no shipping address", ErrInvalidCart, c.ID)
+	}
+	for _, item := range c.Items {
+		if item.Quantity <= 0 || item.UnitPrice < 0 {
+			return fmt.Errorf("%w: cart %s has an invalid line item for variant %s", ErrInvalidCart, c.ID, item.VariantID)
+		}
+	}
+
+	s.Cart = c
+	s.Shop = c.Shop
+	return nil
+}
+
+// createOrder stores the order. An order that exists was created before the saga was interrupted.
+func (o *Orchestrator) createOrder(ctx context.Context, s *Saga) error {
+	record, err := kafka.StatusChangedRecord(order.State{
+		OrderID: s.OrderID,
+		Status:  order.StatusPending,
+		Version: 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	state, err := order.Create(ctx, o.config.DB, newOrder(s), "checkout "+s.SagaID, record)
+	if errors.Is(err, order.ErrOrderExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Checkout %s created order %s (version %d)", s.SagaID, state.OrderID, state.Version)
+	return nil
+}
+
+// convertCart removes the checked out cart, reporting its recovery if it had been abandoned. A cart
+// that is gone was converted before the saga was interrupted. A cart changed since it was validated
+// is kept with what was added meanwhile, and released so it can be checked out again.
+func (o *Orchestrator) convertCart(ctx context.Context, s *Saga) error {
+	var err error
+	if o.config.CartEvents != nil {
+		err = kafka.ConvertCart(ctx, o.config.Carts, o.config.CartEvents, s.CartID, s.Cart.Version, s.OrderID)
+	} else {
+		_, _, err = o.config.Carts.Convert(ctx, s.CartID, s.Cart.Version)
+	}
+	switch {
+	case errors.Is(err, cart.ErrCartNotFound):
+		return nil
+	case errors.Is(err, cart.ErrCartChanged):
+		log.Printf("Cart %s changed during checkout %s and is kept", s.CartID, s.SagaID)
+		return releaseCart(ctx, o.config.DB, s)
+	}
+	return err
+}
+
+// newOrder builds the order placed by the saga
+func newOrder(s *Saga) *order.Order {
+	o := &order.Order{
+		OrderID:         s.OrderID,
+		Shop:            s.Shop,
+		CustomerID:      s.Cart.CustomerID,
+		ShippingAddress: s.Cart.ShippingAddress,
+		Currency:        s.Cart.Currency,
+		Subtotal:        s.Totals.Subtotal,
+		Discount:        s.Totals.Discount,
+		Shipping:        s.Totals.Shipping,
+		Tax:             s.Totals.Tax,
+		Total:           s.Totals.Total,
+	}
+	if s.Cart.CustomerID != "" || s.Cart.Email != "" {
+		o.Customer = &order.Customer{ID: s.Cart.CustomerID, Email: s.Cart.Email}
+	}
+	for _, item := range s.Cart.Items {
+		o.LineItems = append(o.LineItems, order.LineItem{
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			SKU:       item.SKU,
+			Title:     item.Title,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+		})
+	}
+	return o
+}
+
+// orderCreatedEvent builds the order.created event of the saga. The event ID is the saga ID so a
+// republished event is recognizable as the same one.
+func orderCreatedEvent(s *Saga) (*kafka.OrderEvent, error) {
+	event, err := kafka.NewOrderEvent(kafka.OrderCreated, s.Shop, s.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	event.EventID = s.SagaID
+	event.Currency = s.Cart.Currency
+	event.Subtotal = s.Totals.Subtotal
+	event.Discount = s.Totals.Discount
+	event.Shipping = s.Totals.Shipping
+	event.Tax = s.Totals.Tax
+	event.Total = s.Totals.Total
+	for _, item := range s.Cart.Items {
+		event.LineItems = append(event.LineItems, kafka.OrderLineItem{
+			VariantID: item.VariantID,
+			SKU:       item.SKU,
+			Title:     item.Title,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+		})
+	}
+	return event, nil
+}
+
+// commitInventory commits the reservation to the order. A reservation that lapsed before the
+// order was created is made again under the order ID; when the stock is gone by then, the saga
+// completes with the order backordered rather than retrying the commit forever.
+func (o *Orchestrator) commitInventory(ctx context.Context, s *Saga) error {
+	err := o.config.Inventory.Commit(ctx, s.ReservationID, s.OrderID)
+	if !errors.Is(err, ErrReservationLost) {
+		return err
+	}
+
+	if s.ReservationID != s.OrderID {
+		log.Printf("Checkout %s lost reservation %s, reserving again: %v", s.SagaID, s.ReservationID, err)
+		s.ReservationID = s.OrderID
+		err = o.config.Inventory.Reserve(ctx, s.ReservationID, reservationItems(s.Cart))
+		if err == nil {
+			err = o.config.Inventory.Commit(ctx, s.ReservationID, s.OrderID)
+		}
+	}
+	if errors.Is(err, ErrOutOfStock) || errors.Is(err, ErrReservationLost) {
+		log.Printf("Checkout %s backordered order %s: %v", s.SagaID, s.OrderID, err)
+		s.Backordered = true
+		return nil
+	}
+	return err
+}
+
+// reservationItems lists the quantities of the cart to reserve
+func reservationItems(c *cart.Cart) []ReservationItem {
+	items := make([]ReservationItem, 0, len(c.Items))
+	for _, item := range c.Items {
+		items = append(items, ReservationItem{VariantID: item.VariantID, SKU: item.SKU, Quantity: item.Quantity})
+	}
+	return items
+}
+
+// nextStep returns the step after step, or "" after the last one
+func nextStep(step Step) Step {
+	for i, s := range steps {
+		if s == step && i+1 < len(steps) {
+			return steps[i+1]
+		}
+	}
+	return ""
+}
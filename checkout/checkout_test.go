@@ -0,0 +1,885 @@
+package checkout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+	kafka_go "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+
+	"cartloom/cart"
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/kafka"
+	"cartloom/order"
+	"cartloom/shopify"
+)
+
+// attribute is the wire form of the DynamoDB attribute values the fake reads
+type attribute struct {
+	S    string
+	N    string
+	BOOL bool
+	L    []attribute
+}
+
+// savedSaga is what the fake reads of a saga being written
+type savedSaga struct {
+	Status      SagaStatus
+	Completed   []Step
+	Authorizing bool
+}
+
+// fakeDynamoDB keeps sagas, cart claims and orders in memory and enforces the conditions their
+// writes carry. Once crash matches a saga being written, that write and every request after it
+// fail, as if the instance died just before the write, until restart is called.
+type fakeDynamoDB struct {
+	mu      sync.Mutex
+	sagas   map[string]map[string]json.RawMessage
+	claims  map[string]string
+	orders  map[string]bool
+	crash   func(savedSaga) bool
+	crashed bool
+}
+
+// put is a write of one item, alone or in a transaction
+type put struct {
+	TableName                 string
+	Item                      map[string]json.RawMessage
+	ConditionExpression       string
+	ExpressionAttributeValues map[string]attribute
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		put
+		Key           map[string]attribute
+		TransactItems []struct {
+			Put *put
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if f.crashed {
+		writeError(w, "InternalFailure", "instance crashed")
+		return
+	}
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.GetItem":
+		if input.TableName == cartdynamodb.CheckoutClaimsTable {
+			sagaID, ok := f.claims[input.Key["CartID"].S]
+			if !ok {
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			fmt.Fprintf(w, `{"Item":{"SagaID":{"S":%q}}}`, sagaID)
+			return
+		}
+		item, ok := f.sagas[input.Key["SagaID"].S]
+		if !ok {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+
+	case "DynamoDB_20120810.PutItem":
+		if f.crashes(input.Item) {
+			writeError(w, "InternalFailure", "instance crashed")
+			return
+		}
+		if !f.sagaWritable(&input.put) {
+			writeError(w, "ConditionalCheckFailedException", "The conditional request failed")
+			return
+		}
+		f.sagas[stringAttribute(input.Item["SagaID"])] = input.Item
+		fmt.Fprint(w, `{}`)
+
+	case "DynamoDB_20120810.DeleteItem":
+		cartID := input.Key["CartID"].S
+		if f.claims[cartID] != input.ExpressionAttributeValues[":saga"].S {
+			writeError(w, "ConditionalCheckFailedException", "The conditional request failed")
+			return
+		}
+		delete(f.claims, cartID)
+		fmt.Fprint(w, `{}`)
+
+	case "DynamoDB_20120810.TransactWriteItems":
+		var reasons []string
+		cancelled := false
+		for _, item := range input.TransactItems {
+			ok := true
+			switch {
+			case item.Put == nil:
+			case item.Put.TableName == order.OrdersTable:
+				ok = !f.orders[stringAttribute(item.Put.Item["OrderID"])]
+			case item.Put.TableName == cartdynamodb.CheckoutClaimsTable:
+				_, claimed := f.claims[stringAttribute(item.Put.Item["CartID"])]
+				ok = !claimed
+			case item.Put.TableName == cartdynamodb.CheckoutSagasTable:
+				if f.crashes(item.Put.Item) {
+					writeError(w, "InternalFailure", "instance crashed")
+					return
+				}
+				ok = f.sagaWritable(item.Put)
+			}
+			if ok {
+				reasons = append(reasons, `{"Code":"None"}`)
+			} else {
+				reasons = append(reasons, `{"Code":"ConditionalCheckFailed"}`)
+				cancelled = true
+			}
+		}
+		if cancelled {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException",`+
+				`"message":"Transaction cancelled","CancellationReasons":[%s]}`, strings.Join(reasons, ","))
+			return
+		}
+
+		for _, item := range input.TransactItems {
+			if item.Put == nil {
+				continue
+			}
+			switch item.Put.TableName {
+			case order.OrdersTable:
+				f.orders[stringAttribute(item.Put.Item["OrderID"])] = true
+			case cartdynamodb.CheckoutClaimsTable:
+				f.claims[stringAttribute(item.Put.Item["CartID"])] = stringAttribute(item.Put.Item["SagaID"])
+			case cartdynamodb.CheckoutSagasTable:
+				f.sagas[stringAttribute(item.Put.Item["SagaID"])] = item.Put.Item
+			}
+		}
+		fmt.Fprint(w, `{}`)
+
+	default:
+		http.Error(w, "unexpected operation "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+	}
+}
+
+// crashes reports whether writing the saga item crashes the instance, and marks it crashed if so
+func (f *fakeDynamoDB) crashes(item map[string]json.RawMessage) bool {
+	var completed, status, authorizing attribute
+	json.Unmarshal(item["Completed"], &completed)
+	json.Unmarshal(item["Status"], &status)
+	json.Unmarshal(item["Authorizing"], &authorizing)
+
+	saga := savedSaga{Status: SagaStatus(status.S), Authorizing: authorizing.BOOL}
+	for _, step := range completed.L {
+		saga.Completed = append(saga.Completed, Step(step.S))
+	}
+	if f.crash != nil && f.crash(saga) {
+		f.crashed = true
+	}
+	return f.crashed
+}
+
+// sagaWritable reports whether the condition of a saga write holds
+func (f *fakeDynamoDB) sagaWritable(p *put) bool {
+	stored, exists := f.sagas[stringAttribute(p.Item["SagaID"])]
+	var version attribute
+	json.Unmarshal(stored["Version"], &version)
+	return !(p.ConditionExpression == "attribute_not_exists(SagaID)" && exists ||
+		p.ConditionExpression == "Version = :expected" && version.N != p.ExpressionAttributeValues[":expected"].N)
+}
+
+// stringAttribute decodes a string attribute
+func stringAttribute(raw json.RawMessage) string {
+	var value attribute
+	json.Unmarshal(raw, &value)
+	return value.S
+}
+
+// writeError answers with a DynamoDB error that is not retried
+func writeError(w http.ResponseWriter, code, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#%s","message":%q}`, code, message)
+}
+
+// restart lets requests through again after a crash, as a new instance would see the table
+func (f *fakeDynamoDB) restart() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crash = nil
+	f.crashed = false
+}
+
+// orderCreated reports whether the order was written
+func (f *fakeDynamoDB) orderCreated(orderID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.orders[orderID]
+}
+
+// callLog records the calls made to the fake collaborators in order
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, fmt.Sprintf(format, args...))
+}
+
+func (l *callLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.calls...)
+}
+
+// fakeInventory holds reservations in memory. commitErrors are returned by the next Commit calls.
+type fakeInventory struct {
+	mu           sync.Mutex
+	log          *callLog
+	reserved     map[string]bool
+	committed    map[string]string
+	commitErrors []error
+}
+
+func (f *fakeInventory) Reserve(ctx context.Context, reservationID string, items []ReservationItem) error {
+	f.log.add("reserve %s", reservationID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reserved[reservationID] = true
+	return nil
+}
+
+func (f *fakeInventory) Commit(ctx context.Context, reservationID, orderID string) error {
+	f.log.add("commit %s", reservationID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.commitErrors) > 0 {
+		err := f.commitErrors[0]
+		f.commitErrors = f.commitErrors[1:]
+		return err
+	}
+	if f.committed[reservationID] == orderID {
+		return nil
+	}
+	if !f.reserved[reservationID] {
+		return ErrReservationLost
+	}
+	delete(f.reserved, reservationID)
+	f.committed[reservationID] = orderID
+	return nil
+}
+
+func (f *fakeInventory) Release(ctx context.Context, reservationID string) error {
+	f.log.add("release %s", reservationID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.reserved, reservationID)
+	return nil
+}
+
+// held returns the reservations not released or committed
+func (f *fakeInventory) held() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.reserved)
+}
+
+// fakePayments authorizes in memory. authorizeErr is returned by the next Authorize call, after
+// the authorization was made when responseLost is set, as when the gateway's response never
+// arrives, and instead of it otherwise. voidErr fails the next Void call.
+type fakePayments struct {
+	mu             sync.Mutex
+	log            *callLog
+	authorizations map[string]string
+	voided         map[string]bool
+	authorizeErr   error
+	responseLost   bool
+	voidErr        error
+}
+
+func (f *fakePayments) Authorize(ctx context.Context, req AuthorizationRequest) (string, error) {
+	f.log.add("authorize %s", req.IdempotencyKey)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.authorizeErr
+	f.authorizeErr = nil
+	if err != nil && !f.responseLost {
+		return "", err
+	}
+	id, ok := f.authorizations[req.IdempotencyKey]
+	if !ok {
+		id = fmt.Sprintf("auth-%d", len(f.authorizations)+1)
+		f.authorizations[req.IdempotencyKey] = id
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (f *fakePayments) FindAuthorization(ctx context.Context, idempotencyKey string) (string, error) {
+	f.log.add("find %s", idempotencyKey)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.authorizations[idempotencyKey], nil
+}
+
+func (f *fakePayments) Void(ctx context.Context, authorizationID string) error {
+	f.log.add("void %s", authorizationID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.voidErr; err != nil {
+		f.voidErr = nil
+		return err
+	}
+	f.voided[authorizationID] = true
+	return nil
+}
+
+// fakeKafka is a broker with one partition per topic that keeps the values produced to it
+type fakeKafka struct {
+	mu     sync.Mutex
+	values [][]byte
+}
+
+func (f *fakeKafka) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{}
+		for _, topic := range req.TopicNames {
+			res.Topics = append(res.Topics, metadata.ResponseTopic{
+				Name:       topic,
+				Partitions: []metadata.ResponsePartition{{PartitionIndex: 0}},
+			})
+		}
+		return res, nil
+
+	case *produce.Request:
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			resTopic := produce.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if err != nil {
+						break
+					}
+					value, err := protocol.ReadAll(record.Value)
+					if err != nil {
+						return nil, err
+					}
+					f.mu.Lock()
+					f.values = append(f.values, value)
+					f.mu.Unlock()
+				}
+				resTopic.Partitions = append(resTopic.Partitions, produce.ResponsePartition{Partition: partition.Partition})
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected Kafka request %T", req)
+	}
+}
+
+// events decodes the order events produced so far
+func (f *fakeKafka) events(t *testing.T) []*kafka.OrderEvent {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var events []*kafka.OrderEvent
+	for _, value := range f.values {
+		event, err := kafka.JSONCodec{}.Decode(value)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// testEnv is an orchestrator with its collaborators faked
+type testEnv struct {
+	orchestrator *Orchestrator
+	db           *fakeDynamoDB
+	client       *dynamodb.Client
+	carts        *cart.Store
+	rdb          *redis.Client
+	inventory    *fakeInventory
+	payments     *fakePayments
+	kafka        *fakeKafka
+	log          *callLog
+}
+
+// testPricer takes 10% off with WELCOME10, charges 5.00 shipping and 19% tax
+var testPricer = FlatRatePricer{TaxRate: 1900, ShippingFee: 500, Discounts: map[string]int64{"WELCOME10": 1000}}
+
+// newTestEnv creates an orchestrator on miniredis, a fake DynamoDB and a fake Kafka broker
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	fake := &fakeDynamoDB{
+		sagas:  make(map[string]map[string]json.RawMessage),
+		claims: make(map[string]string),
+		orders: make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+		BaseEndpoint: aws.String(server.URL),
+	})
+
+	broker := &fakeKafka{}
+	writer := &kafka_go.Writer{
+		Addr:         kafka_go.TCP("kafka:9092"),
+		Topic:        "orders",
+		Transport:    broker,
+		RequiredAcks: kafka_go.RequireAll,
+		BatchTimeout: time.Millisecond,
+	}
+	t.Cleanup(func() { writer.Close() })
+
+	log := &callLog{}
+	env := &testEnv{
+		db:        fake,
+		client:    client,
+		carts:     cart.NewStore(rdb, time.Hour),
+		rdb:       rdb,
+		inventory: &fakeInventory{log: log, reserved: make(map[string]bool), committed: make(map[string]string)},
+		payments:  &fakePayments{log: log, authorizations: make(map[string]string), voided: make(map[string]bool)},
+		kafka:     broker,
+		log:       log,
+	}
+	env.orchestrator = New(Config{
+		DB:        client,
+		Carts:     env.carts,
+		Inventory: env.inventory,
+		Payments:  env.payments,
+		Pricer:    testPricer,
+		Orders:    writer,
+	})
+	return env
+}
+
+// newCart creates a cart of two mugs at 12.50 EUR with a discount code and a shipping address
+func (e *testEnv) newCart(t *testing.T) *cart.Cart {
+	t.Helper()
+	ctx := context.Background()
+
+	product, _ := json.Marshal(shopify.ProductRecord{
+		ProductID: "p1",
+		Title:     "Mug",
+		Variants:  []shopify.VariantRecord{{VariantID: "v1", SKU: "MUG-1", Price: "12.50"}},
+	})
+	if err := e.rdb.Set(ctx, shopify.ProductCacheKey("p1"), product, 0).Err(); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	c, err := e.carts.Create(ctx, "example.myshopify.com", "EUR", "c1")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := e.carts.AddItem(ctx, c.ID, "p1", "v1", 2); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if _, err := e.carts.ApplyDiscount(ctx, c.ID, "welcome10"); err != nil {
+		t.Fatalf("ApplyDiscount: %v", err)
+	}
+	c, err = e.carts.SetShippingAddress(ctx, c.ID, order.Address{City: "Berlin", CountryCode: "DE"})
+	if err != nil {
+		t.Fatalf("SetShippingAddress: %v", err)
+	}
+	return c
+}
+
+// storedSaga reads the saga as a resuming instance would
+func (e *testEnv) storedSaga(t *testing.T, sagaID string) *Saga {
+	t.Helper()
+	s, err := loadSaga(context.Background(), e.client, sagaID)
+	if err != nil {
+		t.Fatalf("loadSaga: %v", err)
+	}
+	return s
+}
+
+// assertCompleted checks that the saga placed exactly one order, paid once and kept the stock
+func (e *testEnv) assertCompleted(t *testing.T, s *Saga) {
+	t.Helper()
+
+	if s.Status != SagaCompleted {
+		t.Fatalf("status = %s, want %s", s.Status, SagaCompleted)
+	}
+	if !e.db.orderCreated(s.OrderID) {
+		t.Fatalf("order %s was not created", s.OrderID)
+	}
+	if e.inventory.committed[s.ReservationID] != s.OrderID || e.inventory.held() != 0 {
+		t.Fatalf("reservation %s not committed to %s: committed %v, held %d", s.ReservationID, s.OrderID, e.inventory.committed, e.inventory.held())
+	}
+	if len(e.payments.authorizations) != 1 || len(e.payments.voided) != 0 {
+		t.Fatalf("authorizations = %v, voided = %v, want one authorization kept", e.payments.authorizations, e.payments.voided)
+	}
+	if s.AuthorizationID != e.payments.authorizations[s.SagaID] {
+		t.Fatalf("AuthorizationID = %q, want %q", s.AuthorizationID, e.payments.authorizations[s.SagaID])
+	}
+
+	events := e.kafka.events(t)
+	if len(events) == 0 {
+		t.Fatal("order.created was not published")
+	}
+	for _, event := range events {
+		if event.EventID != s.SagaID || event.OrderID != s.OrderID {
+			t.Fatalf("event %s for order %s, want %s for %s", event.EventID, event.OrderID, s.SagaID, s.OrderID)
+		}
+	}
+	if _, err := e.carts.Get(context.Background(), s.CartID); !errors.Is(err, cart.ErrCartNotFound) {
+		t.Fatalf("cart %s was not converted: %v", s.CartID, err)
+	}
+}
+
+// assertCompensated checks that the saga left no order, payment or reservation behind
+func (e *testEnv) assertCompensated(t *testing.T, s *Saga) {
+	t.Helper()
+
+	if s.Status != SagaCompensated || len(s.Completed) != 0 || s.Authorizing {
+		t.Fatalf("saga = %s with %v completed (authorizing %v), want compensated with nothing completed", s.Status, s.Completed, s.Authorizing)
+	}
+	if e.db.orderCreated(s.OrderID) {
+		t.Fatalf("order %s was created", s.OrderID)
+	}
+	if e.inventory.held() != 0 {
+		t.Fatalf("%d reservations still held", e.inventory.held())
+	}
+	for key, id := range e.payments.authorizations {
+		if !e.payments.voided[id] {
+			t.Fatalf("authorization %s of %s was not voided", id, key)
+		}
+	}
+	if events := e.kafka.events(t); len(events) != 0 {
+		t.Fatalf("%d order events published", len(events))
+	}
+}
+
+func TestCheckoutPlacesOrder(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	c := env.newCart(t)
+
+	s, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	env.assertCompleted(t, s)
+	if !reflect.DeepEqual(s.Completed, steps) {
+		t.Fatalf("Completed = %v, want %v", s.Completed, steps)
+	}
+
+	want := Totals{Subtotal: 2500, Discount: 250, Shipping: 500, Tax: 428, Total: 3178}
+	if s.Totals != want {
+		t.Fatalf("Totals = %+v, want %+v", s.Totals, want)
+	}
+	event := env.kafka.events(t)[0]
+	got := Totals{Subtotal: event.Subtotal, Discount: event.Discount, Shipping: event.Shipping, Tax: event.Tax, Total: event.Total}
+	if got != want {
+		t.Fatalf("order.created totals = %+v, want %+v", got, want)
+	}
+	if event.Type != kafka.OrderCreated || event.Currency != "EUR" || len(event.LineItems) != 1 || event.LineItems[0].Quantity != 2 {
+		t.Fatalf("order.created = %+v", event)
+	}
+}
+
+func TestCheckoutIsIdempotentPerCart(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("completed", func(t *testing.T) {
+		env := newTestEnv(t)
+		c := env.newCart(t)
+
+		first, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if err != nil {
+			t.Fatalf("Checkout: %v", err)
+		}
+		again, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if err != nil {
+			t.Fatalf("repeated Checkout: %v", err)
+		}
+		if again.SagaID != first.SagaID || again.OrderID != first.OrderID {
+			t.Fatalf("repeated checkout ran saga %s for order %s, want %s for %s", again.SagaID, again.OrderID, first.SagaID, first.OrderID)
+		}
+		env.assertCompleted(t, again)
+		if len(env.db.sagas) != 1 {
+			t.Fatalf("%d sagas stored, want 1", len(env.db.sagas))
+		}
+	})
+
+	t.Run("running", func(t *testing.T) {
+		env := newTestEnv(t)
+		c := env.newCart(t)
+
+		// The first request's instance stops after reserving the stock
+		env.db.crash = func(s savedSaga) bool {
+			return len(s.Completed) > 0 && s.Completed[len(s.Completed)-1] == StepReserveInventory
+		}
+		first, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if err == nil {
+			t.Fatal("Checkout did not fail when its instance crashed")
+		}
+		env.db.restart()
+		calls := len(env.log.list())
+
+		again, err := New(env.orchestrator.config).Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if err != nil {
+			t.Fatalf("repeated Checkout: %v", err)
+		}
+		if again.SagaID != first.SagaID || again.Status != SagaRunning {
+			t.Fatalf("repeated checkout returned %s saga %s, want running %s", again.Status, again.SagaID, first.SagaID)
+		}
+		if len(env.log.list()) != calls {
+			t.Fatalf("repeated checkout ran steps: %q", env.log.list()[calls:])
+		}
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		env := newTestEnv(t)
+		c := env.newCart(t)
+		declined := errors.New("payment declined")
+		env.payments.authorizeErr = declined
+
+		first, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if !errors.Is(err, declined) {
+			t.Fatalf("Checkout error = %v, want %v", err, declined)
+		}
+		again, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+		if err != nil {
+			t.Fatalf("Checkout after the rollback: %v", err)
+		}
+		if again.SagaID == first.SagaID {
+			t.Fatal("cart of a rolled back checkout could not be checked out again")
+		}
+		if again.Status != SagaCompleted || !env.db.orderCreated(again.OrderID) {
+			t.Fatalf("second checkout is %s, want an order placed", again.Status)
+		}
+	})
+}
+
+// addingPricer prices with testPricer after running add, which changes the cart mid-checkout
+type addingPricer struct {
+	add func()
+}
+
+func (p addingPricer) Price(ctx context.Context, c *cart.Cart) (Totals, error) {
+	p.add()
+	return testPricer.Price(ctx, c)
+}
+
+func TestCheckoutKeepsCartChangedDuringCheckout(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	c := env.newCart(t)
+
+	config := env.orchestrator.config
+	config.Pricer = addingPricer{add: func() {
+		if _, err := env.carts.AddItem(ctx, c.ID, "p1", "v1", 1); err != nil {
+			t.Errorf("AddItem: %v", err)
+		}
+	}}
+	s, err := New(config).Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if s.Status != SagaCompleted || !env.db.orderCreated(s.OrderID) {
+		t.Fatalf("checkout is %s, want an order placed", s.Status)
+	}
+	if s.Cart.Items[0].Quantity != 2 {
+		t.Fatalf("order placed for %d mugs, want the 2 validated", s.Cart.Items[0].Quantity)
+	}
+
+	kept, err := env.carts.Get(ctx, c.ID)
+	if err != nil {
+		t.Fatalf("cart changed during checkout was removed: %v", err)
+	}
+	if kept.Items[0].Quantity != 3 {
+		t.Fatalf("kept cart has %d mugs, want the 3 it was changed to", kept.Items[0].Quantity)
+	}
+	if _, claimed := env.db.claims[c.ID]; claimed {
+		t.Fatal("kept cart is still claimed by the finished checkout")
+	}
+}
+
+func TestCheckoutCompensatesInReverseOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseLost bool
+		want         []string
+	}{
+		{
+			name: "declined",
+			want: []string{"reserve $saga", "authorize $saga", "find $saga", "release $saga"},
+		},
+		{
+			name:         "authorized without response",
+			responseLost: true,
+			want:         []string{"reserve $saga", "authorize $saga", "find $saga", "void auth-1", "release $saga"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			c := env.newCart(t)
+			declined := errors.New("payment declined")
+			env.payments.authorizeErr = declined
+			env.payments.responseLost = tt.responseLost
+
+			s, err := env.orchestrator.Checkout(context.Background(), Request{CartID: c.ID, PaymentToken: "tok"})
+			if !errors.Is(err, declined) {
+				t.Fatalf("Checkout error = %v, want %v", err, declined)
+			}
+			env.assertCompensated(t, env.storedSaga(t, s.SagaID))
+
+			var want []string
+			for _, call := range tt.want {
+				want = append(want, strings.ReplaceAll(call, "$saga", s.SagaID))
+			}
+			if calls := env.log.list(); !reflect.DeepEqual(calls, want) {
+				t.Fatalf("calls = %q, want %q", calls, want)
+			}
+			if _, err := env.carts.Get(context.Background(), c.ID); err != nil {
+				t.Fatalf("cart of a rolled back checkout: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckoutResumesAfterCrash(t *testing.T) {
+	for i, step := range steps {
+		// Sagas interrupted before the payment was authorized cannot get the payment token back
+		rolledBack := i < 3
+
+		t.Run(string(step), func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t)
+			c := env.newCart(t)
+
+			env.db.crash = func(s savedSaga) bool {
+				return len(s.Completed) > 0 && s.Completed[len(s.Completed)-1] == step
+			}
+			s, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+			if err == nil {
+				t.Fatal("Checkout did not fail when its instance crashed")
+			}
+			env.db.restart()
+			if stored := env.storedSaga(t, s.SagaID); stored.Status != SagaRunning || stored.Step != step {
+				t.Fatalf("stored saga is %s at %s, want running at %s", stored.Status, stored.Step, step)
+			}
+
+			resumed, err := New(env.orchestrator.config).Resume(ctx, s.SagaID)
+			if rolledBack {
+				if !errors.Is(err, ErrPaymentTokenUnavailable) {
+					t.Fatalf("Resume error = %v, want %v", err, ErrPaymentTokenUnavailable)
+				}
+				env.assertCompensated(t, resumed)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resume: %v", err)
+			}
+			env.assertCompleted(t, resumed)
+		})
+	}
+}
+
+func TestCheckoutResumesPastPivot(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	c := env.newCart(t)
+
+	unavailable := errors.New("inventory service unavailable")
+	env.inventory.commitErrors = []error{unavailable}
+
+	s, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+	if !errors.Is(err, unavailable) {
+		t.Fatalf("Checkout error = %v, want %v", err, unavailable)
+	}
+	stored := env.storedSaga(t, s.SagaID)
+	if stored.Status != SagaRunning || stored.Step != StepCommitInventory {
+		t.Fatalf("stored saga is %s at %s, want running at %s", stored.Status, stored.Step, StepCommitInventory)
+	}
+	for _, call := range env.log.list() {
+		if call == "release "+s.SagaID || call == "void auth-1" {
+			t.Fatalf("saga past order creation was compensated: %q", env.log.list())
+		}
+	}
+
+	resumed, err := New(env.orchestrator.config).Resume(ctx, s.SagaID)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	env.assertCompleted(t, resumed)
+	if resumed.Backordered {
+		t.Fatal("order was backordered though its reservation was held")
+	}
+}
+
+func TestResumeVoidsUnrecordedAuthorization(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	c := env.newCart(t)
+
+	// The gateway authorized but timed out, and was unreachable when the rollback tried to void
+	timeout := errors.New("gateway timeout")
+	env.payments.authorizeErr = timeout
+	env.payments.responseLost = true
+	env.payments.voidErr = timeout
+
+	s, err := env.orchestrator.Checkout(ctx, Request{CartID: c.ID, PaymentToken: "tok"})
+	if !errors.Is(err, timeout) {
+		t.Fatalf("Checkout error = %v, want %v", err, timeout)
+	}
+	stored := env.storedSaga(t, s.SagaID)
+	if stored.Status != SagaCompensating || !stored.Authorizing || stored.AuthorizationID != "" {
+		t.Fatalf("stored saga is %s (authorizing %v, authorization %q), want compensating with the authorization unrecorded",
+			stored.Status, stored.Authorizing, stored.AuthorizationID)
+	}
+	if env.payments.voided["auth-1"] {
+		t.Fatal("authorization was voided though the gateway failed")
+	}
+
+	resumed, err := New(env.orchestrator.config).Resume(ctx, s.SagaID)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if !env.payments.voided["auth-1"] {
+		t.Fatalf("authorization auth-1 was not voided: %q", env.log.list())
+	}
+	env.assertCompensated(t, resumed)
+}
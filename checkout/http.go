@@ -0,0 +1,107 @@
+package checkout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cartloom/cart"
+)
+
+const (
+	// maxRequestSize caps the body of a checkout request
+	maxRequestSize = 64 << 10
+	// checkoutTimeout bounds a checkout run for a request. It is detached from the request, so a
+	// client that disconnects does not strand the saga halfway through a step.
+	checkoutTimeout = time.Minute
+)
+
+// checkoutRequest is the JSON body of a checkout request
+type checkoutRequest struct {
+	CartID       string `json:"cart_id"`
+	PaymentToken string `json:"payment_token"`
+}
+
+// checkoutResponse is the JSON outcome of a checkout
+type checkoutResponse struct {
+	CheckoutID  string     `json:"checkout_id"`
+	OrderID     string     `json:"order_id,omitempty"`
+	Status      SagaStatus `json:"status"`
+	Backordered bool       `json:"backordered,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// HandleCheckout checks out the cart in a POST body of {"cart_id", "payment_token"}. A completed
+// checkout answers 201 with the order ID, and one that failed after the order was created answers
+// 202, since recovery completes it later, as does a repeated request while the first still runs. A checkout that was rolled back answers with a status
+// matching its error.
+func (o *Orchestrator) HandleCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req checkoutRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "Malformed checkout request", http.StatusBadRequest)
+		return
+	}
+	if req.CartID == "" || req.PaymentToken == "" {
+		http.Error(w, "cart_id and payment_token are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), checkoutTimeout)
+	defer cancel()
+
+	s, err := o.Checkout(ctx, Request{CartID: req.CartID, PaymentToken: req.PaymentToken})
+	if s == nil {
+		log.Printf("Failed to start checkout of cart %s: %v", req.CartID, err)
+		http.Error(w, "Failed to start checkout", http.StatusInternalServerError)
+		return
+	}
+
+	resp := checkoutResponse{CheckoutID: s.SagaID, Status: s.Status, Backordered: s.Backordered}
+	status := http.StatusCreated
+	switch {
+	case err == nil && s.Status == SagaCompleted:
+		resp.OrderID = s.OrderID
+	case s.pastPivot():
+		resp.OrderID = s.OrderID
+		status = http.StatusAccepted
+	case err == nil && s.Status == SagaRunning:
+		// Another request is checking out the cart
+		status = http.StatusAccepted
+	default:
+		if err == nil {
+			err = errors.New(s.Error)
+		}
+		resp.Error = err.Error()
+		status = checkoutErrorStatus(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to write response of checkout %s: %v", s.SagaID, err)
+	}
+}
+
+// checkoutErrorStatus maps the error of a rolled back checkout to an HTTP status
+func checkoutErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, cart.ErrCartNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidCart):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrOutOfStock):
+		return http.StatusConflict
+	case errors.Is(err, ErrPaymentDeclined):
+		return http.StatusPaymentRequired
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,164 @@
+package checkout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrPaymentDeclined is returned when the payment gateway refuses an authorization
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// GatewayError is a non-2xx response from the payment gateway
+type GatewayError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *GatewayError) Error() string {
+	return fmt.Sprintf("payment gateway returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// GatewayAuthorizer authorizes payments with a REST payment gateway. Authorizations are created by
+// POST /authorizations and voided by POST /authorizations/{id}/void, both carrying an
+// Idempotency-Key header so a resumed saga never authorizes or voids twice, and are looked up by
+// GET /authorizations?idempotency_key={key}.
+type GatewayAuthorizer struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+var _ PaymentAuthorizer = (*GatewayAuthorizer)(nil)
+
+// NewGatewayAuthorizer creates an authorizer for the gateway at baseURL
+func NewGatewayAuthorizer(baseURL, apiKey string) *GatewayAuthorizer {
+	return &GatewayAuthorizer{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// gatewayAuthorization is the JSON shape of an authorization request
+type gatewayAuthorization struct {
+	OrderID      string `json:"order_id"`
+	Shop         string `json:"shop"`
+	CustomerID   string `json:"customer_id,omitempty"`
+	PaymentToken string `json:"payment_token"`
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+// Authorize places a hold of the amount on the payment method behind the token
+func (g *GatewayAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) (string, error) {
+	var out struct {
+		ID string `json:"id"`
+	}
+	err := g.do(ctx, http.MethodPost, "/authorizations", req.IdempotencyKey, gatewayAuthorization{
+		OrderID:      req.OrderID,
+		Shop:         req.Shop,
+		CustomerID:   req.CustomerID,
+		PaymentToken: req.PaymentToken,
+		Amount:       req.Amount,
+		Currency:     req.Currency,
+	}, &out)
+	if err != nil {
+		var gwErr *GatewayError
+		if errors.As(err, &gwErr) && gwErr.StatusCode == http.StatusPaymentRequired {
+			return "", fmt.Errorf("%w: %s", ErrPaymentDeclined, gwErr.Message)
+		}
+		return "", fmt.Errorf("failed to authorize payment for order %s: %w", req.OrderID, err)
+	}
+	return out.ID, nil
+}
+
+// FindAuthorization returns the ID of the authorization made with the idempotency key, or "" when
+// the gateway never made one
+func (g *GatewayAuthorizer) FindAuthorization(ctx context.Context, idempotencyKey string) (string, error) {
+	var out struct {
+		ID string `json:"id"`
+	}
+	path := "/authorizations?idempotency_key=" + url.QueryEscape(idempotencyKey)
+	if err := g.do(ctx, http.MethodGet, path, "", nil, &out); err != nil {
+		var gwErr *GatewayError
+		if errors.As(err, &gwErr) && gwErr.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to look up authorization %s: %w", idempotencyKey, err)
+	}
+	return out.ID, nil
+}
+
+// Void releases the hold of an authorization. An authorization the gateway does not know was never
+// made, so there is nothing to void.
+func (g *GatewayAuthorizer) Void(ctx context.Context, authorizationID string) error {
+	if authorizationID == "" {
+		return nil
+	}
+
+	path := "/authorizations/" + url.PathEscape(authorizationID) + "/void"
+	if err := g.do(ctx, http.MethodPost, path, "void-"+authorizationID, struct{}{}, nil); err != nil {
+		var gwErr *GatewayError
+		if errors.As(err, &gwErr) && gwErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("failed to void authorization %s: %w", authorizationID, err)
+	}
+	return nil
+}
+
+// do sends a gateway request with the JSON body, if given, and decodes the JSON response into out,
+// if given
+func (g *GatewayAuthorizer) do(ctx context.Context, method, path, idempotencyKey string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if g.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.APIKey)
+	}
+
+	resp, err := g.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		gwErr := &GatewayError{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, gwErr) != nil || gwErr.Message == "" {
+			gwErr.Message = string(data)
+		}
+		return gwErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
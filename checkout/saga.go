@@ -0,0 +1,283 @@
+package checkout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"cartloom/cart"
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// SagaStatus is where a checkout saga stands overall
+type SagaStatus string
+
+// Saga statuses. Running and compensating sagas are unfinished and can be resumed.
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompleted    SagaStatus = "completed"
+	SagaCompensated  SagaStatus = "compensated"
+)
+
+// Step is one step of the checkout saga
+type Step string
+
+// Checkout steps in the order they run
+const (
+	StepValidateCart        Step = "validate_cart"
+	StepReserveInventory    Step = "reserve_inventory"
+	StepComputeTotals       Step = "compute_totals"
+	StepAuthorizePayment    Step = "authorize_payment"
+	StepCreateOrder         Step = "create_order"
+	StepCommitInventory     Step = "commit_inventory"
+	StepPublishOrderCreated Step = "publish_order_created"
+	StepConvertCart         Step = "convert_cart"
+)
+
+// steps lists the checkout steps in the order they run
+var steps = []Step{
+	StepValidateCart,
+	StepReserveInventory,
+	StepComputeTotals,
+	StepAuthorizePayment,
+	StepCreateOrder,
+	StepCommitInventory,
+	StepPublishOrderCreated,
+	StepConvertCart,
+}
+
+// maxClaimAttempts bounds how often a checkout tries to claim a cart whose claim keeps changing hands
+const maxClaimAttempts = 3
+
+var (
+	// ErrSagaNotFound is returned when no saga has the ID
+	ErrSagaNotFound = errors.New("checkout saga not found")
+	// ErrSagaConflict is returned when another instance advanced the saga first
+	ErrSagaConflict = errors.New("checkout saga was advanced concurrently")
+)
+
+// Saga is the persisted state of one checkout. Step is the next step to run, and Completed lists
+// the steps done so far, which are the ones compensated in reverse when the saga rolls back.
+// PaymentToken is never persisted: only the instance that started the checkout holds it, and a saga
+// resumed elsewhere before its payment was authorized is rolled back. Authorizing is set while an
+// authorization is in flight, so one whose outcome was lost is looked up, and voided on rollback.
+// Backordered is set when the stock held for the order was lost and could not be reserved again.
+type Saga struct {
+	SagaID          string     `dynamodbav:"SagaID"`
+	Status          SagaStatus `dynamodbav:"Status"`
+	Step            Step       `dynamodbav:"Step,omitempty"`
+	Completed       []Step     `dynamodbav:"Completed"`
+	CartID          string     `dynamodbav:"CartID"`
+	OrderID         string     `dynamodbav:"OrderID"`
+	Shop            string     `dynamodbav:"Shop,omitempty"`
+	PaymentToken    string     `dynamodbav:"-"`
+	Cart            *cart.Cart `dynamodbav:"Cart,omitempty"`
+	Totals          Totals     `dynamodbav:"Totals"`
+	ReservationID   string     `dynamodbav:"ReservationID,omitempty"`
+	AuthorizationID string     `dynamodbav:"AuthorizationID,omitempty"`
+	Authorizing     bool       `dynamodbav:"Authorizing,omitempty"`
+	Backordered     bool       `dynamodbav:"Backordered,omitempty"`
+	Error           string     `dynamodbav:"Error,omitempty"`
+	Version         int64      `dynamodbav:"Version"`
+	CreatedAt       time.Time  `dynamodbav:"CreatedAt"`
+	UpdatedAt       time.Time  `dynamodbav:"UpdatedAt"`
+}
+
+// done reports whether the step has completed
+func (s *Saga) done(step Step) bool {
+	for _, completed := range s.Completed {
+		if completed == step {
+			return true
+		}
+	}
+	return false
+}
+
+// pastPivot reports whether the saga has reached order creation. From then on it only moves
+// forward: failures are retried instead of compensated, since a failed create may still have
+// written the order and an order that exists is never rolled back.
+func (s *Saga) pastPivot() bool {
+	return s.Step == StepCreateOrder || s.done(StepCreateOrder)
+}
+
+// loadSaga reads a saga with a consistent read
+func loadSaga(ctx context.Context, db *dynamodb.Client, sagaID string) (*Saga, error) {
+	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cartdynamodb.CheckoutSagasTable),
+		Key:            map[string]types.AttributeValue{"SagaID": &types.AttributeValueMemberS{Value: sagaID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkout saga %s: %w", sagaID, err)
+	}
+	if out.Item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSagaNotFound, sagaID)
+	}
+
+	var s Saga
+	if err := attributevalue.UnmarshalMap(out.Item, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode checkout saga %s: %w", sagaID, err)
+	}
+	return &s, nil
+}
+
+// nextSaga returns the saga as it is stored by the next write, with its version bumped, and its item
+func nextSaga(s *Saga) (Saga, map[string]types.AttributeValue, error) {
+	stored := *s
+	stored.Version = s.Version + 1
+	stored.UpdatedAt = time.Now().UTC()
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = stored.UpdatedAt
+	}
+
+	item, err := attributevalue.MarshalMapWithOptions(stored, cartdynamodb.EncodeTime)
+	if err != nil {
+		return Saga{}, nil, fmt.Errorf("failed to encode checkout saga %s: %w", s.SagaID, err)
+	}
+	return stored, item, nil
+}
+
+// startSaga creates the new saga together with the claim on its cart, so only one checkout of a
+// cart runs at a time. It reports false, writing nothing, when the cart is already claimed.
+func startSaga(ctx context.Context, db *dynamodb.Client, s *Saga) (bool, error) {
+	stored, item, err := nextSaga(s)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName: aws.String(cartdynamodb.CheckoutClaimsTable),
+				Item: map[string]types.AttributeValue{
+					"CartID":    &types.AttributeValueMemberS{Value: s.CartID},
+					"SagaID":    &types.AttributeValueMemberS{Value: s.SagaID},
+					"CreatedAt": cartdynamodb.TimeValue(stored.CreatedAt),
+				},
+				ConditionExpression: aws.String("attribute_not_exists(CartID)"),
+			}},
+			{Put: &types.Put{
+				TableName:           aws.String(cartdynamodb.CheckoutSagasTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(SagaID)"),
+			}},
+		},
+	})
+	if err != nil {
+		var cancelled *types.TransactionCanceledException
+		if errors.As(err, &cancelled) && len(cancelled.CancellationReasons) > 0 &&
+			aws.ToString(cancelled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to start checkout saga %s: %w", s.SagaID, err)
+	}
+
+	*s = stored
+	return true, nil
+}
+
+// cartClaimant returns the ID of the saga holding the claim on the cart, or "" when there is none
+func cartClaimant(ctx context.Context, db *dynamodb.Client, cartID string) (string, error) {
+	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cartdynamodb.CheckoutClaimsTable),
+		Key:            map[string]types.AttributeValue{"CartID": &types.AttributeValueMemberS{Value: cartID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get checkout claim of cart %s: %w", cartID, err)
+	}
+	if id, ok := out.Item["SagaID"].(*types.AttributeValueMemberS); ok {
+		return id.Value, nil
+	}
+	return "", nil
+}
+
+// releaseCart gives up the saga's claim on its cart so the cart can be checked out again. A claim
+// already taken over by another saga is left alone.
+func releaseCart(ctx context.Context, db *dynamodb.Client, s *Saga) error {
+	_, err := db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(cartdynamodb.CheckoutClaimsTable),
+		Key:                 map[string]types.AttributeValue{"CartID": &types.AttributeValueMemberS{Value: s.CartID}},
+		ConditionExpression: aws.String("SagaID = :saga"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":saga": &types.AttributeValueMemberS{Value: s.SagaID},
+		},
+	})
+	var failed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &failed) {
+		return fmt.Errorf("failed to release cart %s of checkout saga %s: %w", s.CartID, s.SagaID, err)
+	}
+	return nil
+}
+
+// saveSaga writes the saga if the stored copy is still at s.Version, or creates it when the version
+// is 0, and bumps the version. A lost race fails with ErrSagaConflict.
+func saveSaga(ctx context.Context, db *dynamodb.Client, s *Saga) error {
+	stored, item, err := nextSaga(s)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(cartdynamodb.CheckoutSagasTable),
+		Item:      item,
+	}
+	if s.Version == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(SagaID)")
+	} else {
+		input.ConditionExpression = aws.String("Version = :expected")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: fmt.Sprint(s.Version)},
+		}
+	}
+
+	if _, err := db.PutItem(ctx, input); err != nil {
+		var failed *types.ConditionalCheckFailedException
+		if errors.As(err, &failed) {
+			return fmt.Errorf("%w: %s at version %d", ErrSagaConflict, s.SagaID, s.Version)
+		}
+		return fmt.Errorf("failed to save checkout saga %s: %w", s.SagaID, err)
+	}
+
+	*s = stored
+	return nil
+}
+
+// stalledSagas lists the IDs of sagas of the status that have not progressed since before
+func stalledSagas(ctx context.Context, db *dynamodb.Client, status SagaStatus, before time.Time) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(cartdynamodb.CheckoutSagasTable),
+		IndexName:              aws.String(cartdynamodb.CheckoutSagasByStatusIndex),
+		KeyConditionExpression: aws.String("#status = :status AND UpdatedAt < :before"),
+		ProjectionExpression:   aws.String("SagaID"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: string(status)},
+			":before": cartdynamodb.TimeValue(before),
+		},
+	}
+
+	var ids []string
+	paginator := dynamodb.NewQueryPaginator(db, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s checkout sagas: %w", status, err)
+		}
+		for _, item := range page.Items {
+			if id, ok := item["SagaID"].(*types.AttributeValueMemberS); ok {
+				ids = append(ids, id.Value)
+			}
+		}
+	}
+	return ids, nil
+}
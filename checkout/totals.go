@@ -0,0 +1,57 @@
+package checkout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cartloom/cart"
+)
+
+// ErrInvalidDiscount is returned when the cart's discount code is not known
+var ErrInvalidDiscount = errors.New("invalid discount code")
+
+// Totals are the amounts charged for a checkout, in minor units of the cart's currency
+type Totals struct {
+	Subtotal int64 `dynamodbav:"Subtotal"`
+	Discount int64 `dynamodbav:"Discount"`
+	Shipping int64 `dynamodbav:"Shipping"`
+	Tax      int64 `dynamodbav:"Tax"`
+	Total    int64 `dynamodbav:"Total"`
+}
+
+// Pricer computes the totals of a cart
+type Pricer interface {
+	Price(ctx context.Context, c *cart.Cart) (Totals, error)
+}
+
+// FlatRatePricer charges a fixed shipping fee and a single tax rate on the discounted subtotal.
+// Discounts maps upper case discount codes to the share of the subtotal they take off, and rates
+// are in basis points.
+type FlatRatePricer struct {
+	TaxRate     int64
+	ShippingFee int64
+	Discounts   map[string]int64
+}
+
+// Price computes the totals of the cart. Amounts are rounded half up to the minor unit.
+func (p FlatRatePricer) Price(ctx context.Context, c *cart.Cart) (Totals, error) {
+	totals := Totals{Subtotal: c.Subtotal(), Shipping: p.ShippingFee}
+
+	if c.DiscountCode != "" {
+		rate, ok := p.Discounts[c.DiscountCode]
+		if !ok {
+			return Totals{}, fmt.Errorf("%w: %s", ErrInvalidDiscount, c.DiscountCode)
+		}
+		totals.Discount = basisPoints(totals.Subtotal, rate)
+	}
+
+	totals.Tax = basisPoints(totals.Subtotal-totals.Discount, p.TaxRate)
+	totals.Total = totals.Subtotal - totals.Discount + totals.Shipping + totals.Tax
+	return totals, nil
+}
+
+// basisPoints returns the share of the amount, rounded half up
+func basisPoints(amount, rate int64) int64 {
+	return (amount*rate + 5000) / 10000
+}
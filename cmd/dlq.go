@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"cartloom/kafka"
+)
+
+const dlqUsage = `usage: cartloom dlq <command> [flags]
+
+commands:
+  list     list dead-lettered messages
+  show     print a message: cartloom dlq show <partition>:<offset>
+  replay   publish matching messages back to their original topic
+  purge    mark matching messages as purged so list, show and replay skip them
+
+list, replay and purge accept --key, --since, --until and --error-class filters.
+--since and --until take an RFC 3339 time or a duration ago such as 24h.
+`
+
+// runDLQ runs a dlq subcommand and returns the process exit code
+func runDLQ(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = dlqList(ctx, args[1:])
+	case "show":
+		err = dlqShow(ctx, args[1:])
+	case "replay":
+		err = dlqReplay(ctx, args[1:])
+	case "purge":
+		err = dlqPurge(ctx, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dlq %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// dlqFlags holds the flags shared by the dlq subcommands
+type dlqFlags struct {
+	*flag.FlagSet
+	topic      string
+	key        string
+	since      string
+	until      string
+	errorClass string
+}
+
+// newDLQFlags defines the topic and filter flags of a subcommand
+func newDLQFlags(name string) *dlqFlags {
+	f := &dlqFlags{FlagSet: flag.NewFlagSet("dlq "+name, flag.ContinueOnError)}
+	defaultTopic := os.Getenv("DLQ_TOPIC")
+	if defaultTopic == "" {
+		defaultTopic = kafka.DefaultDLQTopic
+	}
+	f.StringVar(&f.topic, "topic", defaultTopic, "DLQ topic")
+	f.StringVar(&f.key, "key", "", "only messages with this key")
+	f.StringVar(&f.since, "since", "", "only messages that failed at or after this time")
+	f.StringVar(&f.until, "until", "", "only messages that failed before this time")
+	f.StringVar(&f.errorClass, "error-class", "", "only messages of this error class (permanent or transient)")
+	return f
+}
+
+// admin creates the DLQ admin for the selected topic
+func (f *dlqFlags) admin() *kafka.DLQAdmin {
+	return kafka.NewDLQAdmin(kafkaBrokers(), f.topic)
+}
+
+// filter builds the message filter from the flags
+func (f *dlqFlags) filter() (kafka.DLQFilter, error) {
+	since, err := parseTimeFlag(f.since)
+	if err != nil {
+		return kafka.DLQFilter{}, fmt.Errorf("invalid --since: %v", err)
+	}
+	until, err := parseTimeFlag(f.until)
+	if err != nil {
+		return kafka.DLQFilter{}, fmt.Errorf("invalid --until: %v", err)
+	}
+	return kafka.DLQFilter{Key: f.key, Since: since, Until: until, ErrorClass: f.errorClass}, nil
+}
+
+// parseTimeFlag accepts an RFC 3339 time or a duration before now
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// dlqList prints a line per matching message
+func dlqList(ctx context.Context, args []string) error {
+	flags := newDLQFlags("list")
+	limit := flags.Int("limit", 0, "stop after this many messages (0 for all)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	filter, err := flags.filter()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE\tFAILED AT\tCLASS\tATTEMPTS\tSOURCE\tKEY\tERROR")
+
+	listed := 0
+	errLimit := fmt.Errorf("limit reached")
+	err = flags.admin().Scan(ctx, filter, func(m kafka.DLQMessage) error {
+		fmt.Fprintf(w, "%d:%d\t%s\t%s\t%d\t%s/%d@%d\t%s\t%s\n",
+			m.Partition, m.Offset, m.FailedAt.Format(time.RFC3339), m.ErrorClass, m.Attempts,
+			m.OriginalTopic, m.OriginalPartition, m.OriginalOffset, m.Key, truncate(m.Error, 80))
+		listed++
+		if *limit > 0 && listed >= *limit {
+			return errLimit
+		}
+		return nil
+	})
+	w.Flush()
+
+	if err == errLimit {
+		return nil
+	}
+	return err
+}
+
+// dlqShow prints the headers and payload of a single message
+func dlqShow(ctx context.Context, args []string) error {
+	flags := newDLQFlags("show")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected <partition>:<offset>")
+	}
+
+	partition, offset, err := parseMessageRef(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	m, err := flags.admin().Get(ctx, partition, offset)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Message:   %d:%d\nKey:       %s\nFailed at: %s\n\nHeaders:\n", m.Partition, m.Offset, m.Key, m.FailedAt.Format(time.RFC3339Nano))
+	for _, h := range m.Headers {
+		fmt.Printf("  %s: %s\n", h.Key, h.Value)
+	}
+	fmt.Printf("\nValue:\n%s\n", m.Value)
+	return nil
+}
+
+// dlqReplay republishes matching messages to their source topic
+func dlqReplay(ctx context.Context, args []string) error {
+	flags := newDLQFlags("replay")
+	perSecond := flags.Float64("rate", 10, "messages replayed per second (0 for unlimited)")
+	dryRun := flags.Bool("dry-run", false, "only print the messages that would be replayed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	filter, err := flags.filter()
+	if err != nil {
+		return err
+	}
+
+	opts := kafka.ReplayOptions{Rate: rate.Limit(*perSecond), DryRun: *dryRun}
+	replayed, err := flags.admin().Replay(ctx, filter, opts, func(m kafka.DLQMessage) {
+		fmt.Printf("%d:%d -> %s key=%s\n", m.Partition, m.Offset, m.OriginalTopic, m.Key)
+	})
+
+	if *dryRun {
+		fmt.Printf("%d messages would be replayed\n", replayed)
+	} else {
+		fmt.Printf("%d messages replayed\n", replayed)
+	}
+	return err
+}
+
+// dlqPurge purges matching messages after confirmation
+func dlqPurge(ctx context.Context, args []string) error {
+	flags := newDLQFlags("purge")
+	dryRun := flags.Bool("dry-run", false, "only count the messages that would be purged")
+	yes := flags.Bool("yes", false, "purge without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	filter, err := flags.filter()
+	if err != nil {
+		return err
+	}
+
+	admin := flags.admin()
+	matched, err := admin.Purge(ctx, filter, true)
+	if err != nil {
+		return err
+	}
+	if *dryRun || matched == 0 {
+		fmt.Printf("%d messages would be purged\n", matched)
+		return nil
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Purge %d messages from %s? [y/N] ", matched, flags.topic)) {
+		return fmt.Errorf("aborted")
+	}
+
+	purged, err := admin.Purge(ctx, filter, false)
+	fmt.Printf("%d messages purged\n", purged)
+	return err
+}
+
+// parseMessageRef parses a <partition>:<offset> reference
+func parseMessageRef(ref string) (int, int64, error) {
+	p, o, ok := strings.Cut(ref, ":")
+	partition, perr := strconv.Atoi(p)
+	offset, oerr := strconv.ParseInt(o, 10, 64)
+	if !ok || perr != nil || oerr != nil {
+		return 0, 0, fmt.Errorf("invalid message reference %q, expected <partition>:<offset>", ref)
+	}
+	return partition, offset, nil
+}
+
+// confirm asks a yes/no question on stdin
+func confirm(question string) bool {
+	fmt.Print(question)
+	var answer string
+	fmt.Scanln(&answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cartloom/kafka"
+)
+
+func TestDLQFlagsFilter(t *testing.T) {
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		args []string
+		want kafka.DLQFilter
+		// ago is how long before now Since is expected, for durations
+		ago     time.Duration
+		wantErr bool
+	}{
+		{name: "no filters", args: nil, want: kafka.DLQFilter{}},
+		{
+			name: "every filter",
+			args: []string{"--key", "order-1", "--since", "2024-03-01T00:00:00Z", "--until", "2024-03-02T00:00:00Z", "--error-class", "permanent"},
+			want: kafka.DLQFilter{Key: "order-1", Since: since, Until: since.Add(24 * time.Hour), ErrorClass: kafka.ErrorClassPermanent},
+		},
+		{name: "since a duration ago", args: []string{"--since", "24h", "--error-class", "transient"}, want: kafka.DLQFilter{ErrorClass: kafka.ErrorClassTransient}, ago: 24 * time.Hour},
+		{name: "invalid since", args: []string{"--since", "yesterday"}, wantErr: true},
+		{name: "invalid until", args: []string{"--until", "2024-03-02"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := newDLQFlags("list")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			filter, err := flags.filter()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("filter = %+v, want an error", filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("filter: %v", err)
+			}
+
+			if tt.ago > 0 {
+				if until := time.Since(filter.Since); until < tt.ago || until > tt.ago+time.Minute {
+					t.Fatalf("since %s ago, want %s", until, tt.ago)
+				}
+				filter.Since = time.Time{}
+			}
+			if !filter.Since.Equal(tt.want.Since) || !filter.Until.Equal(tt.want.Until) {
+				t.Fatalf("filter between %s and %s, want %s and %s", filter.Since, filter.Until, tt.want.Since, tt.want.Until)
+			}
+			filter.Since, filter.Until, tt.want.Since, tt.want.Until = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+			if filter != tt.want {
+				t.Fatalf("filter = %+v, want %+v", filter, tt.want)
+			}
+		})
+	}
+}
+
+func TestDLQFlagsTopic(t *testing.T) {
+	t.Setenv("DLQ_TOPIC", "")
+	if flags := newDLQFlags("list"); flags.topic != kafka.DefaultDLQTopic {
+		t.Fatalf("default topic %s, want %s", flags.topic, kafka.DefaultDLQTopic)
+	}
+
+	t.Setenv("DLQ_TOPIC", "dlq-payments")
+	flags := newDLQFlags("list")
+	if flags.topic != "dlq-payments" {
+		t.Fatalf("topic %s, want DLQ_TOPIC", flags.topic)
+	}
+	if err := flags.Parse([]string{"--topic", "dlq-carts"}); err != nil || flags.topic != "dlq-carts" {
+		t.Fatalf("topic %s (%v), want the flag to win", flags.topic, err)
+	}
+}
+
+func TestParseMessageRef(t *testing.T) {
+	tests := []struct {
+		ref       string
+		partition int
+		offset    int64
+		wantErr   bool
+	}{
+		{ref: "0:42", partition: 0, offset: 42},
+		{ref: "12:0", partition: 12, offset: 0},
+		{ref: "42", wantErr: true},
+		{ref: "a:1", wantErr: true},
+		{ref: "1:", wantErr: true},
+		{ref: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			partition, offset, err := parseMessageRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMessageRef error = %v, want error %v", err, tt.wantErr)
+			}
+			if partition != tt.partition || offset != tt.offset {
+				t.Fatalf("parsed %d:%d, want %d:%d", partition, offset, tt.partition, tt.offset)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{s: "payments unavailable", n: 40, want: "payments unavailable"},
+		{s: "payments", n: 8, want: "payments"},
+		{s: "payments unavailable", n: 9, want: "payments…"},
+		{s: "zahlung für bestellung", n: 8, want: "zahlung…"},
+	}
+
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Fatalf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
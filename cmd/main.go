@@ -5,18 +5,44 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	kafka_go "github.com/segmentio/kafka-go"
+	"golang.org/x/time/rate"
 
+	"cartloom/cart"
+	"cartloom/checkout"
 	"cartloom/dynamodb"
+	"cartloom/inventory"
 	"cartloom/kafka"
 	"cartloom/redis"
 	"cartloom/shopify"
 	"cartloom/utils"
 )
 
+// webhookTopics lists the Shopify webhook topics CartLoom subscribes to
+var webhookTopics = []string{
+	shopify.TopicProductsCreate,
+	shopify.TopicProductsUpdate,
+	shopify.TopicProductsDelete,
+	shopify.TopicOrdersCreate,
+	shopify.TopicOrdersUpdated,
+	shopify.TopicOrdersPaid,
+	shopify.TopicOrdersCancelled,
+	shopify.TopicOrdersFulfilled,
+	shopify.TopicInventoryLevelsUpdate,
+	shopify.TopicAppUninstalled,
+}
+
 func main() {
 
 	// Load environment variables from .env file
@@ -25,28 +51,209 @@ func main() {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	// Create context for the application
-	ctx := context.Background()
+	// Run operator subcommands instead of the service
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQ(os.Args[2:]))
+	}
+
+	// Create context for the application, cancelled on shutdown signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Initialize Redis and DynamoDB with environment variables
-	initializeRedisAndDynamoDB(ctx)
+	rdb, db := initializeRedisAndDynamoDB(ctx)
 
 	// Register Shopify webhook
-	registerShopifyWebhook()
+	registry := newShopRegistry(rdb, db)
+	stock := newInventoryStore(rdb, db)
+	registerShopifyWebhook(ctx, rdb, registry)
+	registerOAuthRoutes(rdb, db, registry, stock)
 
-	// Start Prometheus metrics and Kafka services
+	// Start Prometheus metrics and Kafka services sharing a single DLQ writer
+	dlq := newDLQWriter()
 	startMetricsServer()
-	startKafka(ctx)
+	startWebhookConsumer(ctx, rdb, db, registry, stock, dlq)
+	startKafka(ctx, rdb, db, dlq)
+	startOutboxRelay(ctx, db)
+	carts := newCartStore(rdb)
+	startAbandonedCartScheduler(ctx, carts)
+	startReservationExpiry(ctx, stock)
+	orchestrator := newCheckout(ctx, db, carts, stock)
+	registerCheckoutRoute(orchestrator)
+	startCheckoutRecovery(ctx, orchestrator)
 
 	// Set up logging
 	setupLogging()
 
-	// Keep the program running
-	select {}
+	// Run until a shutdown signal, then let consumers finish before flushing the DLQ
+	<-ctx.Done()
+	log.Println("Shutting down")
+	consumers.Wait()
+	if err := dlq.Close(); err != nil {
+		log.Printf("Failed to flush DLQ: %v", err)
+	}
+}
+
+// consumers tracks running Kafka consumers so shutdown can wait for them
+var consumers sync.WaitGroup
+
+// runConsumer runs a consumer or relay in the background; errors other than shutdown are fatal
+func runConsumer(ctx context.Context, name string, consume func() error) {
+	consumers.Add(1)
+	go func() {
+		defer consumers.Done()
+		if err := consume(); err != nil && ctx.Err() == nil {
+			log.Fatalf("Error running %s: %v", name, err)
+		}
+	}()
+}
+
+// startOutboxRelay publishes committed outbox records to Kafka every OUTBOX_POLL_INTERVAL (default 1s)
+func startOutboxRelay(ctx context.Context, db *awsdynamodb.Client) {
+
+	interval := time.Second
+	if value := os.Getenv("OUTBOX_POLL_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid OUTBOX_POLL_INTERVAL %q: %v", value, err)
+		}
+		interval = d
+	}
+
+	writer := &kafka_go.Writer{
+		Addr:                   kafka_go.TCP(kafkaBrokers()...),
+		Balancer:               &kafka_go.Hash{},
+		RequiredAcks:           kafka_go.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+	relay := kafka.NewOutboxRelay(db, writer, interval)
+	runConsumer(ctx, "outbox relay", func() error {
+		defer writer.Close()
+		return relay.Run(ctx)
+	})
+}
+
+// newCartStore creates the cart store; carts expire after CART_TTL (default 168h) without activity
+func newCartStore(rdb *goredis.Client) *cart.Store {
+	return cart.NewStore(rdb, envDuration("CART_TTL", cart.DefaultTTL))
+}
+
+// startAbandonedCartScheduler reports carts idle past CART_ABANDONMENT_THRESHOLDS (default 1h,24h,72h)
+// to the cart events topic, scanning every CART_ABANDONMENT_SCAN_INTERVAL (default 1m)
+func startAbandonedCartScheduler(ctx context.Context, store *cart.Store) {
+	writer := &kafka_go.Writer{
+		Addr:                   kafka_go.TCP(kafkaBrokers()...),
+		Topic:                  kafka.CartTopic,
+		Balancer:               &kafka_go.Hash{},
+		RequiredAcks:           kafka_go.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+	scheduler := kafka.NewAbandonedCartScheduler(store, writer,
+		envDurations("CART_ABANDONMENT_THRESHOLDS", kafka.DefaultAbandonmentThresholds),
+		envDuration("CART_ABANDONMENT_SCAN_INTERVAL", time.Minute))
+	runConsumer(ctx, "abandoned cart scheduler", func() error {
+		defer writer.Close()
+		return scheduler.Run(ctx)
+	})
+}
+
+// newInventoryStore creates the inventory store; reservations are released after RESERVATION_TTL (default 15m)
+func newInventoryStore(rdb *goredis.Client, db *awsdynamodb.Client) *inventory.Store {
+	return inventory.NewStore(rdb, db, envDuration("RESERVATION_TTL", inventory.DefaultReservationTTL))
+}
+
+// startReservationExpiry releases expired reservations every RESERVATION_EXPIRY_INTERVAL (default 10s)
+func startReservationExpiry(ctx context.Context, store *inventory.Store) {
+	interval := envDuration("RESERVATION_EXPIRY_INTERVAL", 10*time.Second)
+	runConsumer(ctx, "reservation expiry", func() error {
+		return store.RunExpiry(ctx, interval)
+	})
+}
+
+// newCheckout creates the checkout orchestrator, authorizing payments with the gateway at
+// PAYMENT_GATEWAY_URL using PAYMENT_GATEWAY_API_KEY and pricing carts with CHECKOUT_TAX_RATE (basis
+// points), CHECKOUT_SHIPPING_FEE (minor units) and CHECKOUT_DISCOUNTS as a comma separated list of
+// code=basis points pairs. It returns nil when no payment gateway is configured.
+func newCheckout(ctx context.Context, db *awsdynamodb.Client, carts *cart.Store, stock *inventory.Store) *checkout.Orchestrator {
+	gatewayURL := os.Getenv("PAYMENT_GATEWAY_URL")
+	if gatewayURL == "" {
+		log.Println("PAYMENT_GATEWAY_URL is not set, checkout is disabled")
+		return nil
+	}
+
+	pricer := checkout.FlatRatePricer{
+		TaxRate:     int64(envInt("CHECKOUT_TAX_RATE", 0)),
+		ShippingFee: int64(envInt("CHECKOUT_SHIPPING_FEE", 0)),
+	}
+	if discounts := os.Getenv("CHECKOUT_DISCOUNTS"); discounts != "" {
+		pricer.Discounts = make(map[string]int64)
+		for _, pair := range strings.Split(discounts, ",") {
+			code, rate, ok := strings.Cut(pair, "=")
+			value, err := strconv.ParseInt(rate, 10, 64)
+			if !ok || err != nil {
+				log.Fatalf("Invalid CHECKOUT_DISCOUNTS entry %q", pair)
+			}
+			pricer.Discounts[strings.ToUpper(strings.TrimSpace(code))] = value
+		}
+	}
+
+	return checkout.New(checkout.Config{
+		DB:        db,
+		Carts:     carts,
+		Inventory: inventory.NewReserver(stock),
+		Payments:  checkout.NewGatewayAuthorizer(gatewayURL, os.Getenv("PAYMENT_GATEWAY_API_KEY")),
+		Pricer:    pricer,
+		Orders: &kafka_go.Writer{
+			Addr:                   kafka_go.TCP(kafkaBrokers()...),
+			Topic:                  "orders",
+			Balancer:               &kafka_go.Hash{},
+			RequiredAcks:           kafka_go.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+		Codec: newOrderEventCodec(ctx, "orders"),
+		CartEvents: &kafka_go.Writer{
+			Addr:                   kafka_go.TCP(kafkaBrokers()...),
+			Topic:                  kafka.CartTopic,
+			Balancer:               &kafka_go.Hash{},
+			RequiredAcks:           kafka_go.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	})
+}
+
+// registerCheckoutRoute exposes the checkout endpoint
+func registerCheckoutRoute(orchestrator *checkout.Orchestrator) {
+	if orchestrator == nil {
+		return
+	}
+	http.HandleFunc("/checkout", orchestrator.HandleCheckout)
+}
+
+// startCheckoutRecovery resumes checkouts stalled for CHECKOUT_STALLED_AFTER (default 5m), checking
+// every CHECKOUT_RECOVERY_INTERVAL (default 1m)
+func startCheckoutRecovery(ctx context.Context, orchestrator *checkout.Orchestrator) {
+	if orchestrator == nil {
+		return
+	}
+	interval := envDuration("CHECKOUT_RECOVERY_INTERVAL", time.Minute)
+	stalledAfter := envDuration("CHECKOUT_STALLED_AFTER", 5*time.Minute)
+	runConsumer(ctx, "checkout recovery", func() error {
+		return orchestrator.RunRecovery(ctx, interval, stalledAfter)
+	})
+}
+
+// newDLQWriter creates the DLQ writer shared by all consumers, publishing to DLQ_TOPIC (default dlq-orders)
+// with a buffer of DLQ_BUFFER_SIZE messages
+func newDLQWriter() *kafka.DLQWriter {
+	return kafka.NewDLQWriter(kafka.DLQConfig{
+		Brokers:    kafkaBrokers(),
+		Topic:      os.Getenv("DLQ_TOPIC"),
+		BufferSize: envInt("DLQ_BUFFER_SIZE", 0),
+	})
 }
 
 // initializeRedisAndDynamoDB initializes Redis and DynamoDB with environment variables
-func initializeRedisAndDynamoDB(ctx context.Context) {
+func initializeRedisAndDynamoDB(ctx context.Context) (*goredis.Client, *awsdynamodb.Client) {
 	// Get Redis address from environment variable
 	redisAddress := os.Getenv("REDIS_ADDRESS")
 	if redisAddress == "" {
@@ -54,7 +261,7 @@ func initializeRedisAndDynamoDB(ctx context.Context) {
 	}
 
 	// Initialize Redis client
-	_, err := redis.InitRedisWithAddress(ctx, redisAddress)
+	rdb, err := redis.InitRedisWithAddress(ctx, redisAddress)
 	if err != nil {
 		log.Fatalf("Error initializing Redis: %v", err)
 	}
@@ -65,8 +272,15 @@ func initializeRedisAndDynamoDB(ctx context.Context) {
 		log.Fatalf("Missing DynamoDB region from environment variables")
 	}
 
-	// Initialize DynamoDB client and set up table and replication
-	db, err := dynamodb.NewDynamoDBClient(ctx, dynamoRegion)
+	// Initialize DynamoDB client, pointing it at DYNAMODB_ENDPOINT (such as dynamodb-local) if set,
+	// and set up table and replication
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	var opts []func(*awsdynamodb.Options)
+	if endpoint != "" {
+		opts = append(opts, dynamodb.WithEndpoint(endpoint))
+	}
+
+	db, err := dynamodb.NewDynamoDBClient(ctx, dynamoRegion, opts...)
 	if err != nil {
 		log.Fatalf("Error initializing DynamoDB: %v", err)
 	}
@@ -76,30 +290,70 @@ func initializeRedisAndDynamoDB(ctx context.Context) {
 		log.Fatalf("Failed to create DynamoDB table: %v", err)
 	}
 
-	if err := dynamodb.EnableGlobalReplication(ctx, db, tableName, "us-west-2"); err != nil {
-		log.Fatalf("Failed to enable global replication for table: %v", err)
+	// dynamodb-local does not support global tables
+	if endpoint == "" {
+		if err := dynamodb.EnableGlobalReplication(ctx, db, tableName, "us-west-2"); err != nil {
+			log.Fatalf("Failed to enable global replication for table: %v", err)
+		}
+		log.Println("Global DynamoDB table created successfully with replication!")
+	}
+
+	if err := dynamodb.CreateShopifyTables(ctx, db); err != nil {
+		log.Fatalf("Failed to create Shopify tables: %v", err)
+	}
+	if err := dynamodb.CreateOutboxTable(ctx, db); err != nil {
+		log.Fatalf("Failed to create outbox table: %v", err)
 	}
+	if err := dynamodb.CreateOrderHistoryTable(ctx, db); err != nil {
+		log.Fatalf("Failed to create order history table: %v", err)
+	}
+	if err := dynamodb.CreateCheckoutTables(ctx, db); err != nil {
+		log.Fatalf("Failed to create checkout tables: %v", err)
+	}
+	if err := dynamodb.CreateInventoryTables(ctx, db); err != nil {
+		log.Fatalf("Failed to create inventory tables: %v", err)
+	}
+	return rdb, db
+}
 
-	log.Println("Global DynamoDB table created successfully with replication!")
+// newShopRegistry creates the registry of installed shops, encrypting tokens with SHOPIFY_TOKEN_KEY
+func newShopRegistry(rdb *goredis.Client, db *awsdynamodb.Client) *shopify.ShopRegistry {
+	tokenCipher, err := shopify.NewTokenCipher(os.Getenv("SHOPIFY_TOKEN_KEY"))
+	if err != nil {
+		log.Fatalf("Invalid SHOPIFY_TOKEN_KEY: %v", err)
+	}
+	return shopify.NewShopRegistry(rdb, db, tokenCipher, 10*time.Minute)
 }
 
-// registerShopifyWebhook registers a product update webhook for Shopify
-func registerShopifyWebhook() {
-	shopName := os.Getenv("SHOP_NAME")
-	accessToken := os.Getenv("SHOPIFY_ACCESS_TOKEN")
+// registerShopifyWebhook reconciles the webhook subscriptions of every installed shop and routes incoming webhooks
+func registerShopifyWebhook(ctx context.Context, rdb *goredis.Client, registry *shopify.ShopRegistry) {
 	webhookURL := os.Getenv("WEBHOOK_URL")
-	if shopName == "" || accessToken == "" || webhookURL == "" {
+	apiSecret := os.Getenv("SHOPIFY_API_SECRET")
+	if webhookURL == "" || apiSecret == "" {
 		log.Fatalf("Missing environment variables for Shopify configuration")
 	}
 
-	if err := shopify.RegisterProductUpdateWebhook(shopName, accessToken, webhookURL); err != nil {
-		log.Fatalf("Failed to register product update webhook: %v", err)
+	writer := kafka_go.NewWriter(kafka_go.WriterConfig{
+		Brokers:      kafkaBrokers(),
+		Balancer:     &kafka_go.Hash{},
+		BatchTimeout: 10 * time.Millisecond,
+	})
+	router := newWebhookRouter(shopify.NewWebhookPublisher(writer))
+
+	shops, err := registry.ActiveShops(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load installed shops: %v", err)
 	}
-	log.Println("Product update webhook registered successfully!")
+	for _, shop := range shops {
+		if err := registry.Client(shop).ReconcileWebhooks(ctx, webhookURL, router.Topics()); err != nil {
+			log.Printf("Failed to reconcile Shopify webhooks for shop %s: %v", shop.Domain, err)
+		}
+	}
+	log.Printf("Shopify webhooks reconciled for %d shops", len(shops))
 
-	http.HandleFunc("/shopify/product/update", func(w http.ResponseWriter, r *http.Request) {
-		shopify.HandleProductUpdateWebhook(w, r, nil, nil) // No need for Redis or DynamoDB in this call
-	})
+	dedupeTTL := webhookDedupeTTL()
+
+	http.HandleFunc("/shopify/webhooks", shopify.VerifyWebhook(apiSecret, shopify.DedupeWebhook(rdb, dedupeTTL, router.ServeHTTP)))
 
 	go func() {
 		log.Println("Starting HTTP server, waiting for webhooks...")
@@ -109,6 +363,73 @@ func registerShopifyWebhook() {
 	}()
 }
 
+// registerOAuthRoutes exposes the Shopify app install and OAuth callback endpoints
+func registerOAuthRoutes(rdb *goredis.Client, db *awsdynamodb.Client, registry *shopify.ShopRegistry, stock *inventory.Store) {
+	cfg := shopify.OAuthConfig{
+		APIKey:      os.Getenv("SHOPIFY_API_KEY"),
+		APISecret:   os.Getenv("SHOPIFY_API_SECRET"),
+		Scopes:      shopify.ParseScopes(os.Getenv("SHOPIFY_SCOPES")),
+		RedirectURI: os.Getenv("SHOPIFY_REDIRECT_URI"),
+		StateTTL:    10 * time.Minute,
+	}
+	if cfg.APIKey == "" || cfg.APISecret == "" || cfg.RedirectURI == "" || len(cfg.Scopes) == 0 {
+		log.Fatalf("Missing environment variables for Shopify OAuth configuration")
+	}
+
+	afterInstall := func(ctx context.Context, shop *shopify.Shop) error {
+		if err := registry.Client(shop).ReconcileWebhooks(ctx, os.Getenv("WEBHOOK_URL"), webhookTopics); err != nil {
+			return err
+		}
+		go backfillShop(shop, registry, rdb, db, stock)
+		return nil
+	}
+
+	http.HandleFunc("/shopify/install", func(w http.ResponseWriter, r *http.Request) {
+		shopify.HandleInstall(w, r, cfg, rdb)
+	})
+	http.HandleFunc("/shopify/callback", func(w http.ResponseWriter, r *http.Request) {
+		shopify.HandleOAuthCallback(w, r, cfg, rdb, registry, afterInstall)
+	})
+}
+
+// backfillShop imports the catalog, stock and order history of a newly installed shop
+func backfillShop(shop *shopify.Shop, registry *shopify.ShopRegistry, rdb *goredis.Client, db *awsdynamodb.Client, stock *inventory.Store) {
+	ctx := context.Background()
+	graphql := shopify.NewGraphQLClient(registry.Client(shop))
+
+	if _, err := shopify.ImportCatalog(ctx, graphql, rdb, db, stock); err != nil {
+		log.Printf("Catalog backfill failed for shop %s: %v", shop.Domain, err)
+	}
+	if _, err := shopify.ImportOrders(ctx, graphql, rdb, db, kafka.StatusChangedOutbox, shop.Domain); err != nil {
+		log.Printf("Order backfill failed for shop %s: %v", shop.Domain, err)
+	}
+}
+
+// newWebhookRouter routes every webhook topic CartLoom consumes to the Kafka publisher
+func newWebhookRouter(publisher *shopify.WebhookPublisher) *shopify.WebhookRouter {
+	router := shopify.NewWebhookRouter()
+
+	for _, topic := range webhookTopics {
+		router.Handle(topic, publisher.HandleWebhook)
+	}
+
+	return router
+}
+
+// webhookDedupeTTL reads how long webhook delivery IDs are remembered, defaulting to 24 hours
+func webhookDedupeTTL() time.Duration {
+	value := os.Getenv("WEBHOOK_DEDUPE_TTL")
+	if value == "" {
+		return 24 * time.Hour
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_DEDUPE_TTL %q: %v", value, err)
+	}
+	return ttl
+}
+
 // startMetricsServer starts the Prometheus metrics server
 func startMetricsServer() {
 	utils.InitMetricsServer()
@@ -122,26 +443,205 @@ func startMetricsServer() {
 	}()
 }
 
+// startWebhookConsumer applies the webhook events published to Kafka with a pool of
+// WEBHOOK_CONSUMER_WORKERS workers, retrying failed events after WEBHOOK_RETRY_DELAYS
+// (default 1m,10m) before dead-lettering them
+func startWebhookConsumer(ctx context.Context, rdb *goredis.Client, db *awsdynamodb.Client, registry *shopify.ShopRegistry, stock *inventory.Store, dlq *kafka.DLQWriter) {
+	topics := make([]string, 0, len(webhookTopics))
+	for _, topic := range webhookTopics {
+		topics = append(topics, shopify.KafkaTopic(topic))
+	}
+
+	reader := kafka_go.NewReader(kafka_go.ReaderConfig{
+		Brokers:     kafkaBrokers(),
+		GroupID:     "webhook-consumer-group",
+		GroupTopics: topics,
+	})
+
+	config := kafka.ConsumerConfig{
+		Workers:   envInt("WEBHOOK_CONSUMER_WORKERS", 0),
+		QueueSize: envInt("WEBHOOK_CONSUMER_QUEUE_SIZE", 0),
+	}
+	delays := envDurations("WEBHOOK_RETRY_DELAYS", []time.Duration{time.Minute, 10 * time.Minute})
+	retrier := kafka.NewRetrier(newRetryWriter(), kafka.RetryTiers(kafka.WebhookRetryTopic, delays...), dlq)
+	handler := kafka.NewWebhookEventHandler(rdb, db, registry, stock, retrier)
+
+	runConsumer(ctx, "webhook consumer", func() error {
+		return kafka.ConsumeMessages(ctx, reader, config, handler)
+	})
+	startRetryConsumers(ctx, retrier, "webhook-consumer-group", config, handler)
+}
+
+// newRetryWriter creates the writer that publishes failed messages to their retry tier
+func newRetryWriter() *kafka_go.Writer {
+	return &kafka_go.Writer{
+		Addr:                   kafka_go.TCP(kafkaBrokers()...),
+		Balancer:               &kafka_go.Hash{},
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// startRetryConsumers consumes every retry tier of the retrier in its own consumer group
+func startRetryConsumers(ctx context.Context, retrier *kafka.Retrier, groupID string, config kafka.ConsumerConfig, handler kafka.MessageHandler) {
+	for _, tier := range retrier.Tiers() {
+		tierReader := kafka_go.NewReader(kafka_go.ReaderConfig{
+			Brokers: kafkaBrokers(),
+			Topic:   tier.Topic,
+			GroupID: groupID + "." + tier.Topic,
+		})
+		runConsumer(ctx, "retry consumer for "+tier.Topic, func() error {
+			return kafka.ConsumeRetryTopic(ctx, tierReader, config, handler)
+		})
+	}
+}
+
+// kafkaBrokers reads the comma separated Kafka broker list, defaulting to kafka:9092
+func kafkaBrokers() []string {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return []string{"kafka:9092"}
+	}
+	return strings.Split(brokers, ",")
+}
+
+// newOrderEventCodec returns the codec order events are produced with. When SCHEMA_REGISTRY_URL is set
+// the schema (SCHEMA_REGISTRY_FORMAT protobuf or avro) is checked and registered for the topic at startup.
+func newOrderEventCodec(ctx context.Context, topic string) kafka.OrderEventCodec {
+	registryURL := os.Getenv("SCHEMA_REGISTRY_URL")
+	if registryURL == "" {
+		return kafka.JSONCodec{}
+	}
+
+	client := kafka.NewRegistryClient(registryURL)
+	client.Username = os.Getenv("SCHEMA_REGISTRY_USERNAME")
+	client.Password = os.Getenv("SCHEMA_REGISTRY_PASSWORD")
+
+	var codec kafka.SchemaCodec = kafka.ProtobufCodec{}
+	if os.Getenv("SCHEMA_REGISTRY_FORMAT") == "avro" {
+		codec = kafka.AvroCodec{}
+	}
+
+	serializer, err := kafka.NewRegistrySerializer(ctx, kafka.NewCachedRegistry(client), kafka.SubjectForTopic(topic), codec)
+	if err != nil {
+		log.Fatalf("Schema registry check failed for topic %s: %v", topic, err)
+	}
+	log.Printf("Order events on %s use schema %d", topic, serializer.SchemaID())
+	return serializer
+}
+
+// orderConsumerConfig reads the order consumer pool settings: ORDER_CONSUMER_WORKERS,
+// ORDER_CONSUMER_QUEUE_SIZE, SHOP_RATE_LIMIT and SHOP_RATE_BURST, plus per shop overrides in
+// SHOP_RATE_LIMITS as a comma separated list of shop=limit pairs
+func orderConsumerConfig() kafka.ConsumerConfig {
+	config := kafka.ConsumerConfig{
+		Workers:       envInt("ORDER_CONSUMER_WORKERS", 0),
+		QueueSize:     envInt("ORDER_CONSUMER_QUEUE_SIZE", 0),
+		ShopRateLimit: rate.Limit(envFloat("SHOP_RATE_LIMIT", 5)),
+		ShopBurst:     envInt("SHOP_RATE_BURST", 1),
+	}
+
+	if overrides := os.Getenv("SHOP_RATE_LIMITS"); overrides != "" {
+		config.ShopRateLimits = make(map[string]rate.Limit)
+		for _, pair := range strings.Split(overrides, ",") {
+			shop, limit, ok := strings.Cut(pair, "=")
+			value, err := strconv.ParseFloat(limit, 64)
+			if !ok || err != nil {
+				log.Fatalf("Invalid SHOP_RATE_LIMITS entry %q", pair)
+			}
+			config.ShopRateLimits[strings.TrimSpace(shop)] = rate.Limit(value)
+		}
+	}
+	return config
+}
+
+// orderRetryDelays reads the comma separated retry tier delays from ORDER_RETRY_DELAYS, defaulting to 1m,10m
+func orderRetryDelays() []time.Duration {
+	return envDurations("ORDER_RETRY_DELAYS", []time.Duration{time.Minute, 10 * time.Minute})
+}
+
+// envDurations reads a comma separated list of durations, falling back to def when unset
+func envDurations(name string, def []time.Duration) []time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	var durations []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", name, field, err)
+		}
+		durations = append(durations, d)
+	}
+	return durations
+}
+
+// envDuration reads a duration environment variable, falling back to def when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return d
+}
+
+// envInt reads an integer environment variable, falling back to def when unset
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+// envFloat reads a decimal environment variable, falling back to def when unset
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return f
+}
+
 // startKafka starts the Kafka consumer and producer
-func startKafka(ctx context.Context) {
+func startKafka(ctx context.Context, rdb *goredis.Client, db *awsdynamodb.Client, dlq *kafka.DLQWriter) {
 	writer := kafka_go.NewWriter(kafka_go.WriterConfig{
-		Brokers: []string{"kafka:9092"},
+		Brokers: kafkaBrokers(),
 		Topic:   "orders",
 	})
 
 	reader := kafka_go.NewReader(kafka_go.ReaderConfig{
-		Brokers: []string{"kafka:9092"},
+		Brokers: kafkaBrokers(),
 		Topic:   "orders",
 		GroupID: "order-consumer-group",
 	})
 
-	go func() {
-		if err := kafka.ConsumeMessages(ctx, reader, nil, nil); err != nil {
-			log.Fatalf("Error consuming Kafka messages: %v", err)
-		}
-	}()
+	codec := newOrderEventCodec(ctx, "orders")
+	config := orderConsumerConfig()
+
+	retrier := kafka.NewRetrier(newRetryWriter(), kafka.RetryTiers("orders", orderRetryDelays()...), dlq)
+	handler := kafka.NewOrderEventHandler(rdb, db, retrier, codec)
+
+	runConsumer(ctx, "order consumer", func() error {
+		return kafka.ConsumeMessages(ctx, reader, config, handler)
+	})
+
+	startRetryConsumers(ctx, retrier, "order-consumer-group", config, handler)
 
-	if err := kafka.ProduceMessages(ctx, writer); err != nil {
+	if err := kafka.ProduceMessages(ctx, writer, codec); err != nil {
 		log.Fatalf("Error producing Kafka messages: %v", err)
 	}
 
@@ -0,0 +1,67 @@
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CheckoutSagasTable stores the progress of every checkout saga, keyed by saga ID
+const CheckoutSagasTable = "CheckoutSagas"
+
+// CheckoutSagasByStatusIndex lists sagas of a status by the time they last progressed
+const CheckoutSagasByStatusIndex = "Status-UpdatedAt-index"
+
+// CheckoutClaimsTable maps every cart being checked out to its saga, keyed by cart ID
+const CheckoutClaimsTable = "CheckoutClaims"
+
+// CreateCheckoutTables creates the checkout saga and claim tables; existing tables are left as is
+func CreateCheckoutTables(ctx context.Context, client *dynamodb.Client) error {
+	if _, err := ensureTable(ctx, client, buildCheckoutSagasTableInput()); err != nil {
+		return err
+	}
+	_, err := ensureTable(ctx, client, buildCheckoutClaimsTableInput())
+	return err
+}
+
+// buildCheckoutSagasTableInput constructs the CreateTableInput for the checkout saga table
+func buildCheckoutSagasTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(CheckoutSagasTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("SagaID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Status"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("UpdatedAt"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("SagaID"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(CheckoutSagasByStatusIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Status"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("UpdatedAt"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
+
+// buildCheckoutClaimsTableInput constructs the CreateTableInput for the checkout claim table
+func buildCheckoutClaimsTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(CheckoutClaimsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("CartID"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("CartID"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
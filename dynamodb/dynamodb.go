@@ -2,7 +2,9 @@ package dynamodb
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -10,34 +12,58 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// Global secondary indexes of the orders table
+const (
+	OrdersByShopIndex     = "Shop-CreatedAt-index"
+	OrdersByCustomerIndex = "CustomerID-CreatedAt-index"
+	OrdersByStatusIndex   = "Status-CreatedAt-index"
+)
+
 // NewDynamoDBClient initializes a DynamoDB client for the specified region.
-func NewDynamoDBClient(ctx context.Context, region string) (*dynamodb.Client, error) {
+func NewDynamoDBClient(ctx context.Context, region string, optFns ...func(*dynamodb.Options)) (*dynamodb.Client, error) {
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
 		return nil, err
 	}
-	return dynamodb.NewFromConfig(cfg), nil
+	return dynamodb.NewFromConfig(cfg, optFns...), nil
+}
+
+// WithEndpoint points the client at a custom endpoint such as dynamodb-local.
+func WithEndpoint(endpoint string) func(*dynamodb.Options) {
+	return func(o *dynamodb.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	}
 }
 
-// CreateTable creates a DynamoDB table with the specified schema.
+// CreateTable creates the orders table with its indexes. A table that already exists gets the
+// indexes it is missing, so tables created before an index was introduced are upgraded in place.
 func CreateTable(ctx context.Context, client *dynamodb.Client, tableName string) error {
 	input := buildCreateTableInput(tableName)
 
-	_, err := client.CreateTable(ctx, input)
-	if err != nil {
-		log.Printf("Failed to create table %s: %v", tableName, err)
+	created, err := ensureTable(ctx, client, input)
+	if err != nil || created {
 		return err
 	}
-
-	log.Printf("Table %s created successfully", tableName)
-	return nil
+	return ensureIndexes(ctx, client, input)
 }
 
-// EnableGlobalReplication adds global replication to an existing table.
+// EnableGlobalReplication adds global replication to an existing table. A table that already
+// replicates to the region is left as is.
 func EnableGlobalReplication(ctx context.Context, client *dynamodb.Client, tableName, region string) error {
+	out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		log.Printf("Failed to describe table %s: %v", tableName, err)
+		return err
+	}
+	for _, replica := range out.Table.Replicas {
+		if aws.ToString(replica.RegionName) == region {
+			return nil
+		}
+	}
+
 	input := buildGlobalReplicationInput(tableName, region)
 
-	_, err := client.UpdateTable(ctx, input)
+	_, err = client.UpdateTable(ctx, input)
 	if err != nil {
 		log.Printf("Failed to add global replication for table %s to region %s: %v", tableName, region, err)
 		return err
@@ -47,15 +73,100 @@ func EnableGlobalReplication(ctx context.Context, client *dynamodb.Client, table
 	return nil
 }
 
-// buildCreateTableInput constructs the CreateTableInput for a DynamoDB table.
+// ensureTable creates the table and waits until it is active. It reports false without error
+// if the table already exists.
+func ensureTable(ctx context.Context, client *dynamodb.Client, input *dynamodb.CreateTableInput) (bool, error) {
+	tableName := aws.ToString(input.TableName)
+
+	_, err := client.CreateTable(ctx, input)
+	var inUse *types.ResourceInUseException
+	if errors.As(err, &inUse) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Failed to create table %s: %v", tableName, err)
+		return false, err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, 2*time.Minute); err != nil {
+		return false, err
+	}
+
+	log.Printf("Table %s created successfully", tableName)
+	return true, nil
+}
+
+// ensureIndexes adds the global secondary indexes of input that the existing table lacks.
+// DynamoDB creates one index per UpdateTable call and rejects updates while the table is
+// updating, so the table is waited for before each index is added. Added indexes backfill in
+// the background and serve queries once they are active.
+func ensureIndexes(ctx context.Context, client *dynamodb.Client, input *dynamodb.CreateTableInput) error {
+	tableName := aws.ToString(input.TableName)
+	waiter := dynamodb.NewTableExistsWaiter(client)
+
+	for _, index := range input.GlobalSecondaryIndexes {
+		for {
+			if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, 10*time.Minute); err != nil {
+				return err
+			}
+
+			out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName})
+			if err != nil {
+				return err
+			}
+			if hasIndex(out.Table, aws.ToString(index.IndexName)) {
+				break
+			}
+
+			_, err = client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+				TableName:            input.TableName,
+				AttributeDefinitions: input.AttributeDefinitions,
+				GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+					Create: &types.CreateGlobalSecondaryIndexAction{
+						IndexName:  index.IndexName,
+						KeySchema:  index.KeySchema,
+						Projection: index.Projection,
+					},
+				}},
+			})
+			var inUse *types.ResourceInUseException
+			if errors.As(err, &inUse) {
+				// Another instance is updating the table; check again once it is done
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to add index %s to table %s: %v", aws.ToString(index.IndexName), tableName, err)
+				return err
+			}
+			log.Printf("Index %s added to table %s", aws.ToString(index.IndexName), tableName)
+			break
+		}
+	}
+	return nil
+}
+
+// hasIndex reports whether the table has a global secondary index of that name
+func hasIndex(table *types.TableDescription, name string) bool {
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.ToString(index.IndexName) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildCreateTableInput constructs the CreateTableInput for the orders table, with indexes
+// listing orders by shop, customer and status in creation order.
 func buildCreateTableInput(tableName string) *dynamodb.CreateTableInput {
 	return &dynamodb.CreateTableInput{
 		TableName: aws.String(tableName),
 		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("OrderID"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
+			{AttributeName: aws.String("OrderID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Shop"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("CustomerID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Status"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("CreatedAt"), AttributeType: types.ScalarAttributeTypeS},
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
@@ -63,10 +174,27 @@ func buildCreateTableInput(tableName string) *dynamodb.CreateTableInput {
 				KeyType:       types.KeyTypeHash,
 			},
 		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			createdAtIndex(OrdersByShopIndex, "Shop"),
+			createdAtIndex(OrdersByCustomerIndex, "CustomerID"),
+			createdAtIndex(OrdersByStatusIndex, "Status"),
+		},
 		BillingMode: types.BillingModePayPerRequest,
 	}
 }
 
+// createdAtIndex defines an index partitioned by the attribute and sorted by CreatedAt
+func createdAtIndex(name, attribute string) types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName: aws.String(name),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attribute), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("CreatedAt"), KeyType: types.KeyTypeRange},
+		},
+		Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+	}
+}
+
 // buildGlobalReplicationInput constructs the UpdateTableInput for global table replication.
 func buildGlobalReplicationInput(tableName, region string) *dynamodb.UpdateTableInput {
 	return &dynamodb.UpdateTableInput{
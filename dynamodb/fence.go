@@ -0,0 +1,35 @@
+package dynamodb
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Fence guards writes made under a distributed lock. The item stores the fencing token of the last
+// holder that wrote it, and a write is only accepted with a token at least as new, so a holder whose
+// lock expired while it was paused cannot overwrite the work of the holder that came after it.
+type Fence struct {
+	Attribute string
+	Token     int64
+}
+
+// Condition returns the condition expression admitting the write
+func (f Fence) Condition() string {
+	return "attribute_not_exists(#fence) OR #fence <= :fence"
+}
+
+// Set returns the update expression clause recording the token on the item
+func (f Fence) Set() string {
+	return "#fence = :fence"
+}
+
+// Names returns the expression attribute names referenced by Condition and Set
+func (f Fence) Names() map[string]string {
+	return map[string]string{"#fence": f.Attribute}
+}
+
+// Values returns the expression attribute values referenced by Condition and Set
+func (f Fence) Values() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{":fence": &types.AttributeValueMemberN{Value: strconv.FormatInt(f.Token, 10)}}
+}
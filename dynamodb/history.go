@@ -0,0 +1,34 @@
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// OrderHistoryTable records every status transition of an order, keyed by order and version
+const OrderHistoryTable = "OrderHistory"
+
+// CreateOrderHistoryTable creates the order history table; an existing table is left as is
+func CreateOrderHistoryTable(ctx context.Context, client *dynamodb.Client) error {
+	_, err := ensureTable(ctx, client, buildOrderHistoryTableInput())
+	return err
+}
+
+// buildOrderHistoryTableInput constructs the CreateTableInput for the order history table
+func buildOrderHistoryTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(OrderHistoryTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("OrderID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Version"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("OrderID"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("Version"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
@@ -0,0 +1,54 @@
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// InventoryTable keeps the committed quantity of every variant per location
+const InventoryTable = "Inventory"
+
+// InventoryCommitsTable records every committed reservation, keyed by reservation ID
+const InventoryCommitsTable = "InventoryCommits"
+
+// CreateInventoryTables creates the inventory and inventory commit tables; existing tables are left as is
+func CreateInventoryTables(ctx context.Context, client *dynamodb.Client) error {
+	if _, err := ensureTable(ctx, client, buildInventoryTableInput()); err != nil {
+		return err
+	}
+	_, err := ensureTable(ctx, client, buildInventoryCommitsTableInput())
+	return err
+}
+
+// buildInventoryTableInput constructs the CreateTableInput for the inventory table
+func buildInventoryTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(InventoryTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("VariantID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("LocationID"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("VariantID"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("LocationID"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
+
+// buildInventoryCommitsTableInput constructs the CreateTableInput for the inventory commit table
+func buildInventoryCommitsTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(InventoryCommitsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("ReservationID"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("ReservationID"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
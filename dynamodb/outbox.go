@@ -0,0 +1,228 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"cartloom/utils"
+)
+
+// OutboxTable holds messages waiting to be published to Kafka
+const OutboxTable = "Outbox"
+
+// Outbox record states. Sent records carry no Status attribute, see MarkOutboxSent.
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusSent    = "sent"
+)
+
+// outboxStatusIndex orders pending records by creation time, formatted with TimeLayout. It is
+// sparse: only records with a Status are indexed, which sent records no longer have.
+const outboxStatusIndex = "Status-CreatedAt-index"
+
+// outboxSentRetention is how long sent records are kept before DynamoDB expires them
+const outboxSentRetention = 7 * 24 * time.Hour
+
+// OutboxRecord is a Kafka message committed together with the state change it describes
+type OutboxRecord struct {
+	ID        string
+	Topic     string
+	Key       string
+	Payload   []byte
+	Headers   map[string]string
+	Status    string
+	CreatedAt time.Time
+}
+
+// NewOutboxRecord creates a pending record with a random ID
+func NewOutboxRecord(topic, key string, payload []byte, headers map[string]string) (OutboxRecord, error) {
+	id, err := utils.NewID()
+	if err != nil {
+		return OutboxRecord{}, err
+	}
+
+	return OutboxRecord{
+		ID:        id,
+		Topic:     topic,
+		Key:       key,
+		Payload:   payload,
+		Headers:   headers,
+		Status:    OutboxStatusPending,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// TransactItem returns the write that inserts the record as part of a transaction
+func (r OutboxRecord) TransactItem() types.TransactWriteItem {
+	headers := make(map[string]types.AttributeValue, len(r.Headers))
+	for k, v := range r.Headers {
+		headers[k] = &types.AttributeValueMemberS{Value: v}
+	}
+
+	item := map[string]types.AttributeValue{
+		"ID":        &types.AttributeValueMemberS{Value: r.ID},
+		"Topic":     &types.AttributeValueMemberS{Value: r.Topic},
+		"Key":       &types.AttributeValueMemberS{Value: r.Key},
+		"Payload":   &types.AttributeValueMemberB{Value: r.Payload},
+		"Headers":   &types.AttributeValueMemberM{Value: headers},
+		"Status":    &types.AttributeValueMemberS{Value: r.Status},
+		"CreatedAt": TimeValue(r.CreatedAt),
+	}
+
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:           aws.String(OutboxTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(ID)"),
+		},
+	}
+}
+
+// WriteWithOutbox commits the writes and the outbox records in a single transaction, so a
+// state change is recorded if and only if its messages are queued for publishing
+func WriteWithOutbox(ctx context.Context, client *dynamodb.Client, writes []types.TransactWriteItem, records ...OutboxRecord) error {
+	items := append([]types.TransactWriteItem{}, writes...)
+	for _, record := range records {
+		items = append(items, record.TransactItem())
+	}
+
+	if _, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		return fmt.Errorf("failed to commit %d writes with %d outbox records: %w", len(writes), len(records), err)
+	}
+	return nil
+}
+
+// PendingOutbox returns up to limit pending records, oldest first
+func PendingOutbox(ctx context.Context, client *dynamodb.Client, limit int32) ([]OutboxRecord, error) {
+	out, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(OutboxTable),
+		IndexName:              aws.String(outboxStatusIndex),
+		KeyConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: OutboxStatusPending},
+		},
+		Limit: aws.Int32(limit),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending outbox records: %w", err)
+	}
+
+	records := make([]OutboxRecord, 0, len(out.Items))
+	for _, item := range out.Items {
+		records = append(records, outboxRecordFromItem(item))
+	}
+	return records, nil
+}
+
+// MarkOutboxSent flags the record as published and lets DynamoDB expire it after the retention period.
+// The Status is removed rather than set to sent, which drops the record from the status index instead
+// of piling every record ever sent under a single "sent" index key.
+func MarkOutboxSent(ctx context.Context, client *dynamodb.Client, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(OutboxTable),
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("REMOVE #status SET SentAt = :now, ExpiresAt = :expires"),
+		ConditionExpression: aws.String("attribute_exists(ID)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":     TimeValue(time.Now()),
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(outboxSentRetention).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox record %s sent: %w", id, err)
+	}
+	return nil
+}
+
+// CreateOutboxTable creates the outbox table with its status index and TTL; an existing table is left as is
+func CreateOutboxTable(ctx context.Context, client *dynamodb.Client) error {
+	created, err := ensureTable(ctx, client, buildOutboxTableInput())
+	if err != nil || !created {
+		return err
+	}
+
+	if _, err := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(OutboxTable),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	}); err != nil {
+		log.Printf("Failed to enable TTL on table %s: %v", OutboxTable, err)
+		return err
+	}
+	return nil
+}
+
+// buildOutboxTableInput constructs the CreateTableInput for the outbox table
+func buildOutboxTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(OutboxTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Status"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("CreatedAt"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(outboxStatusIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Status"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("CreatedAt"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+}
+
+// outboxRecordFromItem decodes an outbox item
+func outboxRecordFromItem(item map[string]types.AttributeValue) OutboxRecord {
+	record := OutboxRecord{
+		ID:      stringValue(item["ID"]),
+		Topic:   stringValue(item["Topic"]),
+		Key:     stringValue(item["Key"]),
+		Status:  stringValue(item["Status"]),
+		Headers: make(map[string]string),
+	}
+	if payload, ok := item["Payload"].(*types.AttributeValueMemberB); ok {
+		record.Payload = payload.Value
+	}
+	if headers, ok := item["Headers"].(*types.AttributeValueMemberM); ok {
+		for k, v := range headers.Value {
+			record.Headers[k] = stringValue(v)
+		}
+	}
+	if _, sent := item["SentAt"]; sent && record.Status == "" {
+		record.Status = OutboxStatusSent
+	}
+	record.CreatedAt, _ = time.Parse(time.RFC3339Nano, stringValue(item["CreatedAt"]))
+	return record
+}
+
+// stringValue returns the value of a string attribute, or "" for any other attribute
+func stringValue(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
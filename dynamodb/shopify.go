@@ -0,0 +1,54 @@
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Tables holding the data synced from Shopify
+const (
+	ShopsTable           = "Shops"
+	ProductsTable        = "Products"
+	InventoryLevelsTable = "InventoryLevels"
+)
+
+// CreateShopifyTables creates the shop registry, product and inventory level tables; existing
+// tables are left as is
+func CreateShopifyTables(ctx context.Context, client *dynamodb.Client) error {
+	inputs := []*dynamodb.CreateTableInput{
+		buildKeyedTableInput(ShopsTable, "ShopDomain", ""),
+		buildKeyedTableInput(ProductsTable, "ProductID", ""),
+		buildKeyedTableInput(InventoryLevelsTable, "InventoryItemID", "LocationID"),
+	}
+	for _, input := range inputs {
+		if _, err := ensureTable(ctx, client, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildKeyedTableInput constructs the CreateTableInput for a table keyed by string attributes,
+// with an optional range key
+func buildKeyedTableInput(tableName, hashKey, rangeKey string) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(hashKey), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(hashKey), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	if rangeKey != "" {
+		input.AttributeDefinitions = append(input.AttributeDefinitions,
+			types.AttributeDefinition{AttributeName: aws.String(rangeKey), AttributeType: types.ScalarAttributeTypeS})
+		input.KeySchema = append(input.KeySchema,
+			types.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: types.KeyTypeRange})
+	}
+	return input
+}
@@ -0,0 +1,30 @@
+package dynamodb
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TimeLayout formats timestamps with a fixed-width fraction so that, in UTC, their strings sort in
+// time order and can be used as range keys. RFC3339Nano drops trailing zeros, which sorts
+// 12:00:00.5Z before 12:00:00Z. The strings still parse as RFC3339.
+const TimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// FormatTime formats t in UTC with TimeLayout
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
+// TimeValue returns t as a string attribute that sorts in time order
+func TimeValue(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: FormatTime(t)}
+}
+
+// EncodeTime makes attributevalue encode time.Time fields with TimeLayout
+func EncodeTime(o *attributevalue.EncoderOptions) {
+	o.EncodeTime = func(t time.Time) (types.AttributeValue, error) {
+		return TimeValue(t), nil
+	}
+}
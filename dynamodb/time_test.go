@@ -0,0 +1,39 @@
+package dynamodb
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFormatTimeSortsInTimeOrder(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		start,
+		start.Add(time.Nanosecond),
+		start.Add(500 * time.Millisecond),
+		start.Add(time.Second),
+		start.Add(time.Second + 250*time.Millisecond),
+		start.Add(2*time.Second - time.Nanosecond),
+		// Another offset is formatted in UTC
+		start.Add(3 * time.Second).In(time.FixedZone("CET", 3600)),
+	}
+
+	formatted := make([]string, len(times))
+	for i, ts := range times {
+		formatted[i] = FormatTime(ts)
+	}
+	if !sort.StringsAreSorted(formatted) {
+		t.Fatalf("formatted times are not in time order: %v", formatted)
+	}
+
+	for i, s := range formatted {
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatalf("parse %s: %v", s, err)
+		}
+		if !parsed.Equal(times[i]) {
+			t.Fatalf("parse %s = %v, want %v", s, parsed, times[i])
+		}
+	}
+}
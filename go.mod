@@ -5,7 +5,7 @@ go 1.21
 require (
 	github.com/aws/aws-sdk-go-v2 v1.30.0
 	github.com/aws/aws-sdk-go-v2/config v1.25.0
-	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.30.0
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.33.2
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/segmentio/kafka-go v0.4.35
 )
@@ -40,4 +40,14 @@ require (
 	google.golang.org/protobuf v1.34.2
 )
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require (
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.14.5
+	github.com/joho/godotenv v1.5.1
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/aws/aws-sdk-go-v2/service/dynamodbstreams v1.21.1 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+)
@@ -0,0 +1,106 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cartloom/checkout"
+)
+
+// maxAllocationAttempts bounds how often a checkout reservation is reallocated after losing stock to a concurrent one
+const maxAllocationAttempts = 3
+
+// Reserver reserves checkout items at the first location, in ID order, that can supply the whole
+// quantity of a line
+type Reserver struct {
+	store *Store
+}
+
+var _ checkout.InventoryReserver = (*Reserver)(nil)
+
+// NewReserver creates a checkout inventory reserver backed by the store
+func NewReserver(store *Store) *Reserver {
+	return &Reserver{store: store}
+}
+
+// Reserve allocates the items to locations and reserves them. Allocation reads stock levels before
+// the atomic reservation, so when another checkout takes the stock in between the items are
+// allocated again. A reservation that is already held or committed succeeds without allocating,
+// since the stock it took may be the last of the variant.
+func (r *Reserver) Reserve(ctx context.Context, reservationID string, items []checkout.ReservationItem) error {
+	state, err := r.store.reservationState(ctx, reservationID)
+	if err != nil {
+		return err
+	}
+	if state == stateReserved || state == stateCommitted || state == stateAcknowledged {
+		return nil
+	}
+
+	for attempt := 0; attempt < maxAllocationAttempts; attempt++ {
+		var allocated []Item
+		allocated, err = r.allocate(ctx, items)
+		if err != nil {
+			return checkoutError(err)
+		}
+
+		err = r.store.Reserve(ctx, reservationID, allocated)
+		if !errors.Is(err, ErrInsufficientStock) {
+			return checkoutError(err)
+		}
+	}
+	return checkoutError(err)
+}
+
+// Commit commits the reservation to the order
+func (r *Reserver) Commit(ctx context.Context, reservationID, orderID string) error {
+	return checkoutError(r.store.Commit(ctx, reservationID, orderID))
+}
+
+// Release returns the reserved stock
+func (r *Reserver) Release(ctx context.Context, reservationID string) error {
+	return r.store.Release(ctx, reservationID)
+}
+
+// allocate picks a location for every item
+func (r *Reserver) allocate(ctx context.Context, items []checkout.ReservationItem) ([]Item, error) {
+	allocated := make([]Item, 0, len(items))
+	for _, item := range items {
+		locationID, err := r.locationFor(ctx, item.VariantID, int64(item.Quantity))
+		if err != nil {
+			return nil, err
+		}
+		allocated = append(allocated, Item{VariantID: item.VariantID, LocationID: locationID, Quantity: item.Quantity})
+	}
+	return allocated, nil
+}
+
+// locationFor returns the first location with quantity of the variant available
+func (r *Reserver) locationFor(ctx context.Context, variantID string, quantity int64) (string, error) {
+	locations, err := r.store.Locations(ctx, variantID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, locationID := range locations {
+		level, err := r.store.Level(ctx, variantID, locationID)
+		if err != nil {
+			return "", err
+		}
+		if level.Available >= quantity {
+			return locationID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: variant %s", ErrInsufficientStock, variantID)
+}
+
+// checkoutError wraps store errors in the errors checkout.InventoryReserver documents
+func checkoutError(err error) error {
+	switch {
+	case errors.Is(err, ErrInsufficientStock):
+		return fmt.Errorf("%w: %w", checkout.ErrOutOfStock, err)
+	case errors.Is(err, ErrReservationReleased), errors.Is(err, ErrReservationNotFound):
+		return fmt.Errorf("%w: %w", checkout.ErrReservationLost, err)
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-redis/redis/v8"
+
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// acknowledgeScript reconciles a committed reservation once Shopify recorded its order at ARGV[1],
+// in Unix milliseconds. Each line's quantity leaves committed: when the stock's recorded Shopify
+// level predates the order, it is taken off that level, which Shopify's next report confirms, and
+// the adjusted level counts as reported at ARGV[1], so reports from before the order are ignored.
+// Otherwise the level already excludes the order and the quantity, subtracted twice so far, goes
+// back to available. The reservation in KEYS[1] and its order's pointer in KEYS[2] are then
+// forgotten after ARGV[2] milliseconds. The stock keys of the lines are passed in KEYS[3..] with
+// their line fields in ARGV[3..]. It returns 1 when the reservation was acknowledged, 0 when it is
+// unknown or was not committed, 2 when it was acknowledged before and -1 when a line's stock key
+// was not passed, followed by the reservation's line fields and quantities.
+var acknowledgeScript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+local state
+local lines = {}
+for i = 1, #fields, 2 do
+	if fields[i] == 'state' then
+		state = fields[i + 1]
+	elseif string.sub(fields[i], 1, 5) == 'line:' then
+		table.insert(lines, fields[i])
+		table.insert(lines, fields[i + 1])
+	end
+end
+if state == 'acknowledged' then return {2, unpack(lines)} end
+if state ~= 'committed' then return {0} end
+local keys = {}
+for i = 3, #KEYS do
+	keys[ARGV[i]] = KEYS[i]
+end
+for i = 1, #lines, 2 do
+	if not keys[lines[i]] then return {-1} end
+end
+local placed = tonumber(ARGV[1])
+for i = 1, #lines, 2 do
+	local key = keys[lines[i]]
+	local quantity = tonumber(lines[i + 1])
+	redis.call('HINCRBY', key, 'committed', -quantity)
+	local recorded = tonumber(redis.call('HGET', key, 'shopify_at') or '0')
+	if recorded < placed then
+		redis.call('HINCRBY', key, 'shopify', -quantity)
+		redis.call('HSET', key, 'shopify_at', placed)
+	else
+		redis.call('HINCRBY', key, 'available', quantity)
+	end
+end
+redis.call('HSET', KEYS[1], 'state', 'acknowledged')
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return {1, unpack(lines)}
+`)
+
+// AcknowledgeOrder reconciles the stock committed to the order once Shopify recorded the order at
+// placedAt. From then on Shopify's own levels exclude the order's units, so they stop counting as
+// committed, in Redis and in DynamoDB. Orders without committed stock, such as orders placed in
+// Shopify directly, are ignored, and acknowledging again retries the DynamoDB write only.
+func (s *Store) AcknowledgeOrder(ctx context.Context, orderID string, placedAt time.Time) error {
+	reservationID, err := s.rdb.Get(ctx, orderReservationKey(orderID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up the reservation of order %s: %w", orderID, err)
+	}
+
+	for attempt := 0; attempt < maxSettleAttempts; attempt++ {
+		fields, err := s.rdb.HGetAll(ctx, reservationKey(reservationID)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read reservation %s: %w", reservationID, err)
+		}
+
+		keys := []string{reservationKey(reservationID), orderReservationKey(orderID)}
+		args := []interface{}{placedAt.UnixMilli(), reservationRetention.Milliseconds()}
+		for field, value := range fields {
+			if line, ok := parseLineField(field, value); ok {
+				keys = append(keys, stockKey(line.VariantID, line.LocationID))
+				args = append(args, field)
+			}
+		}
+
+		reply, err := acknowledgeScript.Run(ctx, s.rdb, keys, args...).Slice()
+		if err != nil {
+			return fmt.Errorf("failed to acknowledge reservation %s of order %s: %w", reservationID, orderID, err)
+		}
+
+		result, _ := reply[0].(int64)
+		switch result {
+		case -1:
+			// The reservation was replaced after its lines were read
+			continue
+		case 0:
+			return nil
+		}
+
+		var lines []Item
+		for i := 1; i+1 < len(reply); i += 2 {
+			field, _ := reply[i].(string)
+			value, _ := reply[i+1].(string)
+			if line, ok := parseLineField(field, value); ok {
+				lines = append(lines, line)
+			}
+		}
+		if result == 1 {
+			log.Printf("Reservation %s acknowledged by Shopify order %s", reservationID, orderID)
+		}
+		return s.writeAcknowledgement(ctx, reservationID, lines)
+	}
+	return fmt.Errorf("failed to acknowledge reservation %s of order %s: its lines kept changing", reservationID, orderID)
+}
+
+// writeCommit records the commit and adds its quantities to the committed stock in DynamoDB, in one
+// transaction conditioned on the commit not being recorded yet, so a retried write counts once
+func (s *Store) writeCommit(ctx context.Context, reservationID, orderID string, lines []Item) error {
+	recorded := make([]types.AttributeValue, 0, len(lines))
+	var writes []types.TransactWriteItem
+	for _, line := range lines {
+		recorded = append(recorded, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"VariantID":  &types.AttributeValueMemberS{Value: line.VariantID},
+			"LocationID": &types.AttributeValueMemberS{Value: line.LocationID},
+			"Quantity":   &types.AttributeValueMemberN{Value: strconv.Itoa(line.Quantity)},
+		}})
+		writes = append(writes, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(cartdynamodb.InventoryTable),
+				Key: map[string]types.AttributeValue{
+					"VariantID":  &types.AttributeValueMemberS{Value: line.VariantID},
+					"LocationID": &types.AttributeValueMemberS{Value: line.LocationID},
+				},
+				UpdateExpression: aws.String("ADD Committed :quantity SET UpdatedAt = :now"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":quantity": &types.AttributeValueMemberN{Value: strconv.Itoa(line.Quantity)},
+					":now":      &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+				},
+			},
+		})
+	}
+
+	commit := types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: aws.String(cartdynamodb.InventoryCommitsTable),
+			Item: map[string]types.AttributeValue{
+				"ReservationID": &types.AttributeValueMemberS{Value: reservationID},
+				"OrderID":       &types.AttributeValueMemberS{Value: orderID},
+				"Lines":         &types.AttributeValueMemberL{Value: recorded},
+				"CommittedAt":   &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(ReservationID)"),
+		},
+	}
+
+	_, err := s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: append([]types.TransactWriteItem{commit}, writes...),
+	})
+	if firstConditionFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write commit of reservation %s to DynamoDB: %w", reservationID, err)
+	}
+	return nil
+}
+
+// writeAcknowledgement marks the commit record acknowledged and takes its quantities off the
+// committed stock in DynamoDB, in one transaction conditioned on the commit being recorded and not
+// acknowledged yet, so a retried write counts once
+func (s *Store) writeAcknowledgement(ctx context.Context, reservationID string, lines []Item) error {
+	now := &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	writes := []types.TransactWriteItem{{
+		Update: &types.Update{
+			TableName: aws.String(cartdynamodb.InventoryCommitsTable),
+			Key: map[string]types.AttributeValue{
+				"ReservationID": &types.AttributeValueMemberS{Value: reservationID},
+			},
+			UpdateExpression:          aws.String("SET AcknowledgedAt = :now"),
+			ConditionExpression:       aws.String("attribute_exists(ReservationID) AND attribute_not_exists(AcknowledgedAt)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":now": now},
+		},
+	}}
+	for _, line := range lines {
+		writes = append(writes, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(cartdynamodb.InventoryTable),
+				Key: map[string]types.AttributeValue{
+					"VariantID":  &types.AttributeValueMemberS{Value: line.VariantID},
+					"LocationID": &types.AttributeValueMemberS{Value: line.LocationID},
+				},
+				UpdateExpression: aws.String("ADD Committed :quantity SET UpdatedAt = :now"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":quantity": &types.AttributeValueMemberN{Value: strconv.Itoa(-line.Quantity)},
+					":now":      now,
+				},
+			},
+		})
+	}
+
+	_, err := s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	if firstConditionFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write acknowledgement of reservation %s to DynamoDB: %w", reservationID, err)
+	}
+	return nil
+}
+
+// firstConditionFailed reports whether the transaction was cancelled by the condition of its first
+// item, the commit record, meaning the write was already made
+func firstConditionFailed(err error) bool {
+	var cancelled *types.TransactionCanceledException
+	if !errors.As(err, &cancelled) || len(cancelled.CancellationReasons) == 0 {
+		return false
+	}
+	return aws.ToString(cancelled.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
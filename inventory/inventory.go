@@ -0,0 +1,457 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+
+	"cartloom/utils"
+)
+
+// DefaultReservationTTL is how long a reservation holds stock before it is released automatically
+const DefaultReservationTTL = 15 * time.Minute
+
+// reservationRetention is how long an acknowledged or released reservation is remembered, so that
+// repeated commits, acknowledgements and releases stay idempotent. Held and committed reservations
+// never expire in Redis: their lines are needed to return the stock or to reconcile it once Shopify
+// has recorded the order, so only the expiry loop and AcknowledgeOrder settle them.
+const reservationRetention = 24 * time.Hour
+
+// ExpiringReservationsKey is the sorted set of held reservations scored by their expiry in Unix milliseconds
+const ExpiringReservationsKey = "inventory:reservations"
+
+// expiryBatchSize is the number of expired reservations released per pass
+const expiryBatchSize = 100
+
+// States of a reservation, stored in the reservation hash's state field. A held reservation is
+// settled into committed or released, and a committed one is acknowledged once Shopify recorded
+// its order.
+const (
+	stateReserved     = "reserved"
+	stateCommitted    = "committed"
+	stateAcknowledged = "acknowledged"
+	stateReleased     = "released"
+)
+
+// lineFieldPrefix starts the reservation hash field of each line, followed by variant ID ":" location ID
+const lineFieldPrefix = "line:"
+
+var (
+	// ErrInsufficientStock is returned when a variant has too little available at a location
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrReservationNotFound is returned for reservations that never existed or were forgotten
+	ErrReservationNotFound = errors.New("reservation not found")
+	// ErrReservationReleased is returned when committing a reservation that was released or expired
+	ErrReservationReleased = errors.New("reservation was released")
+	// ErrReservationCommitted is returned when releasing a reservation that was committed
+	ErrReservationCommitted = errors.New("reservation was committed")
+)
+
+// Item is a quantity of a variant at a location
+type Item struct {
+	VariantID  string
+	LocationID string
+	Quantity   int
+}
+
+// Level is the stock of a variant at a location: available to sell, held by reservations and
+// committed to orders Shopify has not recorded yet. Shopify is the level Shopify last reported,
+// which knows nothing of local reservations and of those orders, so Available is always Shopify
+// less Reserved and Committed.
+type Level struct {
+	Available int64
+	Reserved  int64
+	Committed int64
+	Shopify   int64
+}
+
+// setLevelScript records Shopify's level of a variant at a location in ARGV[1] and derives the
+// available stock from it, less what is held by reservations and committed to orders Shopify has
+// not seen. The variant's location set in KEYS[2] gets the location in ARGV[2]. ARGV[3] is when
+// Shopify updated the level in Unix milliseconds, or 0 when unknown; a level older than the one
+// recorded is ignored. It returns 1 when the level was recorded and 0 when it was stale.
+var setLevelScript = redis.NewScript(`
+local at = tonumber(ARGV[3])
+if at > 0 then
+	local recorded = tonumber(redis.call('HGET', KEYS[1], 'shopify_at') or '0')
+	if at < recorded then return 0 end
+	redis.call('HSET', KEYS[1], 'shopify_at', at)
+end
+local reserved = tonumber(redis.call('HGET', KEYS[1], 'reserved') or '0')
+local committed = tonumber(redis.call('HGET', KEYS[1], 'committed') or '0')
+local available = tonumber(ARGV[1]) - reserved - committed
+redis.call('HSET', KEYS[1], 'shopify', ARGV[1], 'available', available)
+redis.call('SADD', KEYS[2], ARGV[2])
+return 1
+`)
+
+// reserveScript moves each line's quantity from available to reserved, if every line has enough
+// available, and records the reservation without an expiry. It returns 1 when the reservation was made, 2 or 3 when
+// it already exists as held or committed, 4 when it was released, and -i when line i is short.
+var reserveScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], 'state')
+if state == 'reserved' then return 2 end
+if state == 'committed' or state == 'acknowledged' then return 3 end
+if state then return 4 end
+local n = #KEYS - 2
+for i = 1, n do
+	local available = tonumber(redis.call('HGET', KEYS[2 + i], 'available') or '0')
+	if available < tonumber(ARGV[1 + 2 * i]) then
+		return -i
+	end
+end
+for i = 1, n do
+	local quantity = tonumber(ARGV[1 + 2 * i])
+	redis.call('HINCRBY', KEYS[2 + i], 'available', -quantity)
+	redis.call('HINCRBY', KEYS[2 + i], 'reserved', quantity)
+	redis.call('HSET', KEYS[1], ARGV[2 + 2 * i], quantity)
+end
+redis.call('HSET', KEYS[1], 'state', 'reserved')
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// settleScript ends a held reservation, moving each line's quantity from reserved to the field in
+// ARGV[3] (committed or available) and marking the reservation with the state in ARGV[2]. The
+// reservation is forgotten after ARGV[4] milliseconds, or kept when it is 0. The stock keys of the
+// lines are passed in KEYS[3..] with their line fields in ARGV[5..]; the lines are read in the
+// script, so they are exactly the ones that were reserved. It returns the result, 1 when the
+// reservation was settled, 0 when it is unknown, 2 or 3 when it was already committed or released
+// and -1 when a line's stock key was not passed, followed by the reservation's line fields and
+// quantities.
+var settleScript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+local state
+local lines = {}
+for i = 1, #fields, 2 do
+	if fields[i] == 'state' then
+		state = fields[i + 1]
+	elseif string.sub(fields[i], 1, 5) == 'line:' then
+		table.insert(lines, fields[i])
+		table.insert(lines, fields[i + 1])
+	end
+end
+if not state then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return {0}
+end
+if state == 'committed' or state == 'acknowledged' then return {2, unpack(lines)} end
+if state == 'released' then return {3, unpack(lines)} end
+local keys = {}
+for i = 3, #KEYS do
+	keys[ARGV[i + 2]] = KEYS[i]
+end
+for i = 1, #lines, 2 do
+	if not keys[lines[i]] then return {-1} end
+end
+for i = 1, #lines, 2 do
+	local quantity = tonumber(lines[i + 1])
+	redis.call('HINCRBY', keys[lines[i]], 'reserved', -quantity)
+	redis.call('HINCRBY', keys[lines[i]], ARGV[3], quantity)
+end
+redis.call('HSET', KEYS[1], 'state', ARGV[2])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+return {1, unpack(lines)}
+`)
+
+// maxSettleAttempts bounds how often a settle is retried when the reservation's lines changed after they were read
+const maxSettleAttempts = 3
+
+// Store tracks stock per variant and location in Redis hashes. Reservations, commits and releases
+// are single Lua scripts, so concurrent checkouts can never take more than is available. Committed
+// reservations are written through to DynamoDB.
+type Store struct {
+	rdb *redis.Client
+	db  *dynamodb.Client
+	ttl time.Duration
+}
+
+// NewStore creates an inventory store whose reservations are released after ttl unless committed
+func NewStore(rdb *redis.Client, db *dynamodb.Client, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	return &Store{rdb: rdb, db: db, ttl: ttl}
+}
+
+// stockKey returns the Redis key of the stock hash of a variant at a location
+func stockKey(variantID, locationID string) string {
+	return fmt.Sprintf("inventory:%s:%s", variantID, locationID)
+}
+
+// locationsKey returns the Redis key of the set of locations stocking a variant
+func locationsKey(variantID string) string {
+	return fmt.Sprintf("inventory:locations:%s", variantID)
+}
+
+// reservationKey returns the Redis key of a reservation hash
+func reservationKey(reservationID string) string {
+	return fmt.Sprintf("reservation:%s", reservationID)
+}
+
+// orderReservationKey returns the Redis key holding the ID of the reservation committed to an order
+func orderReservationKey(orderID string) string {
+	return fmt.Sprintf("order_reservation:%s", orderID)
+}
+
+// SetAvailable records the quantity of the variant Shopify reports available at the location as of
+// updatedAt, which is zero when unknown. The stock held by reservations and committed to orders
+// Shopify has not recorded is subtracted from it, since Shopify does not know about either, so a
+// level update never puts reserved units back on sale. A level older than the recorded one is
+// ignored, since webhooks may arrive out of order.
+func (s *Store) SetAvailable(ctx context.Context, variantID, locationID string, available int64, updatedAt time.Time) error {
+	keys := []string{stockKey(variantID, locationID), locationsKey(variantID)}
+	recorded, err := setLevelScript.Run(ctx, s.rdb, keys, available, locationID, unixMilli(updatedAt)).Int()
+	if err != nil {
+		return fmt.Errorf("failed to set stock of variant %s at location %s: %w", variantID, locationID, err)
+	}
+	if recorded == 0 {
+		log.Printf("Ignoring stale level of variant %s at location %s from %s", variantID, locationID, updatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// unixMilli returns the time in Unix milliseconds, or 0 for the zero time
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// Level returns the stock of the variant at the location
+func (s *Store) Level(ctx context.Context, variantID, locationID string) (Level, error) {
+	values, err := s.rdb.HMGet(ctx, stockKey(variantID, locationID), "available", "reserved", "committed", "shopify").Result()
+	if err != nil {
+		return Level{}, fmt.Errorf("failed to read stock of variant %s at location %s: %w", variantID, locationID, err)
+	}
+
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			counts[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return Level{Available: counts[0], Reserved: counts[1], Committed: counts[2], Shopify: counts[3]}, nil
+}
+
+// Locations lists the locations stocking the variant
+func (s *Store) Locations(ctx context.Context, variantID string) ([]string, error) {
+	locations, err := s.rdb.SMembers(ctx, locationsKey(variantID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locations of variant %s: %w", variantID, err)
+	}
+	sort.Strings(locations)
+	return locations, nil
+}
+
+// Reserve holds the items under the reservation ID until it is committed, released or expires.
+// Either every item is reserved or none is. Reserving an ID that is already held or committed
+// succeeds without reserving again.
+func (s *Store) Reserve(ctx context.Context, reservationID string, items []Item) error {
+	lines := mergeItems(items)
+	if len(lines) == 0 {
+		return fmt.Errorf("reservation %s has no items", reservationID)
+	}
+
+	keys := []string{reservationKey(reservationID), ExpiringReservationsKey}
+	args := []interface{}{reservationID, time.Now().Add(s.ttl).UnixMilli()}
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return fmt.Errorf("reservation %s has quantity %d of variant %s", reservationID, line.Quantity, line.VariantID)
+		}
+		keys = append(keys, stockKey(line.VariantID, line.LocationID))
+		args = append(args, line.Quantity, lineField(line))
+	}
+
+	result, err := reserveScript.Run(ctx, s.rdb, keys, args...).Int()
+	if err != nil {
+		return fmt.Errorf("failed to reserve %s: %w", reservationID, err)
+	}
+
+	switch {
+	case result < 0:
+		short := lines[-result-1]
+		return fmt.Errorf("%w: variant %s at location %s", ErrInsufficientStock, short.VariantID, short.LocationID)
+	case result == 4:
+		return fmt.Errorf("%w: %s", ErrReservationReleased, reservationID)
+	case result == 1:
+		log.Printf("Reserved %s for %s", reservationID, s.ttl)
+	}
+	return nil
+}
+
+// Commit turns the held reservation into stock committed to the order and records the commit in
+// DynamoDB. The stock stays committed until AcknowledgeOrder learns Shopify recorded the order.
+// Committing again retries the DynamoDB write without touching Redis, so a failed write through
+// can be retried.
+func (s *Store) Commit(ctx context.Context, reservationID, orderID string) error {
+	lines, err := s.settle(ctx, reservationID, stateCommitted, "committed", 0)
+	if errors.Is(err, ErrReservationCommitted) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.writeCommit(ctx, reservationID, orderID, lines); err != nil {
+		return err
+	}
+	// Kept until the order is acknowledged, which makes it expire with the reservation
+	if err := s.rdb.SetNX(ctx, orderReservationKey(orderID), reservationID, 0).Err(); err != nil {
+		return fmt.Errorf("failed to record the reservation of order %s: %w", orderID, err)
+	}
+	return nil
+}
+
+// Release returns the held reservation's stock to available. Releasing a reservation that was
+// released, expired or never made succeeds; releasing a committed one fails.
+func (s *Store) Release(ctx context.Context, reservationID string) error {
+	_, err := s.settle(ctx, reservationID, stateReleased, "available", reservationRetention)
+	if errors.Is(err, ErrReservationReleased) || errors.Is(err, ErrReservationNotFound) {
+		return nil
+	}
+	return err
+}
+
+// reservationState returns the state of a reservation, or "" if it is unknown
+func (s *Store) reservationState(ctx context.Context, reservationID string) (string, error) {
+	state, err := s.rdb.HGet(ctx, reservationKey(reservationID), "state").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read reservation %s: %w", reservationID, err)
+	}
+	return state, nil
+}
+
+// settle runs the settle script for a reservation, keeping the settled reservation for retention
+// or for good when it is 0, and returns its lines. The lines are read first, so every stock key
+// the script touches is declared.
+func (s *Store) settle(ctx context.Context, reservationID, state, target string, retention time.Duration) ([]Item, error) {
+	for attempt := 0; attempt < maxSettleAttempts; attempt++ {
+		fields, err := s.rdb.HGetAll(ctx, reservationKey(reservationID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read reservation %s: %w", reservationID, err)
+		}
+
+		keys := []string{reservationKey(reservationID), ExpiringReservationsKey}
+		args := []interface{}{reservationID, state, target, retention.Milliseconds()}
+		for field, value := range fields {
+			if line, ok := parseLineField(field, value); ok {
+				keys = append(keys, stockKey(line.VariantID, line.LocationID))
+				args = append(args, field)
+			}
+		}
+
+		reply, err := settleScript.Run(ctx, s.rdb, keys, args...).Slice()
+		if err != nil {
+			return nil, fmt.Errorf("failed to settle reservation %s as %s: %w", reservationID, state, err)
+		}
+
+		result, _ := reply[0].(int64)
+		if result == -1 {
+			// The reservation was replaced after its lines were read
+			continue
+		}
+
+		var lines []Item
+		for i := 1; i+1 < len(reply); i += 2 {
+			field, _ := reply[i].(string)
+			value, _ := reply[i+1].(string)
+			if line, ok := parseLineField(field, value); ok {
+				lines = append(lines, line)
+			}
+		}
+
+		switch result {
+		case 0:
+			return nil, fmt.Errorf("%w: %s", ErrReservationNotFound, reservationID)
+		case 2:
+			return lines, fmt.Errorf("%w: %s", ErrReservationCommitted, reservationID)
+		case 3:
+			return lines, fmt.Errorf("%w: %s", ErrReservationReleased, reservationID)
+		}
+		log.Printf("Reservation %s %s", reservationID, state)
+		return lines, nil
+	}
+	return nil, fmt.Errorf("failed to settle reservation %s as %s: its lines kept changing", reservationID, state)
+}
+
+// ReleaseExpired releases reservations held past their TTL and returns how many it released
+func (s *Store) ReleaseExpired(ctx context.Context, now time.Time) (int, error) {
+	ids, err := s.rdb.ZRangeByScore(ctx, ExpiringReservationsKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: expiryBatchSize,
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expired reservations: %w", err)
+	}
+
+	released := 0
+	for _, id := range ids {
+		_, err := s.settle(ctx, id, stateReleased, "available", reservationRetention)
+		switch {
+		case err == nil:
+			released++
+		case errors.Is(err, ErrReservationCommitted), errors.Is(err, ErrReservationReleased), errors.Is(err, ErrReservationNotFound):
+		default:
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// RunExpiry releases expired reservations every interval until the context is cancelled
+func (s *Store) RunExpiry(ctx context.Context, interval time.Duration) error {
+	return utils.Poll(ctx, "Reservation expiry", interval, expiryBatchSize, func(ctx context.Context) (int, error) {
+		return s.ReleaseExpired(ctx, time.Now())
+	})
+}
+
+// mergeItems adds up items for the same variant and location, in a stable order
+func mergeItems(items []Item) []Item {
+	index := make(map[string]int)
+	var lines []Item
+	for _, item := range items {
+		field := lineField(item)
+		if i, ok := index[field]; ok {
+			lines[i].Quantity += item.Quantity
+			continue
+		}
+		index[field] = len(lines)
+		lines = append(lines, item)
+	}
+	return lines
+}
+
+// lineField returns the reservation hash field of a line
+func lineField(item Item) string {
+	return lineFieldPrefix + item.VariantID + ":" + item.LocationID
+}
+
+// parseLineField parses a reservation hash field and value back into a line
+func parseLineField(field, value string) (Item, bool) {
+	key, ok := strings.CutPrefix(field, lineFieldPrefix)
+	if !ok {
+		return Item{}, false
+	}
+	variantID, locationID, ok := strings.Cut(key, ":")
+	quantity, err := strconv.Atoi(value)
+	if !ok || err != nil {
+		return Item{}, false
+	}
+	return Item{VariantID: variantID, LocationID: locationID, Quantity: quantity}, true
+}
@@ -0,0 +1,594 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+
+	"cartloom/checkout"
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/shopify"
+)
+
+// fakeDynamoDB answers TransactWriteItems like DynamoDB does for commit and acknowledgement writes:
+// the first write of a reservation succeeds and later ones are cancelled by the commit record's condition
+type fakeDynamoDB struct {
+	mu      sync.Mutex
+	commits map[string]int
+	acks    map[string]int
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TransactItems []struct {
+			Put *struct {
+				TableName string
+				Item      struct {
+					ReservationID struct{ S string }
+				}
+			}
+			Update *struct {
+				TableName string
+				Key       struct {
+					ReservationID struct{ S string }
+				}
+			}
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	for _, item := range input.TransactItems {
+		writes := f.commits
+		var id string
+		switch {
+		case item.Put != nil && item.Put.TableName == cartdynamodb.InventoryCommitsTable:
+			id = item.Put.Item.ReservationID.S
+		case item.Update != nil && item.Update.TableName == cartdynamodb.InventoryCommitsTable:
+			writes, id = f.acks, item.Update.Key.ReservationID.S
+		default:
+			continue
+		}
+
+		f.mu.Lock()
+		writes[id]++
+		recorded := writes[id] > 1
+		f.mu.Unlock()
+
+		if recorded {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException",`+
+				`"message":"Transaction cancelled","CancellationReasons":[{"Code":"ConditionalCheckFailed"},{"Code":"None"}]}`)
+			return
+		}
+	}
+	fmt.Fprint(w, `{}`)
+}
+
+// commitWrites returns how often the commit of the reservation was written
+func (f *fakeDynamoDB) commitWrites(reservationID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits[reservationID]
+}
+
+// ackWrites returns how often the acknowledgement of the reservation was written
+func (f *fakeDynamoDB) ackWrites(reservationID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acks[reservationID]
+}
+
+// newTestStore creates a store on miniredis with commits written to a fake DynamoDB
+func newTestStore(t *testing.T, ttl time.Duration) (*Store, *fakeDynamoDB) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	fake := &fakeDynamoDB{commits: make(map[string]int), acks: make(map[string]int)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	db := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+		BaseEndpoint: aws.String(server.URL),
+	})
+	return NewStore(rdb, db, ttl), fake
+}
+
+// mustLevel returns the stock of the variant at the location
+func mustLevel(t *testing.T, s *Store, variantID, locationID string) Level {
+	t.Helper()
+	level, err := s.Level(context.Background(), variantID, locationID)
+	if err != nil {
+		t.Fatalf("Level: %v", err)
+	}
+	return level
+}
+
+// assertConserved checks that no stock was created or lost
+func assertConserved(t *testing.T, level Level, total int64) {
+	t.Helper()
+	if level.Available < 0 || level.Reserved < 0 || level.Committed < 0 {
+		t.Fatalf("negative stock: %+v", level)
+	}
+	if sum := level.Available + level.Reserved + level.Committed; sum != total {
+		t.Fatalf("available+reserved+committed = %d, want %d (%+v)", sum, total, level)
+	}
+}
+
+func TestConcurrentReservationsDoNotOversell(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	const stock = 50
+	if err := s.SetAvailable(ctx, "v1", "l1", stock, time.Time{}); err != nil {
+		t.Fatalf("SetAvailable: %v", err)
+	}
+
+	const checkouts = 200
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reserved []string
+	for i := 0; i < checkouts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("r%d", i)
+			err := s.Reserve(ctx, id, []Item{{VariantID: "v1", LocationID: "l1", Quantity: 1 + i%2}})
+			switch {
+			case err == nil:
+				mu.Lock()
+				reserved = append(reserved, id)
+				mu.Unlock()
+			case !errors.Is(err, ErrInsufficientStock):
+				t.Errorf("Reserve %s: %v", id, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	level := mustLevel(t, s, "v1", "l1")
+	assertConserved(t, level, stock)
+	if level.Available > 1 {
+		t.Fatalf("%d left available while reservations were refused", level.Available)
+	}
+
+	// Settle the winners concurrently, half committed and half released
+	for i, id := range reserved {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				err = s.Commit(ctx, id, "order-"+id)
+			} else {
+				err = s.Release(ctx, id)
+			}
+			if err != nil {
+				t.Errorf("settling %s: %v", id, err)
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	level = mustLevel(t, s, "v1", "l1")
+	assertConserved(t, level, stock)
+	if level.Reserved != 0 {
+		t.Fatalf("reserved = %d after settling every reservation", level.Reserved)
+	}
+}
+
+func TestReserveIsAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 5, time.Time{})
+	s.SetAvailable(ctx, "v2", "l1", 1, time.Time{})
+
+	err := s.Reserve(ctx, "r1", []Item{
+		{VariantID: "v1", LocationID: "l1", Quantity: 3},
+		{VariantID: "v2", LocationID: "l1", Quantity: 2},
+	})
+	if !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("Reserve = %v, want ErrInsufficientStock", err)
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level.Available != 5 || level.Reserved != 0 {
+		t.Fatalf("failed reservation changed stock of v1: %+v", level)
+	}
+}
+
+func TestCommitIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 10, time.Time{})
+	items := []Item{{VariantID: "v1", LocationID: "l1", Quantity: 3}}
+	if err := s.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	// Reserving the same ID again does not take more stock
+	if err := s.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("repeated Reserve: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Commit(ctx, "r1", "order-1"); err != nil {
+			t.Fatalf("Commit #%d: %v", i+1, err)
+		}
+	}
+
+	level := mustLevel(t, s, "v1", "l1")
+	if level != (Level{Available: 7, Committed: 3, Shopify: 10}) {
+		t.Fatalf("level after commits = %+v, want 7 available and 3 committed", level)
+	}
+	if writes := fake.commitWrites("r1"); writes != 3 {
+		t.Fatalf("commit written %d times, want every Commit to retry the write", writes)
+	}
+
+	if err := s.Release(ctx, "r1"); !errors.Is(err, ErrReservationCommitted) {
+		t.Fatalf("Release after Commit = %v, want ErrReservationCommitted", err)
+	}
+	if err := s.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("Reserve after Commit: %v", err)
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level != (Level{Available: 7, Committed: 3, Shopify: 10}) {
+		t.Fatalf("level changed after repeated calls: %+v", level)
+	}
+}
+
+func TestReleaseIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 10, time.Time{})
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 4}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Release(ctx, "r1"); err != nil {
+			t.Fatalf("Release #%d: %v", i+1, err)
+		}
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level != (Level{Available: 10, Shopify: 10}) {
+		t.Fatalf("level after releases = %+v, want 10 available", level)
+	}
+
+	if err := s.Release(ctx, "unknown"); err != nil {
+		t.Fatalf("Release of an unknown reservation: %v", err)
+	}
+	if err := s.Commit(ctx, "r1", "order-1"); !errors.Is(err, ErrReservationReleased) {
+		t.Fatalf("Commit after Release = %v, want ErrReservationReleased", err)
+	}
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 4}}); !errors.Is(err, ErrReservationReleased) {
+		t.Fatalf("Reserve after Release = %v, want ErrReservationReleased", err)
+	}
+}
+
+func TestReserverResumesHeldReservationOfLastUnits(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+	reserver := NewReserver(s)
+
+	s.SetAvailable(ctx, "v1", "l1", 2, time.Time{})
+	items := []checkout.ReservationItem{{VariantID: "v1", Quantity: 2}}
+	if err := reserver.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	// A resumed saga reserves again while its own reservation holds the last units
+	if err := reserver.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("repeated Reserve = %v, want the held reservation to count", err)
+	}
+	if err := reserver.Commit(ctx, "r1", "order-1"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := reserver.Reserve(ctx, "r1", items); err != nil {
+		t.Fatalf("Reserve after Commit = %v, want the committed reservation to count", err)
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level != (Level{Committed: 2, Shopify: 2}) {
+		t.Fatalf("level after repeated calls = %+v, want 2 committed", level)
+	}
+}
+
+func TestExpiredReservationsAreReleased(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 10, time.Time{})
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 4}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := s.Reserve(ctx, "r2", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 1}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := s.Commit(ctx, "r2", "order-2"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	released, err := s.ReleaseExpired(ctx, time.Now())
+	if err != nil || released != 0 {
+		t.Fatalf("ReleaseExpired before the TTL = %d, %v; want nothing released", released, err)
+	}
+
+	released, err = s.ReleaseExpired(ctx, time.Now().Add(2*time.Minute))
+	if err != nil || released != 1 {
+		t.Fatalf("ReleaseExpired after the TTL = %d, %v; want 1 released", released, err)
+	}
+	level := mustLevel(t, s, "v1", "l1")
+	if level != (Level{Available: 9, Committed: 1, Shopify: 10}) {
+		t.Fatalf("level after expiry = %+v, want 9 available and 1 committed", level)
+	}
+	assertConserved(t, level, 10)
+
+	released, err = s.ReleaseExpired(ctx, time.Now().Add(2*time.Minute))
+	if err != nil || released != 0 {
+		t.Fatalf("second ReleaseExpired = %d, %v; want nothing released", released, err)
+	}
+
+	if err := s.Commit(ctx, "r1", "order-1"); !errors.Is(err, ErrReservationReleased) {
+		t.Fatalf("Commit after expiry = %v, want ErrReservationReleased", err)
+	}
+	if err := NewReserver(s).Commit(ctx, "r1", "order-1"); !errors.Is(err, checkout.ErrReservationLost) {
+		t.Fatalf("Reserver.Commit after expiry = %v, want checkout.ErrReservationLost", err)
+	}
+}
+
+func TestHeldReservationsOnlyExpireOnceSettled(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 10, time.Time{})
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 4}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	// A held reservation that vanished could never be released, leaking its stock
+	if ttl := s.rdb.PTTL(ctx, reservationKey("r1")).Val(); ttl != -1 {
+		t.Fatalf("held reservation expires in %s, want no expiry", ttl)
+	}
+
+	if err := s.Release(ctx, "r1"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if ttl := s.rdb.PTTL(ctx, reservationKey("r1")).Val(); ttl <= 0 {
+		t.Fatalf("released reservation has TTL %s, want it forgotten after the retention", ttl)
+	}
+}
+
+func TestRunExpiryReleasesStock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, _ := newTestStore(t, 50*time.Millisecond)
+
+	s.SetAvailable(ctx, "v1", "l1", 10, time.Time{})
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 6}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.RunExpiry(ctx, 10*time.Millisecond) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mustLevel(t, s, "v1", "l1") != (Level{Available: 10, Shopify: 10}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("reservation not released after its TTL: %+v", mustLevel(t, s, "v1", "l1"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunExpiry = %v, want context.Canceled", err)
+	}
+}
+
+func TestInventoryLevelWebhookFeedsReservations(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	apply := func(topic, body string) {
+		t.Helper()
+		if err := shopify.ApplyWebhook(ctx, s.rdb, s.db, nil, s, nil, topic, "shop.myshopify.com", []byte(body)); err != nil {
+			t.Fatalf("ApplyWebhook %s: %v", topic, err)
+		}
+	}
+
+	// The level arrives before the product linking its inventory item to a variant
+	apply(shopify.TopicInventoryLevelsUpdate, `{"inventory_item_id":111,"location_id":9,"available":3}`)
+	if err := s.Reserve(ctx, "r0", []Item{{VariantID: "11", LocationID: "9", Quantity: 1}}); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("Reserve before the product = %v, want ErrInsufficientStock", err)
+	}
+
+	apply(shopify.TopicProductsCreate, `{"id":1,"title":"Mug","variants":[{"id":11,"product_id":1,"inventory_item_id":111,"price":"7.50"}]}`)
+	if level := mustLevel(t, s, "11", "9"); level.Available != 3 {
+		t.Fatalf("available after the product = %d, want 3", level.Available)
+	}
+
+	apply(shopify.TopicInventoryLevelsUpdate, `{"inventory_item_id":111,"location_id":9,"available":5}`)
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "11", LocationID: "9", Quantity: 6}}); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("Reserve of more than available = %v, want ErrInsufficientStock", err)
+	}
+	if err := s.Reserve(ctx, "r2", []Item{{VariantID: "11", LocationID: "9", Quantity: 5}}); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if level := mustLevel(t, s, "11", "9"); level.Available != 0 || level.Reserved != 5 {
+		t.Fatalf("level after reserving = %+v", level)
+	}
+
+	// Updating the product again keeps the stock
+	apply(shopify.TopicProductsUpdate, `{"id":1,"title":"Mug","variants":[{"id":11,"product_id":1,"inventory_item_id":111,"price":"8.00"}]}`)
+	if level := mustLevel(t, s, "11", "9"); level.Available != 0 || level.Reserved != 5 {
+		t.Fatalf("level after the product update = %+v", level)
+	}
+
+	// Shopify keeps reporting its own level, which knows nothing of the reservation
+	apply(shopify.TopicInventoryLevelsUpdate, `{"inventory_item_id":111,"location_id":9,"available":5}`)
+	if level := mustLevel(t, s, "11", "9"); level.Available != 0 || level.Reserved != 5 || level.Shopify != 5 {
+		t.Fatalf("level after a level update = %+v", level)
+	}
+	if err := s.Reserve(ctx, "r3", []Item{{VariantID: "11", LocationID: "9", Quantity: 1}}); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("Reserve after a level update = %v, want ErrInsufficientStock", err)
+	}
+}
+
+func TestLevelUpdateAfterReservationNeverOversells(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, time.Minute)
+
+	s.SetAvailable(ctx, "v1", "l1", 5, time.Time{})
+	if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 3}}); err != nil {
+		t.Fatalf("Reserve r1: %v", err)
+	}
+	if err := s.Reserve(ctx, "r2", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 2}}); err != nil {
+		t.Fatalf("Reserve r2: %v", err)
+	}
+	if err := s.Commit(ctx, "r1", "o1"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// Shopify has not recorded the order yet: it reports the level it had before, then a restock of 4
+	s.SetAvailable(ctx, "v1", "l1", 5, time.Time{})
+	if level := mustLevel(t, s, "v1", "l1"); level.Available != 0 {
+		t.Fatalf("available after the stale level = %d, want 0 (%+v)", level.Available, level)
+	}
+	s.SetAvailable(ctx, "v1", "l1", 9, time.Time{})
+	level := mustLevel(t, s, "v1", "l1")
+	assertConserved(t, level, 9)
+	if level.Available != 4 {
+		t.Fatalf("available after the restock = %d, want 4 (%+v)", level.Available, level)
+	}
+
+	// Releasing returns the held stock on top of Shopify's level
+	if err := s.Release(ctx, "r2"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level.Available != 6 {
+		t.Fatalf("available after the release = %d, want 6 (%+v)", level.Available, level)
+	}
+}
+
+func TestAcknowledgedOrderIsNotSubtractedTwice(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	placed := t0.Add(time.Minute)
+
+	type event struct {
+		// level is a level Shopify reports at the time, or an acknowledgement when 0
+		level int64
+		at    time.Time
+		// available is the available stock after the event
+		available int64
+	}
+	ack := func(available int64) event { return event{at: placed, available: available} }
+	level := func(level int64, at time.Time, available int64) event {
+		return event{level: level, at: at, available: available}
+	}
+
+	tests := []struct {
+		name   string
+		events []event
+	}{
+		{
+			name:   "level after the acknowledgement",
+			events: []event{ack(2), level(2, placed.Add(time.Second), 2)},
+		},
+		{
+			name:   "level before the acknowledgement",
+			events: []event{level(2, placed.Add(time.Second), -1), ack(2)},
+		},
+		{
+			name:   "stale level after the acknowledgement",
+			events: []event{ack(2), level(5, t0.Add(time.Second), 2), level(2, placed.Add(time.Second), 2)},
+		},
+		{
+			name:   "restock after the acknowledgement",
+			events: []event{ack(2), level(2, placed.Add(time.Second), 2), level(6, placed.Add(time.Hour), 6)},
+		},
+		{
+			name:   "acknowledged twice",
+			events: []event{level(2, placed.Add(time.Second), -1), ack(2), ack(2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := newTestStore(t, time.Minute)
+			if err := s.SetAvailable(ctx, "v1", "l1", 5, t0); err != nil {
+				t.Fatalf("SetAvailable: %v", err)
+			}
+			if err := s.Reserve(ctx, "r1", []Item{{VariantID: "v1", LocationID: "l1", Quantity: 3}}); err != nil {
+				t.Fatalf("Reserve: %v", err)
+			}
+			if err := s.Commit(ctx, "r1", "o1"); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			for i, e := range tt.events {
+				var err error
+				if e.level == 0 {
+					err = s.AcknowledgeOrder(ctx, "o1", e.at)
+				} else {
+					err = s.SetAvailable(ctx, "v1", "l1", e.level, e.at)
+				}
+				if err != nil {
+					t.Fatalf("event %d: %v", i, err)
+				}
+				if got := mustLevel(t, s, "v1", "l1"); got.Available != e.available {
+					t.Fatalf("event %d: available = %d, want %d (%+v)", i, got.Available, e.available, got)
+				}
+			}
+
+			level := mustLevel(t, s, "v1", "l1")
+			if level.Committed != 0 {
+				t.Fatalf("committed after the acknowledgement = %d, want 0 (%+v)", level.Committed, level)
+			}
+			if writes := fake.ackWrites("r1"); writes < 1 {
+				t.Fatal("acknowledgement was not written to DynamoDB")
+			}
+			if err := s.Release(ctx, "r1"); !errors.Is(err, ErrReservationCommitted) {
+				t.Fatalf("Release after the acknowledgement = %v, want ErrReservationCommitted", err)
+			}
+			if err := s.Commit(ctx, "r1", "o1"); err != nil {
+				t.Fatalf("Commit after the acknowledgement: %v", err)
+			}
+			if got := mustLevel(t, s, "v1", "l1"); got != level {
+				t.Fatalf("level after repeated calls = %+v, want %+v", got, level)
+			}
+		})
+	}
+}
+
+func TestAcknowledgeIgnoresUnknownOrders(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newTestStore(t, time.Minute)
+	s.SetAvailable(ctx, "v1", "l1", 5, time.Time{})
+
+	if err := s.AcknowledgeOrder(ctx, "shopify-order", time.Now()); err != nil {
+		t.Fatalf("AcknowledgeOrder: %v", err)
+	}
+	if level := mustLevel(t, s, "v1", "l1"); level != (Level{Available: 5, Shopify: 5}) {
+		t.Fatalf("level after acknowledging an unknown order = %+v", level)
+	}
+	if writes := fake.ackWrites(""); writes != 0 {
+		t.Fatalf("acknowledgement of an unknown order written %d times", writes)
+	}
+}
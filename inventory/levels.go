@@ -0,0 +1,81 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"cartloom/shopify"
+)
+
+var _ shopify.StockLevels = (*Store)(nil)
+
+// itemVariantKey returns the Redis key holding the variant a Shopify inventory item belongs to
+func itemVariantKey(inventoryItemID string) string {
+	return fmt.Sprintf("inventory_item:%s:variant", inventoryItemID)
+}
+
+// itemLevelsKey returns the Redis key of the hash of an inventory item's available quantity per location
+func itemLevelsKey(inventoryItemID string) string {
+	return fmt.Sprintf("inventory_item:%s:levels", inventoryItemID)
+}
+
+// SetItemAvailable records the quantity of a Shopify inventory item available at a location as of
+// updatedAt as Shopify's level of the item's variant, see SetAvailable. Shopify reports levels per
+// inventory item while reservations are made per variant, so levels of an item whose variant is
+// not known yet are kept until LinkItem applies them.
+func (s *Store) SetItemAvailable(ctx context.Context, inventoryItemID, locationID string, available int64, updatedAt time.Time) error {
+	if err := s.rdb.HSet(ctx, itemLevelsKey(inventoryItemID), locationID, available).Err(); err != nil {
+		return fmt.Errorf("failed to record stock of inventory item %s at location %s: %w", inventoryItemID, locationID, err)
+	}
+
+	variantID, err := s.rdb.Get(ctx, itemVariantKey(inventoryItemID)).Result()
+	if err == redis.Nil {
+		log.Printf("Inventory item %s has no known variant yet; its stock is applied once the product arrives", inventoryItemID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up the variant of inventory item %s: %w", inventoryItemID, err)
+	}
+	return s.SetAvailable(ctx, variantID, locationID, available, updatedAt)
+}
+
+// LinkItem records the inventory item of a variant. The first time the item is linked to the
+// variant, the levels recorded for the item so far become the variant's Shopify levels. Their
+// times are not kept, so they are applied as levels of unknown age.
+func (s *Store) LinkItem(ctx context.Context, inventoryItemID, variantID string) error {
+	previous, err := s.rdb.GetSet(ctx, itemVariantKey(inventoryItemID), variantID).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to link inventory item %s to variant %s: %w", inventoryItemID, variantID, err)
+	}
+	if previous == variantID {
+		return nil
+	}
+
+	levels, err := s.rdb.HGetAll(ctx, itemLevelsKey(inventoryItemID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read stock of inventory item %s: %w", inventoryItemID, err)
+	}
+
+	locations := make([]string, 0, len(levels))
+	for locationID := range levels {
+		locations = append(locations, locationID)
+	}
+	sort.Strings(locations)
+
+	for _, locationID := range locations {
+		available, err := strconv.ParseInt(levels[locationID], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid stock %q of inventory item %s at location %s", levels[locationID], inventoryItemID, locationID)
+		}
+		if err := s.SetAvailable(ctx, variantID, locationID, available, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"cartloom/cart"
+	"cartloom/utils"
+)
+
+// abandonedCartBatchSize is the number of abandoned carts reported per scan
+const abandonedCartBatchSize = 100
+
+// DefaultAbandonmentThresholds are the idle times after which a cart is reported abandoned
+var DefaultAbandonmentThresholds = []time.Duration{time.Hour, 24 * time.Hour, 72 * time.Hour}
+
+// AbandonedCartScheduler periodically reports carts idle past each threshold as cart.abandoned.
+// Each stage is claimed in Redis before it is published, so several schedulers can run side by
+// side without reporting a cart twice; a stage whose event could not be written is released
+// and reported on a later scan.
+type AbandonedCartScheduler struct {
+	store      *cart.Store
+	writer     *kafka.Writer
+	thresholds []time.Duration
+	interval   time.Duration
+}
+
+// NewAbandonedCartScheduler creates a scheduler scanning every interval and publishing to the writer's topic
+func NewAbandonedCartScheduler(store *cart.Store, writer *kafka.Writer, thresholds []time.Duration, interval time.Duration) *AbandonedCartScheduler {
+	if len(thresholds) == 0 {
+		thresholds = DefaultAbandonmentThresholds
+	}
+	return &AbandonedCartScheduler{store: store, writer: writer, thresholds: thresholds, interval: interval}
+}
+
+// Run scans for abandoned carts until the context is cancelled
+func (s *AbandonedCartScheduler) Run(ctx context.Context) error {
+	return utils.Poll(ctx, "Abandoned cart scan", s.interval, abandonedCartBatchSize, s.reportAbandoned)
+}
+
+// publishAbandoned publishes the cart.abandoned event of a claimed abandonment
+func (s *AbandonedCartScheduler) publishAbandoned(ctx context.Context, a cart.Abandonment) error {
+	event, err := newCartEvent(CartAbandoned, a.Cart)
+	if err != nil {
+		return err
+	}
+	event.Stage = a.Stage
+	event.Threshold = a.Threshold.String()
+	return PublishCartEvent(ctx, s.writer, event)
+}
+
+// reportAbandoned publishes one batch of abandoned carts and returns how many were found
+func (s *AbandonedCartScheduler) reportAbandoned(ctx context.Context) (int, error) {
+	now := time.Now()
+	abandoned, err := s.store.AbandonedCarts(ctx, s.thresholds, now, abandonedCartBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, a := range abandoned {
+		claimed, err := s.store.ClaimAbandonment(ctx, a, now)
+		if err != nil {
+			return 0, err
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := s.publishAbandoned(ctx, a); err != nil {
+			if releaseErr := s.store.ReleaseAbandonment(context.WithoutCancel(ctx), a); releaseErr != nil {
+				log.Printf("Failed to release abandonment of cart %s: %v", a.Cart.ID, releaseErr)
+			}
+			return 0, err
+		}
+		log.Printf("Cart %s abandoned for %s (stage %d)", a.Cart.ID, a.Threshold, a.Stage)
+	}
+	return len(abandoned), nil
+}
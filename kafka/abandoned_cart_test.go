@@ -0,0 +1,183 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+
+	"cartloom/cart"
+	"cartloom/shopify"
+)
+
+// cartTestEnv is a cart store on miniredis and a scheduler publishing to a fake broker
+type cartTestEnv struct {
+	store     *cart.Store
+	rdb       *redis.Client
+	broker    *fakeBroker
+	writer    *kafka.Writer
+	scheduler *AbandonedCartScheduler
+}
+
+// newCartTestEnv creates the environment with a cached product p1 whose variant v1 costs 12.50
+func newCartTestEnv(t *testing.T) *cartTestEnv {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	product, _ := json.Marshal(shopify.ProductRecord{
+		ProductID: "p1",
+		Title:     "Mug",
+		Variants:  []shopify.VariantRecord{{VariantID: "v1", SKU: "MUG-1", Price: "12.50"}},
+	})
+	if err := rdb.Set(context.Background(), shopify.ProductCacheKey("p1"), product, 0).Err(); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	broker := &fakeBroker{}
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP("kafka:9092"),
+		Topic:        CartTopic,
+		Transport:    broker,
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: time.Millisecond,
+		MaxAttempts:  1,
+	}
+	t.Cleanup(func() { writer.Close() })
+
+	store := cart.NewStore(rdb, time.Hour)
+	return &cartTestEnv{
+		store:     store,
+		rdb:       rdb,
+		broker:    broker,
+		writer:    writer,
+		scheduler: NewAbandonedCartScheduler(store, writer, nil, time.Minute),
+	}
+}
+
+// idleCart creates a cart holding a mug whose last change was idle ago
+func (e *cartTestEnv) idleCart(t *testing.T, idle time.Duration) *cart.Cart {
+	t.Helper()
+	ctx := context.Background()
+
+	c, err := e.store.Create(ctx, "example.myshopify.com", "EUR", "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if c, err = e.store.AddItem(ctx, c.ID, "p1", "v1", 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	score := float64(time.Now().Add(-idle).UnixMilli()) / 1000
+	if err := e.rdb.ZAdd(ctx, cart.ActivityKey, &redis.Z{Score: score, Member: c.ID}).Err(); err != nil {
+		t.Fatalf("ZAdd: %v", err)
+	}
+	return c
+}
+
+// events decodes the cart events produced so far
+func (e *cartTestEnv) events(t *testing.T) []CartEvent {
+	t.Helper()
+	var events []CartEvent
+	for _, msg := range e.broker.produced() {
+		var event CartEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestReportAbandoned(t *testing.T) {
+	ctx := context.Background()
+	env := newCartTestEnv(t)
+	hour := env.idleCart(t, 2*time.Hour)
+	days := env.idleCart(t, 80*time.Hour)
+	env.idleCart(t, 10*time.Minute)
+
+	found, err := env.scheduler.reportAbandoned(ctx)
+	if err != nil {
+		t.Fatalf("reportAbandoned: %v", err)
+	}
+	if found != 2 {
+		t.Fatalf("found %d abandoned carts, want 2", found)
+	}
+
+	stages := make(map[string]int)
+	for _, event := range env.events(t) {
+		if event.Type != CartAbandoned {
+			t.Fatalf("published %s, want %s", event.Type, CartAbandoned)
+		}
+		stages[event.CartID] = event.Stage
+	}
+	if len(stages) != 2 || stages[hour.ID] != 1 || stages[days.ID] != 3 {
+		t.Fatalf("reported stages %v, want %s at 1 and %s at 3", stages, hour.ID, days.ID)
+	}
+
+	if found, err := env.scheduler.reportAbandoned(ctx); err != nil || found != 0 {
+		t.Fatalf("second scan = %d, %v, want nothing to report", found, err)
+	}
+	if events := env.events(t); len(events) != 2 {
+		t.Fatalf("published %d events after the second scan, want 2", len(events))
+	}
+}
+
+func TestReportAbandonedReleasesClaimWhenPublishFails(t *testing.T) {
+	ctx := context.Background()
+	env := newCartTestEnv(t)
+	c := env.idleCart(t, 2*time.Hour)
+
+	unavailable := errors.New("broker unavailable")
+	env.broker.fail(unavailable)
+	if _, err := env.scheduler.reportAbandoned(ctx); err == nil {
+		t.Fatal("reportAbandoned did not fail when publishing failed")
+	}
+
+	env.broker.fail(nil)
+	if found, err := env.scheduler.reportAbandoned(ctx); err != nil || found != 1 {
+		t.Fatalf("scan after the failure = %d, %v, want the cart reported again", found, err)
+	}
+	events := env.events(t)
+	if len(events) != 1 || events[0].CartID != c.ID || events[0].Stage != 1 {
+		t.Fatalf("published %+v, want stage 1 of %s", events, c.ID)
+	}
+}
+
+func TestConvertCartReportsRecovery(t *testing.T) {
+	ctx := context.Background()
+	env := newCartTestEnv(t)
+	abandoned := env.idleCart(t, 2*time.Hour)
+	if _, err := env.scheduler.reportAbandoned(ctx); err != nil {
+		t.Fatalf("reportAbandoned: %v", err)
+	}
+	active := env.idleCart(t, time.Minute)
+
+	for _, c := range []*cart.Cart{abandoned, active} {
+		if err := ConvertCart(ctx, env.store, env.writer, c.ID, c.Version, "order-"+c.ID); err != nil {
+			t.Fatalf("ConvertCart: %v", err)
+		}
+		if _, err := env.store.Get(ctx, c.ID); !errors.Is(err, cart.ErrCartNotFound) {
+			t.Fatalf("converted cart %s was kept: %v", c.ID, err)
+		}
+	}
+
+	var recovered []CartEvent
+	for _, event := range env.events(t) {
+		if event.Type == CartRecovered {
+			recovered = append(recovered, event)
+		}
+	}
+	if len(recovered) != 1 {
+		t.Fatalf("published %d cart.recovered events, want 1", len(recovered))
+	}
+	if event := recovered[0]; event.CartID != abandoned.ID || event.OrderID != "order-"+abandoned.ID || event.AbandonedAt == nil {
+		t.Fatalf("cart.recovered = %+v, want the abandoned cart's order and abandonment time", event)
+	}
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"cartloom/cart"
+	"cartloom/utils"
+)
+
+// CartTopic receives cart lifecycle events
+const CartTopic = "cart-events"
+
+// CartEventType identifies what happened to the cart
+type CartEventType string
+
+// Cart event types
+const (
+	CartAbandoned CartEventType = "cart.abandoned"
+	CartRecovered CartEventType = "cart.recovered"
+)
+
+// CartEvent is published when a cart is abandoned and when an abandoned cart converts.
+// Amounts are in minor units of Currency.
+type CartEvent struct {
+	EventID      string          `json:"event_id"`
+	Type         CartEventType   `json:"type"`
+	Shop         string          `json:"shop"`
+	CartID       string          `json:"cart_id"`
+	CustomerID   string          `json:"customer_id,omitempty"`
+	Email        string          `json:"email,omitempty"`
+	Phone        string          `json:"phone,omitempty"`
+	LineItems    []cart.LineItem `json:"line_items"`
+	DiscountCode string          `json:"discount_code,omitempty"`
+	Value        int64           `json:"value"`
+	Currency     string          `json:"currency"`
+	LastActivity time.Time       `json:"last_activity"`
+	// Stage and Threshold tell which abandonment threshold a cart.abandoned event reports
+	Stage     int    `json:"stage,omitempty"`
+	Threshold string `json:"threshold,omitempty"`
+	// AbandonedAt and OrderID describe the conversion reported by a cart.recovered event
+	AbandonedAt *time.Time `json:"abandoned_at,omitempty"`
+	OrderID     string     `json:"order_id,omitempty"`
+	OccurredAt  time.Time  `json:"occurred_at"`
+}
+
+// newCartEvent describes the cart's contents, contact details and value
+func newCartEvent(eventType CartEventType, c *cart.Cart) (*CartEvent, error) {
+	eventID, err := utils.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	event := &CartEvent{
+		EventID:      eventID,
+		Type:         eventType,
+		Shop:         c.Shop,
+		CartID:       c.ID,
+		CustomerID:   c.CustomerID,
+		Email:        c.Email,
+		LineItems:    c.Items,
+		DiscountCode: c.DiscountCode,
+		Value:        c.Subtotal(),
+		Currency:     c.Currency,
+		LastActivity: c.UpdatedAt,
+		OccurredAt:   time.Now().UTC(),
+	}
+	if c.ShippingAddress != nil {
+		event.Phone = c.ShippingAddress.Phone
+	}
+	return event, nil
+}
+
+// PublishCartEvent writes the event to the writer's topic, keyed by cart ID
+func PublishCartEvent(ctx context.Context, writer *kafka.Writer, event *CartEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event for cart %s: %w", event.Type, event.CartID, err)
+	}
+
+	err = writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.CartID),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: HeaderContentType, Value: []byte(JSONCodec{}.ContentType())},
+			{Key: HeaderEventType, Value: []byte(event.Type)},
+			{Key: HeaderShop, Value: []byte(event.Shop)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s event for cart %s: %w", event.Type, event.CartID, err)
+	}
+
+	cartEvents.WithLabelValues(string(event.Type)).Inc()
+	return nil
+}
+
+// ConvertCart removes a cart that became an order and, if the cart had been reported abandoned,
+// publishes cart.recovered so the recovery can be attributed. The event is published before the
+// cart is removed, so a failed call can be retried without losing it; its ID is derived from the
+// order, so consumers can tell a retried event from a new one. The cart is only removed while it
+// is still at the version the order was placed from; a cart changed since is kept and
+// cart.ErrCartChanged returned.
+func ConvertCart(ctx context.Context, store *cart.Store, writer *kafka.Writer, cartID string, version int64, orderID string) error {
+	c, abandonedAt, err := store.Conversion(ctx, cartID)
+	if err != nil {
+		return err
+	}
+
+	if !abandonedAt.IsZero() {
+		event, err := newCartEvent(CartRecovered, c)
+		if err != nil {
+			return err
+		}
+		event.EventID = string(CartRecovered) + ":" + orderID
+		event.AbandonedAt = &abandonedAt
+		event.OrderID = orderID
+		if err := PublishCartEvent(ctx, writer, event); err != nil {
+			return err
+		}
+		log.Printf("Cart %s abandoned at %s recovered as order %s", cartID, abandonedAt.Format(time.RFC3339), orderID)
+	}
+
+	return store.DeleteVersion(ctx, cartID, version)
+}
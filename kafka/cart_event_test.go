@@ -0,0 +1,36 @@
+package kafka
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCartEventAbandonedAtJSON(t *testing.T) {
+	abandonedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		event CartEvent
+		want  string
+	}{
+		{name: "abandoned", event: CartEvent{Type: CartAbandoned, Stage: 1}, want: ""},
+		{name: "recovered", event: CartEvent{Type: CartRecovered, AbandonedAt: &abandonedAt}, want: `"abandoned_at":"2024-03-01T12:00:00Z"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.event)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if tt.want == "" && strings.Contains(string(data), "abandoned_at") {
+				t.Fatalf("%s event carries abandoned_at: %s", tt.event.Type, data)
+			}
+			if tt.want != "" && !strings.Contains(string(data), tt.want) {
+				t.Fatalf("%s event lacks %s: %s", tt.event.Type, tt.want, data)
+			}
+		})
+	}
+}
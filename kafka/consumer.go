@@ -2,103 +2,224 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
-	"golang.org/x/time/rate"
+
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/order"
+	"cartloom/utils"
 )
 
-// ConsumeMessages reads messages from Kafka and processes them with rate limiting and retries.
-func ConsumeMessages(ctx context.Context, reader *kafka.Reader, rdb *redis.Client, db *dynamodb.Client) error {
-	limiter := rate.NewLimiter(5, 1) // Allow 5 messages per second
+// orderEventHandler applies an order event to Redis and DynamoDB
+type orderEventHandler func(ctx context.Context, event *OrderEvent) error
 
-	for {
-		if err := limiter.Wait(ctx); err != nil {
-			log.Printf("Rate limiting error: %v", err)
-			continue
-		}
+// ConsumeMessages handles the reader's messages with a worker pool
+func ConsumeMessages(ctx context.Context, reader *kafka.Reader, config ConsumerConfig, handler MessageHandler) error {
+	return NewWorkerPool(reader, config, handler).Run(ctx)
+}
+
+// ConsumeRetryTopic handles the messages of a retry tier, each no earlier than its due time
+func ConsumeRetryTopic(ctx context.Context, reader *kafka.Reader, config ConsumerConfig, handler MessageHandler) error {
+	return NewWorkerPool(reader, config, Delayed(handler)).Run(ctx)
+}
 
-		msg, err := reader.ReadMessage(ctx)
+// NewOrderEventHandler decodes order events and routes them by type. Failures are handed to the
+// retrier; events that cannot be decoded or carry an unsupported schema version are permanent
+// failures, except for payloads whose schema could not be looked up or read yet, which a later
+// attempt, possibly on a consumer with a newer codec, may decode.
+// Codecs such as a RegistrySerializer are matched by content type ahead of the built-in ones.
+func NewOrderEventHandler(rdb *redis.Client, db *dynamodb.Client, retrier *Retrier, codecs ...OrderEventCodec) MessageHandler {
+	handlers := orderEventHandlers(rdb, db)
+
+	return func(ctx context.Context, msg kafka.Message) error {
+		event, err := DecodeOrderEvent(ctx, msg, codecs...)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, ErrRegistryUnavailable) || errors.Is(err, ErrUnreadableSchema) {
+				log.Printf("Cannot decode message Key=%s yet: %v", string(msg.Key), err)
+				return retrier.Fail(ctx, msg, err)
+			}
+			log.Printf("Rejecting message Key=%s: %v", string(msg.Key), err)
+			return retrier.Fail(ctx, msg, Permanent(err))
 		}
 
-		log.Printf("Received message: Key=%s, Value=%s", string(msg.Key), string(msg.Value))
+		log.Printf("Received %s event %s for order %s (attempt %d)", event.Type, event.EventID, event.OrderID, retryAttempt(msg)+1)
 
-		if err := retryProcessOrder(ctx, rdb, db, string(msg.Key)); err != nil {
-			log.Printf("Failed to process order %s after multiple attempts. Sending to DLQ.", string(msg.Key))
-			SendToDLQ(ctx, msg)
+		if err := handlers[event.Type](ctx, event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Error processing order %s: %v", event.OrderID, err)
+			return retrier.Fail(ctx, msg, err)
 		}
+		return nil
 	}
 }
 
-// retryProcessOrder attempts to process the order with retries on failure
-func retryProcessOrder(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, orderID string) error {
-	const maxRetries = 3
-	const retryDelay = 2 * time.Second
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		err := processOrder(ctx, rdb, db, orderID)
-		if err == nil {
-			return nil // Order processed successfully
-		}
+// DecodeOrderEvent decodes and validates the order event carried by a message.
+// The schema-version header is checked before the payload so unknown versions are never parsed.
+func DecodeOrderEvent(ctx context.Context, msg kafka.Message, codecs ...OrderEventCodec) (*OrderEvent, error) {
+	if version := headerValue(msg, HeaderSchemaVersion); version != "" && version != strconv.Itoa(OrderEventSchemaVersion) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSchemaVersion, version)
+	}
 
-		log.Printf("Error processing order %s (attempt %d/%d): %v", orderID, attempt, maxRetries, err)
-		time.Sleep(retryDelay) // Delay before retrying
+	codec, err := codecFor(headerValue(msg, HeaderContentType), codecs)
+	if err != nil {
+		return nil, err
 	}
 
-	return logError("Max retries reached", orderID)
+	var event *OrderEvent
+	if decoder, ok := codec.(ContextDecoder); ok {
+		event, err = decoder.DecodeContext(ctx, msg.Value)
+	} else {
+		event, err = codec.Decode(msg.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := event.Validate(); err != nil {
+		return nil, err
+	}
+	return event, nil
 }
 
-// processOrder processes the order using Redis for caching and DynamoDB for persistence
-func processOrder(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, orderID string) error {
-	status, err := rdb.Get(ctx, orderID).Result()
-
-	switch {
-	case err == redis.Nil:
-		log.Printf("Order %s not found in Redis. Processing...", orderID)
-		if err := updateOrderStatus(ctx, rdb, db, orderID, "Processed"); err != nil {
-			return err
+// orderEventHandlers maps every order event type to its handler
+func orderEventHandlers(rdb *redis.Client, db *dynamodb.Client) map[OrderEventType]orderEventHandler {
+	advance := func(status order.Status) orderEventHandler {
+		return func(ctx context.Context, event *OrderEvent) error {
+			return advanceOrder(ctx, rdb, db, event, status)
 		}
-		log.Printf("Order %s processed and saved", orderID)
+	}
 
-	case err != nil:
-		log.Printf("Redis error for order %s: %v", orderID, err)
+	return map[OrderEventType]orderEventHandler{
+		OrderCreated: func(ctx context.Context, event *OrderEvent) error {
+			return processOrder(ctx, rdb, db, event)
+		},
+		OrderPaid:      advance(order.StatusPaid),
+		OrderCancelled: advance(order.StatusCancelled),
+		OrderFulfilled: advance(order.StatusFulfilled),
+		OrderRefunded:  advance(order.StatusRefunded),
+	}
+}
+
+// processOrder creates the order in the pending state; an order that already exists was created
+// by an earlier delivery of the event and is left alone
+func processOrder(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, event *OrderEvent) error {
+	record, err := StatusChangedRecord(order.State{
+		OrderID: event.OrderID,
+		Status:  order.StatusPending,
+		Version: 1,
+	})
+	if err != nil {
 		return err
+	}
 
-	default:
-		log.Printf("Order %s already processed. Status: %s", orderID, status)
+	state, err := order.Create(ctx, db, newOrder(event), transitionReason(event), record)
+	if errors.Is(err, order.ErrOrderExists) {
+		log.Printf("Order %s already processed", event.OrderID)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	return nil
+	log.Printf("Order %s processed and saved", event.OrderID)
+	return cacheOrderStatus(ctx, rdb, state)
 }
 
-// updateOrderStatus updates the order status in Redis and saves it to DynamoDB
-func updateOrderStatus(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, orderID, status string) error {
-	if err := rdb.Set(ctx, orderID, status, 0).Err(); err != nil {
-		return logError("Failed to update Redis", orderID)
+// newOrder builds the stored order from an order created event
+func newOrder(event *OrderEvent) *order.Order {
+	o := &order.Order{
+		OrderID:   event.OrderID,
+		Shop:      event.Shop,
+		Currency:  event.Currency,
+		Subtotal:  event.Subtotal,
+		Discount:  event.Discount,
+		Shipping:  event.Shipping,
+		Tax:       event.Tax,
+		Total:     event.Total,
+		CreatedAt: event.OccurredAt,
 	}
+	for _, item := range event.LineItems {
+		o.LineItems = append(o.LineItems, order.LineItem{
+			VariantID: item.VariantID,
+			SKU:       item.SKU,
+			Title:     item.Title,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+		})
+	}
+	return o
+}
 
-	log.Printf("Order %s status updated to '%s' in Redis", orderID, status)
+// advanceOrder moves the order to status. Redelivered events for a status the order already went
+// through are acknowledged without a change; other transitions the lifecycle forbids are permanent
+// failures, and concurrent updates and orders not created yet are retried.
+func advanceOrder(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, event *OrderEvent, status order.Status) error {
+	state, err := order.Advance(ctx, db, event.OrderID, status, transitionReason(event), StatusChangedOutbox)
 
-	item := map[string]types.AttributeValue{
-		"OrderID": &types.AttributeValueMemberS{Value: orderID},
-		"Status":  &types.AttributeValueMemberS{Value: status},
+	var transitionErr *order.TransitionError
+	if errors.As(err, &transitionErr) {
+		return Permanent(err)
 	}
+	if err != nil {
+		return err
+	}
+	return cacheOrderStatus(ctx, rdb, state)
+}
+
+// StatusChangedOutbox builds the outbox records of a status change, which announce it
+func StatusChangedOutbox(state order.State) ([]cartdynamodb.OutboxRecord, error) {
+	record, err := StatusChangedRecord(state)
+	if err != nil {
+		return nil, err
+	}
+	return []cartdynamodb.OutboxRecord{record}, nil
+}
+
+// StatusChangedRecord builds the outbox record announcing that the order reached state
+func StatusChangedRecord(state order.State) (cartdynamodb.OutboxRecord, error) {
+	eventID, err := utils.NewID()
+	if err != nil {
+		return cartdynamodb.OutboxRecord{}, err
+	}
+
+	payload, _ := json.Marshal(OrderStatusChanged{
+		EventID:   eventID,
+		OrderID:   state.OrderID,
+		Status:    string(state.Status),
+		Version:   state.Version,
+		ChangedAt: time.Now().UTC(),
+	})
+
+	return cartdynamodb.NewOutboxRecord(OrderStatusTopic, state.OrderID, payload, map[string]string{
+		HeaderContentType: JSONCodec{}.ContentType(),
+		HeaderEventType:   OrderStatusChangedType,
+	})
+}
+
+// transitionReason describes the event that caused a transition in the order history
+func transitionReason(event *OrderEvent) string {
+	return fmt.Sprintf("%s %s", event.Type, event.EventID)
+}
 
-	if _, err := db.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String("Orders"),
-		Item:      item,
-	}); err != nil {
-		return logError("Failed to save order to DynamoDB", orderID)
+// cacheOrderStatus caches the order status in Redis
+func cacheOrderStatus(ctx context.Context, rdb *redis.Client, state order.State) error {
+	if err := rdb.Set(ctx, state.OrderID, string(state.Status), 0).Err(); err != nil {
+		return logError("Failed to update Redis", state.OrderID)
 	}
 
+	log.Printf("Order %s status updated to '%s' (version %d)", state.OrderID, state.Status, state.Version)
 	return nil
 }
 
@@ -2,52 +2,272 @@ package kafka
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
-// DLQWriter handles sending messages to the Dead Letter Queue (DLQ)
+// DefaultDLQTopic receives messages that could not be processed
+const DefaultDLQTopic = "dlq-orders"
+
+// Headers describing why and where a message failed before it was dead-lettered
+const (
+	HeaderDLQOriginalTopic     = "dlq-original-topic"
+	HeaderDLQOriginalPartition = "dlq-original-partition"
+	HeaderDLQOriginalOffset    = "dlq-original-offset"
+	HeaderDLQError             = "dlq-error"
+	HeaderDLQErrorClass        = "dlq-error-class"
+	HeaderDLQAttempts          = "dlq-attempts"
+	HeaderDLQFailedAt          = "dlq-failed-at"
+)
+
+// ErrDLQClosed is returned when sending to a DLQWriter that has been closed
+var ErrDLQClosed = errors.New("DLQ writer is closed")
+
+// DLQConfig configures a DLQWriter
+type DLQConfig struct {
+	Brokers []string
+	// Topic defaults to DefaultDLQTopic
+	Topic string
+	// BufferSize bounds the messages waiting to be written, defaulting to 1000
+	BufferSize int
+	// BatchSize is the maximum number of messages per write, defaulting to 100
+	BatchSize int
+	// BatchTimeout is how long a partial batch waits for more messages, defaulting to 100ms
+	BatchTimeout time.Duration
+	// WriteAttempts is how often a failed batch write is tried before its senders get the error, defaulting to 5
+	WriteAttempts int
+	// RetryBackoff is the pause after the first failed write, doubling up to 5s. Defaults to 200ms.
+	RetryBackoff time.Duration
+}
+
+// withDefaults fills in unset fields
+func (c DLQConfig) withDefaults() DLQConfig {
+	if c.Topic == "" {
+		c.Topic = DefaultDLQTopic
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = 1000
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.BatchTimeout <= 0 {
+		c.BatchTimeout = 100 * time.Millisecond
+	}
+	if c.WriteAttempts <= 0 {
+		c.WriteAttempts = 5
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = 200 * time.Millisecond
+	}
+	return c
+}
+
+// DLQWriter sends failed messages to the Dead Letter Queue (DLQ). It holds a single Kafka writer
+// shared by every consumer and writes in batches from a bounded buffer in the background.
 type DLQWriter struct {
 	writer *kafka.Writer
+	config DLQConfig
+	queue  chan dlqEntry
+	done   chan struct{}
+	// closeErr holds the writes that failed while Close flushed the buffer
+	closeErr error
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// dlqEntry is a queued message and where the outcome of its write is reported
+type dlqEntry struct {
+	msg    kafka.Message
+	result chan error
 }
 
-// NewDLQWriter initializes a new Kafka writer for the DLQ
-func NewDLQWriter(brokers []string, topic string) *DLQWriter {
-	return &DLQWriter{
-		writer: kafka.NewWriter(kafka.WriterConfig{
-			Brokers: brokers,
-			Topic:   topic,
-		}),
+// NewDLQWriter creates the DLQ writer and starts its background flusher
+func NewDLQWriter(config DLQConfig) *DLQWriter {
+	config = config.withDefaults()
+	dlq := &DLQWriter{
+		writer: &kafka.Writer{
+			Addr:      kafka.TCP(config.Brokers...),
+			Topic:     config.Topic,
+			Balancer:  &kafka.Hash{},
+			BatchSize: config.BatchSize,
+			// Batches are assembled by run, so writes should not wait for more messages
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		config: config,
+		queue:  make(chan dlqEntry, config.BufferSize),
+		done:   make(chan struct{}),
 	}
+	go dlq.run()
+	return dlq
 }
 
-// SendToDLQ sends the failed message to the Dead Letter Queue (DLQ)
-func SendToDLQ(ctx context.Context, msg kafka.Message) {
-	dlq := NewDLQWriter([]string{"kafka:9092"}, "dlq-orders")
-	defer dlq.Close()
+// Send writes the failed message with headers describing the failure, batched with the messages
+// other consumers send meanwhile. It returns once the batch was written, or with the error of its
+// last write attempt, so a message is only committed after it reached the DLQ. It blocks while the
+// buffer is full, which slows consumers down instead of dropping messages.
+func (dlq *DLQWriter) Send(ctx context.Context, msg kafka.Message, cause error) error {
+	entry := dlqEntry{msg: dlqMessage(msg, cause), result: make(chan error, 1)}
+	if err := dlq.enqueue(ctx, entry); err != nil {
+		dlqWriteFailures.Inc()
+		return err
+	}
 
-	if err := dlq.SendMessage(ctx, msg); err != nil {
-		log.Printf("Failed to send message to DLQ: %v", err)
+	select {
+	case err := <-entry.result:
+		return err
+	case <-ctx.Done():
+		// The write goes on; the caller only learns too late to commit on it
+		return ctx.Err()
 	}
 }
 
-// SendMessage sends a message to the DLQ
-func (dlq *DLQWriter) SendMessage(ctx context.Context, msg kafka.Message) error {
-	if err := dlq.writer.WriteMessages(ctx, msg); err != nil {
-		log.Printf("Failed to write message to DLQ: %v", err)
-		return err
+// enqueue adds the entry to the buffer unless the writer is closed
+func (dlq *DLQWriter) enqueue(ctx context.Context, entry dlqEntry) error {
+	dlq.mu.RLock()
+	defer dlq.mu.RUnlock()
+
+	if dlq.closed {
+		return ErrDLQClosed
 	}
 
-	log.Printf("Message sent to DLQ: Key=%s", string(msg.Key))
-	return nil
+	select {
+	case dlq.queue <- entry:
+		dlqBuffered.Inc()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Close closes the Kafka writer
+// Close stops accepting messages, flushes the buffer and closes the Kafka writer. It fails when
+// buffered messages could not be written.
 func (dlq *DLQWriter) Close() error {
+	dlq.mu.Lock()
+	if dlq.closed {
+		dlq.mu.Unlock()
+		return nil
+	}
+	dlq.closed = true
+	close(dlq.queue)
+	dlq.mu.Unlock()
+
+	<-dlq.done
 	if err := dlq.writer.Close(); err != nil {
 		log.Printf("Failed to close DLQ writer: %v", err)
-		return err
+		return errors.Join(dlq.closeErr, err)
+	}
+	return dlq.closeErr
+}
+
+// run collects queued messages into batches until the queue is closed
+func (dlq *DLQWriter) run() {
+	defer close(dlq.done)
+
+	batch := make([]dlqEntry, 0, dlq.config.BatchSize)
+	timer := time.NewTimer(dlq.config.BatchTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case entry, ok := <-dlq.queue:
+			if !ok {
+				dlq.closeErr = dlq.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < dlq.config.BatchSize {
+				continue
+			}
+			// The batch filled up before the timeout. Stop the timer and drain a tick that fired
+			// meanwhile, or the reset timer would cut the next batch short right away.
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+
+		dlq.flush(batch)
+		batch = batch[:0]
+		timer.Reset(dlq.config.BatchTimeout)
+	}
+}
+
+// flush writes a batch, retrying failed writes with exponential backoff, and reports the outcome
+// to the senders of its messages. A batch that still cannot be written is returned to them as an
+// error, so they leave their messages uncommitted to be consumed and dead-lettered again.
+func (dlq *DLQWriter) flush(batch []dlqEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	defer dlqBuffered.Sub(float64(len(batch)))
+
+	messages := make([]kafka.Message, len(batch))
+	for i, entry := range batch {
+		messages[i] = entry.msg
 	}
-	return nil
+
+	err := dlq.write(messages)
+	if err != nil {
+		dlqWriteFailures.Add(float64(len(batch)))
+		err = fmt.Errorf("failed to write %d messages to DLQ %s: %w", len(batch), dlq.config.Topic, err)
+		log.Println(err)
+	}
+	for _, entry := range batch {
+		entry.result <- err
+	}
+	return err
+}
+
+// write writes the messages, trying up to WriteAttempts times
+func (dlq *DLQWriter) write(messages []kafka.Message) error {
+	delay := dlq.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := dlq.writer.WriteMessages(context.Background(), messages...)
+		if err == nil {
+			log.Printf("%d messages sent to DLQ %s", len(messages), dlq.config.Topic)
+			return nil
+		}
+		if attempt >= dlq.config.WriteAttempts {
+			return err
+		}
+
+		log.Printf("Failed to write %d messages to DLQ %s, retrying in %s (attempt %d/%d): %v",
+			len(messages), dlq.config.Topic, delay, attempt, dlq.config.WriteAttempts, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+// dlqMessage copies msg with failure headers. Messages coming from a retry tier keep the
+// topic, partition and offset they were first consumed from.
+func dlqMessage(msg kafka.Message, cause error) kafka.Message {
+	topic := headerValue(msg, HeaderOriginalTopic)
+	partition := headerValue(msg, HeaderOriginalPartition)
+	offset := headerValue(msg, HeaderOriginalOffset)
+	if topic == "" {
+		topic = msg.Topic
+		partition = strconv.Itoa(msg.Partition)
+		offset = strconv.FormatInt(msg.Offset, 10)
+	}
+
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = setHeader(headers, HeaderDLQOriginalTopic, topic)
+	headers = setHeader(headers, HeaderDLQOriginalPartition, partition)
+	headers = setHeader(headers, HeaderDLQOriginalOffset, offset)
+	headers = setHeader(headers, HeaderDLQError, cause.Error())
+	headers = setHeader(headers, HeaderDLQErrorClass, ErrorClass(cause))
+	headers = setHeader(headers, HeaderDLQAttempts, strconv.Itoa(retryAttempt(msg)+1))
+	headers = setHeader(headers, HeaderDLQFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	return kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}
 }
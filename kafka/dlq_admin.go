@@ -0,0 +1,486 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"golang.org/x/time/rate"
+)
+
+// dlqReadTimeout bounds the wait for the next message while scanning a partition
+const dlqReadTimeout = 5 * time.Second
+
+// dlqFetchBytes caps the records returned by one fetch
+const dlqFetchBytes = 10 << 20
+
+// dlqWriteBatchTimeout is how long the admin's writers wait to fill a batch. Replays and purges
+// write one message or one batch at a time, so waiting longer only slows them down.
+const dlqWriteBatchTimeout = 10 * time.Millisecond
+
+// DLQMessage is a dead-lettered message together with its failure headers
+type DLQMessage struct {
+	Partition         int
+	Offset            int64
+	Key               string
+	Value             []byte
+	Headers           []kafka.Header
+	OriginalTopic     string
+	OriginalPartition int
+	OriginalOffset    int64
+	Error             string
+	ErrorClass        string
+	Attempts          int
+	FailedAt          time.Time
+	// Time is when the message was written to the DLQ topic
+	Time time.Time
+}
+
+// ParseDLQMessage reads the failure headers of a message consumed from the DLQ.
+// Messages written before the headers existed fall back to the message timestamp.
+func ParseDLQMessage(msg kafka.Message) DLQMessage {
+	m := DLQMessage{
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		Key:           string(msg.Key),
+		Value:         msg.Value,
+		Headers:       msg.Headers,
+		OriginalTopic: headerValue(msg, HeaderDLQOriginalTopic),
+		Error:         headerValue(msg, HeaderDLQError),
+		ErrorClass:    headerValue(msg, HeaderDLQErrorClass),
+		FailedAt:      msg.Time,
+		Time:          msg.Time,
+	}
+	m.OriginalPartition, _ = strconv.Atoi(headerValue(msg, HeaderDLQOriginalPartition))
+	m.OriginalOffset, _ = strconv.ParseInt(headerValue(msg, HeaderDLQOriginalOffset), 10, 64)
+	m.Attempts, _ = strconv.Atoi(headerValue(msg, HeaderDLQAttempts))
+	if failedAt, err := time.Parse(time.RFC3339Nano, headerValue(msg, HeaderDLQFailedAt)); err == nil {
+		m.FailedAt = failedAt
+	}
+	return m
+}
+
+// DLQFilter selects dead-lettered messages; zero fields match everything
+type DLQFilter struct {
+	Key        string
+	Since      time.Time
+	Until      time.Time
+	ErrorClass string
+}
+
+// Empty reports whether the filter matches every message
+func (f DLQFilter) Empty() bool {
+	return f == DLQFilter{}
+}
+
+// Match reports whether the message satisfies every set field of the filter
+func (f DLQFilter) Match(m DLQMessage) bool {
+	if f.Key != "" && m.Key != f.Key {
+		return false
+	}
+	if !f.Since.IsZero() && m.FailedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !m.FailedAt.Before(f.Until) {
+		return false
+	}
+	if f.ErrorClass != "" && m.ErrorClass != f.ErrorClass {
+		return false
+	}
+	return true
+}
+
+// ReplayOptions controls DLQAdmin.Replay
+type ReplayOptions struct {
+	// Rate is the number of messages replayed per second; zero means unlimited
+	Rate rate.Limit
+	// DryRun reports what would be replayed without writing anything
+	DryRun bool
+}
+
+// DLQAdmin inspects, replays and purges a DLQ topic. Every request goes through the client's
+// transport, which the writers of replays and purge markers share.
+type DLQAdmin struct {
+	brokers []string
+	topic   string
+	client  *kafka.Client
+}
+
+// NewDLQAdmin creates an admin for the DLQ topic on the given brokers
+func NewDLQAdmin(brokers []string, topic string) *DLQAdmin {
+	return &DLQAdmin{
+		brokers: brokers,
+		topic:   topic,
+		client:  &kafka.Client{Addr: kafka.TCP(brokers...), Timeout: 30 * time.Second},
+	}
+}
+
+// Scan calls fn for every message of the topic matching the filter, partition by partition in
+// offset order. Purged messages are skipped.
+func (a *DLQAdmin) Scan(ctx context.Context, filter DLQFilter, fn func(DLQMessage) error) error {
+	offsets, err := a.partitionOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	purged, err := a.purgedMessages(ctx)
+	if err != nil {
+		return err
+	}
+	return a.scanOffsets(ctx, offsets, filter, func(m DLQMessage) error {
+		if purged[purgeMarkerKey(m.Partition, m.Offset)] {
+			return nil
+		}
+		return fn(m)
+	})
+}
+
+// scanOffsets scans the partitions up to the given offsets
+func (a *DLQAdmin) scanOffsets(ctx context.Context, offsets []kafka.PartitionOffsets, filter DLQFilter, fn func(DLQMessage) error) error {
+	for _, p := range offsets {
+		if p.LastOffset <= p.FirstOffset {
+			continue
+		}
+		if err := a.scanPartition(ctx, p, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get reads the message at a partition and offset
+func (a *DLQAdmin) Get(ctx context.Context, partition int, offset int64) (DLQMessage, error) {
+	messages, err := a.fetch(ctx, partition, offset)
+	if err != nil {
+		return DLQMessage{}, err
+	}
+	if len(messages) == 0 || messages[0].Offset != offset {
+		return DLQMessage{}, fmt.Errorf("no message at %s/%d@%d", a.topic, partition, offset)
+	}
+	msg := messages[0]
+
+	purged, err := a.purgedMessages(ctx)
+	if err != nil {
+		return DLQMessage{}, err
+	}
+	if purged[purgeMarkerKey(partition, offset)] {
+		return DLQMessage{}, fmt.Errorf("message at %s/%d@%d was purged", a.topic, partition, offset)
+	}
+	return ParseDLQMessage(msg), nil
+}
+
+// Replay publishes matching messages back to their original topic without the DLQ and retry
+// headers, so they are processed as fresh deliveries. fn is called for every selected message.
+func (a *DLQAdmin) Replay(ctx context.Context, filter DLQFilter, opts ReplayOptions, fn func(DLQMessage)) (int, error) {
+	writer := a.writer("")
+	defer writer.Close()
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(opts.Rate, 1)
+	}
+
+	replayed := 0
+	err := a.Scan(ctx, filter, func(m DLQMessage) error {
+		if m.OriginalTopic == "" {
+			log.Printf("Skipping DLQ message %d@%d without original topic", m.Partition, m.Offset)
+			return nil
+		}
+		if fn != nil {
+			fn(m)
+		}
+		if opts.DryRun {
+			replayed++
+			return nil
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := writer.WriteMessages(ctx, kafka.Message{
+			Topic:   m.OriginalTopic,
+			Key:     []byte(m.Key),
+			Value:   m.Value,
+			Headers: replayHeaders(m.Headers),
+		}); err != nil {
+			return fmt.Errorf("failed to replay %d@%d to %s: %w", m.Partition, m.Offset, m.OriginalTopic, err)
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// Purge removes matching messages. Kafka cannot delete individual records, so a purge writes a
+// marker for every matching message to the purge marker topic of the DLQ, and Scan, Get and Replay
+// skip the marked messages. The DLQ topic itself, its offsets and its configs are left alone, so
+// consumers can keep dead-lettering while a purge runs; the purged records go away with the
+// topic's retention. The marker topic is created on the first purge with the retention of the DLQ
+// topic, so markers outlive the messages they mark.
+func (a *DLQAdmin) Purge(ctx context.Context, filter DLQFilter, dryRun bool) (int, error) {
+	var markers []kafka.Message
+	err := a.Scan(ctx, filter, func(m DLQMessage) error {
+		markers = append(markers, kafka.Message{Key: []byte(purgeMarkerKey(m.Partition, m.Offset))})
+		return nil
+	})
+	if err != nil || dryRun || len(markers) == 0 {
+		return len(markers), err
+	}
+
+	if err := a.createMarkerTopic(ctx); err != nil {
+		return 0, err
+	}
+	if err := a.write(ctx, a.markerTopic(), markers); err != nil {
+		return 0, fmt.Errorf("failed to write purge markers to %s: %w", a.markerTopic(), err)
+	}
+	return len(markers), nil
+}
+
+// markerTopic is the topic holding the purge markers of the DLQ topic
+func (a *DLQAdmin) markerTopic() string {
+	return a.topic + ".purged"
+}
+
+// purgeMarkerKey identifies a purged message in the marker topic
+func purgeMarkerKey(partition int, offset int64) string {
+	return fmt.Sprintf("%d:%d", partition, offset)
+}
+
+// purgedMessages reads the marker topic into a set of purge marker keys. A DLQ that was never
+// purged has no marker topic.
+func (a *DLQAdmin) purgedMessages(ctx context.Context) (map[string]bool, error) {
+	purged := make(map[string]bool)
+	marker := &DLQAdmin{brokers: a.brokers, topic: a.markerTopic(), client: a.client}
+	err := marker.scanAll(ctx, func(m DLQMessage) error {
+		purged[m.Key] = true
+		return nil
+	})
+	if errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return purged, nil
+	}
+	return purged, err
+}
+
+// scanAll calls fn for every message of the topic
+func (a *DLQAdmin) scanAll(ctx context.Context, fn func(DLQMessage) error) error {
+	offsets, err := a.partitionOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	return a.scanOffsets(ctx, offsets, DLQFilter{}, fn)
+}
+
+// createMarkerTopic creates the marker topic unless it exists, with one partition and the
+// retention of the DLQ topic
+func (a *DLQAdmin) createMarkerTopic(ctx context.Context) error {
+	layout, err := a.describeTopic(ctx, a.topic)
+	if err != nil {
+		return err
+	}
+
+	config := kafka.TopicConfig{Topic: a.markerTopic(), NumPartitions: 1, ReplicationFactor: layout.ReplicationFactor}
+	for _, entry := range layout.ConfigEntries {
+		if entry.ConfigName == "retention.ms" {
+			config.ConfigEntries = append(config.ConfigEntries, entry)
+		}
+	}
+
+	created, err := a.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: []kafka.TopicConfig{config}})
+	if err == nil {
+		err = created.Errors[config.Topic]
+	}
+	if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return fmt.Errorf("failed to create topic %s: %w", config.Topic, err)
+	}
+	return nil
+}
+
+// write writes the messages to the topic, keeping their timestamps
+func (a *DLQAdmin) write(ctx context.Context, topic string, messages []kafka.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	writer := a.writer(topic)
+	defer writer.Close()
+	return writer.WriteMessages(ctx, messages...)
+}
+
+// writer creates a writer to the topic, or to the topic of each message when it is "", that waits
+// for every replica to acknowledge
+func (a *DLQAdmin) writer(topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(a.brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: dlqWriteBatchTimeout,
+		Transport:    a.client.Transport,
+	}
+}
+
+// describeTopic reads the partition count, replication factor and topic level configs of a topic
+func (a *DLQAdmin) describeTopic(ctx context.Context, topic string) (kafka.TopicConfig, error) {
+	meta, err := a.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return kafka.TopicConfig{}, err
+	}
+	if len(meta.Topics) != 1 || meta.Topics[0].Error != nil {
+		return kafka.TopicConfig{}, fmt.Errorf("failed to describe topic %s: %v", topic, meta.Topics)
+	}
+
+	partitions := meta.Topics[0].Partitions
+	layout := kafka.TopicConfig{Topic: topic, NumPartitions: len(partitions), ReplicationFactor: 1}
+	if len(partitions) > 0 && len(partitions[0].Replicas) > 0 {
+		layout.ReplicationFactor = len(partitions[0].Replicas)
+	}
+
+	configs, err := a.client.DescribeConfigs(ctx, &kafka.DescribeConfigsRequest{
+		Resources: []kafka.DescribeConfigRequestResource{{ResourceType: kafka.ResourceTypeTopic, ResourceName: topic}},
+	})
+	if err != nil {
+		return kafka.TopicConfig{}, fmt.Errorf("failed to describe configs of topic %s: %w", topic, err)
+	}
+	for _, resource := range configs.Resources {
+		if resource.Error != nil {
+			return kafka.TopicConfig{}, fmt.Errorf("failed to describe configs of topic %s: %w", topic, resource.Error)
+		}
+		for _, entry := range resource.ConfigEntries {
+			if topicLevelConfig(entry) {
+				layout.ConfigEntries = append(layout.ConfigEntries, kafka.ConfigEntry{ConfigName: entry.ConfigName, ConfigValue: entry.ConfigValue})
+			}
+		}
+	}
+	return layout, nil
+}
+
+// topicLevelConfig reports whether a config was set on the topic itself rather than inherited
+func topicLevelConfig(entry kafka.DescribeConfigResponseConfigEntry) bool {
+	const dynamicTopicConfig = 1
+	if entry.ReadOnly || entry.IsSensitive {
+		return false
+	}
+	// Brokers before DescribeConfigs v1 report IsDefault instead of the source
+	return entry.ConfigSource == dynamicTopicConfig || (entry.ConfigSource == 0 && !entry.IsDefault)
+}
+
+// partitionOffsets reads the first and last offsets of every partition of the topic from their leaders
+func (a *DLQAdmin) partitionOffsets(ctx context.Context) ([]kafka.PartitionOffsets, error) {
+	meta, err := a.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{a.topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Topics) != 1 {
+		return nil, fmt.Errorf("failed to describe topic %s: %v", a.topic, meta.Topics)
+	}
+	if err := meta.Topics[0].Error; err != nil {
+		return nil, fmt.Errorf("failed to describe topic %s: %w", a.topic, err)
+	}
+
+	var requests []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		requests = append(requests, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+	res, err := a.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{a.topic: requests}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offsets of %s: %w", a.topic, err)
+	}
+
+	offsets := res.Topics[a.topic]
+	for _, p := range offsets {
+		if p.Error != nil {
+			return nil, fmt.Errorf("failed to read offsets of %s/%d: %w", a.topic, p.Partition, p.Error)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Partition < offsets[j].Partition })
+	return offsets, nil
+}
+
+// scanPartition reads a partition from its first to its last offset. The scan is complete only
+// once it has read the message before the last offset; a fetch returning nothing before that fails
+// the scan, so a slow fetch is never mistaken for the end of the partition.
+func (a *DLQAdmin) scanPartition(ctx context.Context, p kafka.PartitionOffsets, filter DLQFilter, fn func(DLQMessage) error) error {
+	for offset := p.FirstOffset; offset < p.LastOffset; {
+		messages, err := a.fetch(ctx, p.Partition, offset)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return fmt.Errorf("timed out reading %s/%d at offset %d of %d, the scan is incomplete", a.topic, p.Partition, offset, p.LastOffset)
+		}
+
+		for _, msg := range messages {
+			if msg.Offset >= p.LastOffset {
+				return nil
+			}
+			if m := ParseDLQMessage(msg); filter.Match(m) {
+				if err := fn(m); err != nil {
+					return err
+				}
+			}
+			offset = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+// fetch reads the messages of a partition from the offset on, as many as one fetch returns. The
+// broker waits up to dlqReadTimeout for the first one.
+func (a *DLQAdmin) fetch(ctx context.Context, partition int, offset int64) ([]kafka.Message, error) {
+	res, err := a.client.Fetch(ctx, &kafka.FetchRequest{
+		Topic:     a.topic,
+		Partition: partition,
+		Offset:    offset,
+		MinBytes:  1,
+		MaxBytes:  dlqFetchBytes,
+		MaxWait:   dlqReadTimeout,
+	})
+	if err == nil {
+		err = res.Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s/%d at offset %d: %w", a.topic, partition, offset, err)
+	}
+
+	var messages []kafka.Message
+	for {
+		record, err := res.Records.ReadRecord()
+		if errors.Is(err, io.EOF) {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s/%d at offset %d: %w", a.topic, partition, offset, err)
+		}
+		// A fetch returns whole batches, which may start before the offset
+		if record.Offset < offset {
+			continue
+		}
+
+		msg := kafka.Message{Topic: a.topic, Partition: partition, Offset: record.Offset, Time: record.Time, Headers: record.Headers}
+		if msg.Key, err = protocol.ReadAll(record.Key); err == nil {
+			msg.Value, err = protocol.ReadAll(record.Value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s/%d@%d: %w", a.topic, partition, record.Offset, err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// replayHeaders drops the DLQ and retry headers so a replayed message starts with fresh attempts
+func replayHeaders(headers []kafka.Header) []kafka.Header {
+	var kept []kafka.Header
+	for _, h := range headers {
+		if strings.HasPrefix(h.Key, "dlq-") || strings.HasPrefix(h.Key, "retry-") {
+			continue
+		}
+		kept = append(kept, h)
+	}
+	return kept
+}
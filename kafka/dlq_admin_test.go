@@ -0,0 +1,231 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// dlqFailedAt is when the test messages were dead-lettered
+var dlqFailedAt = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestDLQAdmin creates an admin for the default DLQ topic on the broker, which has no marker
+// topic until the first purge
+func newTestDLQAdmin(broker *fakeBroker) *DLQAdmin {
+	broker.missing = map[string]bool{DefaultDLQTopic + ".purged": true}
+	admin := NewDLQAdmin([]string{"kafka:9092"}, DefaultDLQTopic)
+	admin.client.Transport = broker
+	return admin
+}
+
+// deadLettered builds a message dead-lettered from the orders topic, or from no topic when
+// originalTopic is ""
+func deadLettered(key, originalTopic, class string, failedAt time.Time) kafka.Message {
+	headers := []kafka.Header{
+		{Key: HeaderShop, Value: []byte("example.myshopify.com")},
+		{Key: HeaderRetryAttempt, Value: []byte("2")},
+		{Key: HeaderDLQError, Value: []byte("payments unavailable")},
+		{Key: HeaderDLQErrorClass, Value: []byte(class)},
+		{Key: HeaderDLQAttempts, Value: []byte("3")},
+		{Key: HeaderDLQFailedAt, Value: []byte(failedAt.Format(time.RFC3339Nano))},
+	}
+	if originalTopic != "" {
+		headers = append(headers,
+			kafka.Header{Key: HeaderDLQOriginalTopic, Value: []byte(originalTopic)},
+			kafka.Header{Key: HeaderDLQOriginalPartition, Value: []byte("3")},
+			kafka.Header{Key: HeaderDLQOriginalOffset, Value: []byte("42")},
+		)
+	}
+	return kafka.Message{Topic: DefaultDLQTopic, Key: []byte(key), Value: []byte(`{"id":"` + key + `"}`), Headers: headers, Time: failedAt}
+}
+
+// scanned returns the keys of the messages the admin scans, in offset order
+func scanned(t *testing.T, admin *DLQAdmin, filter DLQFilter) []string {
+	t.Helper()
+	var keys []string
+	err := admin.Scan(context.Background(), filter, func(m DLQMessage) error {
+		keys = append(keys, m.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return keys
+}
+
+func TestParseDLQMessage(t *testing.T) {
+	msg := deadLettered("order-1", "orders", ErrorClassTransient, dlqFailedAt)
+	msg.Time = dlqFailedAt.Add(time.Second)
+
+	m := ParseDLQMessage(msg)
+	if m.OriginalTopic != "orders" || m.OriginalPartition != 3 || m.OriginalOffset != 42 {
+		t.Fatalf("original %s/%d@%d, want orders/3@42", m.OriginalTopic, m.OriginalPartition, m.OriginalOffset)
+	}
+	if m.Error != "payments unavailable" || m.ErrorClass != ErrorClassTransient || m.Attempts != 3 {
+		t.Fatalf("failure %q (%s) after %d attempts, want the failure headers", m.Error, m.ErrorClass, m.Attempts)
+	}
+	if !m.FailedAt.Equal(dlqFailedAt) {
+		t.Fatalf("failed at %s, want the header's %s", m.FailedAt, dlqFailedAt)
+	}
+
+	// Messages dead-lettered before the failure time header existed fall back to their timestamp
+	msg.Headers = nil
+	if m := ParseDLQMessage(msg); !m.FailedAt.Equal(msg.Time) {
+		t.Fatalf("failed at %s without the header, want the message time %s", m.FailedAt, msg.Time)
+	}
+}
+
+func TestDLQFilterMatch(t *testing.T) {
+	m := ParseDLQMessage(deadLettered("order-1", "orders", ErrorClassPermanent, dlqFailedAt))
+
+	tests := []struct {
+		name   string
+		filter DLQFilter
+		want   bool
+	}{
+		{name: "empty", filter: DLQFilter{}, want: true},
+		{name: "key", filter: DLQFilter{Key: "order-1"}, want: true},
+		{name: "other key", filter: DLQFilter{Key: "order-2"}, want: false},
+		{name: "failed at since", filter: DLQFilter{Since: dlqFailedAt}, want: true},
+		{name: "failed before since", filter: DLQFilter{Since: dlqFailedAt.Add(time.Second)}, want: false},
+		{name: "failed before until", filter: DLQFilter{Until: dlqFailedAt.Add(time.Second)}, want: true},
+		{name: "failed at until", filter: DLQFilter{Until: dlqFailedAt}, want: false},
+		{name: "error class", filter: DLQFilter{ErrorClass: ErrorClassPermanent}, want: true},
+		{name: "other error class", filter: DLQFilter{ErrorClass: ErrorClassTransient}, want: false},
+		{name: "every field", filter: DLQFilter{Key: "order-1", Since: dlqFailedAt.Add(-time.Hour), Until: dlqFailedAt.Add(time.Hour), ErrorClass: ErrorClassPermanent}, want: true},
+		{name: "one field fails", filter: DLQFilter{Key: "order-1", Since: dlqFailedAt.Add(-time.Hour), ErrorClass: ErrorClassTransient}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(m); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDLQAdminReplay(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	broker.seed(
+		deadLettered("order-1", "orders", ErrorClassTransient, dlqFailedAt),
+		deadLettered("order-2", "", ErrorClassTransient, dlqFailedAt),
+		deadLettered("order-3", "orders", ErrorClassPermanent, dlqFailedAt),
+		deadLettered("order-4", "orders", ErrorClassTransient, dlqFailedAt),
+	)
+	admin := newTestDLQAdmin(broker)
+	filter := DLQFilter{ErrorClass: ErrorClassTransient}
+
+	var selected []string
+	replayed, err := admin.Replay(ctx, filter, ReplayOptions{DryRun: true}, func(m DLQMessage) { selected = append(selected, m.Key) })
+	if err != nil || replayed != 2 {
+		t.Fatalf("dry run = %d, %v, want 2 messages", replayed, err)
+	}
+	if strings.Join(selected, ",") != "order-1,order-4" {
+		t.Fatalf("dry run selected %v, want order-1 and order-4", selected)
+	}
+	if produced := broker.topicMessages("orders"); len(produced) != 0 {
+		t.Fatalf("dry run replayed %d messages", len(produced))
+	}
+
+	if replayed, err := admin.Replay(ctx, filter, ReplayOptions{}, nil); err != nil || replayed != 2 {
+		t.Fatalf("Replay = %d, %v, want 2 messages", replayed, err)
+	}
+	produced := broker.topicMessages("orders")
+	if len(produced) != 2 {
+		t.Fatalf("replayed %d messages to orders, want 2", len(produced))
+	}
+	for i, key := range []string{"order-1", "order-4"} {
+		msg := produced[i]
+		if string(msg.Key) != key || string(msg.Value) != `{"id":"`+key+`"}` {
+			t.Fatalf("replayed %s=%s, want %s with its value", msg.Key, msg.Value, key)
+		}
+		if len(msg.Headers) != 1 || headerValue(msg, HeaderShop) != "example.myshopify.com" {
+			t.Fatalf("replayed headers %v, want only the shop header", msg.Headers)
+		}
+	}
+	if dlq := broker.topicMessages(DefaultDLQTopic); len(dlq) != 4 {
+		t.Fatalf("DLQ holds %d messages after the replay, want all 4", len(dlq))
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	headers := []kafka.Header{
+		{Key: HeaderEventType, Value: []byte("order.created")},
+		{Key: HeaderDLQError, Value: []byte("payments unavailable")},
+		{Key: HeaderRetryAttempt, Value: []byte("2")},
+		{Key: HeaderSchemaVersion, Value: []byte("1")},
+		{Key: HeaderDLQOriginalTopic, Value: []byte("orders")},
+	}
+
+	kept := replayHeaders(headers)
+	if len(kept) != 2 || kept[0].Key != HeaderEventType || kept[1].Key != HeaderSchemaVersion {
+		t.Fatalf("kept %v, want the event type and schema version headers", kept)
+	}
+	if replayHeaders(nil) != nil {
+		t.Fatal("replayHeaders(nil) is not nil")
+	}
+}
+
+func TestDLQAdminPurge(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	for i := 1; i <= 4; i++ {
+		broker.seed(deadLettered("order-"+strconv.Itoa(i), "orders", ErrorClassTransient, dlqFailedAt))
+	}
+	admin := newTestDLQAdmin(broker)
+
+	if purged, err := admin.Purge(ctx, DLQFilter{Key: "order-2"}, true); err != nil || purged != 1 {
+		t.Fatalf("dry run = %d, %v, want 1 message", purged, err)
+	}
+	if len(broker.created) != 0 {
+		t.Fatal("dry run created the marker topic")
+	}
+
+	if purged, err := admin.Purge(ctx, DLQFilter{Key: "order-2"}, false); err != nil || purged != 1 {
+		t.Fatalf("Purge = %d, %v, want 1 message", purged, err)
+	}
+	if len(broker.created) != 1 {
+		t.Fatalf("created %d topics, want the marker topic", len(broker.created))
+	}
+	created := broker.created[0]
+	if created.Name != DefaultDLQTopic+".purged" || created.NumPartitions != 1 {
+		t.Fatalf("created %s with %d partitions, want %s.purged with 1", created.Name, created.NumPartitions, DefaultDLQTopic)
+	}
+	if len(created.Configs) != 1 || created.Configs[0].Name != "retention.ms" || created.Configs[0].Value != fakeRetention {
+		t.Fatalf("marker topic configs %v, want the DLQ's retention.ms only", created.Configs)
+	}
+	markers := broker.topicMessages(DefaultDLQTopic + ".purged")
+	if len(markers) != 1 || string(markers[0].Key) != "0:1" {
+		t.Fatalf("markers %v, want 0:1", markers)
+	}
+
+	if keys := scanned(t, admin, DLQFilter{}); strings.Join(keys, ",") != "order-1,order-3,order-4" {
+		t.Fatalf("scanned %v after the purge, want order-2 skipped", keys)
+	}
+	if _, err := admin.Get(ctx, 0, 1); err == nil || !strings.Contains(err.Error(), "purged") {
+		t.Fatalf("Get of the purged message = %v, want it reported purged", err)
+	}
+	if m, err := admin.Get(ctx, 0, 2); err != nil || m.Key != "order-3" {
+		t.Fatalf("Get(0, 2) = %+v, %v, want order-3", m, err)
+	}
+	if _, err := admin.Get(ctx, 0, 9); err == nil {
+		t.Fatal("Get past the end of the partition found a message")
+	}
+
+	// A second purge writes markers to the existing topic and skips what was already purged
+	if purged, err := admin.Purge(ctx, DLQFilter{}, false); err != nil || purged != 3 {
+		t.Fatalf("second Purge = %d, %v, want the 3 remaining messages", purged, err)
+	}
+	if keys := scanned(t, admin, DLQFilter{}); len(keys) != 0 {
+		t.Fatalf("scanned %v after purging everything", keys)
+	}
+	if dlq := broker.topicMessages(DefaultDLQTopic); len(dlq) != 4 {
+		t.Fatalf("DLQ holds %d messages after the purges, want all 4 left for retention", len(dlq))
+	}
+}
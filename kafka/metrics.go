@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// consumerMessages counts messages handled by worker pools by result
+var consumerMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_kafka_consumer_messages_total",
+	Help: "Kafka messages handled by consumer worker pools, by result.",
+}, []string{"result"})
+
+// consumerQueued reports messages fetched by worker pools but not yet handled
+var consumerQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "cartloom_kafka_consumer_queued_messages",
+	Help: "Kafka messages held back by a shop's rate limit, waiting in or being handled by consumer workers.",
+})
+
+// consumerRateLimitWaits counts messages that had to wait for their shop's rate limit
+var consumerRateLimitWaits = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cartloom_kafka_consumer_rate_limit_waits_total",
+	Help: "Kafka messages delayed by the per shop rate limit.",
+})
+
+// retriedMessages counts messages published to a retry tier
+var retriedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_kafka_retried_messages_total",
+	Help: "Failed Kafka messages published to a retry topic, by topic.",
+}, []string{"topic"})
+
+// deadLetteredMessages counts messages sent to the DLQ by the retrier
+var deadLetteredMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_kafka_dead_lettered_messages_total",
+	Help: "Kafka messages sent to the DLQ, by class (permanent errors or exhausted retries).",
+}, []string{"class"})
+
+// dlqWriteFailures counts messages that could not be written to the DLQ
+var dlqWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cartloom_kafka_dlq_write_failures_total",
+	Help: "Messages that could not be written to the DLQ.",
+})
+
+// dlqBuffered reports messages waiting in the DLQ writer's buffer
+var dlqBuffered = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "cartloom_kafka_dlq_buffered_messages",
+	Help: "Messages waiting in the DLQ writer's buffer.",
+})
+
+// outboxRelayed counts outbox records published by the relay by result
+var outboxRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_kafka_outbox_relayed_total",
+	Help: "Outbox records published to Kafka by the relay, by result.",
+}, []string{"result"})
+
+// cartEvents counts cart lifecycle events published
+var cartEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_kafka_cart_events_total",
+	Help: "Cart events published, by type.",
+}, []string{"type"})
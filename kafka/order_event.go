@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cartloom/utils"
+)
+
+// OrderEventSchemaVersion is the version of the order event envelope produced by this build
+const OrderEventSchemaVersion = 1
+
+// OrderEventType identifies what happened to the order
+type OrderEventType string
+
+// Order event types
+const (
+	OrderCreated   OrderEventType = "order.created"
+	OrderPaid      OrderEventType = "order.paid"
+	OrderCancelled OrderEventType = "order.cancelled"
+	OrderFulfilled OrderEventType = "order.fulfilled"
+	OrderRefunded  OrderEventType = "order.refunded"
+)
+
+// OrderStatusTopic receives an OrderStatusChanged event, through the outbox, for every order status written
+const OrderStatusTopic = "order-status-changes"
+
+// OrderStatusChangedType is the event-type header of OrderStatusChanged events
+const OrderStatusChangedType = "order.status_changed"
+
+// OrderStatusChanged announces that an order moved to a new status
+type OrderStatusChanged struct {
+	EventID   string    `json:"event_id"`
+	OrderID   string    `json:"order_id"`
+	Status    string    `json:"status"`
+	Version   int64     `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ErrUnsupportedSchemaVersion is returned when an event was produced with a schema this build does not know
+var ErrUnsupportedSchemaVersion = errors.New("unsupported order event schema version")
+
+// OrderEvent is the versioned envelope published on the orders topic.
+// Amounts are in minor units of Currency.
+type OrderEvent struct {
+	SchemaVersion int             `json:"schema_version"`
+	EventID       string          `json:"event_id"`
+	Type          OrderEventType  `json:"type"`
+	Shop          string          `json:"shop"`
+	OrderID       string          `json:"order_id"`
+	LineItems     []OrderLineItem `json:"line_items"`
+	Subtotal      int64           `json:"subtotal"`
+	Discount      int64           `json:"discount"`
+	Shipping      int64           `json:"shipping"`
+	Tax           int64           `json:"tax"`
+	Total         int64           `json:"total"`
+	Currency      string          `json:"currency"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	PublishedAt   time.Time       `json:"published_at"`
+}
+
+// OrderLineItem is a line of the order carried by an order event
+type OrderLineItem struct {
+	VariantID string `json:"variant_id"`
+	SKU       string `json:"sku"`
+	Title     string `json:"title"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+}
+
+// NewOrderEvent creates an event of the current schema version with a random event ID
+func NewOrderEvent(eventType OrderEventType, shop, orderID string) (*OrderEvent, error) {
+	eventID, err := utils.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrderEvent{
+		SchemaVersion: OrderEventSchemaVersion,
+		EventID:       eventID,
+		Type:          eventType,
+		Shop:          shop,
+		OrderID:       orderID,
+		OccurredAt:    time.Now().UTC(),
+	}, nil
+}
+
+// Validate checks that the event is complete and internally consistent
+func (e *OrderEvent) Validate() error {
+	if e.SchemaVersion != OrderEventSchemaVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, e.SchemaVersion)
+	}
+	if e.EventID == "" || e.OrderID == "" || e.Shop == "" {
+		return fmt.Errorf("order event is missing event ID, order ID or shop")
+	}
+
+	switch e.Type {
+	case OrderCreated, OrderPaid, OrderCancelled, OrderFulfilled, OrderRefunded:
+	default:
+		return fmt.Errorf("unknown order event type %q", e.Type)
+	}
+
+	if e.Currency == "" && e.Total != 0 {
+		return fmt.Errorf("order event %s has a total without currency", e.EventID)
+	}
+	for _, item := range e.LineItems {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("order event %s has a line item with quantity %d", e.EventID, item.Quantity)
+		}
+	}
+	return nil
+}
+
+// OrderEventCodec serializes order events for Kafka
+type OrderEventCodec interface {
+	Encode(event *OrderEvent) ([]byte, error)
+	Decode(data []byte) (*OrderEvent, error)
+	ContentType() string
+}
+
+// ContextDecoder is implemented by codecs whose decoding makes requests, such as schema lookups,
+// that should be bounded by the consumer's context
+type ContextDecoder interface {
+	DecodeContext(ctx context.Context, data []byte) (*OrderEvent, error)
+}
+
+// JSONCodec encodes order events as JSON
+type JSONCodec struct{}
+
+// Encode marshals the event to JSON
+func (JSONCodec) Encode(event *OrderEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// Decode unmarshals a JSON event
+func (JSONCodec) Decode(data []byte) (*OrderEvent, error) {
+	var event OrderEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("invalid JSON order event: %v", err)
+	}
+	return &event, nil
+}
+
+// ContentType identifies JSON payloads in the content-type header
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// codecFor returns the codec matching a content-type header, preferring the extra codecs
+// and defaulting to JSON
+func codecFor(contentType string, codecs []OrderEventCodec) (OrderEventCodec, error) {
+	for _, codec := range codecs {
+		if codec.ContentType() == contentType {
+			return codec, nil
+		}
+	}
+
+	switch contentType {
+	case "", JSONCodec{}.ContentType():
+		return JSONCodec{}, nil
+	case ProtobufCodec{}.ContentType():
+		return ProtobufCodec{}, nil
+	case AvroCodec{}.ContentType():
+		return AvroCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+}
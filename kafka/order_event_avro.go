@@ -0,0 +1,176 @@
+package kafka
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OrderEventAvroSchema is the Avro definition matching AvroCodec's binary encoding
+const OrderEventAvroSchema = `{
+  "type": "record",
+  "name": "OrderEvent",
+  "namespace": "cartloom.orders.v1",
+  "fields": [
+    {"name": "schema_version", "type": "int"},
+    {"name": "event_id", "type": "string"},
+    {"name": "type", "type": "string"},
+    {"name": "shop", "type": "string"},
+    {"name": "order_id", "type": "string"},
+    {"name": "line_items", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "OrderLineItem",
+      "fields": [
+        {"name": "variant_id", "type": "string"},
+        {"name": "sku", "type": "string"},
+        {"name": "title", "type": "string"},
+        {"name": "quantity", "type": "int"},
+        {"name": "unit_price", "type": "long"}
+      ]
+    }}},
+    {"name": "subtotal", "type": "long"},
+    {"name": "tax", "type": "long"},
+    {"name": "total", "type": "long"},
+    {"name": "currency", "type": "string"},
+    {"name": "occurred_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "published_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "discount", "type": "long", "default": 0},
+    {"name": "shipping", "type": "long", "default": 0}
+  ]
+}`
+
+// AvroCodec encodes order events with the Avro binary encoding of OrderEventAvroSchema
+type AvroCodec struct{}
+
+// ContentType identifies Avro payloads in the content-type header
+func (AvroCodec) ContentType() string {
+	return "application/avro"
+}
+
+// Schema returns the Avro schema registered for order events
+func (AvroCodec) Schema() Schema {
+	return Schema{Type: SchemaTypeAvro, Definition: OrderEventAvroSchema}
+}
+
+// Encode serializes the event as an OrderEvent record
+func (AvroCodec) Encode(event *OrderEvent) ([]byte, error) {
+	var b []byte
+	b = appendAvroLong(b, int64(event.SchemaVersion))
+	b = appendAvroString(b, event.EventID)
+	b = appendAvroString(b, string(event.Type))
+	b = appendAvroString(b, event.Shop)
+	b = appendAvroString(b, event.OrderID)
+	if len(event.LineItems) > 0 {
+		b = appendAvroLong(b, int64(len(event.LineItems)))
+		for _, item := range event.LineItems {
+			b = appendAvroString(b, item.VariantID)
+			b = appendAvroString(b, item.SKU)
+			b = appendAvroString(b, item.Title)
+			b = appendAvroLong(b, int64(item.Quantity))
+			b = appendAvroLong(b, item.UnitPrice)
+		}
+	}
+	b = appendAvroLong(b, 0) // end of array blocks
+	b = appendAvroLong(b, event.Subtotal)
+	b = appendAvroLong(b, event.Tax)
+	b = appendAvroLong(b, event.Total)
+	b = appendAvroString(b, event.Currency)
+	b = appendAvroLong(b, unixMilli(event.OccurredAt))
+	b = appendAvroLong(b, unixMilli(event.PublishedAt))
+	b = appendAvroLong(b, event.Discount)
+	b = appendAvroLong(b, event.Shipping)
+	return b, nil
+}
+
+// Decode parses an OrderEvent record
+func (AvroCodec) Decode(data []byte) (*OrderEvent, error) {
+	r := &avroReader{data: data}
+	event := &OrderEvent{
+		SchemaVersion: int(r.long()),
+		EventID:       r.string(),
+		Type:          OrderEventType(r.string()),
+		Shop:          r.string(),
+		OrderID:       r.string(),
+	}
+
+	for {
+		count := r.long()
+		if count == 0 || r.err != nil {
+			break
+		}
+		if count < 0 {
+			// A negative count is followed by the block size in bytes
+			count = -count
+			r.long()
+		}
+		for i := int64(0); i < count && r.err == nil; i++ {
+			event.LineItems = append(event.LineItems, OrderLineItem{
+				VariantID: r.string(),
+				SKU:       r.string(),
+				Title:     r.string(),
+				Quantity:  int(r.long()),
+				UnitPrice: r.long(),
+			})
+		}
+	}
+
+	event.Subtotal = r.long()
+	event.Tax = r.long()
+	event.Total = r.long()
+	event.Currency = r.string()
+	event.OccurredAt = fromUnixMilli(r.long())
+	event.PublishedAt = fromUnixMilli(r.long())
+	event.Discount = r.long()
+	event.Shipping = r.long()
+
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid Avro order event: %v", r.err)
+	}
+	return event, nil
+}
+
+// avroReader decodes Avro primitives, remembering the first error
+type avroReader struct {
+	data []byte
+	err  error
+}
+
+// long reads a zig-zag encoded int or long
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := protowire.ConsumeVarint(r.data)
+	if n < 0 {
+		r.err = protowire.ParseError(n)
+		return 0
+	}
+	r.data = r.data[n:]
+	return protowire.DecodeZigZag(v)
+}
+
+// string reads a length prefixed UTF-8 string
+func (r *avroReader) string() string {
+	length := r.long()
+	if r.err != nil {
+		return ""
+	}
+	if length < 0 || length > int64(len(r.data)) {
+		r.err = fmt.Errorf("string length %d out of range", length)
+		return ""
+	}
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
+
+// appendAvroLong appends a zig-zag encoded int or long
+func appendAvroLong(b []byte, v int64) []byte {
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+}
+
+// appendAvroString appends a length prefixed string
+func appendAvroString(b []byte, s string) []byte {
+	b = appendAvroLong(b, int64(len(s)))
+	return append(b, s...)
+}
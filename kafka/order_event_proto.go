@@ -0,0 +1,218 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OrderEventProtoSchema is the Protobuf definition matching ProtobufCodec's wire format
+const OrderEventProtoSchema = `syntax = "proto3";
+
+package cartloom.orders.v1;
+
+message OrderEvent {
+  int32 schema_version = 1;
+  string event_id = 2;
+  string type = 3;
+  string shop = 4;
+  string order_id = 5;
+  repeated OrderLineItem line_items = 6;
+  int64 subtotal = 7;
+  int64 tax = 8;
+  int64 total = 9;
+  string currency = 10;
+  int64 occurred_at_unix_ms = 11;
+  int64 published_at_unix_ms = 12;
+  int64 discount = 13;
+  int64 shipping = 14;
+}
+
+message OrderLineItem {
+  string variant_id = 1;
+  string sku = 2;
+  string title = 3;
+  int32 quantity = 4;
+  int64 unit_price = 5;
+}
+`
+
+// ProtobufCodec encodes order events with the Protobuf wire format described by OrderEventProtoSchema
+type ProtobufCodec struct{}
+
+// ContentType identifies Protobuf payloads in the content-type header
+func (ProtobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// Schema returns the Protobuf schema registered for order events
+func (ProtobufCodec) Schema() Schema {
+	return Schema{Type: SchemaTypeProtobuf, Definition: OrderEventProtoSchema}
+}
+
+// Encode serializes the event as an OrderEvent message
+func (ProtobufCodec) Encode(event *OrderEvent) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, 1, uint64(event.SchemaVersion))
+	b = appendString(b, 2, event.EventID)
+	b = appendString(b, 3, string(event.Type))
+	b = appendString(b, 4, event.Shop)
+	b = appendString(b, 5, event.OrderID)
+	for _, item := range event.LineItems {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeLineItem(item))
+	}
+	b = appendVarint(b, 7, uint64(event.Subtotal))
+	b = appendVarint(b, 8, uint64(event.Tax))
+	b = appendVarint(b, 9, uint64(event.Total))
+	b = appendString(b, 10, event.Currency)
+	b = appendVarint(b, 11, uint64(unixMilli(event.OccurredAt)))
+	b = appendVarint(b, 12, uint64(unixMilli(event.PublishedAt)))
+	b = appendVarint(b, 13, uint64(event.Discount))
+	b = appendVarint(b, 14, uint64(event.Shipping))
+	return b, nil
+}
+
+// Decode parses an OrderEvent message, skipping unknown fields
+func (ProtobufCodec) Decode(data []byte) (*OrderEvent, error) {
+	event := &OrderEvent{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v uint64, bytes []byte) error {
+		switch num {
+		case 1:
+			event.SchemaVersion = int(int32(v))
+		case 2:
+			event.EventID = string(bytes)
+		case 3:
+			event.Type = OrderEventType(bytes)
+		case 4:
+			event.Shop = string(bytes)
+		case 5:
+			event.OrderID = string(bytes)
+		case 6:
+			item, err := decodeLineItem(bytes)
+			if err != nil {
+				return err
+			}
+			event.LineItems = append(event.LineItems, item)
+		case 7:
+			event.Subtotal = int64(v)
+		case 8:
+			event.Tax = int64(v)
+		case 9:
+			event.Total = int64(v)
+		case 10:
+			event.Currency = string(bytes)
+		case 11:
+			event.OccurredAt = fromUnixMilli(int64(v))
+		case 12:
+			event.PublishedAt = fromUnixMilli(int64(v))
+		case 13:
+			event.Discount = int64(v)
+		case 14:
+			event.Shipping = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid Protobuf order event: %v", err)
+	}
+	return event, nil
+}
+
+// encodeLineItem serializes an OrderLineItem message
+func encodeLineItem(item OrderLineItem) []byte {
+	var b []byte
+	b = appendString(b, 1, item.VariantID)
+	b = appendString(b, 2, item.SKU)
+	b = appendString(b, 3, item.Title)
+	b = appendVarint(b, 4, uint64(item.Quantity))
+	b = appendVarint(b, 5, uint64(item.UnitPrice))
+	return b
+}
+
+// decodeLineItem parses an OrderLineItem message
+func decodeLineItem(data []byte) (OrderLineItem, error) {
+	var item OrderLineItem
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v uint64, bytes []byte) error {
+		switch num {
+		case 1:
+			item.VariantID = string(bytes)
+		case 2:
+			item.SKU = string(bytes)
+		case 3:
+			item.Title = string(bytes)
+		case 4:
+			item.Quantity = int(int32(v))
+		case 5:
+			item.UnitPrice = int64(v)
+		}
+		return nil
+	})
+	return item, err
+}
+
+// walkFields iterates over the fields of a message, passing varint values or length-delimited bytes
+func walkFields(data []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var v uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if err := fn(num, typ, v, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVarint appends a varint field, omitting zero values as proto3 does
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString appends a string field, omitting empty values as proto3 does
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// unixMilli converts a time to Unix milliseconds, mapping the zero time to 0
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// fromUnixMilli converts Unix milliseconds back to UTC time
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
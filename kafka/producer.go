@@ -4,15 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
-// ProduceMessages generates and sends a series of order messages to Kafka
-func ProduceMessages(ctx context.Context, writer *kafka.Writer) error {
+// Headers describing order event payloads
+const (
+	HeaderContentType   = "content-type"
+	HeaderEventType     = "event-type"
+	HeaderSchemaVersion = "schema-version"
+)
+
+// ProduceMessages generates and sends a series of order messages to Kafka encoded with the codec
+func ProduceMessages(ctx context.Context, writer *kafka.Writer, codec OrderEventCodec) error {
 	for i := 0; i < 5; i++ {
-		if err := produceOrder(ctx, writer, i); err != nil {
+		if err := produceOrder(ctx, writer, codec, i); err != nil {
 			return err
 		}
 		time.Sleep(1 * time.Second) // Simulate delay between orders
@@ -20,14 +28,18 @@ func ProduceMessages(ctx context.Context, writer *kafka.Writer) error {
 	return nil
 }
 
-// produceOrder generates and sends a single order message to Kafka
-func produceOrder(ctx context.Context, writer *kafka.Writer, orderID int) error {
-	message := kafka.Message{
-		Key:   []byte(fmt.Sprintf("OrderID-%d", orderID)),
-		Value: []byte(fmt.Sprintf("Order Created: #%d", orderID)),
+// produceOrder generates and sends a single order created event to Kafka
+func produceOrder(ctx context.Context, writer *kafka.Writer, codec OrderEventCodec, orderID int) error {
+	event, err := NewOrderEvent(OrderCreated, "demo.myshopify.com", fmt.Sprintf("OrderID-%d", orderID))
+	if err != nil {
+		return err
 	}
+	event.Currency = "USD"
+	event.LineItems = []OrderLineItem{{SKU: "DEMO-SKU", Title: "Demo product", Quantity: 1, UnitPrice: 1000}}
+	event.Subtotal = 1000
+	event.Total = 1000
 
-	if err := writer.WriteMessages(ctx, message); err != nil {
+	if err := PublishOrderEvent(ctx, writer, codec, event); err != nil {
 		log.Printf("Failed to send order %d to Kafka: %v", orderID, err)
 		return err
 	}
@@ -35,3 +47,38 @@ func produceOrder(ctx context.Context, writer *kafka.Writer, orderID int) error
 	log.Printf("Order %d sent to Kafka", orderID)
 	return nil
 }
+
+// PublishOrderEvent encodes the event with the codec and writes it keyed by order ID
+func PublishOrderEvent(ctx context.Context, writer *kafka.Writer, codec OrderEventCodec, event *OrderEvent) error {
+	if event.PublishedAt.IsZero() {
+		event.PublishedAt = time.Now().UTC()
+	}
+	if err := event.Validate(); err != nil {
+		return err
+	}
+
+	message, err := orderEventMessage(codec, event)
+	if err != nil {
+		return err
+	}
+	return writer.WriteMessages(ctx, message)
+}
+
+// orderEventMessage builds the Kafka message carrying an order event
+func orderEventMessage(codec OrderEventCodec, event *OrderEvent) (kafka.Message, error) {
+	value, err := codec.Encode(event)
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("failed to encode order event %s: %v", event.EventID, err)
+	}
+
+	return kafka.Message{
+		Key:   []byte(event.OrderID),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: HeaderContentType, Value: []byte(codec.ContentType())},
+			{Key: HeaderEventType, Value: []byte(event.Type)},
+			{Key: HeaderShop, Value: []byte(event.Shop)},
+			{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(event.SchemaVersion))},
+		},
+	}, nil
+}
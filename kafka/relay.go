@@ -0,0 +1,76 @@
+package kafka
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/segmentio/kafka-go"
+
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/utils"
+)
+
+// HeaderOutboxID carries the outbox record ID so consumers can drop redelivered messages
+const HeaderOutboxID = "outbox-id"
+
+// outboxBatchSize is the number of pending records published per poll
+const outboxBatchSize = 100
+
+// OutboxRelay publishes pending outbox records to Kafka and marks them sent. A record is
+// only marked after the broker acknowledged it, so a crash in between republishes it:
+// delivery is at least once.
+type OutboxRelay struct {
+	db       *dynamodb.Client
+	writer   *kafka.Writer
+	interval time.Duration
+}
+
+// NewOutboxRelay creates a relay polling every interval and publishing with a writer that has no fixed topic
+func NewOutboxRelay(db *dynamodb.Client, writer *kafka.Writer, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{db: db, writer: writer, interval: interval}
+}
+
+// Run polls the outbox until the context is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	return utils.Poll(ctx, "Outbox relay", r.interval, outboxBatchSize, r.relayPending)
+}
+
+// relayPending publishes one batch of pending records and returns how many were published
+func (r *OutboxRelay) relayPending(ctx context.Context) (int, error) {
+	records, err := cartdynamodb.PendingOutbox(ctx, r.db, outboxBatchSize)
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	messages := make([]kafka.Message, 0, len(records))
+	for _, record := range records {
+		headers := []kafka.Header{{Key: HeaderOutboxID, Value: []byte(record.ID)}}
+		for k, v := range record.Headers {
+			headers = append(headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+		messages = append(messages, kafka.Message{
+			Topic:   record.Topic,
+			Key:     []byte(record.Key),
+			Value:   record.Payload,
+			Headers: headers,
+		})
+	}
+
+	if err := r.writer.WriteMessages(ctx, messages...); err != nil {
+		outboxRelayed.WithLabelValues("failed").Add(float64(len(messages)))
+		return 0, err
+	}
+
+	for _, record := range records {
+		if err := cartdynamodb.MarkOutboxSent(ctx, r.db, record.ID); err != nil {
+			// The record stays pending and is published again on the next poll
+			return 0, err
+		}
+	}
+
+	outboxRelayed.WithLabelValues("sent").Add(float64(len(records)))
+	log.Printf("Outbox relay published %d records", len(records))
+	return len(records), nil
+}
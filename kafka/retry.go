@@ -0,0 +1,188 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers recording the retry history of a message
+const (
+	HeaderRetryAttempt      = "retry-attempt"
+	HeaderFirstFailure      = "retry-first-failure"
+	HeaderLastError         = "retry-last-error"
+	HeaderRetryDueAt        = "retry-due-at"
+	HeaderOriginalTopic     = "retry-original-topic"
+	HeaderOriginalPartition = "retry-original-partition"
+	HeaderOriginalOffset    = "retry-original-offset"
+)
+
+// Error classes recorded on dead-lettered messages
+const (
+	ErrorClassPermanent = "permanent"
+	ErrorClassTransient = "transient"
+)
+
+// PermanentError marks a failure that retrying cannot fix, such as a malformed payload
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so the Retrier sends the message straight to the DLQ
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent classifies an error; anything not explicitly permanent is treated as transient
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent) || errors.Is(err, ErrUnsupportedSchemaVersion)
+}
+
+// ErrorClass returns the class of an error as recorded in the DLQ
+func ErrorClass(err error) string {
+	if IsPermanent(err) {
+		return ErrorClassPermanent
+	}
+	return ErrorClassTransient
+}
+
+// RetryTier is a retry topic whose messages are re-consumed after Delay
+type RetryTier struct {
+	Topic string
+	Delay time.Duration
+}
+
+// RetryTiers names a tier per delay after the source topic, e.g. orders.retry.1m and orders.retry.10m
+func RetryTiers(topic string, delays ...time.Duration) []RetryTier {
+	tiers := make([]RetryTier, 0, len(delays))
+	for _, delay := range delays {
+		tiers = append(tiers, RetryTier{Topic: topic + ".retry." + durationLabel(delay), Delay: delay})
+	}
+	return tiers
+}
+
+// durationLabel formats a delay compactly, e.g. 90s, 10m or 1h
+func durationLabel(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// Retrier moves failed messages through the retry tiers and dead-letters them after the last one
+type Retrier struct {
+	writer *kafka.Writer
+	tiers  []RetryTier
+	dlq    *DLQWriter
+}
+
+// NewRetrier creates a retrier publishing with a writer that has no fixed topic
+func NewRetrier(writer *kafka.Writer, tiers []RetryTier, dlq *DLQWriter) *Retrier {
+	return &Retrier{writer: writer, tiers: tiers, dlq: dlq}
+}
+
+// Tiers returns the retry tiers in order
+func (r *Retrier) Tiers() []RetryTier {
+	return r.tiers
+}
+
+// Fail records a failed attempt of msg. Permanent errors and messages that exhausted every tier
+// go to the DLQ; others are published to the next tier. An error is returned only if the message
+// could not be handed off, in which case it must not be committed.
+func (r *Retrier) Fail(ctx context.Context, msg kafka.Message, cause error) error {
+	attempt := retryAttempt(msg)
+
+	if IsPermanent(cause) || attempt >= len(r.tiers) {
+		class := "exhausted"
+		if IsPermanent(cause) {
+			class = "permanent"
+		}
+		deadLetteredMessages.WithLabelValues(class).Inc()
+		log.Printf("Sending message Key=%s to DLQ after %d attempts (%s): %v", string(msg.Key), attempt+1, class, cause)
+		return r.dlq.Send(ctx, msg, cause)
+	}
+
+	tier := r.tiers[attempt]
+	now := time.Now().UTC()
+
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = setHeader(headers, HeaderRetryAttempt, strconv.Itoa(attempt+1))
+	headers = setHeader(headers, HeaderLastError, cause.Error())
+	headers = setHeader(headers, HeaderRetryDueAt, now.Add(tier.Delay).Format(time.RFC3339Nano))
+	if headerValue(msg, HeaderFirstFailure) == "" {
+		headers = setHeader(headers, HeaderFirstFailure, now.Format(time.RFC3339Nano))
+	}
+	if headerValue(msg, HeaderOriginalTopic) == "" {
+		headers = setHeader(headers, HeaderOriginalTopic, msg.Topic)
+		headers = setHeader(headers, HeaderOriginalPartition, strconv.Itoa(msg.Partition))
+		headers = setHeader(headers, HeaderOriginalOffset, strconv.FormatInt(msg.Offset, 10))
+	}
+
+	if err := r.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   tier.Topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}); err != nil {
+		return fmt.Errorf("failed to publish message to %s: %w", tier.Topic, err)
+	}
+
+	retriedMessages.WithLabelValues(tier.Topic).Inc()
+	log.Printf("Message Key=%s scheduled on %s (attempt %d): %v", string(msg.Key), tier.Topic, attempt+1, cause)
+	return nil
+}
+
+// Delayed wraps a handler for a retry topic so each message is handled no earlier than its due time.
+// Tier topics have a single delay, so messages of a partition become due in order.
+func Delayed(handler MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg kafka.Message) error {
+		if due, err := time.Parse(time.RFC3339Nano, headerValue(msg, HeaderRetryDueAt)); err == nil {
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		return handler(ctx, msg)
+	}
+}
+
+// retryAttempt returns how many retries the message already went through
+func retryAttempt(msg kafka.Message) int {
+	attempt, _ := strconv.Atoi(headerValue(msg, HeaderRetryAttempt))
+	return attempt
+}
+
+// setHeader replaces the header with the given key or appends it
+func setHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	for i := range headers {
+		if headers[i].Key == key {
+			headers[i].Value = []byte(value)
+			return headers
+		}
+	}
+	return append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
@@ -0,0 +1,411 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/createtopics"
+	"github.com/segmentio/kafka-go/protocol/describeconfigs"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// fakeRetention is the retention.ms the fake broker reports as set on every topic
+const fakeRetention = "604800000"
+
+// fakeBroker is a broker with one partition per topic that keeps the messages produced to it.
+// While err is set, produce requests fail with it. The topics in missing are unknown until they
+// are created; created records the topics created on the broker.
+type fakeBroker struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	err      error
+	missing  map[string]bool
+	created  []createtopics.RequestTopic
+}
+
+func (f *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{}
+		for _, topic := range req.TopicNames {
+			resTopic := metadata.ResponseTopic{Name: topic, Partitions: []metadata.ResponsePartition{{PartitionIndex: 0}}}
+			if f.missing[topic] {
+				resTopic = metadata.ResponseTopic{Name: topic, ErrorCode: int16(kafka.UnknownTopicOrPartition)}
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	case *listoffsets.Request:
+		res := &listoffsets.Response{}
+		for _, topic := range req.Topics {
+			resTopic := listoffsets.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				resPartition := listoffsets.ResponsePartition{Partition: partition.Partition, Timestamp: partition.Timestamp}
+				if partition.Timestamp == kafka.LastOffset {
+					resPartition.Offset = int64(len(f.topicMessages(topic.Topic)))
+				}
+				resTopic.Partitions = append(resTopic.Partitions, resPartition)
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	case *fetch.Request:
+		res := &fetch.Response{}
+		for _, topic := range req.Topics {
+			messages := f.topicMessages(topic.Topic)
+			resTopic := fetch.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				var records []protocol.Record
+				for _, msg := range messages {
+					if msg.Offset >= partition.FetchOffset {
+						records = append(records, protocol.Record{
+							Offset:  msg.Offset,
+							Time:    msg.Time,
+							Key:     protocol.NewBytes(msg.Key),
+							Value:   protocol.NewBytes(msg.Value),
+							Headers: msg.Headers,
+						})
+					}
+				}
+				resTopic.Partitions = append(resTopic.Partitions, fetch.ResponsePartition{
+					Partition:     partition.Partition,
+					HighWatermark: int64(len(messages)),
+					RecordSet:     protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)},
+				})
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	case *createtopics.Request:
+		res := &createtopics.Response{}
+		for _, topic := range req.Topics {
+			resTopic := createtopics.ResponseTopic{Name: topic.Name}
+			if f.missing[topic.Name] {
+				delete(f.missing, topic.Name)
+				f.created = append(f.created, topic)
+			} else {
+				resTopic.ErrorCode = int16(kafka.TopicAlreadyExists)
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	case *describeconfigs.Request:
+		res := &describeconfigs.Response{}
+		for _, resource := range req.Resources {
+			res.Resources = append(res.Resources, describeconfigs.ResponseResource{
+				ResourceType: resource.ResourceType,
+				ResourceName: resource.ResourceName,
+				ConfigEntries: []describeconfigs.ResponseConfigEntry{
+					{ConfigName: "retention.ms", ConfigValue: fakeRetention, ConfigSource: 1},
+					{ConfigName: "segment.bytes", ConfigValue: "1073741824", ConfigSource: 5},
+				},
+			})
+		}
+		return res, nil
+
+	case *produce.Request:
+		if f.err != nil {
+			return nil, f.err
+		}
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			resTopic := produce.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if err != nil {
+						break
+					}
+					key, err := protocol.ReadAll(record.Key)
+					if err != nil {
+						return nil, err
+					}
+					value, err := protocol.ReadAll(record.Value)
+					if err != nil {
+						return nil, err
+					}
+					msg := kafka.Message{Topic: topic.Topic, Key: key, Value: value, Time: record.Time}
+					for _, h := range record.Headers {
+						msg.Headers = append(msg.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+					}
+					f.append(msg)
+				}
+				resTopic.Partitions = append(resTopic.Partitions, produce.ResponsePartition{Partition: partition.Partition})
+			}
+			res.Topics = append(res.Topics, resTopic)
+		}
+		return res, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected Kafka request %T", req)
+	}
+}
+
+// append stores a message at the next offset of its topic
+func (f *fakeBroker) append(msg kafka.Message) {
+	msg.Partition = 0
+	msg.Offset = int64(len(f.topicMessages(msg.Topic)))
+	f.messages = append(f.messages, msg)
+}
+
+// topicMessages returns the messages of a topic in offset order
+func (f *fakeBroker) topicMessages(topic string) []kafka.Message {
+	var messages []kafka.Message
+	for _, msg := range f.messages {
+		if msg.Topic == topic {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// seed stores messages as if they had been produced
+func (f *fakeBroker) seed(messages ...kafka.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range messages {
+		f.append(msg)
+	}
+}
+
+// fail makes the following produce requests fail with err, or succeed again when it is nil
+func (f *fakeBroker) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// produced returns the messages produced so far
+func (f *fakeBroker) produced() []kafka.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]kafka.Message(nil), f.messages...)
+}
+
+// newTestRetrier creates a retrier with 1m and 10m tiers publishing to the broker
+func newTestRetrier(t *testing.T, broker *fakeBroker) *Retrier {
+	t.Helper()
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP("kafka:9092"),
+		Transport:    broker,
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: time.Millisecond,
+	}
+	t.Cleanup(func() { writer.Close() })
+
+	dlq := NewDLQWriter(DLQConfig{Brokers: []string{"kafka:9092"}, BatchTimeout: time.Millisecond, WriteAttempts: 1})
+	dlq.writer.Transport = broker
+	dlq.writer.RequiredAcks = kafka.RequireAll
+	t.Cleanup(func() { dlq.Close() })
+
+	return NewRetrier(writer, RetryTiers("orders", time.Minute, 10*time.Minute), dlq)
+}
+
+func TestRetryTiers(t *testing.T) {
+	tiers := RetryTiers("orders", 90*time.Second, time.Minute, 10*time.Minute, time.Hour, 2*time.Hour)
+
+	want := []string{"orders.retry.90s", "orders.retry.1m", "orders.retry.10m", "orders.retry.1h", "orders.retry.2h"}
+	if len(tiers) != len(want) {
+		t.Fatalf("got %d tiers, want %d", len(tiers), len(want))
+	}
+	for i, tier := range tiers {
+		if tier.Topic != want[i] {
+			t.Fatalf("tier %d is %s, want %s", i, tier.Topic, want[i])
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	transient := errors.New("connection refused")
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "transient", err: transient, want: ErrorClassTransient},
+		{name: "permanent", err: Permanent(transient), want: ErrorClassPermanent},
+		{name: "wrapped permanent", err: fmt.Errorf("handle order: %w", Permanent(transient)), want: ErrorClassPermanent},
+		{name: "unsupported schema", err: fmt.Errorf("decode: %w", ErrUnsupportedSchemaVersion), want: ErrorClassPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorClass(tt.err); got != tt.want {
+				t.Fatalf("ErrorClass = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if Permanent(nil) != nil {
+		t.Fatal("Permanent(nil) is not nil")
+	}
+}
+
+func TestRetrierFail(t *testing.T) {
+	const firstFailure = "2024-03-01T12:00:00Z"
+	transient := errors.New("payments unavailable")
+
+	source := kafka.Message{Topic: "orders", Partition: 3, Offset: 42, Key: []byte("order-1"), Value: []byte(`{}`)}
+	retried := func(attempt int, topic string) kafka.Message {
+		return kafka.Message{Topic: topic, Partition: 0, Offset: 7, Key: source.Key, Value: source.Value, Headers: []kafka.Header{
+			{Key: HeaderRetryAttempt, Value: []byte(strconv.Itoa(attempt))},
+			{Key: HeaderFirstFailure, Value: []byte(firstFailure)},
+			{Key: HeaderOriginalTopic, Value: []byte("orders")},
+			{Key: HeaderOriginalPartition, Value: []byte("3")},
+			{Key: HeaderOriginalOffset, Value: []byte("42")},
+		}}
+	}
+
+	tests := []struct {
+		name  string
+		msg   kafka.Message
+		cause error
+		topic string
+		// headers are expected on the produced message
+		headers map[string]string
+		// delay is the expected time until the retry is due
+		delay time.Duration
+	}{
+		{
+			name: "first failure", msg: source, cause: transient, topic: "orders.retry.1m", delay: time.Minute,
+			headers: map[string]string{
+				HeaderRetryAttempt:      "1",
+				HeaderLastError:         "payments unavailable",
+				HeaderOriginalTopic:     "orders",
+				HeaderOriginalPartition: "3",
+				HeaderOriginalOffset:    "42",
+			},
+		},
+		{
+			name: "promoted to the next tier", msg: retried(1, "orders.retry.1m"), cause: transient, topic: "orders.retry.10m", delay: 10 * time.Minute,
+			headers: map[string]string{
+				HeaderRetryAttempt:      "2",
+				HeaderFirstFailure:      firstFailure,
+				HeaderOriginalTopic:     "orders",
+				HeaderOriginalPartition: "3",
+				HeaderOriginalOffset:    "42",
+			},
+		},
+		{
+			name: "promoted to the DLQ after the last tier", msg: retried(2, "orders.retry.10m"), cause: transient, topic: DefaultDLQTopic,
+			headers: map[string]string{
+				HeaderDLQOriginalTopic:     "orders",
+				HeaderDLQOriginalPartition: "3",
+				HeaderDLQOriginalOffset:    "42",
+				HeaderDLQError:             "payments unavailable",
+				HeaderDLQErrorClass:        ErrorClassTransient,
+				HeaderDLQAttempts:          "3",
+			},
+		},
+		{
+			name: "permanent error skips the tiers", msg: source, cause: Permanent(errors.New("malformed order")), topic: DefaultDLQTopic,
+			headers: map[string]string{
+				HeaderDLQOriginalTopic:  "orders",
+				HeaderDLQOriginalOffset: "42",
+				HeaderDLQError:          "malformed order",
+				HeaderDLQErrorClass:     ErrorClassPermanent,
+				HeaderDLQAttempts:       "1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &fakeBroker{}
+			retrier := newTestRetrier(t, broker)
+
+			if err := retrier.Fail(context.Background(), tt.msg, tt.cause); err != nil {
+				t.Fatalf("Fail: %v", err)
+			}
+
+			produced := broker.produced()
+			if len(produced) != 1 {
+				t.Fatalf("produced %d messages, want 1", len(produced))
+			}
+			got := produced[0]
+			if got.Topic != tt.topic {
+				t.Fatalf("produced to %s, want %s", got.Topic, tt.topic)
+			}
+			if string(got.Key) != "order-1" || string(got.Value) != "{}" {
+				t.Fatalf("produced %s=%s, want the original key and value", got.Key, got.Value)
+			}
+			for key, want := range tt.headers {
+				if value := headerValue(got, key); value != want {
+					t.Fatalf("header %s = %q, want %q", key, value, want)
+				}
+			}
+
+			if tt.delay > 0 {
+				due, err := time.Parse(time.RFC3339Nano, headerValue(got, HeaderRetryDueAt))
+				if err != nil {
+					t.Fatalf("invalid due time: %v", err)
+				}
+				if until := time.Until(due); until <= tt.delay-time.Minute/2 || until > tt.delay {
+					t.Fatalf("retry due in %s, want %s", until, tt.delay)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	due := func(d time.Duration) kafka.Message {
+		return kafka.Message{Headers: []kafka.Header{{Key: HeaderRetryDueAt, Value: []byte(time.Now().Add(d).Format(time.RFC3339Nano))}}}
+	}
+
+	tests := []struct {
+		name    string
+		msg     kafka.Message
+		timeout time.Duration
+		// wait is the least time the handler is held back
+		wait    time.Duration
+		handled bool
+	}{
+		{name: "due", msg: due(-time.Minute), timeout: time.Second, handled: true},
+		{name: "not yet due", msg: due(50 * time.Millisecond), timeout: time.Second, wait: 40 * time.Millisecond, handled: true},
+		{name: "no due time", msg: kafka.Message{}, timeout: time.Second, handled: true},
+		{name: "cancelled while waiting", msg: due(time.Hour), timeout: 20 * time.Millisecond, handled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			handled := false
+			start := time.Now()
+			err := Delayed(func(ctx context.Context, msg kafka.Message) error {
+				handled = true
+				return nil
+			})(ctx, tt.msg)
+
+			if handled != tt.handled {
+				t.Fatalf("handled = %v, want %v", handled, tt.handled)
+			}
+			if !tt.handled && !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Delayed = %v, want the context error", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wait {
+				t.Fatalf("handled after %s, want at least %s", elapsed, tt.wait)
+			}
+		})
+	}
+}
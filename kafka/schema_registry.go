@@ -0,0 +1,475 @@
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schema types understood by the registry
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+// Errors returned by schema registries
+var (
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrIncompatibleSchema = errors.New("schema is incompatible with the latest registered version")
+	// ErrRegistryUnavailable marks schema lookups that failed for reasons other than a missing
+	// schema, such as network errors and 5xx responses, which a later attempt may not hit
+	ErrRegistryUnavailable = errors.New("schema registry unavailable")
+)
+
+// Schema is a schema definition together with its type
+type Schema struct {
+	Type       string
+	Definition string
+}
+
+// SchemaRegistry stores schemas under subjects and hands out their global IDs
+type SchemaRegistry interface {
+	// Register adds the schema to the subject, returning the ID of an identical schema if one exists
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	// SchemaByID returns the schema with the given ID
+	SchemaByID(ctx context.Context, id int) (Schema, error)
+	// CheckCompatibility returns ErrIncompatibleSchema if the schema cannot replace the subject's latest version
+	CheckCompatibility(ctx context.Context, subject string, schema Schema) error
+}
+
+// SubjectForTopic returns the value subject of a topic under the default topic name strategy
+func SubjectForTopic(topic string) string {
+	return topic + "-value"
+}
+
+// RegistryError is a non-2xx response from a Confluent compatible schema registry
+type RegistryError struct {
+	StatusCode int
+	ErrorCode  int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("schema registry returned %d (%d): %s", e.StatusCode, e.ErrorCode, e.Message)
+}
+
+// Registry error codes signalling a missing subject, version or schema
+const (
+	registrySubjectNotFound = 40401
+	registryVersionNotFound = 40402
+	registrySchemaNotFound  = 40403
+)
+
+// RegistryClient talks to a Confluent compatible schema registry over HTTP
+type RegistryClient struct {
+	BaseURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// NewRegistryClient creates a client for the registry at baseURL
+func NewRegistryClient(baseURL string) *RegistryClient {
+	return &RegistryClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// registrySchema is the JSON shape of a schema in registry requests and responses
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// newRegistrySchema converts a schema to its request shape; AVRO is the registry default and is omitted
+func newRegistrySchema(schema Schema) registrySchema {
+	rs := registrySchema{Schema: schema.Definition}
+	if schema.Type != SchemaTypeAvro {
+		rs.SchemaType = schema.Type
+	}
+	return rs
+}
+
+// Register adds the schema to the subject
+func (c *RegistryClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	var out struct {
+		ID int `json:"id"`
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := c.do(ctx, http.MethodPost, path, newRegistrySchema(schema), &out); err != nil {
+		return 0, fmt.Errorf("failed to register schema for subject %s: %w", subject, err)
+	}
+	return out.ID, nil
+}
+
+// SchemaByID fetches the schema with the given ID
+func (c *RegistryClient) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	var out registrySchema
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &out); err != nil {
+		var regErr *RegistryError
+		if errors.As(err, &regErr) && regErr.ErrorCode == registrySchemaNotFound {
+			return Schema{}, fmt.Errorf("%w: %d", ErrSchemaNotFound, id)
+		}
+		return Schema{}, fmt.Errorf("failed to fetch schema %d: %w", id, err)
+	}
+
+	schema := Schema{Type: out.SchemaType, Definition: out.Schema}
+	if schema.Type == "" {
+		schema.Type = SchemaTypeAvro
+	}
+	return schema, nil
+}
+
+// CheckCompatibility tests the schema against the subject's latest version; a new subject is always compatible
+func (c *RegistryClient) CheckCompatibility(ctx context.Context, subject string, schema Schema) error {
+	var out struct {
+		IsCompatible bool     `json:"is_compatible"`
+		Messages     []string `json:"messages"`
+	}
+	path := "/compatibility/subjects/" + url.PathEscape(subject) + "/versions/latest?verbose=true"
+	if err := c.do(ctx, http.MethodPost, path, newRegistrySchema(schema), &out); err != nil {
+		var regErr *RegistryError
+		if errors.As(err, &regErr) && (regErr.ErrorCode == registrySubjectNotFound || regErr.ErrorCode == registryVersionNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to check compatibility for subject %s: %w", subject, err)
+	}
+
+	if !out.IsCompatible {
+		return fmt.Errorf("%w: %s", ErrIncompatibleSchema, strings.Join(out.Messages, "; "))
+	}
+	return nil
+}
+
+// do sends a registry request and decodes the JSON response into out
+func (c *RegistryClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		regErr := &RegistryError{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, regErr) != nil || regErr.Message == "" {
+			regErr.Message = string(data)
+		}
+		return regErr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// CachedRegistry keeps registered IDs and fetched schemas in memory so they are resolved once per process
+type CachedRegistry struct {
+	registry SchemaRegistry
+
+	mu   sync.RWMutex
+	byID map[int]Schema
+	ids  map[string]int
+}
+
+// NewCachedRegistry wraps a registry with a local schema cache
+func NewCachedRegistry(registry SchemaRegistry) *CachedRegistry {
+	return &CachedRegistry{
+		registry: registry,
+		byID:     make(map[int]Schema),
+		ids:      make(map[string]int),
+	}
+}
+
+// Register returns the cached ID of the schema or registers it
+func (c *CachedRegistry) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	key := subject + "\x00" + schema.Type + "\x00" + schema.Definition
+
+	c.mu.RLock()
+	id, ok := c.ids[key]
+	c.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := c.registry.Register(ctx, subject, schema)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.ids[key] = id
+	c.byID[id] = schema
+	c.mu.Unlock()
+	return id, nil
+}
+
+// SchemaByID returns the cached schema or fetches it
+func (c *CachedRegistry) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	c.mu.RLock()
+	schema, ok := c.byID[id]
+	c.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := c.registry.SchemaByID(ctx, id)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	c.mu.Lock()
+	c.byID[id] = schema
+	c.mu.Unlock()
+	return schema, nil
+}
+
+// CheckCompatibility always asks the underlying registry since the latest version may have changed
+func (c *CachedRegistry) CheckCompatibility(ctx context.Context, subject string, schema Schema) error {
+	return c.registry.CheckCompatibility(ctx, subject, schema)
+}
+
+// MemoryRegistry is an in-process registry enforcing backward compatibility.
+// It stands in for a real registry in local development and tests.
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	schemas  []Schema
+	subjects map[string][]int
+}
+
+// NewMemoryRegistry creates an empty in-process registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{subjects: make(map[string][]int)}
+}
+
+// Register adds the schema as the subject's next version if it is backward compatible
+func (m *MemoryRegistry) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := 0
+	for i, existing := range m.schemas {
+		if existing == schema {
+			id = i + 1
+			break
+		}
+	}
+
+	versions := m.subjects[subject]
+	for _, version := range versions {
+		if version == id {
+			return id, nil
+		}
+	}
+
+	if len(versions) > 0 {
+		latest := m.schemas[versions[len(versions)-1]-1]
+		if err := checkBackwardCompatible(latest, schema); err != nil {
+			return 0, err
+		}
+	}
+
+	if id == 0 {
+		m.schemas = append(m.schemas, schema)
+		id = len(m.schemas)
+	}
+	m.subjects[subject] = append(versions, id)
+	return id, nil
+}
+
+// SchemaByID returns the schema with the given ID
+func (m *MemoryRegistry) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id < 1 || id > len(m.schemas) {
+		return Schema{}, fmt.Errorf("%w: %d", ErrSchemaNotFound, id)
+	}
+	return m.schemas[id-1], nil
+}
+
+// CheckCompatibility tests the schema against the subject's latest version
+func (m *MemoryRegistry) CheckCompatibility(ctx context.Context, subject string, schema Schema) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := m.subjects[subject]
+	if len(versions) == 0 {
+		return nil
+	}
+	return checkBackwardCompatible(m.schemas[versions[len(versions)-1]-1], schema)
+}
+
+// checkBackwardCompatible reports whether consumers using next can read data written with prev
+func checkBackwardCompatible(prev, next Schema) error {
+	if prev.Type != next.Type {
+		return fmt.Errorf("%w: schema type changed from %s to %s", ErrIncompatibleSchema, prev.Type, next.Type)
+	}
+
+	switch next.Type {
+	case SchemaTypeProtobuf:
+		return checkProtobufCompatible(prev.Definition, next.Definition)
+	case SchemaTypeAvro:
+		return checkAvroCompatible(prev.Definition, next.Definition)
+	default:
+		return fmt.Errorf("unsupported schema type %s", next.Type)
+	}
+}
+
+var (
+	protoMessagePattern = regexp.MustCompile(`^\s*message\s+(\w+)\s*\{`)
+	protoFieldPattern   = regexp.MustCompile(`^\s*(repeated\s+|optional\s+)?([\w.]+)\s+(\w+)\s*=\s*(\d+)`)
+)
+
+// checkProtobufCompatible rejects field numbers whose type or cardinality changed between definitions
+func checkProtobufCompatible(prev, next string) error {
+	prevFields := protobufFields(prev)
+	for key, field := range protobufFields(next) {
+		if old, ok := prevFields[key]; ok && old != field {
+			return fmt.Errorf("%w: field %s changed from %q to %q", ErrIncompatibleSchema, key, old, field)
+		}
+	}
+	return nil
+}
+
+// protobufFields maps "Message.number" to the field's label and type for every field of the definition
+func protobufFields(definition string) map[string]string {
+	fields := make(map[string]string)
+	var messages []string
+
+	scanner := bufio.NewScanner(strings.NewReader(definition))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := protoMessagePattern.FindStringSubmatch(line); m != nil {
+			messages = append(messages, m[1])
+			continue
+		}
+		if m := protoFieldPattern.FindStringSubmatch(line); m != nil && len(messages) > 0 {
+			key := strings.Join(messages, ".") + "." + m[4]
+			fields[key] = strings.TrimSpace(m[1] + m[2])
+			continue
+		}
+		if strings.TrimSpace(line) == "}" && len(messages) > 0 {
+			messages = messages[:len(messages)-1]
+		}
+	}
+	return fields
+}
+
+// avroField is a record field of an Avro schema
+type avroField struct {
+	Name    string          `json:"name"`
+	Type    json.RawMessage `json:"type"`
+	Default json.RawMessage `json:"default"`
+}
+
+// checkAvroCompatible requires fields added to a record to carry a default and primitive field types to stay the same
+func checkAvroCompatible(prev, next string) error {
+	prevRecords, err := avroRecords(prev)
+	if err != nil {
+		return err
+	}
+	nextRecords, err := avroRecords(next)
+	if err != nil {
+		return err
+	}
+
+	for name, fields := range nextRecords {
+		oldFields, ok := prevRecords[name]
+		if !ok {
+			continue
+		}
+		for _, field := range fields {
+			old, ok := oldFields[field.Name]
+			if !ok {
+				if field.Default == nil {
+					return fmt.Errorf("%w: field %s.%s was added without a default", ErrIncompatibleSchema, name, field.Name)
+				}
+				continue
+			}
+			if isAvroPrimitive(old.Type) && isAvroPrimitive(field.Type) && !bytes.Equal(old.Type, field.Type) {
+				return fmt.Errorf("%w: field %s.%s changed type from %s to %s", ErrIncompatibleSchema, name, field.Name, old.Type, field.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// avroRecords indexes the fields of every named record in an Avro schema
+func avroRecords(definition string) (map[string]map[string]avroField, error) {
+	var root interface{}
+	if err := json.Unmarshal([]byte(definition), &root); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+
+	records := make(map[string]map[string]avroField)
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case []interface{}:
+			for _, branch := range n {
+				walk(branch)
+			}
+		case map[string]interface{}:
+			if n["type"] == "record" {
+				name, _ := n["name"].(string)
+				rawFields, _ := json.Marshal(n["fields"])
+				var fields []avroField
+				json.Unmarshal(rawFields, &fields)
+
+				indexed := make(map[string]avroField, len(fields))
+				for _, field := range fields {
+					indexed[field.Name] = field
+				}
+				records[name] = indexed
+
+				if list, ok := n["fields"].([]interface{}); ok {
+					for _, field := range list {
+						if f, ok := field.(map[string]interface{}); ok {
+							walk(f["type"])
+						}
+					}
+				}
+				return
+			}
+			walk(n["items"])
+			walk(n["values"])
+		}
+	}
+	walk(root)
+	return records, nil
+}
+
+// isAvroPrimitive reports whether a field type is a bare type name such as "string"
+func isAvroPrimitive(t json.RawMessage) bool {
+	return len(t) > 0 && t[0] == '"'
+}
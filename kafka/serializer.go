@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Content types of payloads framed with the schema registry wire format
+const (
+	ContentTypeRegistryAvro     = "application/vnd.confluent.avro"
+	ContentTypeRegistryProtobuf = "application/vnd.confluent.protobuf"
+)
+
+// ErrUnreadableSchema is returned for payloads written with a schema other than the codec's, whose
+// field layout the codec cannot decode. A consumer built with a newer codec may read them, so they
+// are retried rather than dead-lettered.
+var ErrUnreadableSchema = errors.New("payload schema cannot be read by the codec")
+
+// confluentMagicByte starts every payload in the schema registry wire format
+const confluentMagicByte = 0
+
+// confluentHeaderSize is the magic byte followed by the big endian schema ID
+const confluentHeaderSize = 5
+
+// SchemaCodec is an order event codec with a schema that can be registered
+type SchemaCodec interface {
+	OrderEventCodec
+	Schema() Schema
+}
+
+// RegistrySerializer frames payloads of a SchemaCodec with the magic byte and schema ID
+// of the Confluent wire format, so producers and consumers agree on the schema version.
+type RegistrySerializer struct {
+	registry SchemaRegistry
+	codec    SchemaCodec
+	schemaID int
+}
+
+// NewRegistrySerializer checks the codec's schema against the subject's latest version and registers it.
+// Producers call it at startup so an incompatible schema fails fast instead of breaking consumers.
+func NewRegistrySerializer(ctx context.Context, registry SchemaRegistry, subject string, codec SchemaCodec) (*RegistrySerializer, error) {
+	schema := codec.Schema()
+	if err := registry.CheckCompatibility(ctx, subject, schema); err != nil {
+		return nil, fmt.Errorf("schema for subject %s rejected: %w", subject, err)
+	}
+
+	id, err := registry.Register(ctx, subject, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegistrySerializer{registry: registry, codec: codec, schemaID: id}, nil
+}
+
+// SchemaID returns the registry ID of the schema payloads are written with
+func (s *RegistrySerializer) SchemaID() int {
+	return s.schemaID
+}
+
+// ContentType identifies registry framed payloads of the codec's schema type
+func (s *RegistrySerializer) ContentType() string {
+	if s.codec.Schema().Type == SchemaTypeProtobuf {
+		return ContentTypeRegistryProtobuf
+	}
+	return ContentTypeRegistryAvro
+}
+
+// Encode writes the wire format header followed by the codec's payload
+func (s *RegistrySerializer) Encode(event *OrderEvent) ([]byte, error) {
+	payload, err := s.codec.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, confluentHeaderSize, confluentHeaderSize+1+len(payload))
+	b[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(b[1:], uint32(s.schemaID))
+	if s.codec.Schema().Type == SchemaTypeProtobuf {
+		// Message indexes [0], i.e. the first message of the file, are written as a single zero
+		b = append(b, 0)
+	}
+	return append(b, payload...), nil
+}
+
+// Decode decodes the payload without a deadline on the schema lookup; consumers use DecodeContext
+func (s *RegistrySerializer) Decode(data []byte) (*OrderEvent, error) {
+	return s.DecodeContext(context.Background(), data)
+}
+
+// DecodeContext resolves the schema ID through the registry and decodes the payload with the codec.
+// Protobuf payloads of another schema are decoded when every field the two schemas share keeps its
+// type, since fields are matched by number and unknown ones skipped. The Avro codec reads a fixed
+// field layout, so Avro payloads of any schema but the codec's own fail with ErrUnreadableSchema.
+// Lookups failing for any reason but a missing schema are wrapped in ErrRegistryUnavailable.
+func (s *RegistrySerializer) DecodeContext(ctx context.Context, data []byte) (*OrderEvent, error) {
+	if len(data) < confluentHeaderSize || data[0] != confluentMagicByte {
+		return nil, fmt.Errorf("payload is not in schema registry wire format")
+	}
+
+	readable := s.codec.Schema()
+	id := int(binary.BigEndian.Uint32(data[1:confluentHeaderSize]))
+	if id != s.schemaID {
+		schema, err := s.registry.SchemaByID(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrSchemaNotFound) || ctx.Err() != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %w", ErrRegistryUnavailable, err)
+		}
+		if schema.Type != readable.Type {
+			return nil, fmt.Errorf("schema %d is %s, expected %s", id, schema.Type, readable.Type)
+		}
+		if !readableWith(schema, readable) {
+			return nil, fmt.Errorf("%w: schema %d, codec reads schema %d", ErrUnreadableSchema, id, s.schemaID)
+		}
+	}
+
+	payload := data[confluentHeaderSize:]
+	if readable.Type == SchemaTypeProtobuf {
+		var err error
+		if payload, err = skipMessageIndexes(payload); err != nil {
+			return nil, err
+		}
+	}
+	return s.codec.Decode(payload)
+}
+
+// readableWith reports whether a codec reading the reader schema can decode payloads of the writer schema
+func readableWith(writer, reader Schema) bool {
+	if writer.Definition == reader.Definition {
+		return true
+	}
+	return reader.Type == SchemaTypeProtobuf && checkProtobufCompatible(writer.Definition, reader.Definition) == nil
+}
+
+// skipMessageIndexes consumes the zig-zag encoded message index path, which must point at OrderEvent
+func skipMessageIndexes(data []byte) ([]byte, error) {
+	count, n := protowire.ConsumeVarint(data)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	data = data[n:]
+
+	for i := int64(0); i < protowire.DecodeZigZag(count); i++ {
+		index, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		if protowire.DecodeZigZag(index) != 0 {
+			return nil, fmt.Errorf("payload references message index %d, expected OrderEvent", protowire.DecodeZigZag(index))
+		}
+		data = data[n:]
+	}
+	return data, nil
+}
@@ -0,0 +1,286 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOrderEvent returns a complete event with millisecond timestamps, which every codec preserves
+func testOrderEvent(t *testing.T) *OrderEvent {
+	t.Helper()
+	event, err := NewOrderEvent(OrderCreated, "example.myshopify.com", "order-1")
+	if err != nil {
+		t.Fatalf("NewOrderEvent: %v", err)
+	}
+	event.OccurredAt = time.UnixMilli(1700000000123).UTC()
+	event.PublishedAt = time.UnixMilli(1700000000456).UTC()
+	event.Currency = "EUR"
+	event.Subtotal = 2500
+	event.Discount = 250
+	event.Shipping = 500
+	event.Tax = 475
+	event.Total = 3225
+	event.LineItems = []OrderLineItem{
+		{VariantID: "v1", SKU: "SKU-1", Title: "Mug", Quantity: 2, UnitPrice: 750},
+		{VariantID: "v2", SKU: "SKU-2", Title: "Poster", Quantity: 1, UnitPrice: 1000},
+	}
+	return event
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []OrderEventCodec{JSONCodec{}, ProtobufCodec{}, AvroCodec{}}
+	for _, codec := range codecs {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			event := testOrderEvent(t)
+			data, err := codec.Encode(event)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			decoded, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, event) {
+				t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", decoded, event)
+			}
+		})
+	}
+}
+
+func TestRegistrySerializerRoundTrip(t *testing.T) {
+	tests := []struct {
+		codec       SchemaCodec
+		contentType string
+		// indexes is the Protobuf message index path written between the header and the payload
+		indexes []byte
+	}{
+		{codec: ProtobufCodec{}, contentType: ContentTypeRegistryProtobuf, indexes: []byte{0}},
+		{codec: AvroCodec{}, contentType: ContentTypeRegistryAvro},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			ctx := context.Background()
+			registry := NewMemoryRegistry()
+			// Register an unrelated schema first so the serializer's ID is not the default 1
+			if _, err := registry.Register(ctx, "other-value", Schema{Type: SchemaTypeAvro, Definition: `{"type":"string"}`}); err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+
+			serializer, err := NewRegistrySerializer(ctx, registry, SubjectForTopic("orders"), tt.codec)
+			if err != nil {
+				t.Fatalf("NewRegistrySerializer: %v", err)
+			}
+			if serializer.SchemaID() != 2 {
+				t.Fatalf("SchemaID = %d, want 2", serializer.SchemaID())
+			}
+			if serializer.ContentType() != tt.contentType {
+				t.Fatalf("ContentType = %s, want %s", serializer.ContentType(), tt.contentType)
+			}
+
+			event := testOrderEvent(t)
+			data, err := serializer.Encode(event)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			if data[0] != confluentMagicByte {
+				t.Fatalf("magic byte = %d, want %d", data[0], confluentMagicByte)
+			}
+			if id := binary.BigEndian.Uint32(data[1:confluentHeaderSize]); id != 2 {
+				t.Fatalf("framed schema ID = %d, want 2", id)
+			}
+			payload, err := tt.codec.Encode(event)
+			if err != nil {
+				t.Fatalf("codec Encode: %v", err)
+			}
+			want := append(append([]byte(nil), tt.indexes...), payload...)
+			if got := data[confluentHeaderSize:]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("framed payload = %x, want %x", got, want)
+			}
+
+			decoded, err := serializer.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, event) {
+				t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", decoded, event)
+			}
+		})
+	}
+}
+
+func TestRegistrySerializerDecodeRejectsBadFraming(t *testing.T) {
+	ctx := context.Background()
+	serializer, err := NewRegistrySerializer(ctx, NewMemoryRegistry(), SubjectForTopic("orders"), ProtobufCodec{})
+	if err != nil {
+		t.Fatalf("NewRegistrySerializer: %v", err)
+	}
+	data, err := serializer.Encode(testOrderEvent(t))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	badMagic := append([]byte(nil), data...)
+	badMagic[0] = 1
+	if _, err := serializer.Decode(badMagic); err == nil {
+		t.Fatal("Decode accepted a payload with the wrong magic byte")
+	}
+
+	if _, err := serializer.Decode(data[:confluentHeaderSize-1]); err == nil {
+		t.Fatal("Decode accepted a truncated header")
+	}
+
+	unknownID := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(unknownID[1:], 42)
+	if _, err := serializer.Decode(unknownID); !errors.Is(err, ErrSchemaNotFound) {
+		t.Fatalf("Decode with unknown schema ID = %v, want ErrSchemaNotFound", err)
+	}
+
+	// Message index path [1], zig-zag encoded, in place of the [0] written by Encode
+	otherIndex := append([]byte(nil), data[:confluentHeaderSize]...)
+	otherIndex = append(otherIndex, 2, 2)
+	otherIndex = append(otherIndex, data[confluentHeaderSize+1:]...)
+	if _, err := serializer.Decode(otherIndex); err == nil {
+		t.Fatal("Decode accepted a payload referencing another message")
+	}
+}
+
+func TestRegistrySerializerDecodesCompatibleProtobufVersions(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	subject := SubjectForTopic("orders")
+	serializer, err := NewRegistrySerializer(ctx, registry, subject, ProtobufCodec{})
+	if err != nil {
+		t.Fatalf("NewRegistrySerializer: %v", err)
+	}
+	event := testOrderEvent(t)
+	data, err := serializer.Encode(event)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// A newer compatible version adds a field the codec does not know about
+	newer := Schema{
+		Type:       SchemaTypeProtobuf,
+		Definition: strings.Replace(OrderEventProtoSchema, "int64 total = 9;", "int64 total = 9;\n  string note = 99;", 1),
+	}
+	newerID, err := registry.Register(ctx, subject, newer)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	framed := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(framed[1:], uint32(newerID))
+	decoded, err := serializer.DecodeContext(ctx, framed)
+	if err != nil {
+		t.Fatalf("Decode with schema %d: %v", newerID, err)
+	}
+	if !reflect.DeepEqual(decoded, event) {
+		t.Fatalf("decoded event differs:\n got %+v\nwant %+v", decoded, event)
+	}
+
+	// A schema changing the type of a field the codec reads cannot be decoded
+	changedID, err := registry.Register(ctx, SubjectForTopic("other"), changedProtobufCodec{}.Schema())
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	binary.BigEndian.PutUint32(framed[1:], uint32(changedID))
+	if _, err := serializer.DecodeContext(ctx, framed); !errors.Is(err, ErrUnreadableSchema) {
+		t.Fatalf("Decode with schema %d = %v, want ErrUnreadableSchema", changedID, err)
+	}
+}
+
+func TestRegistrySerializerDecodeRejectsOtherAvroVersions(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	subject := SubjectForTopic("orders")
+	serializer, err := NewRegistrySerializer(ctx, registry, subject, AvroCodec{})
+	if err != nil {
+		t.Fatalf("NewRegistrySerializer: %v", err)
+	}
+	data, err := serializer.Encode(testOrderEvent(t))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	newer := Schema{
+		Type:       SchemaTypeAvro,
+		Definition: strings.Replace(OrderEventAvroSchema, `{"name": "schema_version", "type": "int"},`, `{"name": "schema_version", "type": "int"}, {"name": "note", "type": "string", "default": ""},`, 1),
+	}
+	newerID, err := registry.Register(ctx, subject, newer)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	framed := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(framed[1:], uint32(newerID))
+	if _, err := serializer.DecodeContext(ctx, framed); !errors.Is(err, ErrUnreadableSchema) {
+		t.Fatalf("Decode with schema %d = %v, want ErrUnreadableSchema", newerID, err)
+	}
+}
+
+// unavailableRegistry fails every schema lookup like a registry that cannot be reached
+type unavailableRegistry struct {
+	*MemoryRegistry
+}
+
+func (unavailableRegistry) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	return Schema{}, errors.New("connection refused")
+}
+
+func TestRegistrySerializerMarksFailedLookupsUnavailable(t *testing.T) {
+	ctx := context.Background()
+	serializer, err := NewRegistrySerializer(ctx, unavailableRegistry{NewMemoryRegistry()}, SubjectForTopic("orders"), ProtobufCodec{})
+	if err != nil {
+		t.Fatalf("NewRegistrySerializer: %v", err)
+	}
+	data, err := serializer.Encode(testOrderEvent(t))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	binary.BigEndian.PutUint32(data[1:], uint32(serializer.SchemaID()+1))
+	if _, err := serializer.DecodeContext(ctx, data); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode during a registry outage = %v, want ErrRegistryUnavailable", err)
+	}
+}
+
+// changedProtobufCodec is ProtobufCodec with a schema that changes the type of an existing field
+type changedProtobufCodec struct {
+	ProtobufCodec
+}
+
+func (changedProtobufCodec) Schema() Schema {
+	definition := strings.Replace(OrderEventProtoSchema, "int64 total = 9;", "string total = 9;", 1)
+	return Schema{Type: SchemaTypeProtobuf, Definition: definition}
+}
+
+func TestNewRegistrySerializerRejectsIncompatibleSchema(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry()
+	subject := SubjectForTopic("orders")
+
+	if _, err := NewRegistrySerializer(ctx, registry, subject, ProtobufCodec{}); err != nil {
+		t.Fatalf("NewRegistrySerializer: %v", err)
+	}
+
+	_, err := NewRegistrySerializer(ctx, registry, subject, changedProtobufCodec{})
+	if !errors.Is(err, ErrIncompatibleSchema) {
+		t.Fatalf("NewRegistrySerializer with a changed field type = %v, want ErrIncompatibleSchema", err)
+	}
+
+	_, err = NewRegistrySerializer(ctx, registry, subject, AvroCodec{})
+	if !errors.Is(err, ErrIncompatibleSchema) {
+		t.Fatalf("NewRegistrySerializer with another schema type = %v, want ErrIncompatibleSchema", err)
+	}
+
+	if _, err := registry.SchemaByID(ctx, 2); !errors.Is(err, ErrSchemaNotFound) {
+		t.Fatalf("rejected schema was registered: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+
+	"cartloom/shopify"
+)
+
+// WebhookRetryTopic names the retry tiers of webhook events, which come from one topic per webhook topic
+const WebhookRetryTopic = "shopify.webhooks"
+
+// NewWebhookEventHandler applies Shopify webhook events to Redis, DynamoDB and the stock levels.
+// Events from shops that are not active in the registry are skipped. Failures are handed to the
+// retrier; payloads that cannot be decoded and unsupported topics are permanent failures.
+func NewWebhookEventHandler(rdb *redis.Client, db *dynamodb.Client, registry *shopify.ShopRegistry, stock shopify.StockLevels, retrier *Retrier) MessageHandler {
+	return func(ctx context.Context, msg kafka.Message) error {
+		topic := headerValue(msg, shopify.HeaderTopic)
+		shop := headerValue(msg, shopify.HeaderShopDomain)
+		log.Printf("Received webhook event: Topic=%s, Shop=%s, WebhookID=%s (attempt %d)", topic, shop, headerValue(msg, shopify.HeaderWebhookID), retryAttempt(msg)+1)
+
+		err := applyWebhookEvent(ctx, rdb, db, registry, stock, topic, shop, msg)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var payloadErr *shopify.PayloadError
+		if errors.As(err, &payloadErr) || errors.Is(err, shopify.ErrUnsupportedTopic) {
+			err = Permanent(err)
+		}
+		log.Printf("Failed to apply %s webhook for shop %s: %v", topic, shop, err)
+		return retrier.Fail(ctx, msg, err)
+	}
+}
+
+// applyWebhookEvent applies the event unless its shop is not active
+func applyWebhookEvent(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, registry *shopify.ShopRegistry, stock shopify.StockLevels, topic, shop string, msg kafka.Message) error {
+	if topic != shopify.TopicAppUninstalled {
+		active, err := activeShop(ctx, registry, shop)
+		if err != nil {
+			return fmt.Errorf("failed to resolve shop %s: %w", shop, err)
+		}
+		if !active {
+			log.Printf("Skipping %s webhook for inactive shop %s", topic, shop)
+			return nil
+		}
+	}
+	return shopify.ApplyWebhook(ctx, rdb, db, registry, stock, StatusChangedOutbox, topic, shop, msg.Value)
+}
+
+// activeShop reports whether the shop is installed according to the registry
+func activeShop(ctx context.Context, registry *shopify.ShopRegistry, domain string) (bool, error) {
+	shop, err := registry.Get(ctx, domain)
+	if err == shopify.ErrShopNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return shop.Active(), nil
+}
+
+// headerValue returns the value of the first message header with the given key
+func headerValue(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,543 @@
+package kafka
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"cartloom/shopify"
+
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/time/rate"
+)
+
+// HeaderShop carries the shop an event belongs to
+const HeaderShop = "shop"
+
+// MessageHandler processes a single message. A returned error is retried with backoff, holding
+// back the messages of the worker behind it, so handlers dead-letter messages they cannot process.
+type MessageHandler func(ctx context.Context, msg kafka.Message) error
+
+// ConsumerConfig tunes a WorkerPool
+type ConsumerConfig struct {
+	// Workers is the number of concurrent handlers, defaulting to the number of CPUs
+	Workers int
+	// QueueSize bounds the messages buffered per worker before fetching blocks, defaulting to 100
+	QueueSize int
+	// ShopRateLimit is the default messages per second per shop; zero disables rate limiting
+	ShopRateLimit rate.Limit
+	// ShopBurst is the burst allowed by every shop limiter, defaulting to 1
+	ShopBurst int
+	// ShopRateLimits overrides ShopRateLimit for individual shops
+	ShopRateLimits map[string]rate.Limit
+	// ShopOf extracts the shop of a message, defaulting to the shop headers
+	ShopOf func(msg kafka.Message) string
+}
+
+// withDefaults fills in unset fields
+func (c ConsumerConfig) withDefaults() ConsumerConfig {
+	if c.Workers <= 0 {
+		c.Workers = runtime.NumCPU()
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 100
+	}
+	if c.ShopBurst <= 0 {
+		c.ShopBurst = 1
+	}
+	if c.ShopOf == nil {
+		c.ShopOf = messageShop
+	}
+	return c
+}
+
+// messageShop reads the shop from the order event or webhook headers
+func messageShop(msg kafka.Message) string {
+	if shop := headerValue(msg, HeaderShop); shop != "" {
+		return shop
+	}
+	return headerValue(msg, shopify.HeaderShopDomain)
+}
+
+// WorkerPool consumes a reader with a fixed set of workers. Messages are dispatched by key hash
+// so messages with the same key are handled in order by the same worker, and offsets are
+// committed only once every earlier message of the partition has been handled. Messages of a
+// shop over its rate limit are held back before dispatch, so they never occupy a worker that
+// other shops' messages are queued on.
+type WorkerPool struct {
+	reader   *kafka.Reader
+	handler  MessageHandler
+	config   ConsumerConfig
+	limiters *shopLimiters
+	offsets  *offsetTracker
+}
+
+// NewWorkerPool creates a pool handling the reader's messages with handler
+func NewWorkerPool(reader *kafka.Reader, config ConsumerConfig, handler MessageHandler) *WorkerPool {
+	config = config.withDefaults()
+	return &WorkerPool{
+		reader:   reader,
+		handler:  handler,
+		config:   config,
+		limiters: newShopLimiters(config.ShopRateLimit, config.ShopBurst, config.ShopRateLimits),
+		offsets:  newOffsetTracker(),
+	}
+}
+
+// maxBackoffShift is the largest exponent of the backoff; 100ms << 9 already exceeds the 30s cap
+const maxBackoffShift = 9
+
+// backoffDelay returns the pause before the next attempt at a failed fetch or message, an
+// exponential backoff with full jitter capped at 30s
+func backoffDelay(attempt int) time.Duration {
+	if attempt > maxBackoffShift {
+		attempt = maxBackoffShift
+	}
+	ceiling := 100 * time.Millisecond << attempt
+	if ceiling > 30*time.Second {
+		ceiling = 30 * time.Second
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Run fetches and dispatches messages until the context is cancelled or the reader is closed.
+// Failed fetches and messages are retried with backoff rather than stopping the pool.
+func (p *WorkerPool) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	commits := make(chan kafka.Message, p.config.Workers*p.config.QueueSize)
+	queues := make([]chan kafka.Message, p.config.Workers)
+
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, p.config.QueueSize)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			p.work(ctx, queue, commits)
+		}(queues[i])
+	}
+
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		p.commit(ctx, commits)
+	}()
+
+	held := newThrottle(p.config.Workers * p.config.QueueSize)
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		held.run(ctx, func(msg kafka.Message) { p.enqueue(ctx, queues, msg) })
+	}()
+
+	var runErr error
+	for attempt := 0; ctx.Err() == nil; {
+		msg, err := p.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if errors.Is(err, io.EOF) {
+				// The reader was closed
+				runErr = err
+				cancel()
+				break
+			}
+			delay := backoffDelay(attempt)
+			log.Printf("Failed to fetch message, retrying in %s: %v", delay, err)
+			sleepContext(ctx, delay)
+			attempt++
+			continue
+		}
+		attempt = 0
+
+		p.offsets.track(msg)
+		consumerQueued.Inc()
+
+		shop := p.config.ShopOf(msg)
+		if !held.hold(ctx, shop, p.limiters.delay(shop), msg) {
+			p.enqueue(ctx, queues, msg)
+		}
+	}
+
+	<-released
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(commits)
+	<-committed
+
+	if runErr != nil {
+		return runErr
+	}
+	return ctx.Err()
+}
+
+// enqueue hands the message to its worker. Sending blocks while the worker's queue is full, which
+// stops dispatching until it catches up.
+func (p *WorkerPool) enqueue(ctx context.Context, queues []chan kafka.Message, msg kafka.Message) {
+	select {
+	case queues[p.workerFor(msg)] <- msg:
+	case <-ctx.Done():
+		consumerQueued.Dec()
+	}
+}
+
+// workerFor hashes the message key, or the partition for unkeyed messages, onto a worker
+func (p *WorkerPool) workerFor(msg kafka.Message) int {
+	h := fnv.New32a()
+	if len(msg.Key) > 0 {
+		h.Write(msg.Key)
+	} else {
+		fmt.Fprintf(h, "%s/%d", msg.Topic, msg.Partition)
+	}
+	return int(h.Sum32() % uint32(p.config.Workers))
+}
+
+// work handles queued messages, passing the offsets that became safe to commit to the committer
+func (p *WorkerPool) work(ctx context.Context, queue <-chan kafka.Message, commits chan<- kafka.Message) {
+	for msg := range queue {
+		handled := ctx.Err() == nil && p.handle(ctx, msg)
+		consumerQueued.Dec()
+		if !handled {
+			continue
+		}
+
+		if next, ok := p.offsets.complete(msg); ok {
+			commits <- next
+		}
+	}
+}
+
+// handle calls the handler until it succeeds, backing off between attempts, and reports whether
+// it did before the pool stopped. A failure, such as a retry or DLQ publish during a Kafka
+// outage, holds up the worker until it clears instead of losing or reordering the message.
+func (p *WorkerPool) handle(ctx context.Context, msg kafka.Message) bool {
+	for attempt := 0; ; attempt++ {
+		err := p.handler(ctx, msg)
+		if err == nil {
+			consumerMessages.WithLabelValues("handled").Inc()
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		consumerMessages.WithLabelValues("failed").Inc()
+		delay := backoffDelay(attempt)
+		log.Printf("Failed to handle message %s/%d@%d, retrying in %s: %v", msg.Topic, msg.Partition, msg.Offset, delay, err)
+		if sleepContext(ctx, delay) != nil {
+			return false
+		}
+	}
+}
+
+// commit commits completed offsets one at a time, skipping any that an earlier commit already
+// covered. A failed commit is only logged: the next commit of the partition covers it, and
+// without one the messages are redelivered, which handlers already tolerate.
+func (p *WorkerPool) commit(ctx context.Context, commits <-chan kafka.Message) {
+	committed := make(map[partitionKey]int64)
+	for msg := range commits {
+		key := partitionKey{msg.Topic, msg.Partition}
+		if last, ok := committed[key]; ok && msg.Offset <= last {
+			continue
+		}
+
+		// Commits of handled messages go through even while shutting down
+		if err := p.reader.CommitMessages(context.WithoutCancel(ctx), msg); err != nil {
+			log.Printf("Failed to commit offset %d of %s/%d: %v", msg.Offset, msg.Topic, msg.Partition, err)
+			continue
+		}
+		committed[key] = msg.Offset
+	}
+}
+
+// partitionKey identifies a topic partition
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// offsetTracker records fetched offsets per partition and finds the highest offset whose
+// predecessors have all been handled, which is the only offset that is safe to commit
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+// partitionOffsets holds the in-flight offsets of one partition in fetch order
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]kafka.Message
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+// track registers a fetched message. An offset at or below the last tracked one means the
+// partition was rewound by a rebalance, so earlier in-flight state is discarded.
+func (t *offsetTracker) track(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := partitionKey{msg.Topic, msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok || (len(p.pending) > 0 && msg.Offset <= p.pending[len(p.pending)-1]) {
+		p = &partitionOffsets{done: make(map[int64]kafka.Message)}
+		t.partitions[key] = p
+	}
+	p.pending = append(p.pending, msg.Offset)
+}
+
+// complete marks the message handled and returns the message to commit, if the
+// partition's lowest in-flight offsets are now all handled
+func (t *offsetTracker) complete(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partitionKey{msg.Topic, msg.Partition}]
+	if !ok {
+		return kafka.Message{}, false
+	}
+	p.done[msg.Offset] = msg
+
+	var next kafka.Message
+	advanced := false
+	for len(p.pending) > 0 {
+		m, ok := p.done[p.pending[0]]
+		if !ok {
+			break
+		}
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+		next, advanced = m, true
+	}
+	return next, advanced
+}
+
+// shopLimiters lazily creates a rate limiter per shop
+type shopLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	overrides map[string]rate.Limit
+	limiters  map[string]*rate.Limiter
+}
+
+func newShopLimiters(limit rate.Limit, burst int, overrides map[string]rate.Limit) *shopLimiters {
+	return &shopLimiters{
+		limit:     limit,
+		burst:     burst,
+		overrides: overrides,
+		limiters:  make(map[string]*rate.Limiter),
+	}
+}
+
+// delay takes the shop's next turn and returns how long the message has to wait for it
+func (s *shopLimiters) delay(shop string) time.Duration {
+	limiter := s.limiter(shop)
+	if limiter == nil {
+		return 0
+	}
+	reservation := limiter.Reserve()
+	if !reservation.OK() {
+		return 0
+	}
+
+	delay := reservation.Delay()
+	if delay > 0 {
+		// Shops are unbounded, so the metric is not labelled by shop and the waiting shop is logged instead
+		consumerRateLimitWaits.Inc()
+		log.Printf("Rate limit reached for shop %s, delaying message by %s", shop, delay)
+	}
+	return delay
+}
+
+// limiter returns the shop's limiter, or nil if the shop is not rate limited
+func (s *shopLimiters) limiter(shop string) *rate.Limiter {
+	limit, ok := s.overrides[shop]
+	if !ok {
+		limit = s.limit
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limiter, ok := s.limiters[shop]
+	if !ok {
+		limiter = rate.NewLimiter(limit, s.burst)
+		s.limiters[shop] = limiter
+	}
+	return limiter
+}
+
+// heldMessage is a message waiting for its shop's turn
+type heldMessage struct {
+	msg  kafka.Message
+	shop string
+	due  time.Time
+	seq  int64
+}
+
+// heldMessages orders held messages by due time, then by fetch order
+type heldMessages []heldMessage
+
+func (h heldMessages) Len() int { return len(h) }
+func (h heldMessages) Less(i, j int) bool {
+	if !h[i].due.Equal(h[j].due) {
+		return h[i].due.Before(h[j].due)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h heldMessages) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *heldMessages) Push(x interface{}) { *h = append(*h, x.(heldMessage)) }
+func (h *heldMessages) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// throttle holds the messages of rate limited shops until they are due and then releases them in
+// order. A shop with messages held has all its messages held, each due no earlier than the one
+// before, so every shop's messages are released in the order they were fetched. slots bounds the
+// messages held, which stops fetching once a throttled backlog fills it.
+type throttle struct {
+	mu      sync.Mutex
+	held    heldMessages
+	pending map[string]int
+	last    map[string]time.Time
+	seq     int64
+	slots   chan struct{}
+	wake    chan struct{}
+}
+
+func newThrottle(size int) *throttle {
+	return &throttle{
+		pending: make(map[string]int),
+		last:    make(map[string]time.Time),
+		slots:   make(chan struct{}, size),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// hold keeps the message until the delay is over, or reports false when it can be dispatched
+// right away because it is not delayed and no earlier message of the shop is held
+func (t *throttle) hold(ctx context.Context, shop string, delay time.Duration, msg kafka.Message) bool {
+	t.mu.Lock()
+	if delay <= 0 && t.pending[shop] == 0 {
+		t.mu.Unlock()
+		return false
+	}
+	due := time.Now().Add(delay)
+	if last := t.last[shop]; due.Before(last) {
+		due = last
+	}
+	t.last[shop] = due
+	t.pending[shop]++
+	t.mu.Unlock()
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		t.release(shop)
+		consumerQueued.Dec()
+		return true
+	}
+
+	t.mu.Lock()
+	t.seq++
+	heap.Push(&t.held, heldMessage{msg: msg, shop: shop, due: due, seq: t.seq})
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// release marks a held message of the shop as dispatched
+func (t *throttle) release(shop string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[shop]--; t.pending[shop] <= 0 {
+		delete(t.pending, shop)
+		delete(t.last, shop)
+	}
+}
+
+// run passes held messages to dispatch as they become due until the context is done, when the
+// messages still held are dropped for redelivery
+func (t *throttle) run(ctx context.Context, dispatch func(kafka.Message)) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		wait := time.Hour
+		var due *heldMessage
+		if len(t.held) > 0 {
+			if wait = time.Until(t.held[0].due); wait <= 0 {
+				m := heap.Pop(&t.held).(heldMessage)
+				due = &m
+			}
+		}
+		t.mu.Unlock()
+
+		if due != nil {
+			dispatch(due.msg)
+			// The shop stays pending until the message is queued, so a later one cannot overtake it
+			t.release(due.shop)
+			<-t.slots
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			consumerQueued.Sub(float64(len(t.held)))
+			t.held = nil
+			t.mu.Unlock()
+			return
+		case <-t.wake:
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/time/rate"
+)
+
+func TestOffsetTrackerCommitsContiguousOffsets(t *testing.T) {
+	type step struct {
+		track     bool
+		partition int
+		offset    int64
+		// commit is the offset that becomes safe to commit, or -1 for none
+		commit int64
+	}
+	track := func(partition int, offset int64) step {
+		return step{track: true, partition: partition, offset: offset, commit: -1}
+	}
+	complete := func(partition int, offset int64, commit int64) step {
+		return step{partition: partition, offset: offset, commit: commit}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				track(0, 1), track(0, 2),
+				complete(0, 1, 1), complete(0, 2, 2),
+			},
+		},
+		{
+			name: "waits for the lowest offset",
+			steps: []step{
+				track(0, 1), track(0, 2), track(0, 3),
+				complete(0, 3, -1), complete(0, 2, -1), complete(0, 1, 3),
+			},
+		},
+		{
+			name: "stops at a gap",
+			steps: []step{
+				track(0, 1), track(0, 2), track(0, 3), track(0, 4),
+				complete(0, 1, 1), complete(0, 3, -1), complete(0, 4, -1), complete(0, 2, 4),
+			},
+		},
+		{
+			name: "non-consecutive offsets",
+			steps: []step{
+				track(0, 10), track(0, 15), track(0, 30),
+				complete(0, 15, -1), complete(0, 10, 15), complete(0, 30, 30),
+			},
+		},
+		{
+			name: "partitions are independent",
+			steps: []step{
+				track(0, 1), track(1, 1), track(0, 2),
+				complete(0, 2, -1), complete(1, 1, 1), complete(0, 1, 2),
+			},
+		},
+		{
+			name: "rewind discards earlier offsets",
+			steps: []step{
+				track(0, 5), track(0, 6), track(0, 3),
+				complete(0, 6, -1), complete(0, 3, 3),
+			},
+		},
+		{
+			name: "untracked partition",
+			steps: []step{
+				track(0, 1),
+				complete(1, 1, -1), complete(0, 1, 1),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker()
+			for i, s := range tt.steps {
+				msg := kafka.Message{Topic: "orders", Partition: s.partition, Offset: s.offset}
+				if s.track {
+					tracker.track(msg)
+					continue
+				}
+
+				next, ok := tracker.complete(msg)
+				switch {
+				case s.commit < 0 && ok:
+					t.Fatalf("step %d: completing %d/%d committed %d, want nothing", i, s.partition, s.offset, next.Offset)
+				case s.commit >= 0 && !ok:
+					t.Fatalf("step %d: completing %d/%d committed nothing, want %d", i, s.partition, s.offset, s.commit)
+				case ok && (next.Offset != s.commit || next.Partition != s.partition):
+					t.Fatalf("step %d: completing %d/%d committed %d/%d, want %d/%d",
+						i, s.partition, s.offset, next.Partition, next.Offset, s.partition, s.commit)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleReleasesShopsInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	held := newThrottle(10)
+	released := make(chan kafka.Message, 10)
+	go held.run(ctx, func(msg kafka.Message) { released <- msg })
+
+	msg := func(offset int64) kafka.Message { return kafka.Message{Topic: "orders", Offset: offset} }
+	if !held.hold(ctx, "slow", 50*time.Millisecond, msg(1)) {
+		t.Fatal("delayed message was not held")
+	}
+	// Not delayed, but behind a held message of the same shop
+	if !held.hold(ctx, "slow", 0, msg(2)) {
+		t.Fatal("message behind a held one was not held")
+	}
+	if held.hold(ctx, "fast", 0, msg(3)) {
+		t.Fatal("message of a shop within its rate limit was held")
+	}
+
+	for _, want := range []int64{1, 2} {
+		select {
+		case got := <-released:
+			if got.Offset != want {
+				t.Fatalf("released offset %d, want %d", got.Offset, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("offset %d was not released", want)
+		}
+	}
+	if held.hold(ctx, "slow", 0, msg(4)) {
+		t.Fatal("message was held after the shop's backlog was released")
+	}
+}
+
+func TestShopLimitersDelayOverLimit(t *testing.T) {
+	limiters := newShopLimiters(rate.Limit(10), 1, map[string]rate.Limit{"unlimited": 0})
+
+	if d := limiters.delay("shop"); d != 0 {
+		t.Fatalf("first message delayed by %s", d)
+	}
+	if d := limiters.delay("shop"); d <= 0 || d > 100*time.Millisecond {
+		t.Fatalf("second message delayed by %s, want up to 100ms", d)
+	}
+	if d := limiters.delay("other"); d != 0 {
+		t.Fatalf("other shop delayed by %s", d)
+	}
+	for i := 0; i < 5; i++ {
+		if d := limiters.delay("unlimited"); d != 0 {
+			t.Fatalf("unlimited shop delayed by %s", d)
+		}
+	}
+}
+
+func TestWorkerPoolRetriesFailedMessages(t *testing.T) {
+	calls := 0
+	pool := NewWorkerPool(nil, ConsumerConfig{}, func(ctx context.Context, msg kafka.Message) error {
+		calls++
+		if calls < 3 {
+			return errors.New("kafka unavailable")
+		}
+		return nil
+	})
+
+	if !pool.handle(context.Background(), kafka.Message{Topic: "orders"}) {
+		t.Fatal("message was not handled")
+	}
+	if calls != 3 {
+		t.Fatalf("handler called %d times, want 3", calls)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pool = NewWorkerPool(nil, ConsumerConfig{}, func(ctx context.Context, msg kafka.Message) error {
+		return errors.New("kafka unavailable")
+	})
+	if pool.handle(ctx, kafka.Message{Topic: "orders"}) {
+		t.Fatal("failing message reported handled")
+	}
+}
@@ -0,0 +1,370 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// Order is an order as stored in the orders table. Amounts are in minor units of Currency.
+// SourceUpdatedAt is set on orders mirrored from a storefront platform to when the platform last
+// changed them, so that stale copies are not written over newer ones. Fence is the fencing token
+// of the last distributed lock holder that wrote the order.
+type Order struct {
+	OrderID         string     `dynamodbav:"OrderID"`
+	Shop            string     `dynamodbav:"Shop,omitempty"`
+	Status          Status     `dynamodbav:"Status"`
+	Version         int64      `dynamodbav:"Version"`
+	CustomerID      string     `dynamodbav:"CustomerID,omitempty"`
+	Customer        *Customer  `dynamodbav:"Customer,omitempty"`
+	LineItems       []LineItem `dynamodbav:"LineItems"`
+	ShippingAddress *Address   `dynamodbav:"ShippingAddress,omitempty"`
+	BillingAddress  *Address   `dynamodbav:"BillingAddress,omitempty"`
+	Currency        string     `dynamodbav:"Currency"`
+	Subtotal        int64      `dynamodbav:"Subtotal"`
+	Discount        int64      `dynamodbav:"Discount"`
+	Shipping        int64      `dynamodbav:"Shipping"`
+	Tax             int64      `dynamodbav:"Tax"`
+	Total           int64      `dynamodbav:"Total"`
+	CreatedAt       time.Time  `dynamodbav:"CreatedAt"`
+	UpdatedAt       time.Time  `dynamodbav:"UpdatedAt"`
+	SourceUpdatedAt *time.Time `dynamodbav:"SourceUpdatedAt,omitempty"`
+	Fence           int64      `dynamodbav:"Fence,omitempty"`
+}
+
+// Customer is the buyer of an order
+type Customer struct {
+	ID        string `dynamodbav:"ID"`
+	Email     string `dynamodbav:"Email,omitempty"`
+	FirstName string `dynamodbav:"FirstName,omitempty"`
+	LastName  string `dynamodbav:"LastName,omitempty"`
+	Phone     string `dynamodbav:"Phone,omitempty"`
+}
+
+// Address is a shipping or billing address
+type Address struct {
+	FirstName    string `dynamodbav:"FirstName,omitempty"`
+	LastName     string `dynamodbav:"LastName,omitempty"`
+	Company      string `dynamodbav:"Company,omitempty"`
+	Address1     string `dynamodbav:"Address1,omitempty"`
+	Address2     string `dynamodbav:"Address2,omitempty"`
+	City         string `dynamodbav:"City,omitempty"`
+	Province     string `dynamodbav:"Province,omitempty"`
+	ProvinceCode string `dynamodbav:"ProvinceCode,omitempty"`
+	Country      string `dynamodbav:"Country,omitempty"`
+	CountryCode  string `dynamodbav:"CountryCode,omitempty"`
+	Zip          string `dynamodbav:"Zip,omitempty"`
+	Phone        string `dynamodbav:"Phone,omitempty"`
+}
+
+// LineItem is a purchased variant with its unit price at the time of the order
+type LineItem struct {
+	ProductID string `dynamodbav:"ProductID,omitempty"`
+	VariantID string `dynamodbav:"VariantID"`
+	SKU       string `dynamodbav:"SKU,omitempty"`
+	Title     string `dynamodbav:"Title"`
+	Quantity  int    `dynamodbav:"Quantity"`
+	UnitPrice int64  `dynamodbav:"UnitPrice"`
+}
+
+// protectedAttributes may only change through Put or Transition
+var protectedAttributes = map[string]bool{"OrderID": true, "Status": true, "Version": true, "CreatedAt": true, "Fence": true}
+
+// Repository reads and writes orders with optimistic locking on the Version attribute
+type Repository struct {
+	db    *dynamodb.Client
+	table string
+}
+
+// NewRepository creates a repository for the orders table
+func NewRepository(db *dynamodb.Client) *Repository {
+	return &Repository{db: db, table: OrdersTable}
+}
+
+// Get reads an order with a consistent read
+func (r *Repository) Get(ctx context.Context, orderID string) (*Order, error) {
+	out, err := r.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.table),
+		Key:            orderKey(orderID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order %s: %w", orderID, err)
+	}
+	if out.Item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	var o Order
+	if err := attributevalue.UnmarshalMap(out.Item, &o); err != nil {
+		return nil, fmt.Errorf("failed to decode order %s: %w", orderID, err)
+	}
+	return &o, nil
+}
+
+// Put writes the whole order. An order with version 0 is created, failing with ErrOrderExists if
+// the ID is taken; otherwise the stored order must still be at o.Version or ErrConcurrentUpdate is
+// returned. The stored fence must not be newer than o.Fence either, or ErrStaleFence is returned:
+// an order read with Get keeps its fence, and a lock holder sets its fencing token, so a holder
+// whose lock expired cannot overwrite what a later holder wrote. An existing order must keep its
+// stored status, which only changes through Transition so every change is recorded in the history
+// and outbox, or ErrStatusChange is returned. On success o carries its new version and timestamps.
+func (r *Repository) Put(ctx context.Context, o *Order) error {
+	stored := *o
+	stored.Version = o.Version + 1
+	stored.UpdatedAt = time.Now().UTC()
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = stored.UpdatedAt
+	}
+	if stored.Status == "" {
+		stored.Status = StatusPending
+	}
+
+	item, err := attributevalue.MarshalMapWithOptions(stored, cartdynamodb.EncodeTime)
+	if err != nil {
+		return fmt.Errorf("failed to encode order %s: %w", o.OrderID, err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item:      item,
+	}
+	if o.Version == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(OrderID)")
+	} else {
+		fence := cartdynamodb.Fence{Attribute: "Fence", Token: o.Fence}
+		input.ConditionExpression = aws.String("Version = :expected AND #status = :status AND (" + fence.Condition() + ")")
+		input.ExpressionAttributeNames = fence.Names()
+		input.ExpressionAttributeNames["#status"] = "Status"
+		input.ExpressionAttributeValues = fence.Values()
+		input.ExpressionAttributeValues[":expected"] = versionValue(o.Version)
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: string(stored.Status)}
+		input.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+	}
+
+	if _, err := r.db.PutItem(ctx, input); err != nil {
+		if staleFence(err, o.Fence) {
+			return fmt.Errorf("%w: %s", ErrStaleFence, o.OrderID)
+		}
+		if statusChanged(err, o.Version, stored.Status) {
+			return fmt.Errorf("%w: order %s", ErrStatusChange, o.OrderID)
+		}
+		return r.conditionError(err, o.OrderID, o.Version)
+	}
+
+	*o = stored
+	return nil
+}
+
+// ConditionalUpdate sets the given attributes if the order is still at expectedVersion, bumping
+// its version, and returns the updated order. Status changes go through Transition instead.
+func (r *Repository) ConditionalUpdate(ctx context.Context, orderID string, expectedVersion int64, changes map[string]interface{}) (*Order, error) {
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":expected": versionValue(expectedVersion),
+		":next":     versionValue(expectedVersion + 1),
+		":now":      cartdynamodb.TimeValue(time.Now()),
+	}
+	sets := []string{"Version = :next", "UpdatedAt = :now"}
+
+	// Sorted so the expression is deterministic
+	attributes := make([]string, 0, len(changes))
+	for attribute := range changes {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+
+	for i, attribute := range attributes {
+		if protectedAttributes[attribute] {
+			return nil, fmt.Errorf("attribute %s cannot be changed with ConditionalUpdate", attribute)
+		}
+		value, err := attributevalue.MarshalWithOptions(changes[attribute], cartdynamodb.EncodeTime)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s of order %s: %w", attribute, orderID, err)
+		}
+
+		name, placeholder := fmt.Sprintf("#a%d", i), fmt.Sprintf(":v%d", i)
+		names[name] = attribute
+		values[placeholder] = value
+		sets = append(sets, name+" = "+placeholder)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table),
+		Key:                       orderKey(orderID),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:       aws.String("Version = :expected"),
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+
+	out, err := r.db.UpdateItem(ctx, input)
+	if err != nil {
+		return nil, r.conditionError(err, orderID, expectedVersion)
+	}
+
+	var o Order
+	if err := attributevalue.UnmarshalMap(out.Attributes, &o); err != nil {
+		return nil, fmt.Errorf("failed to decode order %s: %w", orderID, err)
+	}
+	return &o, nil
+}
+
+// Filter selects orders by exactly one of shop, customer or status, optionally within a creation time range
+type Filter struct {
+	Shop       string
+	CustomerID string
+	Status     Status
+	// From and To bound CreatedAt; To is exclusive
+	From time.Time
+	To   time.Time
+	// Limit caps the orders per page
+	Limit int32
+	// Newest returns the most recently created orders first
+	Newest bool
+	// Cursor continues from the page that returned it
+	Cursor map[string]types.AttributeValue
+}
+
+// Page is a page of orders and the cursor of the next page, nil after the last page
+type Page struct {
+	Orders []Order
+	Cursor map[string]types.AttributeValue
+}
+
+// Query lists orders through the shop, customer or status index in creation order
+func (r *Repository) Query(ctx context.Context, f Filter) (*Page, error) {
+	index, attribute, value, err := f.index()
+	if err != nil {
+		return nil, err
+	}
+
+	condition := "#pk = :pk"
+	values := map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: value}}
+	switch {
+	case !f.From.IsZero() && !f.To.IsZero():
+		condition += " AND CreatedAt BETWEEN :from AND :to"
+	case !f.From.IsZero():
+		condition += " AND CreatedAt >= :from"
+	case !f.To.IsZero():
+		condition += " AND CreatedAt < :to"
+	}
+	if !f.From.IsZero() {
+		values[":from"] = cartdynamodb.TimeValue(f.From)
+	}
+	switch {
+	case !f.To.IsZero() && !f.From.IsZero():
+		// BETWEEN is inclusive, so the upper bound moves just before To
+		values[":to"] = cartdynamodb.TimeValue(f.To.Add(-time.Nanosecond))
+	case !f.To.IsZero():
+		values[":to"] = cartdynamodb.TimeValue(f.To)
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeNames:  map[string]string{"#pk": attribute},
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(!f.Newest),
+		ExclusiveStartKey:         f.Cursor,
+	}
+	if f.Limit > 0 {
+		input.Limit = aws.Int32(f.Limit)
+	}
+
+	out, err := r.db.Query(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders by %s: %w", attribute, err)
+	}
+
+	page := &Page{Cursor: out.LastEvaluatedKey}
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &page.Orders); err != nil {
+		return nil, fmt.Errorf("failed to decode orders: %w", err)
+	}
+	return page, nil
+}
+
+// index returns the index, partition attribute and value selected by the filter
+func (f Filter) index() (string, string, string, error) {
+	set := 0
+	var index, attribute, value string
+	if f.Shop != "" {
+		set++
+		index, attribute, value = cartdynamodb.OrdersByShopIndex, "Shop", f.Shop
+	}
+	if f.CustomerID != "" {
+		set++
+		index, attribute, value = cartdynamodb.OrdersByCustomerIndex, "CustomerID", f.CustomerID
+	}
+	if f.Status != "" {
+		set++
+		index, attribute, value = cartdynamodb.OrdersByStatusIndex, "Status", string(f.Status)
+	}
+	if set != 1 {
+		return "", "", "", fmt.Errorf("order filter needs exactly one of shop, customer or status")
+	}
+	return index, attribute, value, nil
+}
+
+// conditionError maps a failed version or existence condition to the package errors
+func (r *Repository) conditionError(err error, orderID string, version int64) error {
+	var failed *types.ConditionalCheckFailedException
+	if !errors.As(err, &failed) {
+		return fmt.Errorf("failed to write order %s: %w", orderID, err)
+	}
+	if version == 0 {
+		return fmt.Errorf("%w: %s", ErrOrderExists, orderID)
+	}
+	return fmt.Errorf("%w: %s at version %d", ErrConcurrentUpdate, orderID, version)
+}
+
+// staleFence reports whether a write was rejected because the stored order carries a newer fence
+func staleFence(err error, fence int64) bool {
+	var failed *types.ConditionalCheckFailedException
+	if !errors.As(err, &failed) {
+		return false
+	}
+	n, ok := failed.Item["Fence"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	stored, err := strconv.ParseInt(n.Value, 10, 64)
+	return err == nil && stored > fence
+}
+
+// statusChanged reports whether a write at the stored version was rejected because it would have
+// changed the stored status
+func statusChanged(err error, version int64, status Status) bool {
+	var failed *types.ConditionalCheckFailedException
+	if !errors.As(err, &failed) {
+		return false
+	}
+	var stored struct {
+		Status  Status `dynamodbav:"Status"`
+		Version int64  `dynamodbav:"Version"`
+	}
+	if failed.Item == nil || attributevalue.UnmarshalMap(failed.Item, &stored) != nil {
+		return false
+	}
+	return stored.Version == version && stored.Status != status
+}
+
+// orderKey returns the primary key of an order
+func orderKey(orderID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"OrderID": &types.AttributeValueMemberS{Value: orderID}}
+}
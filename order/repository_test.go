@@ -0,0 +1,341 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// newTestRepository creates a repository on a fresh orders table in the DynamoDB at
+// DYNAMODB_ENDPOINT, such as dynamodb-local. The test is skipped when it is unset.
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+	region := os.Getenv("DYNAMODB_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	db := dynamodb.New(dynamodb.Options{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}, cartdynamodb.WithEndpoint(endpoint))
+
+	ctx := context.Background()
+	table := fmt.Sprintf("OrdersTest-%d", time.Now().UnixNano())
+	if err := cartdynamodb.CreateTable(ctx, db, table); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	t.Cleanup(func() {
+		db.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	})
+
+	// Creating the table again, as every restart does, must leave it as is
+	if err := cartdynamodb.CreateTable(ctx, db, table); err != nil {
+		t.Fatalf("CreateTable on an existing table: %v", err)
+	}
+
+	return &Repository{db: db, table: table}
+}
+
+// testOrder returns a pending order of the shop and customer created at the given time
+func testOrder(id, shop, customerID string, createdAt time.Time) *Order {
+	return &Order{
+		OrderID:    id,
+		Shop:       shop,
+		Status:     StatusPending,
+		CustomerID: customerID,
+		LineItems:  []LineItem{{VariantID: "v1", SKU: "SKU-1", Title: "Mug", Quantity: 2, UnitPrice: 750}},
+		Currency:   "EUR",
+		Subtotal:   1500,
+		Total:      1500,
+		CreatedAt:  createdAt.UTC(),
+	}
+}
+
+func TestRepositoryPutAndGet(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	o := testOrder("o1", "shop-a", "c1", time.Now())
+	if err := repo.Put(ctx, o); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if o.Version != 1 {
+		t.Fatalf("version after create = %d, want 1", o.Version)
+	}
+
+	if err := repo.Put(ctx, testOrder("o1", "shop-a", "c1", time.Now())); !errors.Is(err, ErrOrderExists) {
+		t.Fatalf("Put of an existing ID = %v, want ErrOrderExists", err)
+	}
+
+	got, err := repo.Get(ctx, "o1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Shop != o.Shop || got.CustomerID != o.CustomerID || got.Total != o.Total || got.Version != 1 ||
+		!got.CreatedAt.Equal(o.CreatedAt) || !reflect.DeepEqual(got.LineItems, o.LineItems) {
+		t.Fatalf("Get = %+v, want %+v", got, o)
+	}
+
+	if _, err := repo.Get(ctx, "missing"); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("Get of a missing order = %v, want ErrOrderNotFound", err)
+	}
+
+	got.Total = 2000
+	if err := repo.Put(ctx, got); err != nil {
+		t.Fatalf("Put at the current version: %v", err)
+	}
+	if got.Version != 2 {
+		t.Fatalf("version after update = %d, want 2", got.Version)
+	}
+
+	// o is still at version 1
+	o.Total = 3000
+	if err := repo.Put(ctx, o); !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("Put at a stale version = %v, want ErrConcurrentUpdate", err)
+	}
+}
+
+func TestRepositoryConditionalUpdate(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	o := testOrder("o1", "shop-a", "c1", time.Now())
+	if err := repo.Put(ctx, o); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	updated, err := repo.ConditionalUpdate(ctx, "o1", 1, map[string]interface{}{
+		"Tax":             int64(300),
+		"ShippingAddress": &Address{City: "Berlin", CountryCode: "DE"},
+	})
+	if err != nil {
+		t.Fatalf("ConditionalUpdate: %v", err)
+	}
+	if updated.Version != 2 || updated.Tax != 300 || updated.ShippingAddress == nil || updated.ShippingAddress.City != "Berlin" {
+		t.Fatalf("ConditionalUpdate = %+v", updated)
+	}
+	if updated.Total != o.Total || updated.Shop != o.Shop {
+		t.Fatalf("ConditionalUpdate changed other attributes: %+v", updated)
+	}
+
+	if _, err := repo.ConditionalUpdate(ctx, "o1", 1, map[string]interface{}{"Tax": int64(0)}); !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("ConditionalUpdate at a stale version = %v, want ErrConcurrentUpdate", err)
+	}
+	if _, err := repo.ConditionalUpdate(ctx, "o1", 2, map[string]interface{}{"Status": StatusPaid}); err == nil {
+		t.Fatal("ConditionalUpdate changed the status")
+	}
+
+	got, err := repo.Get(ctx, "o1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Version != 2 || got.Tax != 300 || got.Status != StatusPending {
+		t.Fatalf("stored order = %+v", got)
+	}
+}
+
+// orderIDs returns the IDs of the orders in their order
+func orderIDs(orders []Order) []string {
+	ids := make([]string, 0, len(orders))
+	for _, o := range orders {
+		ids = append(ids, o.OrderID)
+	}
+	return ids
+}
+
+func TestRepositoryQueryIndexes(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	orders := []*Order{
+		testOrder("o1", "shop-a", "c1", start),
+		testOrder("o2", "shop-a", "c2", start.Add(time.Hour)),
+		testOrder("o3", "shop-b", "c1", start.Add(2*time.Hour)),
+		testOrder("o4", "shop-a", "c1", start.Add(3*time.Hour)),
+		testOrder("o5", "shop-b", "c2", start.Add(4*time.Hour)),
+	}
+	orders[1].Status = StatusPaid
+	orders[3].Status = StatusPaid
+	for _, o := range orders {
+		if err := repo.Put(ctx, o); err != nil {
+			t.Fatalf("Put %s: %v", o.OrderID, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"by shop", Filter{Shop: "shop-a"}, []string{"o1", "o2", "o4"}},
+		{"by shop newest first", Filter{Shop: "shop-a", Newest: true}, []string{"o4", "o2", "o1"}},
+		{"by customer", Filter{CustomerID: "c1"}, []string{"o1", "o3", "o4"}},
+		{"by status", Filter{Status: StatusPaid}, []string{"o2", "o4"}},
+		{"by status pending", Filter{Status: StatusPending}, []string{"o1", "o3", "o5"}},
+		{"from", Filter{Shop: "shop-b", From: start.Add(3 * time.Hour)}, []string{"o5"}},
+		{"before", Filter{CustomerID: "c2", To: start.Add(4 * time.Hour)}, []string{"o2"}},
+		{"between, to exclusive", Filter{Shop: "shop-a", From: start.Add(time.Hour), To: start.Add(3 * time.Hour)}, []string{"o2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := repo.Query(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if got := orderIDs(page.Orders); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Query = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		var got []string
+		filter := Filter{Shop: "shop-a", Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatalf("too many pages: %v", got)
+			}
+			page, err := repo.Query(ctx, filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			got = append(got, orderIDs(page.Orders)...)
+			if page.Cursor == nil {
+				break
+			}
+			filter.Cursor = page.Cursor
+		}
+		if want := []string{"o1", "o2", "o4"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("paged Query = %v, want %v", got, want)
+		}
+	})
+
+	if _, err := repo.Query(ctx, Filter{Shop: "shop-a", Status: StatusPaid}); err == nil {
+		t.Fatal("Query accepted a filter on two indexes")
+	}
+	if _, err := repo.Query(ctx, Filter{}); err == nil {
+		t.Fatal("Query accepted an empty filter")
+	}
+}
+
+func TestRepositoryQuerySubSecond(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	// Timestamps whose RFC3339Nano strings do not sort in time order
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	orders := []*Order{
+		testOrder("o1", "shop-a", "c1", start),
+		testOrder("o2", "shop-a", "c1", start.Add(500*time.Millisecond)),
+		testOrder("o3", "shop-a", "c1", start.Add(time.Second)),
+		testOrder("o4", "shop-a", "c1", start.Add(time.Second+250*time.Millisecond)),
+		testOrder("o5", "shop-a", "c1", start.Add(2*time.Second-time.Nanosecond)),
+	}
+	for _, o := range orders {
+		if err := repo.Put(ctx, o); err != nil {
+			t.Fatalf("Put %s: %v", o.OrderID, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"oldest first", Filter{Shop: "shop-a"}, []string{"o1", "o2", "o3", "o4", "o5"}},
+		{"newest first", Filter{Shop: "shop-a", Newest: true}, []string{"o5", "o4", "o3", "o2", "o1"}},
+		{"from a whole second", Filter{Shop: "shop-a", From: start.Add(time.Second)}, []string{"o3", "o4", "o5"}},
+		{"before a whole second", Filter{Shop: "shop-a", To: start.Add(time.Second)}, []string{"o1", "o2"}},
+		{"within a second", Filter{Shop: "shop-a", From: start.Add(time.Second), To: start.Add(2 * time.Second)}, []string{"o3", "o4", "o5"}},
+		{"sub-second bounds", Filter{Shop: "shop-a", From: start.Add(time.Millisecond), To: start.Add(time.Second + time.Nanosecond)}, []string{"o2", "o3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := repo.Query(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if got := orderIDs(page.Orders); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Query = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepositoryPutChecksFence(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	o := testOrder("o1", "shop-a", "c1", time.Now())
+	o.Fence = 5
+	if err := repo.Put(ctx, o); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// A read-modify-write without a lock keeps the fence
+	got, err := repo.Get(ctx, "o1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got.Total = 2000
+	if err := repo.Put(ctx, got); err != nil {
+		t.Fatalf("Put of a read order: %v", err)
+	}
+	if got, _ := repo.Get(ctx, "o1"); got.Fence != 5 {
+		t.Fatalf("fence after Put = %d, want 5", got.Fence)
+	}
+
+	// A holder of an older lock is rejected even at the current version
+	got.Fence = 4
+	if err := repo.Put(ctx, got); !errors.Is(err, ErrStaleFence) {
+		t.Fatalf("Put under an older lock = %v, want ErrStaleFence", err)
+	}
+	got.Fence = 6
+	if err := repo.Put(ctx, got); err != nil {
+		t.Fatalf("Put under a newer lock: %v", err)
+	}
+}
+
+func TestRepositoryPutKeepsStatus(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	if err := repo.Put(ctx, testOrder("o1", "shop-a", "c1", time.Now())); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	got, err := repo.Get(ctx, "o1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	got.Status = StatusPaid
+	if err := repo.Put(ctx, got); !errors.Is(err, ErrStatusChange) {
+		t.Fatalf("Put changing the status = %v, want ErrStatusChange", err)
+	}
+	if stored, _ := repo.Get(ctx, "o1"); stored.Status != StatusPending || stored.Version != got.Version {
+		t.Fatalf("stored order is %s at version %d, want unchanged", stored.Status, stored.Version)
+	}
+
+	got.Status = StatusPending
+	got.Total = 2000
+	if err := repo.Put(ctx, got); err != nil {
+		t.Fatalf("Put keeping the status: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package order
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Status is a state of the order lifecycle
+type Status string
+
+// Order lifecycle states
+const (
+	StatusPending            Status = "pending"
+	StatusAuthorized         Status = "authorized"
+	StatusPaid               Status = "paid"
+	StatusPartiallyFulfilled Status = "partially_fulfilled"
+	StatusFulfilled          Status = "fulfilled"
+	StatusCancelled          Status = "cancelled"
+	StatusRefunded           Status = "refunded"
+	StatusPartiallyRefunded  Status = "partially_refunded"
+)
+
+// transitions lists the states each state may move to
+var transitions = map[Status][]Status{
+	StatusPending:            {StatusAuthorized, StatusPaid, StatusCancelled},
+	StatusAuthorized:         {StatusPaid, StatusCancelled},
+	StatusPaid:               {StatusPartiallyFulfilled, StatusFulfilled, StatusPartiallyRefunded, StatusRefunded, StatusCancelled},
+	StatusPartiallyFulfilled: {StatusFulfilled, StatusPartiallyRefunded, StatusRefunded},
+	StatusFulfilled:          {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded:  {StatusRefunded},
+	StatusCancelled:          {StatusRefunded},
+	StatusRefunded:           {},
+}
+
+// Errors returned by order transitions
+var (
+	ErrOrderNotFound    = errors.New("order not found")
+	ErrOrderExists      = errors.New("order already exists")
+	ErrConcurrentUpdate = errors.New("order was modified concurrently")
+	ErrStaleFence       = errors.New("order was written under a later lock")
+	ErrStatusChange     = errors.New("order status can only change through a transition")
+)
+
+// TransitionError is returned for a transition the lifecycle does not allow
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order cannot move from %s to %s", e.From, e.To)
+}
+
+// Valid reports whether s is a known state
+func (s Status) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Terminal reports whether no transition leaves s
+func (s Status) Terminal() bool {
+	return s.Valid() && len(transitions[s]) == 0
+}
+
+// CanTransitionTo reports whether the lifecycle allows moving from s to next
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// PathTo returns the shortest sequence of transitions from s to next, ending with next. It is empty
+// when s is next and nil when the lifecycle does not lead from s to next.
+func (s Status) PathTo(next Status) []Status {
+	if s == next {
+		return []Status{}
+	}
+
+	previous := map[Status]Status{s: ""}
+	queue := []Status{s}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, to := range transitions[current] {
+			if _, seen := previous[to]; seen {
+				continue
+			}
+			previous[to] = current
+			if to != next {
+				queue = append(queue, to)
+				continue
+			}
+
+			var path []Status
+			for step := next; step != s; step = previous[step] {
+				path = append([]Status{step}, path...)
+			}
+			return path
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package order
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatusPathTo(t *testing.T) {
+	tests := []struct {
+		from, to Status
+		want     []Status
+	}{
+		{StatusPending, StatusPending, []Status{}},
+		{StatusPending, StatusPaid, []Status{StatusPaid}},
+		{StatusPending, StatusFulfilled, []Status{StatusPaid, StatusFulfilled}},
+		{StatusAuthorized, StatusRefunded, []Status{StatusPaid, StatusRefunded}},
+		{StatusPartiallyFulfilled, StatusRefunded, []Status{StatusRefunded}},
+		{StatusPaid, StatusPending, nil},
+		{StatusFulfilled, StatusCancelled, nil},
+		{StatusRefunded, StatusPaid, nil},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.PathTo(tt.to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s.PathTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// OrdersTable stores the current state of every order
+const OrdersTable = "Orders"
+
+// State is the status of an order together with its version, which increases with every transition
+type State struct {
+	OrderID string
+	Status  Status
+	Version int64
+}
+
+// HistoryEvent is a transition recorded in the order history table
+type HistoryEvent struct {
+	OrderID string
+	Version int64
+	From    Status
+	To      Status
+	Reason  string
+	At      time.Time
+}
+
+// Create inserts the order as pending at version 1 and records the creation in the history, in one
+// transaction with the given outbox records. It fails with ErrOrderExists if the order exists.
+func Create(ctx context.Context, db *dynamodb.Client, o *Order, reason string, outbox ...cartdynamodb.OutboxRecord) (State, error) {
+	stored := *o
+	stored.Status = StatusPending
+	stored.Version = 1
+	stored.UpdatedAt = time.Now().UTC()
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = stored.UpdatedAt
+	}
+
+	item, err := attributevalue.MarshalMapWithOptions(stored, cartdynamodb.EncodeTime)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to encode order %s: %w", o.OrderID, err)
+	}
+
+	put := types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:           aws.String(OrdersTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(OrderID)"),
+		},
+	}
+
+	history := historyItem(HistoryEvent{OrderID: o.OrderID, Version: 1, To: StatusPending, Reason: reason, At: stored.UpdatedAt})
+	if err := cartdynamodb.WriteWithOutbox(ctx, db, []types.TransactWriteItem{put, history}, outbox...); err != nil {
+		if conditionFailed(err) {
+			return State{}, fmt.Errorf("%w: %s", ErrOrderExists, o.OrderID)
+		}
+		return State{}, err
+	}
+
+	*o = stored
+	return State{OrderID: o.OrderID, Status: StatusPending, Version: 1}, nil
+}
+
+// Load reads the current status and version of an order with a consistent read
+func Load(ctx context.Context, db *dynamodb.Client, orderID string) (State, error) {
+	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(OrdersTable),
+		Key:                  map[string]types.AttributeValue{"OrderID": &types.AttributeValueMemberS{Value: orderID}},
+		ProjectionExpression: aws.String("OrderID, #status, Version"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return State{}, fmt.Errorf("failed to load order %s: %w", orderID, err)
+	}
+	if out.Item == nil {
+		return State{}, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	state := State{OrderID: orderID}
+	if s, ok := out.Item["Status"].(*types.AttributeValueMemberS); ok {
+		state.Status = Status(s.Value)
+	}
+	if n, ok := out.Item["Version"].(*types.AttributeValueMemberN); ok {
+		state.Version, _ = strconv.ParseInt(n.Value, 10, 64)
+	}
+	return state, nil
+}
+
+// Transition moves the order from current to next. The update is conditioned on the order still
+// being at current's status and version, and commits the history event and the outbox records in
+// the same transaction. It fails with a *TransitionError for transitions the lifecycle forbids and
+// with ErrConcurrentUpdate if the order changed since current was loaded.
+func Transition(ctx context.Context, db *dynamodb.Client, current State, next Status, reason string, outbox ...cartdynamodb.OutboxRecord) (State, error) {
+	if !current.Status.CanTransitionTo(next) {
+		return current, &TransitionError{From: current.Status, To: next}
+	}
+
+	now := time.Now().UTC()
+	version := current.Version + 1
+
+	update := types.TransactWriteItem{
+		Update: &types.Update{
+			TableName:           aws.String(OrdersTable),
+			Key:                 map[string]types.AttributeValue{"OrderID": &types.AttributeValueMemberS{Value: current.OrderID}},
+			UpdateExpression:    aws.String("SET #status = :next, Version = :version, UpdatedAt = :now"),
+			ConditionExpression: aws.String("#status = :current AND Version = :expected"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "Status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":next":     &types.AttributeValueMemberS{Value: string(next)},
+				":current":  &types.AttributeValueMemberS{Value: string(current.Status)},
+				":version":  versionValue(version),
+				":expected": versionValue(current.Version),
+				":now":      cartdynamodb.TimeValue(now),
+			},
+		},
+	}
+
+	history := historyItem(HistoryEvent{
+		OrderID: current.OrderID,
+		Version: version,
+		From:    current.Status,
+		To:      next,
+		Reason:  reason,
+		At:      now,
+	})
+
+	if err := cartdynamodb.WriteWithOutbox(ctx, db, []types.TransactWriteItem{update, history}, outbox...); err != nil {
+		if conditionFailed(err) {
+			return current, fmt.Errorf("%w: %s at version %d", ErrConcurrentUpdate, current.OrderID, current.Version)
+		}
+		return current, err
+	}
+	return State{OrderID: current.OrderID, Status: next, Version: version}, nil
+}
+
+// Advance loads the order and moves it to next. An order already at next, or one that moved past
+// next after reaching it earlier, is left unchanged, so redelivered and retried events are
+// harmless. outbox builds the records committed with the transition.
+func Advance(ctx context.Context, db *dynamodb.Client, orderID string, next Status, reason string, outbox func(State) ([]cartdynamodb.OutboxRecord, error)) (State, error) {
+	current, err := Load(ctx, db, orderID)
+	if err != nil {
+		return State{}, err
+	}
+	if current.Status == next {
+		return current, nil
+	}
+
+	if !current.Status.CanTransitionTo(next) {
+		reached, err := reachedBefore(ctx, db, orderID, next)
+		if err != nil {
+			return State{}, err
+		}
+		if reached {
+			return current, nil
+		}
+		return current, &TransitionError{From: current.Status, To: next}
+	}
+
+	var records []cartdynamodb.OutboxRecord
+	if outbox != nil {
+		if records, err = outbox(State{OrderID: orderID, Status: next, Version: current.Version + 1}); err != nil {
+			return State{}, err
+		}
+	}
+	return Transition(ctx, db, current, next, reason, records...)
+}
+
+// History returns the transitions of an order in version order
+func History(ctx context.Context, db *dynamodb.Client, orderID string) ([]HistoryEvent, error) {
+	var events []HistoryEvent
+	paginator := dynamodb.NewQueryPaginator(db, &dynamodb.QueryInput{
+		TableName:              aws.String(cartdynamodb.OrderHistoryTable),
+		KeyConditionExpression: aws.String("OrderID = :order"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":order": &types.AttributeValueMemberS{Value: orderID},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query history of order %s: %w", orderID, err)
+		}
+		for _, item := range page.Items {
+			events = append(events, historyEventFromItem(item))
+		}
+	}
+	return events, nil
+}
+
+// reachedBefore reports whether the history of the order records a transition to status
+func reachedBefore(ctx context.Context, db *dynamodb.Client, orderID string, status Status) (bool, error) {
+	events, err := History(ctx, db, orderID)
+	if err != nil {
+		return false, err
+	}
+	for _, event := range events {
+		if event.To == status {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// historyItem returns the write that records a transition; the version makes it unique per order
+func historyItem(event HistoryEvent) types.TransactWriteItem {
+	item := map[string]types.AttributeValue{
+		"OrderID": &types.AttributeValueMemberS{Value: event.OrderID},
+		"Version": versionValue(event.Version),
+		"To":      &types.AttributeValueMemberS{Value: string(event.To)},
+		"At":      cartdynamodb.TimeValue(event.At),
+	}
+	if event.From != "" {
+		item["From"] = &types.AttributeValueMemberS{Value: string(event.From)}
+	}
+	if event.Reason != "" {
+		item["Reason"] = &types.AttributeValueMemberS{Value: event.Reason}
+	}
+
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:           aws.String(cartdynamodb.OrderHistoryTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(OrderID)"),
+		},
+	}
+}
+
+// historyEventFromItem decodes a history item
+func historyEventFromItem(item map[string]types.AttributeValue) HistoryEvent {
+	str := func(name string) string {
+		if s, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return s.Value
+		}
+		return ""
+	}
+
+	event := HistoryEvent{
+		OrderID: str("OrderID"),
+		From:    Status(str("From")),
+		To:      Status(str("To")),
+		Reason:  str("Reason"),
+	}
+	if n, ok := item["Version"].(*types.AttributeValueMemberN); ok {
+		event.Version, _ = strconv.ParseInt(n.Value, 10, 64)
+	}
+	event.At, _ = time.Parse(time.RFC3339Nano, str("At"))
+	return event
+}
+
+// versionValue encodes a version as a number attribute
+func versionValue(version int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+}
+
+// conditionFailed reports whether a transaction was cancelled by a failed condition expression
+func conditionFailed(err error) bool {
+	var cancelled *types.TransactionCanceledException
+	if !errors.As(err, &cancelled) {
+		return false
+	}
+	for _, reason := range cancelled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	cartdynamodb "cartloom/dynamodb"
+)
+
+// newTestLifecycleDB connects to the DynamoDB at DYNAMODB_ENDPOINT and creates the orders, history
+// and outbox tables transitions write to. The test is skipped when it is unset.
+func newTestLifecycleDB(t *testing.T) *dynamodb.Client {
+	t.Helper()
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+	region := os.Getenv("DYNAMODB_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	db := dynamodb.New(dynamodb.Options{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}, cartdynamodb.WithEndpoint(endpoint))
+
+	ctx := context.Background()
+	if err := cartdynamodb.CreateTable(ctx, db, OrdersTable); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	if err := cartdynamodb.CreateOrderHistoryTable(ctx, db); err != nil {
+		t.Fatalf("CreateOrderHistoryTable: %v", err)
+	}
+	if err := cartdynamodb.CreateOutboxTable(ctx, db); err != nil {
+		t.Fatalf("CreateOutboxTable: %v", err)
+	}
+	return db
+}
+
+func TestAdvanceIgnoresRedeliveredTransitions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestLifecycleDB(t)
+
+	id := fmt.Sprintf("advance-%d", time.Now().UnixNano())
+	if _, err := Create(ctx, db, testOrder(id, "shop-a", "c1", time.Now()), "created"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, status := range []Status{StatusPaid, StatusFulfilled} {
+		if _, err := Advance(ctx, db, id, status, "event", nil); err != nil {
+			t.Fatalf("Advance to %s: %v", status, err)
+		}
+	}
+
+	// A redelivered order.paid after the order was fulfilled is a no-op
+	state, err := Advance(ctx, db, id, StatusPaid, "redelivered", nil)
+	if err != nil {
+		t.Fatalf("Advance to a status reached before = %v", err)
+	}
+	if state.Status != StatusFulfilled || state.Version != 3 {
+		t.Fatalf("state after the redelivery = %+v, want fulfilled at version 3", state)
+	}
+
+	// A status the order never reached is still refused
+	var transitionErr *TransitionError
+	if _, err := Advance(ctx, db, id, StatusCancelled, "event", nil); !errors.As(err, &transitionErr) {
+		t.Fatalf("Advance to cancelled = %v, want a TransitionError", err)
+	}
+
+	history, err := History(ctx, db, id)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("history has %d events, want 3: %+v", len(history), history)
+	}
+}
@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/utils"
+)
+
+var (
+	// ErrLockNotAcquired is returned when the lock is still held by someone else at the acquire timeout
+	ErrLockNotAcquired = errors.New("lock not acquired")
+	// ErrLockNotHeld is returned when extending or releasing a lock that expired or was taken over
+	ErrLockNotHeld = errors.New("lock not held")
+)
+
+// LockOptions configures how a lock is acquired and held
+type LockOptions struct {
+	// TTL is the lease; it is extended every TTL/3 while the lock is held. Defaults to 10s.
+	TTL time.Duration
+	// Timeout is how long to wait for a held lock. Zero tries once.
+	Timeout time.Duration
+	// RetryDelay is the first pause between attempts, doubling up to MaxRetryDelay. Defaults to 50ms and 1s.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// fenceRetention is how long the fencing counter of a lock outlives its last acquisition
+const fenceRetention = 24 * time.Hour
+
+// acquireScript sets the lock to the owner token if it is free and hands out the next fencing
+// token. The counter expires ARGV[3] milliseconds after the last acquisition, so locks of keys that
+// are no longer used leave nothing behind; it never hands out less than the Redis clock in
+// microseconds, so the tokens keep increasing after the counter expired and starts over.
+var acquireScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+local fence = redis.call('INCR', KEYS[2])
+local now = redis.call('TIME')
+local floor = now[1] .. string.sub('000000' .. now[2], -6)
+if fence < tonumber(floor) then
+	redis.call('SET', KEYS[2], floor)
+	fence = redis.call('INCR', KEYS[2])
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return fence
+`)
+
+// extendScript renews the lease if the lock still belongs to the owner token
+var extendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the lock if it still belongs to the owner token
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Lock is a held distributed lock. Each acquisition has a random owner token, so only the holder
+// can extend or release it, and a fencing token that increases with every acquisition of the key.
+// The lease is extended in the background until Release; once it no longer is, because an
+// extension found the lock gone or the context of AcquireLock was cancelled, Lost is closed and the
+// holder must stop writing.
+type Lock struct {
+	rdb   *redis.Client
+	key   string
+	token string
+	fence int64
+	ttl   time.Duration
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     context.CancelFunc
+	stopped  chan struct{}
+}
+
+// lockKey returns the Redis key of a lock. The key is a hash tag so that the lock and its fencing
+// counter, which the acquire script updates together, are in the same Redis Cluster slot.
+func lockKey(key string) string {
+	return "{" + key + "}"
+}
+
+// fenceKey returns the Redis key of the fencing counter of a lock
+func fenceKey(key string) string {
+	return lockKey(key) + ":fence"
+}
+
+// AcquireLock takes the lock at key, retrying with jittered exponential backoff until opts.Timeout.
+// The lease is kept alive until Release or until ctx is cancelled.
+func AcquireLock(ctx context.Context, rdb *redis.Client, key string, opts LockOptions) (*Lock, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Second
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = 50 * time.Millisecond
+	}
+	if opts.MaxRetryDelay <= 0 {
+		opts.MaxRetryDelay = time.Second
+	}
+
+	token, err := utils.NewID()
+	if err != nil {
+		return nil, fmt.Errorf("error creating token for lock %s: %w", key, err)
+	}
+	deadline := time.Now().Add(opts.Timeout)
+	delay := opts.RetryDelay
+	for {
+		fence, err := acquireScript.Run(ctx, rdb, []string{lockKey(key), fenceKey(key)}, token, opts.TTL.Milliseconds(), fenceRetention.Milliseconds()).Int64()
+		if err != nil {
+			return nil, fmt.Errorf("error acquiring lock %s: %w", key, err)
+		}
+		if fence > 0 {
+			return newLock(ctx, rdb, key, token, fence, opts.TTL), nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrLockNotAcquired, key)
+		}
+		pause := delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+		if pause > remaining {
+			pause = remaining
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if delay *= 2; delay > opts.MaxRetryDelay {
+			delay = opts.MaxRetryDelay
+		}
+	}
+}
+
+// newLock starts the lease extension of an acquired lock
+func newLock(ctx context.Context, rdb *redis.Client, key, token string, fence int64, ttl time.Duration) *Lock {
+	ctx, stop := context.WithCancel(ctx)
+	l := &Lock{
+		rdb:     rdb,
+		key:     key,
+		token:   token,
+		fence:   fence,
+		ttl:     ttl,
+		lost:    make(chan struct{}),
+		stop:    stop,
+		stopped: make(chan struct{}),
+	}
+	go l.keepAlive(ctx)
+	return l
+}
+
+// Key returns the locked key
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the random owner token of this acquisition
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// FencingToken returns the token of this acquisition; later acquisitions of the key get larger ones
+func (l *Lock) FencingToken() int64 {
+	return l.fence
+}
+
+// Fence returns the DynamoDB fence for writes made under the lock, recorded in the item's attribute
+func (l *Lock) Fence(attribute string) cartdynamodb.Fence {
+	return cartdynamodb.Fence{Attribute: attribute, Token: l.fence}
+}
+
+// Lost is closed when the lease is no longer extended and the lock may be held by someone else
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Extend renews the lease for another TTL
+func (l *Lock) Extend(ctx context.Context) error {
+	extended, err := extendScript.Run(ctx, l.rdb, []string{lockKey(l.key)}, l.token, l.ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("error extending lock %s: %w", l.key, err)
+	}
+	if extended == 0 {
+		l.markLost()
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, l.key)
+	}
+	return nil
+}
+
+// Release stops the lease extension and deletes the lock if it is still ours. A lock that expired
+// or was taken over is left alone and ErrLockNotHeld is returned.
+func (l *Lock) Release(ctx context.Context) error {
+	l.stop()
+	<-l.stopped
+
+	released, err := releaseScript.Run(ctx, l.rdb, []string{lockKey(l.key)}, l.token).Int()
+	if err != nil {
+		return fmt.Errorf("error releasing lock %s: %w", l.key, err)
+	}
+	if released == 0 {
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, l.key)
+	}
+	return nil
+}
+
+// keepAlive extends the lease every TTL/3 until the lock is released, its context is cancelled or
+// the lock is lost, and then marks the lock lost since the lease will run out. Failed extensions
+// are retried on the next tick as long as the lease can still be running.
+func (l *Lock) keepAlive(ctx context.Context) {
+	defer close(l.stopped)
+	defer l.markLost()
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	extendedAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := l.Extend(ctx)
+		switch {
+		case err == nil:
+			extendedAt = time.Now()
+		case errors.Is(err, ErrLockNotHeld):
+			log.Printf("Lost lock %s", l.key)
+			return
+		case ctx.Err() != nil:
+			return
+		case time.Since(extendedAt) >= l.ttl:
+			log.Printf("Lost lock %s: lease ran out while extending failed: %v", l.key, err)
+			return
+		default:
+			log.Printf("Failed to extend lock %s: %v", l.key, err)
+		}
+	}
+}
+
+// markLost closes the Lost channel once
+func (l *Lock) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
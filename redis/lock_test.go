@@ -0,0 +1,159 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis starts a miniredis and returns it with a client connected to it
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+// mustAcquire takes the lock without waiting
+func mustAcquire(t *testing.T, rdb *redis.Client, key string, ttl time.Duration) *Lock {
+	t.Helper()
+	lock, err := AcquireLock(context.Background(), rdb, key, LockOptions{TTL: ttl})
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	return lock
+}
+
+func TestAcquireLockIsExclusive(t *testing.T) {
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+
+	first := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	if got, _ := mr.Get(lockKey("order:1")); got != first.Token() {
+		t.Fatalf("lock value = %q, want the owner token %q", got, first.Token())
+	}
+	if _, err := AcquireLock(ctx, rdb, "order:1", LockOptions{}); !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("AcquireLock of a held lock = %v, want ErrLockNotAcquired", err)
+	}
+
+	if err := first.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if mr.Exists(lockKey("order:1")) {
+		t.Fatal("lock still set after Release")
+	}
+
+	second := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	defer second.Release(ctx)
+	if second.FencingToken() <= first.FencingToken() {
+		t.Fatalf("fencing token %d of the second acquisition is not above %d", second.FencingToken(), first.FencingToken())
+	}
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := newTestRedis(t)
+
+	held := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.Release(ctx)
+	}()
+
+	start := time.Now()
+	lock, err := AcquireLock(ctx, rdb, "order:1", LockOptions{Timeout: 5 * time.Second, RetryDelay: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	defer lock.Release(ctx)
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("acquired after %s, before the holder released", waited)
+	}
+}
+
+func TestReleaseLeavesTakenOverLockAlone(t *testing.T) {
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+
+	lock := mustAcquire(t, rdb, "order:1", 30*time.Second)
+
+	// The lease ran out and another process took the lock
+	mr.Set(lockKey("order:1"), "other-owner")
+
+	if err := lock.Extend(ctx); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("Extend of a taken over lock = %v, want ErrLockNotHeld", err)
+	}
+	select {
+	case <-lock.Lost():
+	default:
+		t.Fatal("Lost not closed after a failed extension")
+	}
+
+	if err := lock.Release(ctx); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("Release of a taken over lock = %v, want ErrLockNotHeld", err)
+	}
+	if got, _ := mr.Get(lockKey("order:1")); got != "other-owner" {
+		t.Fatalf("Release deleted the lock of another owner, value = %q", got)
+	}
+}
+
+func TestLockExtendsLease(t *testing.T) {
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+
+	lock := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	defer lock.Release(ctx)
+
+	mr.FastForward(20 * time.Second)
+	if err := lock.Extend(ctx); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	if ttl := mr.TTL(lockKey("order:1")); ttl != 30*time.Second {
+		t.Fatalf("lease after Extend = %s, want 30s", ttl)
+	}
+}
+
+func TestLockLostWhenLeaseCannotBeExtended(t *testing.T) {
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+
+	lock := mustAcquire(t, rdb, "order:1", 150*time.Millisecond)
+	defer lock.Release(ctx)
+
+	// The lock expired while the holder was paused
+	mr.Del(lockKey("order:1"))
+
+	select {
+	case <-lock.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Lost not closed after the lease could not be extended")
+	}
+}
+
+func TestFencingCounterExpiresAndKeepsIncreasing(t *testing.T) {
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+
+	first := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	first.Release(ctx)
+	if ttl := mr.TTL(fenceKey("order:1")); ttl <= 0 || ttl > fenceRetention {
+		t.Fatalf("fencing counter TTL = %s, want up to %s", ttl, fenceRetention)
+	}
+
+	// The counter of an unused lock goes away; tokens handed out afterwards are still larger
+	mr.FastForward(fenceRetention)
+	if mr.Exists(fenceKey("order:1")) {
+		t.Fatal("fencing counter did not expire")
+	}
+
+	second := mustAcquire(t, rdb, "order:1", 30*time.Second)
+	defer second.Release(ctx)
+	if second.FencingToken() <= first.FencingToken() {
+		t.Fatalf("fencing token %d after the counter expired is not above %d", second.FencingToken(), first.FencingToken())
+	}
+}
@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// webhookKey returns the Redis key that marks a webhook delivery as seen
+func webhookKey(webhookID string) string {
+	return fmt.Sprintf("webhook:%s", webhookID)
+}
+
+// ClaimWebhook records a webhook delivery ID and reports whether this is its first delivery
+func ClaimWebhook(ctx context.Context, rdb *redis.Client, webhookID string, ttl time.Duration) (bool, error) {
+	claimed, err := rdb.SetNX(ctx, webhookKey(webhookID), time.Now().UTC().Format(time.RFC3339), ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("error claiming webhook %s: %v", webhookID, err)
+	}
+	return claimed, nil
+}
+
+// ReleaseWebhook forgets a webhook delivery so that a retry of it is processed again
+func ReleaseWebhook(ctx context.Context, rdb *redis.Client, webhookID string) error {
+	if err := rdb.Del(ctx, webhookKey(webhookID)).Err(); err != nil {
+		return fmt.Errorf("error releasing webhook %s: %v", webhookID, err)
+	}
+	return nil
+}
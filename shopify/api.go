@@ -1,74 +1,34 @@
 package shopify
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 )
 
 // FetchProductDetails fetches the details of a specific product from Shopify
-func FetchProductDetails(shop, accessToken, productID string) (string, error) {
-	url := buildProductURL(shop, productID)
-
-	req, err := buildRequest(url, accessToken)
-	if err != nil {
-		return "", fmt.Errorf("failed to build request: %v", err)
-	}
-
-	resp, err := executeRequest(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	body, err := readResponseBody(resp)
-	if err != nil {
-		return "", err
+func (c *Client) FetchProductDetails(ctx context.Context, productID int64) (*Product, error) {
+	var payload struct {
+		Product Product `json:"product"`
 	}
-
-	log.Printf("Fetched product details for product %s", productID)
-	return body, nil
-}
-
-// buildProductURL constructs the product URL for the Shopify API
-func buildProductURL(shop, productID string) string {
-	return fmt.Sprintf("https://%s.myshopify.com/admin/api/2023-01/products/%s.json", shop, productID)
-}
-
-// buildRequest creates a new HTTP GET request with the appropriate headers
-func buildRequest(url, accessToken string) (*http.Request, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+	if _, err := c.Do(ctx, http.MethodGet, fmt.Sprintf("products/%d.json", productID), nil, nil, &payload); err != nil {
+		return nil, fmt.Errorf("failed to fetch product %d: %w", productID, err)
 	}
 
-	req.Header.Set("X-Shopify-Access-Token", accessToken)
-	req.Header.Set("Content-Type", "application/json")
-	return req, nil
+	log.Printf("Fetched product details for product %d", productID)
+	return &payload.Product, nil
 }
 
-// executeRequest sends the HTTP request and returns the response
-func executeRequest(req *http.Request) (*http.Response, error) {
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+// ShopPlan returns the Shopify plan name of the shop
+func (c *Client) ShopPlan(ctx context.Context) (string, error) {
+	var payload struct {
+		Shop struct {
+			PlanName string `json:"plan_name"`
+		} `json:"shop"`
 	}
-
-	return resp, nil
-}
-
-// readResponseBody reads the body from the HTTP response
-func readResponseBody(resp *http.Response) (string, error) {
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+	if _, err := c.Do(ctx, http.MethodGet, "shop.json", nil, nil, &payload); err != nil {
+		return "", fmt.Errorf("failed to fetch shop: %w", err)
 	}
-
-	return string(body), nil
+	return payload.Shop.PlanName, nil
 }
@@ -1,71 +1,314 @@
 package shopify
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// shopDomainPattern matches valid myshopify.com shop hostnames
+var shopDomainPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-]*\.myshopify\.com$`)
+
+// maxCallbackAge is how old a callback's signed timestamp may be, so a leaked callback URL cannot
+// be replayed later; maxCallbackSkew allows for Shopify's clock running ahead of ours
+const (
+	maxCallbackAge  = 5 * time.Minute
+	maxCallbackSkew = time.Minute
 )
 
-// OAuthURL generates the authentication URL for Shopify OAuth flow
-func OAuthURL(apiKey, shopName string) string {
-	redirectURI := url.QueryEscape("https://your-app.com/shopify/callback")
-	return fmt.Sprintf("https://%s.myshopify.com/admin/oauth/authorize?client_id=%s&scope=read_products,write_products&redirect_uri=%s", shopName, apiKey, redirectURI)
+// OAuthConfig holds the app credentials and install settings used by the OAuth flow
+type OAuthConfig struct {
+	APIKey      string
+	APISecret   string
+	Scopes      []string
+	RedirectURI string
+	StateTTL    time.Duration
+}
+
+// AccessToken is the token granted to the app by a shop
+type AccessToken struct {
+	AccessToken string `json:"access_token"`
+	Scope       string `json:"scope"`
 }
 
-// HandleOAuthCallback handles the OAuth callback from Shopify and exchanges the code for an access token
-func HandleOAuthCallback(w http.ResponseWriter, r *http.Request, apiKey, apiSecret string) {
-	code, shop, err := extractOAuthParams(r)
+// OAuthURL generates the authorization URL for the shop with the given state nonce
+func (cfg OAuthConfig) OAuthURL(shop, state string) string {
+	query := url.Values{
+		"client_id":    {cfg.APIKey},
+		"scope":        {strings.Join(cfg.Scopes, ",")},
+		"redirect_uri": {cfg.RedirectURI},
+		"state":        {state},
+	}
+	return fmt.Sprintf("https://%s/admin/oauth/authorize?%s", shop, query.Encode())
+}
+
+// HandleInstall starts the OAuth flow by redirecting the merchant to Shopify with a fresh state nonce
+func HandleInstall(w http.ResponseWriter, r *http.Request, cfg OAuthConfig, rdb *redis.Client) {
+	shop := r.URL.Query().Get("shop")
+	if !ValidShopDomain(shop) {
+		http.Error(w, "Invalid shop parameter", http.StatusBadRequest)
+		return
+	}
+
+	state, err := createOAuthState(r.Context(), rdb, cfg, shop)
+	if err != nil {
+		log.Printf("Failed to create OAuth state for shop %s: %v", shop, err)
+		http.Error(w, "Failed to start installation", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, cfg.OAuthURL(shop, state), http.StatusFound)
+}
+
+// HandleOAuthCallback validates the OAuth callback, exchanges the code for an access token
+// and registers the shop; afterInstall runs once the shop is saved. An install that did not
+// grant every configured scope is refused rather than saved.
+func HandleOAuthCallback(w http.ResponseWriter, r *http.Request, cfg OAuthConfig, rdb *redis.Client, registry *ShopRegistry, afterInstall func(context.Context, *Shop) error) {
+	code, shop, state, err := extractOAuthParams(r, cfg.APISecret)
 	if err != nil {
 		log.Printf("Invalid OAuth parameters: %v", err)
 		http.Error(w, "Invalid request parameters", http.StatusBadRequest)
 		return
 	}
 
-	token, err := exchangeCodeForToken(shop, code, apiKey, apiSecret)
+	if err := consumeOAuthState(r.Context(), rdb, cfg, shop, state); err != nil {
+		log.Printf("Invalid OAuth state for shop %s: %v", shop, err)
+		http.Error(w, "Invalid or expired state", http.StatusForbidden)
+		return
+	}
+
+	token, err := exchangeCodeForToken(r.Context(), shop, code, cfg.APIKey, cfg.APISecret)
 	if err != nil {
 		log.Printf("Failed to exchange code for token: %v", err)
 		http.Error(w, "Failed to authenticate with Shopify", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully authenticated shop %s with token: %s", shop, token)
+	if missing := missingScopes(cfg.Scopes, token.Scope); len(missing) > 0 {
+		log.Printf("Shop %s did not grant scopes: %s", shop, strings.Join(missing, ","))
+		http.Error(w, "Required permissions were not granted", http.StatusForbidden)
+		return
+	}
+
+	plan, err := NewClient(shop, token.AccessToken).ShopPlan(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch plan for shop %s: %v", shop, err)
+	}
+
+	installed := &Shop{
+		Domain:      shop,
+		AccessToken: token.AccessToken,
+		Scopes:      splitTags(token.Scope),
+		InstalledAt: time.Now().UTC(),
+		Plan:        plan,
+		Status:      ShopStatusActive,
+	}
+	if err := registry.Save(r.Context(), installed); err != nil {
+		log.Printf("Failed to register shop %s: %v", shop, err)
+		http.Error(w, "Failed to complete installation", http.StatusInternalServerError)
+		return
+	}
+
+	if afterInstall != nil {
+		if err := afterInstall(r.Context(), installed); err != nil {
+			log.Printf("Post-install setup failed for shop %s: %v", shop, err)
+			http.Error(w, "Failed to complete installation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("Successfully authenticated shop %s with scopes %s", shop, token.Scope)
 	fmt.Fprintf(w, "Shop %s authenticated", shop)
 }
 
-// extractOAuthParams extracts the required parameters from the OAuth callback request
-func extractOAuthParams(r *http.Request) (string, string, error) {
+// ValidShopDomain reports whether the value is a myshopify.com shop hostname
+func ValidShopDomain(shop string) bool {
+	return shopDomainPattern.MatchString(shop)
+}
+
+// extractOAuthParams validates the callback query HMAC, timestamp and shop, and returns code, shop and state
+func extractOAuthParams(r *http.Request, apiSecret string) (string, string, string, error) {
 	query := r.URL.Query()
 	code := query.Get("code")
 	shop := query.Get("shop")
+	state := query.Get("state")
 
-	if code == "" || shop == "" {
-		return "", "", fmt.Errorf("missing code or shop parameter")
+	if code == "" || shop == "" || state == "" {
+		return "", "", "", fmt.Errorf("missing code, shop or state parameter")
+	}
+	if !ValidShopDomain(shop) {
+		return "", "", "", fmt.Errorf("invalid shop hostname %q", shop)
+	}
+	if !validQueryHMAC(query, apiSecret) {
+		return "", "", "", fmt.Errorf("invalid hmac for shop %s", shop)
 	}
-	return code, shop, nil
+	if err := checkCallbackTimestamp(query.Get("timestamp"), time.Now()); err != nil {
+		return "", "", "", fmt.Errorf("%v for shop %s", err, shop)
+	}
+	return code, shop, state, nil
 }
 
+// checkCallbackTimestamp requires the signed Unix timestamp of a callback to be recent
+func checkCallbackTimestamp(value string, now time.Time) error {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid timestamp %q", value)
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > maxCallbackAge || age < -maxCallbackSkew {
+		return fmt.Errorf("stale timestamp %d", seconds)
+	}
+	return nil
+}
+
+// validQueryHMAC checks the hex HMAC Shopify computes over the sorted query parameters
+func validQueryHMAC(query url.Values, apiSecret string) bool {
+	signature, err := hex.DecodeString(query.Get("hmac"))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if key != "hmac" && key != "signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+strings.Join(query[key], ","))
+	}
+
+	mac := hmac.New(sha256.New, []byte(apiSecret))
+	mac.Write([]byte(strings.Join(pairs, "&")))
+	return hmac.Equal(mac.Sum(nil), signature)
+}
+
+// oauthStateKey returns the Redis key holding a pending OAuth state nonce
+func oauthStateKey(nonce string) string {
+	return fmt.Sprintf("oauth_state:%s", nonce)
+}
+
+// createOAuthState stores a random nonce for the shop and returns it signed with the app secret
+func createOAuthState(ctx context.Context, rdb *redis.Client, cfg OAuthConfig, shop string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(buf)
+
+	if err := rdb.Set(ctx, oauthStateKey(nonce), shop, cfg.StateTTL).Err(); err != nil {
+		return "", fmt.Errorf("failed to store nonce: %v", err)
+	}
+	return nonce + "." + signState(cfg.APISecret, nonce, shop), nil
+}
+
+// consumeOAuthState verifies the state signature and deletes the nonce so it cannot be reused
+func consumeOAuthState(ctx context.Context, rdb *redis.Client, cfg OAuthConfig, shop, state string) error {
+	nonce, signature, ok := strings.Cut(state, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signState(cfg.APISecret, nonce, shop))) {
+		return fmt.Errorf("bad state signature")
+	}
+
+	storedShop, err := rdb.GetDel(ctx, oauthStateKey(nonce)).Result()
+	if err == redis.Nil {
+		return fmt.Errorf("unknown or expired nonce")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read nonce: %v", err)
+	}
+	if storedShop != shop {
+		return fmt.Errorf("nonce issued for a different shop")
+	}
+	return nil
+}
+
+// signState binds the nonce to the shop with an HMAC of the app secret
+func signState(apiSecret, nonce, shop string) string {
+	mac := hmac.New(sha256.New, []byte(apiSecret))
+	mac.Write([]byte(nonce + ":" + shop))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseScopes splits a comma separated scope list such as "read_products, write_orders",
+// dropping blanks
+func ParseScopes(scopes string) []string {
+	return splitTags(scopes)
+}
+
+// missingScopes returns the requested scopes the shop did not grant. Shopify leaves read_X out of
+// the granted scopes when it grants write_X, which implies it.
+func missingScopes(requested []string, granted string) []string {
+	grantedSet := make(map[string]bool)
+	for _, scope := range ParseScopes(granted) {
+		grantedSet[scope] = true
+		if resource, ok := strings.CutPrefix(scope, "write_"); ok {
+			grantedSet["read_"+resource] = true
+		}
+	}
+
+	var missing []string
+	for _, scope := range requested {
+		if scope = strings.TrimSpace(scope); scope != "" && !grantedSet[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// oauthHTTPClient bounds the token exchange so a hung Shopify endpoint cannot block the callback
+var oauthHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
 // exchangeCodeForToken exchanges the authorization code for an access token
-func exchangeCodeForToken(shop, code, apiKey, apiSecret string) (string, error) {
-	tokenURL := fmt.Sprintf("https://%s.myshopify.com/admin/oauth/access_token", shop)
+func exchangeCodeForToken(ctx context.Context, shop, code, apiKey, apiSecret string) (*AccessToken, error) {
+	tokenURL := fmt.Sprintf("https://%s/admin/oauth/access_token", shop)
 	data := url.Values{
 		"client_id":     {apiKey},
 		"client_secret": {apiSecret},
 		"code":          {code},
 	}
 
-	resp, err := http.PostForm(tokenURL, data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("failed to send token exchange request: %v", err)
+		return nil, fmt.Errorf("failed to build token exchange request: %v", err)
 	}
-	defer resp.Body.Close()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	body, err := io.ReadAll(resp.Body) // io.ReadAll is preferred over ioutil.ReadAll
+	resp, err := oauthHTTPClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to read token response: %v", err)
+		return nil, fmt.Errorf("failed to send token exchange request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token exchange failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	// Extract the token - consider using json decoding for a real application
-	return string(body), nil
+	var token AccessToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response did not contain an access token")
+	}
+	return &token, nil
 }
@@ -0,0 +1,325 @@
+package shopify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+const testAPISecret = "shpss_app_secret"
+
+// signQuery adds the hex HMAC Shopify computes over the sorted, unescaped parameters
+func signQuery(query url.Values) url.Values {
+	signed := url.Values{}
+	var pairs []string
+	for key, values := range query {
+		signed[key] = values
+		pairs = append(pairs, key+"="+strings.Join(values, ","))
+	}
+	sort.Strings(pairs)
+
+	mac := hmac.New(sha256.New, []byte(testAPISecret))
+	mac.Write([]byte(strings.Join(pairs, "&")))
+	signed.Set("hmac", hex.EncodeToString(mac.Sum(nil)))
+	return signed
+}
+
+// roundTripFunc serves HTTP requests with a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// stubTokenExchange makes the token exchange grant the scopes, restoring the real client afterwards
+func stubTokenExchange(t *testing.T, scope string) *int {
+	t.Helper()
+	exchanges := 0
+	original := oauthHTTPClient
+	oauthHTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		exchanges++
+		body := fmt.Sprintf(`{"access_token":"shpat_token","scope":%q}`, scope)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})}
+	t.Cleanup(func() { oauthHTTPClient = original })
+	return &exchanges
+}
+
+func TestValidQueryHMAC(t *testing.T) {
+	query := url.Values{
+		"code":      {"abc"},
+		"shop":      {"example.myshopify.com"},
+		"state":     {"nonce.sig"},
+		"timestamp": {"1700000000"},
+	}
+	signed := signQuery(query)
+
+	tests := []struct {
+		name  string
+		query func() url.Values
+		want  bool
+	}{
+		{name: "valid", query: func() url.Values { return signed }, want: true},
+		{name: "missing", query: func() url.Values { return query }, want: false},
+		{name: "empty", query: func() url.Values {
+			q := signQuery(query)
+			q.Set("hmac", "")
+			return q
+		}, want: false},
+		{name: "not hex", query: func() url.Values {
+			q := signQuery(query)
+			q.Set("hmac", "zz")
+			return q
+		}, want: false},
+		{name: "tampered shop", query: func() url.Values {
+			q := signQuery(query)
+			q.Set("shop", "attacker.myshopify.com")
+			return q
+		}, want: false},
+		{name: "added parameter", query: func() url.Values {
+			q := signQuery(query)
+			q.Set("host", "admin.shopify.com")
+			return q
+		}, want: false},
+		{name: "signature parameter ignored", query: func() url.Values {
+			q := signQuery(query)
+			q.Set("signature", "legacy")
+			return q
+		}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validQueryHMAC(tt.query(), testAPISecret); got != tt.want {
+				t.Fatalf("validQueryHMAC = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCallbackTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{name: "now", value: "1700000000", ok: true},
+		{name: "recent", value: strconv.FormatInt(now.Add(-maxCallbackAge+time.Second).Unix(), 10), ok: true},
+		{name: "stale", value: strconv.FormatInt(now.Add(-maxCallbackAge-time.Second).Unix(), 10), ok: false},
+		{name: "slightly ahead", value: strconv.FormatInt(now.Add(maxCallbackSkew-time.Second).Unix(), 10), ok: true},
+		{name: "far ahead", value: strconv.FormatInt(now.Add(maxCallbackSkew+time.Second).Unix(), 10), ok: false},
+		{name: "missing", value: "", ok: false},
+		{name: "not a number", value: "yesterday", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCallbackTimestamp(tt.value, now)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkCallbackTimestamp(%q) = %v, want ok %v", tt.value, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConsumeOAuthState(t *testing.T) {
+	ctx := context.Background()
+	cfg := OAuthConfig{APISecret: testAPISecret, StateTTL: time.Minute}
+
+	tests := []struct {
+		name string
+		// use mangles the issued state and shop before they are presented
+		use  func(mr *miniredis.Miniredis, state string) (string, string)
+		uses int
+		ok   bool
+	}{
+		{name: "valid", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			return state, "example.myshopify.com"
+		}, uses: 1, ok: true},
+		{name: "replayed", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			return state, "example.myshopify.com"
+		}, uses: 2, ok: false},
+		{name: "other shop", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			return state, "attacker.myshopify.com"
+		}, uses: 1, ok: false},
+		{name: "tampered signature", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			nonce, _, _ := strings.Cut(state, ".")
+			return nonce + "." + strings.Repeat("0", 64), "example.myshopify.com"
+		}, uses: 1, ok: false},
+		{name: "unsigned", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			nonce, _, _ := strings.Cut(state, ".")
+			return nonce, "example.myshopify.com"
+		}, uses: 1, ok: false},
+		{name: "expired", use: func(mr *miniredis.Miniredis, state string) (string, string) {
+			mr.FastForward(cfg.StateTTL + time.Second)
+			return state, "example.myshopify.com"
+		}, uses: 1, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer rdb.Close()
+
+			issued, err := createOAuthState(ctx, rdb, cfg, "example.myshopify.com")
+			if err != nil {
+				t.Fatalf("createOAuthState: %v", err)
+			}
+			state, shop := tt.use(mr, issued)
+
+			for i := 0; i < tt.uses; i++ {
+				err = consumeOAuthState(ctx, rdb, cfg, shop, state)
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("consumeOAuthState = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandleOAuthCallbackRejects(t *testing.T) {
+	const shop = "example.myshopify.com"
+	cfg := OAuthConfig{
+		APIKey:    "key",
+		APISecret: testAPISecret,
+		Scopes:    []string{"read_products", "write_orders"},
+		StateTTL:  time.Minute,
+	}
+
+	tests := []struct {
+		name string
+		// query adjusts the callback query before it is signed
+		query func(q url.Values)
+		// tamper adjusts the signed query
+		tamper   func(q url.Values)
+		scope    string
+		replay   bool
+		want     int
+		exchange bool
+	}{
+		{name: "missing hmac", tamper: func(q url.Values) { q.Del("hmac") }, want: http.StatusBadRequest},
+		{name: "tampered code", tamper: func(q url.Values) { q.Set("code", "other") }, want: http.StatusBadRequest},
+		{name: "stale timestamp", query: func(q url.Values) {
+			q.Set("timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		}, want: http.StatusBadRequest},
+		{name: "invalid shop", query: func(q url.Values) { q.Set("shop", "example.com") }, want: http.StatusBadRequest},
+		{name: "replayed state", scope: "read_products,write_orders", replay: true, want: http.StatusForbidden},
+		{name: "missing scopes", scope: "read_products", want: http.StatusForbidden, exchange: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer rdb.Close()
+			exchanges := stubTokenExchange(t, tt.scope)
+
+			state, err := createOAuthState(context.Background(), rdb, cfg, shop)
+			if err != nil {
+				t.Fatalf("createOAuthState: %v", err)
+			}
+			query := url.Values{
+				"code":      {"auth-code"},
+				"shop":      {shop},
+				"state":     {state},
+				"timestamp": {strconv.FormatInt(time.Now().Unix(), 10)},
+			}
+			if tt.query != nil {
+				tt.query(query)
+			}
+			query = signQuery(query)
+			if tt.tamper != nil {
+				tt.tamper(query)
+			}
+			if tt.replay {
+				// The state was already used by an earlier callback
+				if err := consumeOAuthState(context.Background(), rdb, cfg, shop, state); err != nil {
+					t.Fatalf("consumeOAuthState: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+query.Encode(), nil)
+			rec := httptest.NewRecorder()
+			// A nil registry fails the test if the install were saved
+			HandleOAuthCallback(rec, req, cfg, rdb, nil, func(context.Context, *Shop) error {
+				t.Fatal("install completed")
+				return nil
+			})
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.exchange != (*exchanges > 0) {
+				t.Fatalf("code exchanged %d times, want exchange %v", *exchanges, tt.exchange)
+			}
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "read_products,write_orders", want: "read_products,write_orders"},
+		{value: "read_products, write_orders", want: "read_products,write_orders"},
+		{value: " read_products ,,write_orders, ", want: "read_products,write_orders"},
+		{value: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := strings.Join(ParseScopes(tt.value), ","); got != tt.want {
+				t.Fatalf("ParseScopes(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		granted   string
+		want      []string
+	}{
+		{name: "all granted", requested: []string{"read_products", "write_orders"}, granted: "read_products,write_orders"},
+		{name: "spaces", requested: []string{"read_products", "write_orders"}, granted: "read_products, write_orders"},
+		{name: "extra granted", requested: []string{"read_products"}, granted: "read_products,read_customers"},
+		{name: "missing", requested: []string{"read_products", "write_orders"}, granted: "read_products", want: []string{"write_orders"}},
+		{name: "none granted", requested: []string{"read_products"}, granted: "", want: []string{"read_products"}},
+		{name: "untrimmed request", requested: []string{"read_products", " write_orders", ""}, granted: "read_products,write_orders"},
+		{name: "write implies read", requested: []string{"read_products", "write_products", "read_orders"}, granted: "write_products,read_orders"},
+		{name: "read does not imply write", requested: []string{"write_products"}, granted: "read_products", want: []string{"write_products"}},
+		{name: "write implies only its own read", requested: []string{"read_orders"}, granted: "write_products", want: []string{"read_orders"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingScopes(tt.requested, tt.granted)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("missingScopes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
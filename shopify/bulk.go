@@ -0,0 +1,222 @@
+package shopify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Terminal and running states of a bulk operation
+const (
+	BulkStatusCreated   = "CREATED"
+	BulkStatusRunning   = "RUNNING"
+	BulkStatusCompleted = "COMPLETED"
+	BulkStatusFailed    = "FAILED"
+	BulkStatusCanceled  = "CANCELED"
+	BulkStatusExpired   = "EXPIRED"
+)
+
+// maxBulkLineSize bounds a single JSONL line of a bulk result
+const maxBulkLineSize = 10 << 20
+
+// BulkOperation is the state of a bulkOperationRunQuery job
+type BulkOperation struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ErrorCode      string `json:"errorCode"`
+	ObjectCount    string `json:"objectCount"`
+	URL            string `json:"url"`
+	PartialDataURL string `json:"partialDataUrl"`
+}
+
+// Finished reports whether the operation reached a terminal state
+func (op *BulkOperation) Finished() bool {
+	switch op.Status {
+	case BulkStatusCompleted, BulkStatusFailed, BulkStatusCanceled, BulkStatusExpired:
+		return true
+	}
+	return false
+}
+
+// BulkObject is a line of a bulk result; ParentID is set for objects of nested connections
+type BulkObject struct {
+	ID       string
+	ParentID string
+	Raw      json.RawMessage
+}
+
+// BulkNode is an object together with the nested objects that reference it through __parentId
+type BulkNode struct {
+	BulkObject
+	Children []BulkObject
+}
+
+// bulkRunMutation submits a bulk query
+const bulkRunMutation = `mutation BulkRun($query: String!) {
+	bulkOperationRunQuery(query: $query) {
+		bulkOperation { id status }
+		userErrors { field message }
+	}
+}`
+
+// bulkStatusQuery polls a bulk operation
+const bulkStatusQuery = `query BulkStatus($id: ID!) {
+	node(id: $id) {
+		... on BulkOperation { id status errorCode objectCount url partialDataUrl }
+	}
+}`
+
+// RunBulkQuery submits a bulkOperationRunQuery and returns the created operation
+func (g *GraphQLClient) RunBulkQuery(ctx context.Context, query string) (*BulkOperation, error) {
+	var data struct {
+		BulkOperationRunQuery struct {
+			BulkOperation *BulkOperation `json:"bulkOperation"`
+			UserErrors    []struct {
+				Field   []string `json:"field"`
+				Message string   `json:"message"`
+			} `json:"userErrors"`
+		} `json:"bulkOperationRunQuery"`
+	}
+	if err := g.Mutate(ctx, bulkRunMutation, map[string]interface{}{"query": query}, &data); err != nil {
+		return nil, fmt.Errorf("failed to start bulk operation: %w", err)
+	}
+
+	result := data.BulkOperationRunQuery
+	if len(result.UserErrors) > 0 {
+		return nil, fmt.Errorf("failed to start bulk operation: %s", result.UserErrors[0].Message)
+	}
+	if result.BulkOperation == nil {
+		return nil, fmt.Errorf("failed to start bulk operation: no operation returned")
+	}
+
+	log.Printf("Bulk operation %s started", result.BulkOperation.ID)
+	return result.BulkOperation, nil
+}
+
+// BulkOperationStatus fetches the current state of a bulk operation
+func (g *GraphQLClient) BulkOperationStatus(ctx context.Context, id string) (*BulkOperation, error) {
+	var data struct {
+		Node *BulkOperation `json:"node"`
+	}
+	if err := g.Query(ctx, bulkStatusQuery, map[string]interface{}{"id": id}, &data); err != nil {
+		return nil, fmt.Errorf("failed to poll bulk operation %s: %w", id, err)
+	}
+	if data.Node == nil {
+		return nil, fmt.Errorf("bulk operation %s not found", id)
+	}
+	return data.Node, nil
+}
+
+// WaitForBulkOperation polls the operation until it finishes, reporting progress through onPoll
+func (g *GraphQLClient) WaitForBulkOperation(ctx context.Context, id string, interval time.Duration, onPoll func(*BulkOperation)) (*BulkOperation, error) {
+	for {
+		op, err := g.BulkOperationStatus(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if onPoll != nil {
+			onPoll(op)
+		}
+
+		if op.Finished() {
+			if op.Status != BulkStatusCompleted {
+				return op, fmt.Errorf("bulk operation %s ended with status %s (%s)", id, op.Status, op.ErrorCode)
+			}
+			return op, nil
+		}
+
+		if err := sleepContext(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// StreamBulkResult downloads the JSONL result and calls fn for every top level object together
+// with its nested children. Shopify writes children after their parent, so a node is complete
+// as soon as the next top level object starts.
+func (g *GraphQLClient) StreamBulkResult(ctx context.Context, resultURL string, fn func(*BulkNode) error) error {
+	if resultURL == "" {
+		// Operations that matched no objects have no result file
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resultURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build bulk result request: %v", err)
+	}
+	resp, err := g.client.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download bulk result: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkLineSize)
+
+	// nodes maps the IDs of the current node and its children to the node, so children nested
+	// at any depth find their top level object without scanning its children
+	var current *BulkNode
+	nodes := make(map[string]*BulkNode)
+	for scanner.Scan() {
+		obj, err := parseBulkLine(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if obj.ParentID == "" {
+			if current != nil {
+				if err := fn(current); err != nil {
+					return err
+				}
+			}
+			current = &BulkNode{BulkObject: obj}
+			nodes = map[string]*BulkNode{obj.ID: current}
+			continue
+		}
+
+		node, ok := nodes[obj.ParentID]
+		if !ok {
+			return fmt.Errorf("bulk object %s references unknown parent %s", obj.ID, obj.ParentID)
+		}
+		node.Children = append(node.Children, obj)
+		nodes[obj.ID] = node
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read bulk result: %v", err)
+	}
+
+	if current != nil {
+		return fn(current)
+	}
+	return nil
+}
+
+// parseBulkLine decodes the id and __parentId of a JSONL line, keeping the raw object
+func parseBulkLine(line []byte) (BulkObject, error) {
+	var header struct {
+		ID       string `json:"id"`
+		ParentID string `json:"__parentId"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return BulkObject{}, fmt.Errorf("invalid bulk result line: %v", err)
+	}
+
+	raw := make(json.RawMessage, len(line))
+	copy(raw, line)
+	return BulkObject{ID: header.ID, ParentID: header.ParentID, Raw: raw}, nil
+}
+
+// objectCount parses the objectCount string Shopify returns
+func (op *BulkOperation) objectCount() float64 {
+	count, _ := strconv.ParseFloat(op.ObjectCount, 64)
+	return count
+}
@@ -0,0 +1,347 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+)
+
+// bulkPollInterval is how often running bulk operations are polled
+const bulkPollInterval = 5 * time.Second
+
+// bulkProductsQuery exports the full catalog; variants and images come back as child lines
+const bulkProductsQuery = `{
+	products {
+		edges {
+			node {
+				id title descriptionHtml vendor productType handle status tags createdAt updatedAt publishedAt
+				options { id name position values }
+				variants {
+					edges {
+						node {
+							id title sku price compareAtPrice position barcode inventoryQuantity inventoryPolicy
+							selectedOptions { value }
+							inventoryItem {
+								id
+								inventoryLevels {
+									edges { node { id updatedAt item { id } location { id } quantities(names: ["available"]) { quantity } } }
+								}
+							}
+							image { id }
+						}
+					}
+				}
+				images {
+					edges { node { id url altText width height } }
+				}
+			}
+		}
+	}
+}`
+
+// bulkOrdersQuery exports the order history; line items come back as child lines
+const bulkOrdersQuery = `{
+	orders {
+		edges {
+			node {
+				id name email displayFinancialStatus displayFulfillmentStatus cancelledAt cancelReason
+				currencyCode createdAt updatedAt processedAt
+				subtotalPriceSet { shopMoney { amount } }
+				totalTaxSet { shopMoney { amount } }
+				totalDiscountsSet { shopMoney { amount } }
+				totalShippingPriceSet { shopMoney { amount } }
+				totalPriceSet { shopMoney { amount } }
+				customer { id email firstName lastName phone }
+				lineItems {
+					edges {
+						node {
+							id title sku quantity
+							product { id }
+							variant { id }
+							originalUnitPriceSet { shopMoney { amount } }
+						}
+					}
+				}
+			}
+		}
+	}
+}`
+
+// ImportCatalog backfills every product of the shop and the inventory levels of its variants into
+// Redis, DynamoDB and the stock levels through a bulk operation
+func ImportCatalog(ctx context.Context, g *GraphQLClient, rdb *redis.Client, db *dynamodb.Client, stock StockLevels) (int, error) {
+	return runBulkImport(ctx, g, "products", bulkProductsQuery, func(node *BulkNode) error {
+		product, levels, err := bulkProduct(node)
+		if err != nil {
+			return err
+		}
+		if err := StoreProduct(ctx, rdb, db, stock, product); err != nil {
+			return err
+		}
+		for i := range levels {
+			if err := StoreInventoryLevel(ctx, rdb, db, stock, &levels[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportOrders backfills the shop's order history into Redis and DynamoDB through a bulk operation.
+// Order status changes commit the records built by outbox.
+func ImportOrders(ctx context.Context, g *GraphQLClient, rdb *redis.Client, db *dynamodb.Client, outbox OrderOutbox, shop string) (int, error) {
+	return runBulkImport(ctx, g, "orders", bulkOrdersQuery, func(node *BulkNode) error {
+		order, err := bulkOrder(node)
+		if err != nil {
+			return err
+		}
+		return StoreOrder(ctx, rdb, db, outbox, shop, order)
+	})
+}
+
+// runBulkImport submits the query, waits for it and applies every resulting node
+func runBulkImport(ctx context.Context, g *GraphQLClient, resource, query string, apply func(*BulkNode) error) (int, error) {
+	imported, err := bulkImport(ctx, g, resource, query, apply)
+	if err != nil {
+		bulkImports.WithLabelValues(resource, "failed").Inc()
+		return imported, err
+	}
+
+	bulkImports.WithLabelValues(resource, "completed").Inc()
+	log.Printf("Bulk import of %s finished: %d imported", resource, imported)
+	return imported, nil
+}
+
+// bulkImport runs the bulk operation and streams its result through apply
+func bulkImport(ctx context.Context, g *GraphQLClient, resource, query string, apply func(*BulkNode) error) (int, error) {
+	op, err := g.RunBulkQuery(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	op, err = g.WaitForBulkOperation(ctx, op.ID, bulkPollInterval, func(op *BulkOperation) {
+		bulkOperationObjects.WithLabelValues(resource).Set(op.objectCount())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	err = g.StreamBulkResult(ctx, op.URL, func(node *BulkNode) error {
+		if err := apply(node); err != nil {
+			return fmt.Errorf("failed to import %s %s: %w", resource, node.ID, err)
+		}
+		imported++
+		bulkImportedObjects.WithLabelValues(resource).Inc()
+		return nil
+	})
+	return imported, err
+}
+
+// bulkProduct rebuilds a product from its bulk line and its variant and image children, and returns
+// the inventory levels of its variants
+func bulkProduct(node *BulkNode) (*Product, []InventoryLevel, error) {
+	var gp graphQLProduct
+	if err := json.Unmarshal(node.Raw, &gp); err != nil {
+		return nil, nil, fmt.Errorf("invalid product line: %v", err)
+	}
+
+	var levels []InventoryLevel
+	for _, child := range node.Children {
+		switch gidResource(child.ID) {
+		case "ProductVariant":
+			var variant graphQLVariant
+			if err := json.Unmarshal(child.Raw, &variant); err != nil {
+				return nil, nil, fmt.Errorf("invalid variant line: %v", err)
+			}
+			gp.Variants.Nodes = append(gp.Variants.Nodes, variant)
+		case "ProductImage", "MediaImage":
+			var image graphQLImage
+			if err := json.Unmarshal(child.Raw, &image); err != nil {
+				return nil, nil, fmt.Errorf("invalid image line: %v", err)
+			}
+			gp.Images.Nodes = append(gp.Images.Nodes, image)
+		case "InventoryLevel":
+			level, err := bulkInventoryLevel(child)
+			if err != nil {
+				return nil, nil, err
+			}
+			levels = append(levels, level)
+		}
+	}
+	return gp.toProduct(), levels, nil
+}
+
+// bulkInventoryLevel decodes an inventory level child line
+func bulkInventoryLevel(obj BulkObject) (InventoryLevel, error) {
+	var gl struct {
+		UpdatedAt time.Time `json:"updatedAt"`
+		Item      struct {
+			ID string `json:"id"`
+		} `json:"item"`
+		Location struct {
+			ID string `json:"id"`
+		} `json:"location"`
+		Quantities []struct {
+			Quantity int `json:"quantity"`
+		} `json:"quantities"`
+	}
+	if err := json.Unmarshal(obj.Raw, &gl); err != nil {
+		return InventoryLevel{}, fmt.Errorf("invalid inventory level line: %v", err)
+	}
+
+	itemID, err := ParseGID(gl.Item.ID)
+	if err != nil {
+		return InventoryLevel{}, err
+	}
+	locationID, err := ParseGID(gl.Location.ID)
+	if err != nil {
+		return InventoryLevel{}, err
+	}
+
+	level := InventoryLevel{InventoryItemID: itemID, LocationID: locationID, UpdatedAt: gl.UpdatedAt}
+	if len(gl.Quantities) > 0 {
+		level.Available = &gl.Quantities[0].Quantity
+	}
+	return level, nil
+}
+
+// graphQLMoney is a MoneyBag in the shop currency
+type graphQLMoney struct {
+	ShopMoney struct {
+		Amount string `json:"amount"`
+	} `json:"shopMoney"`
+}
+
+// bulkOrder rebuilds an order from its bulk line and its line item children
+func bulkOrder(node *BulkNode) (*Order, error) {
+	var bo struct {
+		ID                       string       `json:"id"`
+		Name                     string       `json:"name"`
+		Email                    string       `json:"email"`
+		DisplayFinancialStatus   string       `json:"displayFinancialStatus"`
+		DisplayFulfillmentStatus string       `json:"displayFulfillmentStatus"`
+		CancelledAt              *time.Time   `json:"cancelledAt"`
+		CancelReason             *string      `json:"cancelReason"`
+		CurrencyCode             string       `json:"currencyCode"`
+		CreatedAt                time.Time    `json:"createdAt"`
+		UpdatedAt                time.Time    `json:"updatedAt"`
+		ProcessedAt              *time.Time   `json:"processedAt"`
+		SubtotalPriceSet         graphQLMoney `json:"subtotalPriceSet"`
+		TotalTaxSet              graphQLMoney `json:"totalTaxSet"`
+		TotalDiscountsSet        graphQLMoney `json:"totalDiscountsSet"`
+		TotalShippingPriceSet    graphQLMoney `json:"totalShippingPriceSet"`
+		TotalPriceSet            graphQLMoney `json:"totalPriceSet"`
+		Customer                 *struct {
+			ID        string `json:"id"`
+			Email     string `json:"email"`
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+			Phone     string `json:"phone"`
+		} `json:"customer"`
+	}
+	if err := json.Unmarshal(node.Raw, &bo); err != nil {
+		return nil, fmt.Errorf("invalid order line: %v", err)
+	}
+
+	orderID, err := ParseGID(bo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &Order{
+		ID:              orderID,
+		Name:            bo.Name,
+		Email:           bo.Email,
+		FinancialStatus: strings.ToLower(bo.DisplayFinancialStatus),
+		CancelledAt:     bo.CancelledAt,
+		CancelReason:    bo.CancelReason,
+		Currency:        bo.CurrencyCode,
+		SubtotalPrice:   bo.SubtotalPriceSet.ShopMoney.Amount,
+		TotalTax:        bo.TotalTaxSet.ShopMoney.Amount,
+		TotalDiscounts:  bo.TotalDiscountsSet.ShopMoney.Amount,
+		TotalPrice:      bo.TotalPriceSet.ShopMoney.Amount,
+		TotalShippingPriceSet: &MoneySet{
+			ShopMoney: Money{Amount: bo.TotalShippingPriceSet.ShopMoney.Amount, CurrencyCode: bo.CurrencyCode},
+		},
+		CreatedAt:   bo.CreatedAt,
+		UpdatedAt:   bo.UpdatedAt,
+		ProcessedAt: bo.ProcessedAt,
+	}
+
+	if status := strings.ToLower(bo.DisplayFulfillmentStatus); status != "" && status != "unfulfilled" {
+		order.FulfillmentStatus = &status
+	}
+
+	if c := bo.Customer; c != nil {
+		customerID, _ := ParseGID(c.ID)
+		order.Customer = &Customer{ID: customerID, Email: c.Email, FirstName: c.FirstName, LastName: c.LastName, Phone: c.Phone}
+	}
+
+	for _, child := range node.Children {
+		if gidResource(child.ID) != "LineItem" {
+			continue
+		}
+		item, err := bulkLineItem(child)
+		if err != nil {
+			return nil, err
+		}
+		order.LineItems = append(order.LineItems, item)
+	}
+	return order, nil
+}
+
+// bulkLineItem decodes an order line item child line
+func bulkLineItem(obj BulkObject) (OrderLineItem, error) {
+	var gl struct {
+		ID       string `json:"id"`
+		Title    string `json:"title"`
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+		Product  *struct {
+			ID string `json:"id"`
+		} `json:"product"`
+		Variant *struct {
+			ID string `json:"id"`
+		} `json:"variant"`
+		OriginalUnitPriceSet graphQLMoney `json:"originalUnitPriceSet"`
+	}
+	if err := json.Unmarshal(obj.Raw, &gl); err != nil {
+		return OrderLineItem{}, fmt.Errorf("invalid line item line: %v", err)
+	}
+
+	lineItemID, _ := ParseGID(gl.ID)
+	item := OrderLineItem{
+		ID:       lineItemID,
+		Title:    gl.Title,
+		SKU:      gl.SKU,
+		Quantity: gl.Quantity,
+		Price:    gl.OriginalUnitPriceSet.ShopMoney.Amount,
+	}
+	if gl.Product != nil {
+		if id, err := ParseGID(gl.Product.ID); err == nil {
+			item.ProductID = &id
+		}
+	}
+	if gl.Variant != nil {
+		if id, err := ParseGID(gl.Variant.ID); err == nil {
+			item.VariantID = &id
+		}
+	}
+	return item, nil
+}
+
+// gidResource returns the resource type of a global ID, e.g. "ProductVariant"
+func gidResource(gid string) string {
+	parts := strings.Split(strings.TrimPrefix(gid, "gid://shopify/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0]
+}
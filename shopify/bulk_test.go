@@ -0,0 +1,174 @@
+package shopify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// bulkCatalog is a bulk result of two products, the first with a variant, the variant's inventory
+// level and an image, in the order Shopify writes them
+var bulkCatalog = strings.Join([]string{
+	`{"id":"gid://shopify/Product/1","title":"Mug","status":"ACTIVE","tags":["kitchen","gift"]}`,
+	`{"id":"gid://shopify/ProductVariant/11","sku":"MUG-1","price":"12.50","position":1,"inventoryItem":{"id":"gid://shopify/InventoryItem/111"},"__parentId":"gid://shopify/Product/1"}`,
+	`{"id":"gid://shopify/InventoryLevel/111?inventory_item_id=111","updatedAt":"2024-03-01T12:00:00Z","item":{"id":"gid://shopify/InventoryItem/111"},"location":{"id":"gid://shopify/Location/5"},"quantities":[{"quantity":7}],"__parentId":"gid://shopify/ProductVariant/11"}`,
+	`{"id":"gid://shopify/ProductImage/12","url":"https://cdn.shopify.com/mug.png","width":800,"height":600,"__parentId":"gid://shopify/Product/1"}`,
+	`{"id":"gid://shopify/Product/2","title":"Plate","status":"DRAFT"}`,
+}, "\n") + "\n"
+
+// serveBulkResult serves the body as the bulk result file, which is downloaded without the access
+// token, and returns its URL
+func serveBulkResult(t *testing.T, status int, body string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/bulk/result.jsonl"
+}
+
+// streamBulk streams the result served with the body and returns the nodes passed to fn
+func streamBulk(t *testing.T, body string) ([]*BulkNode, error) {
+	t.Helper()
+	g := NewGraphQLClient(NewClient("example.myshopify.com", "shpat_token"))
+	var nodes []*BulkNode
+	err := g.StreamBulkResult(context.Background(), serveBulkResult(t, http.StatusOK, body), func(node *BulkNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+	return nodes, err
+}
+
+func TestStreamBulkResult(t *testing.T) {
+	nodes, err := streamBulk(t, bulkCatalog)
+	if err != nil {
+		t.Fatalf("StreamBulkResult: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].ID != "gid://shopify/Product/1" || nodes[1].ID != "gid://shopify/Product/2" {
+		t.Fatalf("streamed %d nodes, want products 1 and 2", len(nodes))
+	}
+
+	var children []string
+	for _, child := range nodes[0].Children {
+		children = append(children, gidResource(child.ID))
+	}
+	if strings.Join(children, ",") != "ProductVariant,InventoryLevel,ProductImage" {
+		t.Fatalf("product 1 children %v, want its variant, the variant's level and its image", children)
+	}
+	if level := nodes[0].Children[1]; level.ParentID != "gid://shopify/ProductVariant/11" {
+		t.Fatalf("inventory level parent %s, want the variant", level.ParentID)
+	}
+	if len(nodes[1].Children) != 0 {
+		t.Fatalf("product 2 has %d children, want none", len(nodes[1].Children))
+	}
+	if !strings.Contains(string(nodes[1].Raw), `"title":"Plate"`) {
+		t.Fatalf("product 2 raw line %s, want the whole object", nodes[1].Raw)
+	}
+}
+
+func TestStreamBulkResultLongLine(t *testing.T) {
+	description := strings.Repeat("a", 200<<10)
+	nodes, err := streamBulk(t, `{"id":"gid://shopify/Product/1","descriptionHtml":"`+description+`"}`)
+	if err != nil {
+		t.Fatalf("StreamBulkResult: %v", err)
+	}
+	if len(nodes) != 1 || len(nodes[0].Raw) < len(description) {
+		t.Fatalf("streamed %d nodes, want the product with its long description", len(nodes))
+	}
+}
+
+func TestStreamBulkResultUnknownParent(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "child before any parent",
+			body: `{"id":"gid://shopify/ProductVariant/11","__parentId":"gid://shopify/Product/1"}`,
+		},
+		{
+			name: "child of an earlier top level object",
+			body: `{"id":"gid://shopify/Product/1"}` + "\n" +
+				`{"id":"gid://shopify/Product/2"}` + "\n" +
+				`{"id":"gid://shopify/ProductVariant/11","__parentId":"gid://shopify/Product/1"}`,
+		},
+		{
+			name: "child of an earlier node's child",
+			body: `{"id":"gid://shopify/Product/1"}` + "\n" +
+				`{"id":"gid://shopify/ProductVariant/11","__parentId":"gid://shopify/Product/1"}` + "\n" +
+				`{"id":"gid://shopify/Product/2"}` + "\n" +
+				`{"id":"gid://shopify/InventoryLevel/111","__parentId":"gid://shopify/ProductVariant/11"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := streamBulk(t, tt.body); err == nil || !strings.Contains(err.Error(), "unknown parent") {
+				t.Fatalf("StreamBulkResult = %v, want an unknown parent error", err)
+			}
+		})
+	}
+}
+
+func TestStreamBulkResultErrors(t *testing.T) {
+	ctx := context.Background()
+	g := NewGraphQLClient(NewClient("example.myshopify.com", "shpat_token"))
+	called := 0
+	count := func(*BulkNode) error {
+		called++
+		return nil
+	}
+
+	// Operations that matched nothing have no result file
+	if err := g.StreamBulkResult(ctx, "", count); err != nil || called != 0 {
+		t.Fatalf("StreamBulkResult without a URL = %v after %d nodes, want nothing streamed", err, called)
+	}
+
+	err := g.StreamBulkResult(ctx, serveBulkResult(t, http.StatusForbidden, "expired"), count)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("StreamBulkResult of an expired URL = %v, want the API error", err)
+	}
+
+	if _, err := streamBulk(t, `{"id":"gid://shopify/Product/1"}`+"\nnot json\n"); err == nil {
+		t.Fatal("StreamBulkResult accepted an invalid line")
+	}
+
+	stop := fmt.Errorf("store unavailable")
+	err = g.StreamBulkResult(ctx, serveBulkResult(t, http.StatusOK, bulkCatalog), func(node *BulkNode) error {
+		called++
+		return stop
+	})
+	if !errors.Is(err, stop) || called != 1 {
+		t.Fatalf("StreamBulkResult = %v after %d nodes, want it to stop at the first error", err, called)
+	}
+}
+
+func TestBulkProduct(t *testing.T) {
+	nodes, err := streamBulk(t, bulkCatalog)
+	if err != nil {
+		t.Fatalf("StreamBulkResult: %v", err)
+	}
+
+	product, levels, err := bulkProduct(nodes[0])
+	if err != nil {
+		t.Fatalf("bulkProduct: %v", err)
+	}
+	if product.ID != 1 || product.Title != "Mug" || product.Status != "active" || product.Tags != "kitchen, gift" {
+		t.Fatalf("product %+v, want the mug", product)
+	}
+	if len(product.Variants) != 1 || product.Variants[0].ID != 11 || product.Variants[0].SKU != "MUG-1" {
+		t.Fatalf("variants %+v, want MUG-1", product.Variants)
+	}
+	if len(product.Images) != 1 || product.Images[0].ID != 12 {
+		t.Fatalf("images %+v, want image 12", product.Images)
+	}
+	if len(levels) != 1 || levels[0].InventoryItemID != 111 || levels[0].LocationID != 5 || levels[0].Available == nil || *levels[0].Available != 7 {
+		t.Fatalf("inventory levels %+v, want 7 of item 111 at location 5", levels)
+	}
+}
@@ -0,0 +1,312 @@
+package shopify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAPIVersion is the Admin API version used when none is configured
+const DefaultAPIVersion = "2024-07"
+
+// Defaults of the REST Admin API leaky bucket for standard plans
+const (
+	defaultBucketSize = 40
+	defaultLeakRate   = 2.0
+)
+
+// Client is a Shopify Admin REST API client for a single shop
+type Client struct {
+	BaseURL     string
+	APIVersion  string
+	AccessToken string
+	HTTPClient  *http.Client
+	MaxRetries  int
+
+	limiter *leakyBucket
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithBaseURL overrides the https://<shop> base URL, e.g. for a proxy or test server
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) { c.BaseURL = strings.TrimRight(baseURL, "/") }
+}
+
+// WithAPIVersion pins the Admin API version
+func WithAPIVersion(version string) ClientOption {
+	return func(c *Client) { c.APIVersion = version }
+}
+
+// WithHTTPClient sets the underlying HTTP client
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) { c.HTTPClient = httpClient }
+}
+
+// WithMaxRetries sets how many times throttled or failed requests are retried
+func WithMaxRetries(retries int) ClientOption {
+	return func(c *Client) { c.MaxRetries = retries }
+}
+
+// NewClient creates a client for the shop domain authenticated with the access token
+func NewClient(shop, accessToken string, opts ...ClientOption) *Client {
+	c := &Client{
+		BaseURL:     "https://" + shop,
+		APIVersion:  DefaultAPIVersion,
+		AccessToken: accessToken,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+		MaxRetries:  4,
+		limiter:     newLeakyBucket(defaultBucketSize, defaultLeakRate),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is returned when Shopify answers with a non-success status code
+type APIError struct {
+	StatusCode int
+	Errors     json.RawMessage
+	Body       string
+	RequestID  string
+}
+
+// Error describes the failed request
+func (e *APIError) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("shopify API error %d: %s", e.StatusCode, string(e.Errors))
+	}
+	return fmt.Sprintf("shopify API error %d: %s", e.StatusCode, e.Body)
+}
+
+// IsNotFound reports whether the error is a Shopify 404
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Do sends a request to the versioned Admin API path (for example "products/1.json"),
+// encoding body as JSON and decoding the response into out when they are not nil
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body, out interface{}) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to encode request body: %v", err)
+		}
+	}
+
+	resp, err := c.doWithRetry(ctx, method, c.endpoint(path, query), payload, c.limiter, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("failed to decode response: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// endpoint builds the absolute URL of an Admin API path
+func (c *Client) endpoint(path string, query url.Values) string {
+	endpoint := fmt.Sprintf("%s/admin/api/%s/%s", c.BaseURL, c.APIVersion, strings.TrimLeft(path, "/"))
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return endpoint
+}
+
+// doWithRetry sends the request, retrying 429s after Retry-After and 5xx with jittered backoff.
+// POSTs are only retried on 5xx when retryPost is set, since the request may already have been
+// applied; callers set it for POSTs without side effects such as GraphQL queries. The REST leaky
+// bucket is applied when limiter is not nil.
+func (c *Client) doWithRetry(ctx context.Context, method, endpoint string, payload []byte, limiter *leakyBucket, retryPost bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.send(ctx, method, endpoint, payload)
+		if err != nil {
+			return nil, err
+		}
+		if limiter != nil {
+			limiter.observe(resp.Header.Get("X-Shopify-Shop-Api-Call-Limit"))
+		}
+
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		apiErr := newAPIError(resp)
+		retryable := resp.StatusCode == http.StatusTooManyRequests ||
+			(resp.StatusCode >= 500 && (method != http.MethodPost || retryPost))
+		if !retryable || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+
+		delay := backoffDelay(attempt)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			delay = retryAfter(resp.Header.Get("Retry-After"))
+		}
+		log.Printf("Shopify %s %s returned %d, retrying in %s (attempt %d/%d)", method, endpoint, resp.StatusCode, delay, attempt+1, c.MaxRetries)
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// send performs a single HTTP round trip
+func (c *Client) send(ctx context.Context, method, endpoint string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("X-Shopify-Access-Token", c.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %v", err)
+	}
+	return resp, nil
+}
+
+// newAPIError reads the error body of a failed response and closes it
+func newAPIError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RequestID:  resp.Header.Get("X-Request-Id"),
+	}
+
+	var payload struct {
+		Errors json.RawMessage `json:"errors"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		apiErr.Errors = payload.Errors
+	}
+	return apiErr
+}
+
+// retryAfter parses the Retry-After header, defaulting to two seconds
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// maxBackoffShift is the largest exponent of the backoff; 500ms << 6 already exceeds the 30s cap
+const maxBackoffShift = 6
+
+// backoffDelay returns an exponential backoff with full jitter
+func backoffDelay(attempt int) time.Duration {
+	if attempt > maxBackoffShift {
+		attempt = maxBackoffShift
+	}
+	ceiling := 500 * time.Millisecond << attempt
+	if ceiling > 30*time.Second {
+		ceiling = 30 * time.Second
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// leakyBucket mirrors Shopify's request bucket so the client waits instead of getting throttled
+type leakyBucket struct {
+	mu       sync.Mutex
+	size     float64
+	level    float64
+	leakRate float64
+	updated  time.Time
+}
+
+// newLeakyBucket creates an empty bucket of the given size that drains leakRate requests per second
+func newLeakyBucket(size int, leakRate float64) *leakyBucket {
+	return &leakyBucket{size: float64(size), leakRate: leakRate, updated: time.Now()}
+}
+
+// wait blocks until the bucket has room for one more request and reserves it
+func (b *leakyBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		b.drain()
+		if b.level+1 <= b.size {
+			b.level++
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((b.level + 1 - b.size) / b.leakRate * float64(time.Second))
+		b.mu.Unlock()
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// observe syncs the bucket with the X-Shopify-Shop-Api-Call-Limit header, e.g. "32/40"
+func (b *leakyBucket) observe(header string) {
+	used, size, ok := strings.Cut(header, "/")
+	if !ok {
+		return
+	}
+	usedCalls, err1 := strconv.Atoi(used)
+	bucketSize, err2 := strconv.Atoi(size)
+	if err1 != nil || err2 != nil || bucketSize <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = float64(bucketSize)
+	b.level = float64(usedCalls)
+	b.updated = time.Now()
+}
+
+// drain removes the requests leaked since the last update; callers hold the lock
+func (b *leakyBucket) drain() {
+	now := time.Now()
+	b.level -= now.Sub(b.updated).Seconds() * b.leakRate
+	if b.level < 0 {
+		b.level = 0
+	}
+	b.updated = now
+}
@@ -0,0 +1,187 @@
+package shopify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// response is a canned answer of the test server
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+// newTestClient serves the responses in order and counts the requests
+func newTestClient(t *testing.T, responses ...response) (*Client, *int) {
+	t.Helper()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Shopify-Access-Token") != "shpat_token" {
+			t.Errorf("request without the access token")
+		}
+		if requests >= len(responses) {
+			t.Errorf("unexpected request %d to %s", requests+1, r.URL)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := responses[requests]
+		requests++
+		for key, value := range resp.header {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(server.Close)
+
+	return NewClient("example.myshopify.com", "shpat_token", WithBaseURL(server.URL), WithMaxRetries(2)), &requests
+}
+
+func TestClientDoRetries(t *testing.T) {
+	ok := response{status: http.StatusOK, body: `{"product":{"id":1}}`}
+	throttled := response{status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "0.01"}, body: `{"errors":"Exceeded 2 calls per second"}`}
+	unavailable := response{status: http.StatusServiceUnavailable, body: `{"errors":"Service Unavailable"}`}
+
+	tests := []struct {
+		name      string
+		method    string
+		responses []response
+		requests  int
+		// status is the status of the returned APIError, or 0 for success
+		status int
+	}{
+		{name: "success", method: http.MethodGet, responses: []response{ok}, requests: 1},
+		{name: "throttled then success", method: http.MethodGet, responses: []response{throttled, ok}, requests: 2},
+		{name: "throttled POST retried", method: http.MethodPost, responses: []response{throttled, ok}, requests: 2},
+		{name: "throttled until retries run out", method: http.MethodGet, responses: []response{throttled, throttled, throttled}, requests: 3, status: http.StatusTooManyRequests},
+		{name: "server error retried", method: http.MethodGet, responses: []response{unavailable, ok}, requests: 2},
+		{name: "server error on POST not retried", method: http.MethodPost, responses: []response{unavailable}, requests: 1, status: http.StatusServiceUnavailable},
+		{name: "client error not retried", method: http.MethodGet, responses: []response{{status: http.StatusNotFound, body: `{"errors":"Not Found"}`}}, requests: 1, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, requests := newTestClient(t, tt.responses...)
+
+			var out struct {
+				Product struct {
+					ID int64 `json:"id"`
+				} `json:"product"`
+			}
+			_, err := client.Do(context.Background(), tt.method, "products/1.json", nil, nil, &out)
+
+			if *requests != tt.requests {
+				t.Fatalf("sent %d requests, want %d", *requests, tt.requests)
+			}
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("Do: %v", err)
+				}
+				if out.Product.ID != 1 {
+					t.Fatalf("decoded product %d, want 1", out.Product.ID)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+				t.Fatalf("Do = %v, want an API error with status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestClientWaitsForRetryAfter(t *testing.T) {
+	client, _ := newTestClient(t,
+		response{status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "0.2"}},
+		response{status: http.StatusOK, body: `{}`},
+	)
+
+	start := time.Now()
+	if _, err := client.Do(context.Background(), http.MethodGet, "shop.json", nil, nil, nil); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("retried after %s, want at least the 200ms of Retry-After", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "2.0", want: 2 * time.Second},
+		{value: "0.5", want: 500 * time.Millisecond},
+		{value: "10", want: 10 * time.Second},
+		{value: "", want: 2 * time.Second},
+		{value: "0", want: 2 * time.Second},
+		{value: "-1", want: 2 * time.Second},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := retryAfter(tt.value); got != tt.want {
+				t.Fatalf("retryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		if d := backoffDelay(attempt); d < 0 || d > 30*time.Second {
+			t.Fatalf("backoffDelay(%d) = %s, want within [0, 30s]", attempt, d)
+		}
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		// header is the observed X-Shopify-Shop-Api-Call-Limit
+		header string
+		// wait is whether a request has to wait for the bucket to drain
+		wait bool
+	}{
+		{name: "empty", header: "", wait: false},
+		{name: "room left", header: "38/40", wait: false},
+		{name: "full", header: "40/40", wait: true},
+		{name: "larger plan", header: "40/80", wait: false},
+		{name: "malformed", header: "40", wait: false},
+		{name: "zero size", header: "40/0", wait: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newLeakyBucket(defaultBucketSize, defaultLeakRate)
+			bucket.observe(tt.header)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := bucket.wait(ctx)
+			if waited := errors.Is(err, context.DeadlineExceeded); waited != tt.wait {
+				t.Fatalf("wait = %v, want waiting %v", err, tt.wait)
+			}
+		})
+	}
+}
+
+func TestLeakyBucketDrains(t *testing.T) {
+	bucket := newLeakyBucket(2, 20)
+	bucket.observe("2/2")
+
+	// At 20 requests per second a slot frees up after 50ms
+	start := time.Now()
+	if err := bucket.wait(context.Background()); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("full bucket admitted a request after %s", elapsed)
+	}
+}
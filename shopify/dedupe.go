@@ -0,0 +1,62 @@
+package shopify
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	cartredis "cartloom/redis"
+)
+
+// DedupeWebhook wraps a webhook handler and skips deliveries whose
+// X-Shopify-Webhook-Id was already processed within the TTL
+func DedupeWebhook(rdb *redis.Client, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID := r.Header.Get("X-Shopify-Webhook-Id")
+		if webhookID == "" {
+			log.Printf("Webhook without X-Shopify-Webhook-Id, processing without deduplication")
+			next(w, r)
+			return
+		}
+
+		claimed, err := cartredis.ClaimWebhook(r.Context(), rdb, webhookID, ttl)
+		if err != nil {
+			log.Printf("Error checking webhook %s for duplicates: %v", webhookID, err)
+			http.Error(w, "Failed to check webhook delivery", http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			log.Printf("Skipping duplicate webhook %s", webhookID)
+			webhookDeduplications.WithLabelValues("hit").Inc()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Duplicate webhook ignored"))
+			return
+		}
+		webhookDeduplications.WithLabelValues("miss").Inc()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// Let Shopify's retry go through when processing failed
+		if rec.status >= http.StatusInternalServerError {
+			if err := cartredis.ReleaseWebhook(r.Context(), rdb, webhookID); err != nil {
+				log.Printf("Failed to release webhook %s after error: %v", webhookID, err)
+			}
+		}
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
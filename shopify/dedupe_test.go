@@ -0,0 +1,121 @@
+package shopify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestDedupeWebhook(t *testing.T) {
+	const ttl = time.Hour
+
+	type delivery struct {
+		webhookID string
+		// status is what the wrapped handler answers
+		status int
+		// after is how long after the previous delivery this one arrives
+		after time.Duration
+		// processed is whether the wrapped handler should run
+		processed bool
+		want      int
+	}
+
+	tests := []struct {
+		name       string
+		deliveries []delivery
+	}{
+		{
+			name: "duplicate skipped",
+			deliveries: []delivery{
+				{webhookID: "w1", status: http.StatusOK, processed: true, want: http.StatusOK},
+				{webhookID: "w1", status: http.StatusOK, processed: false, want: http.StatusOK},
+				{webhookID: "w2", status: http.StatusOK, processed: true, want: http.StatusOK},
+			},
+		},
+		{
+			name: "retried after a server error",
+			deliveries: []delivery{
+				{webhookID: "w1", status: http.StatusInternalServerError, processed: true, want: http.StatusInternalServerError},
+				{webhookID: "w1", status: http.StatusOK, processed: true, want: http.StatusOK},
+				{webhookID: "w1", status: http.StatusOK, processed: false, want: http.StatusOK},
+			},
+		},
+		{
+			name: "not retried after a client error",
+			deliveries: []delivery{
+				{webhookID: "w1", status: http.StatusBadRequest, processed: true, want: http.StatusBadRequest},
+				{webhookID: "w1", status: http.StatusOK, processed: false, want: http.StatusOK},
+			},
+		},
+		{
+			name: "processed again once forgotten",
+			deliveries: []delivery{
+				{webhookID: "w1", status: http.StatusOK, processed: true, want: http.StatusOK},
+				{webhookID: "w1", status: http.StatusOK, after: ttl + time.Second, processed: true, want: http.StatusOK},
+			},
+		},
+		{
+			name: "missing webhook ID",
+			deliveries: []delivery{
+				{status: http.StatusOK, processed: true, want: http.StatusOK},
+				{status: http.StatusOK, processed: true, want: http.StatusOK},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer rdb.Close()
+
+			for i, d := range tt.deliveries {
+				mr.FastForward(d.after)
+
+				processed := false
+				handler := DedupeWebhook(rdb, ttl, func(w http.ResponseWriter, r *http.Request) {
+					processed = true
+					w.WriteHeader(d.status)
+				})
+
+				req := httptest.NewRequest(http.MethodPost, "/webhooks/products/update", nil)
+				if d.webhookID != "" {
+					req.Header.Set("X-Shopify-Webhook-Id", d.webhookID)
+				}
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+
+				if processed != d.processed {
+					t.Fatalf("delivery %d: processed = %v, want %v", i, processed, d.processed)
+				}
+				if rec.Code != d.want {
+					t.Fatalf("delivery %d: status = %d, want %d", i, rec.Code, d.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupeWebhookFailsWithoutRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer rdb.Close()
+	mr.Close()
+
+	handler := DedupeWebhook(rdb, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("webhook processed without a duplicate check")
+	})
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/products/update", nil)
+	req.Header.Set("X-Shopify-Webhook-Id", "w1")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	// Shopify retries the delivery once the check works again
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
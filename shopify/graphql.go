@@ -0,0 +1,282 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultQueryCost is assumed for the first query before Shopify reports real costs
+const defaultQueryCost = 50
+
+// GraphQLClient sends queries and mutations to the GraphQL Admin API,
+// waiting whenever the next query would exceed the shop's cost budget
+type GraphQLClient struct {
+	client *Client
+
+	mu          sync.Mutex
+	available   float64
+	maximum     float64
+	restoreRate float64
+	updated     time.Time
+	lastCost    float64
+}
+
+// GraphQLError is an entry of the top level errors array
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// GraphQLErrors is returned when a response carries errors
+type GraphQLErrors []GraphQLError
+
+// Error joins the error messages
+func (e GraphQLErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Message)
+	}
+	return "shopify GraphQL error: " + strings.Join(messages, "; ")
+}
+
+// throttled reports whether Shopify rejected the query for exceeding the cost budget
+func (e GraphQLErrors) throttled() bool {
+	for _, err := range e {
+		if code, _ := err.Extensions["code"].(string); code == "THROTTLED" {
+			return true
+		}
+	}
+	return false
+}
+
+// graphQLResponse is the envelope of every GraphQL response
+type graphQLResponse struct {
+	Data       json.RawMessage `json:"data"`
+	Errors     GraphQLErrors   `json:"errors"`
+	Extensions struct {
+		Cost *struct {
+			RequestedQueryCost float64 `json:"requestedQueryCost"`
+			ActualQueryCost    float64 `json:"actualQueryCost"`
+			ThrottleStatus     struct {
+				MaximumAvailable   float64 `json:"maximumAvailable"`
+				CurrentlyAvailable float64 `json:"currentlyAvailable"`
+				RestoreRate        float64 `json:"restoreRate"`
+			} `json:"throttleStatus"`
+		} `json:"cost"`
+	} `json:"extensions"`
+}
+
+// NewGraphQLClient creates a GraphQL client sharing the REST client's shop, token and HTTP settings
+func NewGraphQLClient(client *Client) *GraphQLClient {
+	return &GraphQLClient{
+		client:      client,
+		available:   1000,
+		maximum:     1000,
+		restoreRate: 50,
+		updated:     time.Now(),
+		lastCost:    defaultQueryCost,
+	}
+}
+
+// Query executes a read-only query and decodes its data into out. Queries are retried when
+// Shopify fails with a 5xx.
+func (g *GraphQLClient) Query(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	return g.execute(ctx, query, variables, out, true)
+}
+
+// Mutate executes a mutation and decodes its data into out. Mutations are not retried on 5xx
+// since Shopify may already have applied them.
+func (g *GraphQLClient) Mutate(ctx context.Context, mutation string, variables map[string]interface{}, out interface{}) error {
+	return g.execute(ctx, mutation, variables, out, false)
+}
+
+// execute sends the document, waiting for cost budget and retrying when Shopify throttles it
+func (g *GraphQLClient) execute(ctx context.Context, query string, variables map[string]interface{}, out interface{}, retryable bool) error {
+	payload, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return fmt.Errorf("failed to encode GraphQL request: %v", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := g.waitForBudget(ctx); err != nil {
+			return err
+		}
+
+		result, err := g.send(ctx, payload, retryable)
+		if err != nil {
+			return err
+		}
+
+		if len(result.Errors) > 0 {
+			if result.Errors.throttled() && attempt < g.client.MaxRetries {
+				log.Printf("Shopify GraphQL query throttled, retrying (attempt %d/%d)", attempt+1, g.client.MaxRetries)
+				continue
+			}
+			return result.Errors
+		}
+
+		if out != nil && len(result.Data) > 0 {
+			if err := json.Unmarshal(result.Data, out); err != nil {
+				return fmt.Errorf("failed to decode GraphQL data: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// send posts the request and records the cost extension of the response
+func (g *GraphQLClient) send(ctx context.Context, payload []byte, retryable bool) (*graphQLResponse, error) {
+	resp, err := g.client.doWithRetry(ctx, http.MethodPost, g.client.endpoint("graphql.json", nil), payload, nil, retryable)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode GraphQL response: %v", err)
+	}
+
+	if cost := result.Extensions.Cost; cost != nil {
+		g.mu.Lock()
+		g.available = cost.ThrottleStatus.CurrentlyAvailable
+		g.maximum = cost.ThrottleStatus.MaximumAvailable
+		g.restoreRate = cost.ThrottleStatus.RestoreRate
+		g.lastCost = cost.RequestedQueryCost
+		g.updated = time.Now()
+		g.mu.Unlock()
+	}
+	return &result, nil
+}
+
+// waitForBudget blocks until the restored budget covers the expected cost of the next query
+func (g *GraphQLClient) waitForBudget(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		now := time.Now()
+		g.available += now.Sub(g.updated).Seconds() * g.restoreRate
+		if g.available > g.maximum {
+			g.available = g.maximum
+		}
+		g.updated = now
+
+		cost := g.lastCost
+		if cost > g.maximum {
+			cost = g.maximum
+		}
+		if g.available >= cost || g.restoreRate <= 0 {
+			g.available -= cost
+			g.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((cost - g.available) / g.restoreRate * float64(time.Second))
+		g.mu.Unlock()
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// PaginateConnection runs a query that takes a $cursor variable and follows the connection
+// found at path (for example "products") until pageInfo.hasNextPage is false, calling fn for every node
+func (g *GraphQLClient) PaginateConnection(ctx context.Context, query string, variables map[string]interface{}, path []string, fn func(json.RawMessage) error) error {
+	vars := make(map[string]interface{}, len(variables)+1)
+	for k, v := range variables {
+		vars[k] = v
+	}
+
+	for {
+		var data json.RawMessage
+		if err := g.Query(ctx, query, vars, &data); err != nil {
+			return err
+		}
+
+		conn, err := connectionAt(data, path)
+		if err != nil {
+			return err
+		}
+
+		for _, node := range conn.allNodes() {
+			if err := fn(node); err != nil {
+				return err
+			}
+		}
+
+		if !conn.PageInfo.HasNextPage {
+			return nil
+		}
+		vars["cursor"] = conn.PageInfo.EndCursor
+	}
+}
+
+// connection is a GraphQL connection exposing either nodes or edges
+type connection struct {
+	Nodes []json.RawMessage `json:"nodes"`
+	Edges []struct {
+		Node json.RawMessage `json:"node"`
+	} `json:"edges"`
+	PageInfo struct {
+		HasNextPage bool   `json:"hasNextPage"`
+		EndCursor   string `json:"endCursor"`
+	} `json:"pageInfo"`
+}
+
+// allNodes returns the nodes of the page whichever shape the query selected
+func (c *connection) allNodes() []json.RawMessage {
+	if len(c.Nodes) > 0 {
+		return c.Nodes
+	}
+	nodes := make([]json.RawMessage, 0, len(c.Edges))
+	for _, edge := range c.Edges {
+		nodes = append(nodes, edge.Node)
+	}
+	return nodes
+}
+
+// connectionAt walks the data object along path and decodes the connection found there
+func connectionAt(data json.RawMessage, path []string) (*connection, error) {
+	current := data
+	for _, field := range path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(current, &object); err != nil {
+			return nil, fmt.Errorf("failed to decode GraphQL data at %s: %v", field, err)
+		}
+		next, ok := object[field]
+		if !ok {
+			return nil, fmt.Errorf("GraphQL data has no field %s", field)
+		}
+		current = next
+	}
+
+	var conn connection
+	if err := json.Unmarshal(current, &conn); err != nil {
+		return nil, fmt.Errorf("failed to decode GraphQL connection: %v", err)
+	}
+	return &conn, nil
+}
+
+// GID returns the GraphQL global ID of a resource, e.g. gid://shopify/Product/1
+func GID(resource string, id int64) string {
+	return fmt.Sprintf("gid://shopify/%s/%d", resource, id)
+}
+
+// ParseGID returns the numeric ID of a GraphQL global ID
+func ParseGID(gid string) (int64, error) {
+	idx := strings.LastIndex(gid, "/")
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid global ID %q", gid)
+	}
+	var id int64
+	if _, err := fmt.Sscan(gid[idx+1:], &id); err != nil {
+		return 0, fmt.Errorf("invalid global ID %q", gid)
+	}
+	return id, nil
+}
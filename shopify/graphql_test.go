@@ -0,0 +1,227 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// graphQLCost is a cost extension leaving plenty of budget
+const graphQLCost = `"extensions":{"cost":{"requestedQueryCost":10,"actualQueryCost":10,` +
+	`"throttleStatus":{"maximumAvailable":1000,"currentlyAvailable":990,"restoreRate":50}}}`
+
+// throttledResponse is what Shopify answers when a query exceeds the cost budget
+const throttledResponse = `{"errors":[{"message":"Throttled","extensions":{"code":"THROTTLED"}}],` + graphQLCost + `}`
+
+// newTestGraphQLClient serves the responses in order and counts the requests
+func newTestGraphQLClient(t *testing.T, responses ...response) (*GraphQLClient, *int) {
+	t.Helper()
+	client, requests := newTestClient(t, responses...)
+	return NewGraphQLClient(client), requests
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	ok := response{status: http.StatusOK, body: `{"data":{"shop":{"name":"Example"}},` + graphQLCost + `}`}
+	throttled := response{status: http.StatusOK, body: throttledResponse}
+	unavailable := response{status: http.StatusServiceUnavailable, body: `{"errors":"Service Unavailable"}`}
+	failed := response{status: http.StatusOK, body: `{"errors":[{"message":"Field 'nme' doesn't exist on type 'Shop'"}]}`}
+
+	tests := []struct {
+		name      string
+		mutate    bool
+		responses []response
+		requests  int
+		// err checks the returned error, nil for success
+		err func(error) bool
+	}{
+		{name: "success", responses: []response{ok}, requests: 1},
+		{name: "throttled then success", responses: []response{throttled, ok}, requests: 2},
+		{name: "throttled mutation retried", mutate: true, responses: []response{throttled, ok}, requests: 2},
+		{name: "throttled until retries run out", responses: []response{throttled, throttled, throttled}, requests: 3, err: func(err error) bool {
+			var gqlErrs GraphQLErrors
+			return errors.As(err, &gqlErrs) && gqlErrs.throttled()
+		}},
+		{name: "server error on query retried", responses: []response{unavailable, ok}, requests: 2},
+		{name: "server error on mutation not retried", mutate: true, responses: []response{unavailable}, requests: 1, err: func(err error) bool {
+			var apiErr *APIError
+			return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable
+		}},
+		{name: "query error not retried", responses: []response{failed}, requests: 1, err: func(err error) bool {
+			var gqlErrs GraphQLErrors
+			return errors.As(err, &gqlErrs) && !gqlErrs.throttled()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, requests := newTestGraphQLClient(t, tt.responses...)
+
+			var out struct {
+				Shop struct {
+					Name string `json:"name"`
+				} `json:"shop"`
+			}
+			var err error
+			if tt.mutate {
+				err = client.Mutate(context.Background(), "mutation { shopUpdate }", nil, &out)
+			} else {
+				err = client.Query(context.Background(), "{ shop { name } }", nil, &out)
+			}
+
+			if *requests != tt.requests {
+				t.Fatalf("sent %d requests, want %d", *requests, tt.requests)
+			}
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("execute: %v", err)
+				}
+				if out.Shop.Name != "Example" {
+					t.Fatalf("decoded shop %q, want Example", out.Shop.Name)
+				}
+				return
+			}
+			if !tt.err(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestGraphQLWaitsForBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		available float64
+		lastCost  float64
+		// wait is whether the next query has to wait for the budget to restore
+		wait bool
+	}{
+		{name: "enough budget", available: 100, lastCost: 50, wait: false},
+		{name: "exhausted", available: 0, lastCost: 50, wait: true},
+		{name: "cost above maximum", available: 1000, lastCost: 5000, wait: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewGraphQLClient(NewClient("example.myshopify.com", "shpat_token"))
+			client.available = tt.available
+			client.lastCost = tt.lastCost
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := client.waitForBudget(ctx)
+			if waited := errors.Is(err, context.DeadlineExceeded); waited != tt.wait {
+				t.Fatalf("waitForBudget = %v, want waiting %v", err, tt.wait)
+			}
+		})
+	}
+}
+
+func TestGraphQLRecordsCost(t *testing.T) {
+	client, _ := newTestGraphQLClient(t, response{status: http.StatusOK, body: `{"data":{},"extensions":{"cost":` +
+		`{"requestedQueryCost":120,"actualQueryCost":80,"throttleStatus":{"maximumAvailable":2000,"currentlyAvailable":300,"restoreRate":100}}}}`})
+
+	if err := client.Query(context.Background(), "{ products { nodes { id } } }", nil, nil); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if client.available != 300 || client.maximum != 2000 || client.restoreRate != 100 || client.lastCost != 120 {
+		t.Fatalf("recorded budget %v/%v at %v/s with cost %v, want 300/2000 at 100/s with cost 120",
+			client.available, client.maximum, client.restoreRate, client.lastCost)
+	}
+}
+
+func TestPaginateConnection(t *testing.T) {
+	pages := []string{
+		`{"data":{"products":{"nodes":[{"id":"gid://shopify/Product/1"},{"id":"gid://shopify/Product/2"}],"pageInfo":{"hasNextPage":true,"endCursor":"c2"}}}}`,
+		`{"data":{"products":{"edges":[{"node":{"id":"gid://shopify/Product/3"}}],"pageInfo":{"hasNextPage":false,"endCursor":"c3"}}}}`,
+	}
+	var cursors []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		cursors = append(cursors, req.Variables["cursor"])
+		fmt.Fprint(w, pages[len(cursors)-1])
+	}))
+	defer server.Close()
+	client := NewGraphQLClient(NewClient("example.myshopify.com", "shpat_token", WithBaseURL(server.URL)))
+
+	var ids []string
+	err := client.PaginateConnection(context.Background(), "query($cursor: String) { ... }", nil, []string{"products"}, func(node json.RawMessage) error {
+		var product struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(node, &product); err != nil {
+			return err
+		}
+		ids = append(ids, product.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("PaginateConnection: %v", err)
+	}
+
+	if fmt.Sprint(ids) != "[gid://shopify/Product/1 gid://shopify/Product/2 gid://shopify/Product/3]" {
+		t.Fatalf("visited %v", ids)
+	}
+	if fmt.Sprint(cursors) != "[<nil> c2]" {
+		t.Fatalf("sent cursors %v, want none then c2", cursors)
+	}
+}
+
+func TestConnectionAt(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		path  []string
+		nodes int
+		ok    bool
+	}{
+		{name: "top level", data: `{"orders":{"nodes":[{},{}]}}`, path: []string{"orders"}, nodes: 2, ok: true},
+		{name: "nested", data: `{"product":{"variants":{"edges":[{"node":{}}]}}}`, path: []string{"product", "variants"}, nodes: 1, ok: true},
+		{name: "missing field", data: `{"orders":{}}`, path: []string{"products"}, ok: false},
+		{name: "not an object", data: `{"orders":[]}`, path: []string{"orders", "nodes"}, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := connectionAt(json.RawMessage(tt.data), tt.path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("connectionAt = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && len(conn.allNodes()) != tt.nodes {
+				t.Fatalf("found %d nodes, want %d", len(conn.allNodes()), tt.nodes)
+			}
+		})
+	}
+}
+
+func TestParseGID(t *testing.T) {
+	tests := []struct {
+		gid  string
+		want int64
+		ok   bool
+	}{
+		{gid: GID("Product", 632910392), want: 632910392, ok: true},
+		{gid: "gid://shopify/ProductVariant/808950810", want: 808950810, ok: true},
+		{gid: "gid://shopify/Product/abc", ok: false},
+		{gid: "632910392", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gid, func(t *testing.T) {
+			got, err := ParseGID(tt.gid)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseGID = %v, want ok %v", err, tt.ok)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseGID = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-redis/redis/v8"
+)
+
+// InventoryLevel is the available quantity of an inventory item at a location
+type InventoryLevel struct {
+	InventoryItemID int64     `json:"inventory_item_id"`
+	LocationID      int64     `json:"location_id"`
+	Available       *int      `json:"available"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// StockLevels tracks sellable stock per variant from the levels Shopify reports per inventory item.
+// Products link their variants to inventory items, and inventory levels set the available quantity
+// as of when Shopify updated it. Orders acknowledge the stock committed to them by CartLoom, keyed
+// by CartLoom's order ID, once Shopify recorded them.
+type StockLevels interface {
+	SetItemAvailable(ctx context.Context, inventoryItemID, locationID string, available int64, updatedAt time.Time) error
+	LinkItem(ctx context.Context, inventoryItemID, variantID string) error
+	AcknowledgeOrder(ctx context.Context, orderID string, placedAt time.Time) error
+}
+
+// DecodeInventoryLevel parses an inventory_levels/update webhook payload
+func DecodeInventoryLevel(body []byte) (*InventoryLevel, error) {
+	var level InventoryLevel
+	if err := json.Unmarshal(body, &level); err != nil {
+		return nil, &PayloadError{Resource: "inventory level", Err: err}
+	}
+	if level.InventoryItemID == 0 || level.LocationID == 0 {
+		return nil, &PayloadError{Resource: "inventory level", Err: errors.New("missing inventory item or location")}
+	}
+	return &level, nil
+}
+
+// InventoryLevelCacheKey returns the Redis key holding the available quantity of an item at a location
+func InventoryLevelCacheKey(inventoryItemID, locationID int64) string {
+	return fmt.Sprintf("inventory_level:%d:%d", inventoryItemID, locationID)
+}
+
+// StoreInventoryLevel writes the inventory level to Redis and DynamoDB and passes it on to the stock levels
+func StoreInventoryLevel(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, stock StockLevels, level *InventoryLevel) error {
+	available := 0
+	if level.Available != nil {
+		available = *level.Available
+	}
+
+	key := InventoryLevelCacheKey(level.InventoryItemID, level.LocationID)
+	if err := rdb.Set(ctx, key, available, 0).Err(); err != nil {
+		return fmt.Errorf("failed to update inventory level in Redis: %v", err)
+	}
+
+	_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("InventoryLevels"),
+		Item: map[string]types.AttributeValue{
+			"InventoryItemID": &types.AttributeValueMemberS{Value: strconv.FormatInt(level.InventoryItemID, 10)},
+			"LocationID":      &types.AttributeValueMemberS{Value: strconv.FormatInt(level.LocationID, 10)},
+			"Available":       &types.AttributeValueMemberN{Value: strconv.Itoa(available)},
+			"UpdatedAt":       &types.AttributeValueMemberS{Value: level.UpdatedAt.UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update inventory level in DynamoDB: %v", err)
+	}
+
+	itemID, locationID := strconv.FormatInt(level.InventoryItemID, 10), strconv.FormatInt(level.LocationID, 10)
+	if err := stock.SetItemAvailable(ctx, itemID, locationID, int64(available), level.UpdatedAt); err != nil {
+		return err
+	}
+
+	log.Printf("Inventory item %d at location %d set to %d", level.InventoryItemID, level.LocationID, available)
+	return nil
+}
@@ -0,0 +1,36 @@
+package shopify
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// webhookVerifications counts webhook requests by HMAC verification result
+var webhookVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_shopify_webhook_verifications_total",
+	Help: "Shopify webhook requests by HMAC verification result.",
+}, []string{"result"})
+
+// webhookDeduplications counts webhook deliveries by deduplication result
+var webhookDeduplications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_shopify_webhook_dedupe_total",
+	Help: "Shopify webhook deliveries by deduplication result (hit for duplicates, miss for first deliveries).",
+}, []string{"result"})
+
+// bulkOperationObjects reports the object count of running bulk operations as Shopify polls it
+var bulkOperationObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cartloom_shopify_bulk_operation_objects",
+	Help: "Objects processed so far by the current Shopify bulk operation, by resource.",
+}, []string{"resource"})
+
+// bulkImportedObjects counts objects loaded into Redis and DynamoDB from bulk results
+var bulkImportedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_shopify_bulk_imported_objects_total",
+	Help: "Objects imported from Shopify bulk operation results, by resource.",
+}, []string{"resource"})
+
+// bulkImports counts finished bulk imports by resource and result
+var bulkImports = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cartloom_shopify_bulk_imports_total",
+	Help: "Finished Shopify bulk imports, by resource and result.",
+}, []string{"resource", "result"})
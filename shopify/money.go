@@ -0,0 +1,45 @@
+package shopify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyExponent returns the number of decimal places of the currency's minor unit
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ParseAmount converts a decimal amount such as the Admin API's "19.99" into minor units of the currency
+func ParseAmount(amount, currency string) (int64, error) {
+	exp := currencyExponent(currency)
+
+	whole, frac, _ := strings.Cut(strings.TrimSpace(amount), ".")
+	if whole == "" || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	if len(frac) > exp {
+		if strings.Trim(frac[exp:], "0") != "" {
+			return 0, fmt.Errorf("amount %q has more precision than %s allows", amount, currency)
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %v", amount, err)
+	}
+	return minor, nil
+}
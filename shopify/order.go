@@ -0,0 +1,402 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+
+	cartdynamodb "cartloom/dynamodb"
+	"cartloom/order"
+	cartredis "cartloom/redis"
+)
+
+// Order is a Shopify order as delivered by the orders/* webhooks and the Admin API
+type Order struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// SourceIdentifier is the ID of the order on the platform that placed it, CartLoom's order ID
+	// for orders CartLoom placed in Shopify
+	SourceIdentifier  string     `json:"source_identifier"`
+	Email             string     `json:"email"`
+	FinancialStatus   string     `json:"financial_status"`
+	FulfillmentStatus *string    `json:"fulfillment_status"`
+	CancelledAt       *time.Time `json:"cancelled_at"`
+	CancelReason      *string    `json:"cancel_reason"`
+	Currency          string     `json:"currency"`
+	SubtotalPrice     string     `json:"subtotal_price"`
+	TotalTax          string     `json:"total_tax"`
+	TotalDiscounts    string     `json:"total_discounts"`
+	TotalPrice        string     `json:"total_price"`
+	// TotalShippingPriceSet is the shipping charged before shipping discounts, which Shopify
+	// counts in TotalDiscounts
+	TotalShippingPriceSet *MoneySet       `json:"total_shipping_price_set"`
+	ShippingLines         []ShippingLine  `json:"shipping_lines"`
+	LineItems             []OrderLineItem `json:"line_items"`
+	Customer              *Customer       `json:"customer"`
+	ShippingAddress       *Address        `json:"shipping_address"`
+	BillingAddress        *Address        `json:"billing_address"`
+	CreatedAt             time.Time       `json:"created_at"`
+	UpdatedAt             time.Time       `json:"updated_at"`
+	ProcessedAt           *time.Time      `json:"processed_at"`
+}
+
+// OrderLineItem is a single line of an order
+type OrderLineItem struct {
+	ID        int64  `json:"id"`
+	ProductID *int64 `json:"product_id"`
+	VariantID *int64 `json:"variant_id"`
+	Title     string `json:"title"`
+	SKU       string `json:"sku"`
+	Quantity  int    `json:"quantity"`
+	Price     string `json:"price"`
+}
+
+// ShippingLine is a shipping method charged on an order
+type ShippingLine struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Code  string `json:"code"`
+	Price string `json:"price"`
+}
+
+// MoneySet is an amount in the shop's currency and in the currency the customer was presented
+type MoneySet struct {
+	ShopMoney        Money `json:"shop_money"`
+	PresentmentMoney Money `json:"presentment_money"`
+}
+
+// Money is an amount in a currency
+type Money struct {
+	Amount       string `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+// Customer is a shop customer, as attached to orders or listed through the Admin API
+type Customer struct {
+	ID          int64     `json:"id"`
+	Email       string    `json:"email"`
+	FirstName   string    `json:"first_name"`
+	LastName    string    `json:"last_name"`
+	Phone       string    `json:"phone"`
+	State       string    `json:"state"`
+	Tags        string    `json:"tags"`
+	OrdersCount int       `json:"orders_count"`
+	TotalSpent  string    `json:"total_spent"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Address is a shipping or billing address
+type Address struct {
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Company      string `json:"company"`
+	Address1     string `json:"address1"`
+	Address2     string `json:"address2"`
+	City         string `json:"city"`
+	Province     string `json:"province"`
+	ProvinceCode string `json:"province_code"`
+	Zip          string `json:"zip"`
+	Country      string `json:"country"`
+	CountryCode  string `json:"country_code"`
+	Phone        string `json:"phone"`
+}
+
+// DecodeOrder parses an order webhook payload
+func DecodeOrder(body []byte) (*Order, error) {
+	var order Order
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, &PayloadError{Resource: "order", Err: err}
+	}
+	if order.ID == 0 {
+		return nil, &PayloadError{Resource: "order", Err: errors.New("missing id")}
+	}
+	return &order, nil
+}
+
+// Status maps the order's financial and fulfillment state onto the order lifecycle
+func (o *Order) Status() order.Status {
+	financial := strings.ToLower(o.FinancialStatus)
+	fulfillment := ""
+	if o.FulfillmentStatus != nil {
+		fulfillment = strings.ToLower(*o.FulfillmentStatus)
+	}
+
+	switch {
+	case financial == "refunded":
+		return order.StatusRefunded
+	case o.CancelledAt != nil || financial == "voided" || financial == "expired":
+		return order.StatusCancelled
+	case financial == "partially_refunded":
+		return order.StatusPartiallyRefunded
+	case fulfillment == "fulfilled":
+		return order.StatusFulfilled
+	case fulfillment == "partial" || fulfillment == "partially_fulfilled":
+		return order.StatusPartiallyFulfilled
+	case financial == "paid" || financial == "partially_paid":
+		return order.StatusPaid
+	case financial == "authorized":
+		return order.StatusAuthorized
+	default:
+		return order.StatusPending
+	}
+}
+
+// ToOrder converts the order into the stored order of the shop. Shopify's subtotal is net of
+// discounts, so the stored subtotal adds them back. Shipping is read from the order's shipping
+// total, or summed from its shipping lines when the total is missing.
+func (o *Order) ToOrder(shop string) (*order.Order, error) {
+	orderID := strconv.FormatInt(o.ID, 10)
+
+	amounts := make([]int64, 4)
+	for i, amount := range []string{o.SubtotalPrice, o.TotalDiscounts, o.TotalTax, o.TotalPrice} {
+		minor, err := parseOptionalAmount(amount, o.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("order %s: %v", orderID, err)
+		}
+		amounts[i] = minor
+	}
+	subtotal, discount, tax, total := amounts[0], amounts[1], amounts[2], amounts[3]
+
+	shipping, err := o.shipping()
+	if err != nil {
+		return nil, fmt.Errorf("order %s: %v", orderID, err)
+	}
+
+	updatedAt := o.UpdatedAt.UTC()
+	stored := &order.Order{
+		OrderID:         orderID,
+		Shop:            shop,
+		Status:          o.Status(),
+		ShippingAddress: o.ShippingAddress.toOrderAddress(),
+		BillingAddress:  o.BillingAddress.toOrderAddress(),
+		Currency:        o.Currency,
+		Subtotal:        subtotal + discount,
+		Discount:        discount,
+		Shipping:        shipping,
+		Tax:             tax,
+		Total:           total,
+		CreatedAt:       o.CreatedAt.UTC(),
+		SourceUpdatedAt: &updatedAt,
+	}
+
+	if c := o.Customer; c != nil {
+		stored.CustomerID = strconv.FormatInt(c.ID, 10)
+		stored.Customer = &order.Customer{
+			ID:        stored.CustomerID,
+			Email:     c.Email,
+			FirstName: c.FirstName,
+			LastName:  c.LastName,
+			Phone:     c.Phone,
+		}
+	} else if o.Email != "" {
+		stored.Customer = &order.Customer{Email: o.Email}
+	}
+
+	for _, item := range o.LineItems {
+		unitPrice, err := parseOptionalAmount(item.Price, o.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("order %s line %d: %v", orderID, item.ID, err)
+		}
+		line := order.LineItem{SKU: item.SKU, Title: item.Title, Quantity: item.Quantity, UnitPrice: unitPrice}
+		if item.ProductID != nil {
+			line.ProductID = strconv.FormatInt(*item.ProductID, 10)
+		}
+		if item.VariantID != nil {
+			line.VariantID = strconv.FormatInt(*item.VariantID, 10)
+		}
+		stored.LineItems = append(stored.LineItems, line)
+	}
+	return stored, nil
+}
+
+// shipping returns the shipping charged on the order in minor units
+func (o *Order) shipping() (int64, error) {
+	if o.TotalShippingPriceSet != nil {
+		return parseOptionalAmount(o.TotalShippingPriceSet.ShopMoney.Amount, o.Currency)
+	}
+
+	var shipping int64
+	for _, line := range o.ShippingLines {
+		price, err := parseOptionalAmount(line.Price, o.Currency)
+		if err != nil {
+			return 0, fmt.Errorf("shipping line %d: %v", line.ID, err)
+		}
+		shipping += price
+	}
+	return shipping, nil
+}
+
+// toOrderAddress converts the address into the stored order address
+func (a *Address) toOrderAddress() *order.Address {
+	if a == nil {
+		return nil
+	}
+	return &order.Address{
+		FirstName:    a.FirstName,
+		LastName:     a.LastName,
+		Company:      a.Company,
+		Address1:     a.Address1,
+		Address2:     a.Address2,
+		City:         a.City,
+		Province:     a.Province,
+		ProvinceCode: a.ProvinceCode,
+		Country:      a.Country,
+		CountryCode:  a.CountryCode,
+		Zip:          a.Zip,
+		Phone:        a.Phone,
+	}
+}
+
+// parseOptionalAmount parses an amount into minor units, reading a missing amount as zero
+func parseOptionalAmount(amount, currency string) (int64, error) {
+	if strings.TrimSpace(amount) == "" {
+		return 0, nil
+	}
+	return ParseAmount(amount, currency)
+}
+
+// storeOrderAttempts bounds how often StoreOrder retries an order that changed while it was writing
+const storeOrderAttempts = 5
+
+// storeOrderLockTimeout bounds how long StoreOrder waits for another writer of the same order
+const storeOrderLockTimeout = 5 * time.Second
+
+// OrderOutbox builds the outbox records committed with an order status change, such as the event
+// announcing it. A nil OrderOutbox commits none.
+type OrderOutbox func(order.State) ([]cartdynamodb.OutboxRecord, error)
+
+// StoreOrder writes the order to the orders table and caches its status in Redis. A new order is
+// created pending and, like a stored one, moved to Shopify's status through the lifecycle
+// transitions, recording each in the history with the outbox records built by outbox. A status the
+// lifecycle cannot reach from the stored one, such as a regression, is not applied. Every write is
+// checked against the stored version and retried when it lost a race, and a copy older than the
+// stored one is skipped, since webhooks and bulk imports may deliver an order out of order. The
+// order's lock is held while it is written to both stores, so concurrent deliveries cannot leave
+// Redis with an older status than DynamoDB, and data writes are fenced by the lock.
+func StoreOrder(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, outbox OrderOutbox, shop string, o *Order) error {
+	incoming, err := o.ToOrder(shop)
+	if err != nil {
+		return err
+	}
+
+	lock, err := cartredis.AcquireLock(ctx, rdb, fmt.Sprintf("lock:order:%s", incoming.OrderID), cartredis.LockOptions{Timeout: storeOrderLockTimeout})
+	if err != nil {
+		return fmt.Errorf("could not acquire lock for order %s: %w", incoming.OrderID, err)
+	}
+	defer func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("Failed to release lock for order %s: %v", incoming.OrderID, err)
+		}
+	}()
+	incoming.Fence = lock.FencingToken()
+
+	w := &orderWriter{db: db, orders: order.NewRepository(db), outbox: outbox, reason: orderReason(o)}
+	var state *order.State
+	for attempt := 1; ; attempt++ {
+		state, err = w.store(ctx, *incoming)
+		lostRace := errors.Is(err, order.ErrConcurrentUpdate) || errors.Is(err, order.ErrOrderExists)
+		if !lostRace || attempt == storeOrderAttempts {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		log.Printf("Order %s is older than the stored copy, skipped", incoming.OrderID)
+		return nil
+	}
+
+	select {
+	case <-lock.Lost():
+		return fmt.Errorf("%w: %s", cartredis.ErrLockNotHeld, lock.Key())
+	default:
+	}
+	if err := rdb.Set(ctx, state.OrderID, string(state.Status), 0).Err(); err != nil {
+		return fmt.Errorf("failed to update order %s in Redis: %v", state.OrderID, err)
+	}
+
+	log.Printf("Order %s stored with status '%s' (version %d)", state.OrderID, state.Status, state.Version)
+	return nil
+}
+
+// orderWriter writes mirrored orders for StoreOrder
+type orderWriter struct {
+	db     *dynamodb.Client
+	orders *order.Repository
+	outbox OrderOutbox
+	reason string
+}
+
+// store creates the order or replaces the data of the stored copy at its current version, then
+// moves it to the incoming status. It returns nil when the stored copy is newer than the incoming one.
+func (w *orderWriter) store(ctx context.Context, incoming order.Order) (*order.State, error) {
+	var state order.State
+	current, err := w.orders.Get(ctx, incoming.OrderID)
+	switch {
+	case errors.Is(err, order.ErrOrderNotFound):
+		records, err := w.records(order.State{OrderID: incoming.OrderID, Status: order.StatusPending, Version: 1})
+		if err != nil {
+			return nil, err
+		}
+		created := incoming
+		if state, err = order.Create(ctx, w.db, &created, w.reason, records...); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if current.SourceUpdatedAt != nil && current.SourceUpdatedAt.After(*incoming.SourceUpdatedAt) {
+			return nil, nil
+		}
+
+		updated := incoming
+		updated.Status = current.Status
+		updated.Version = current.Version
+		if updated.CreatedAt.IsZero() {
+			updated.CreatedAt = current.CreatedAt
+		}
+		if err := w.orders.Put(ctx, &updated); err != nil {
+			return nil, err
+		}
+		state = order.State{OrderID: updated.OrderID, Status: updated.Status, Version: updated.Version}
+	}
+
+	path := state.Status.PathTo(incoming.Status)
+	if path == nil {
+		log.Printf("Order %s cannot move from %s to Shopify's status %s, status kept", state.OrderID, state.Status, incoming.Status)
+		return &state, nil
+	}
+	for _, next := range path {
+		records, err := w.records(order.State{OrderID: state.OrderID, Status: next, Version: state.Version + 1})
+		if err != nil {
+			return nil, err
+		}
+		if state, err = order.Transition(ctx, w.db, state, next, w.reason, records...); err != nil {
+			return nil, err
+		}
+	}
+	return &state, nil
+}
+
+// records builds the outbox records of a status change
+func (w *orderWriter) records(next order.State) ([]cartdynamodb.OutboxRecord, error) {
+	if w.outbox == nil {
+		return nil, nil
+	}
+	return w.outbox(next)
+}
+
+// orderReason describes a Shopify order update in the order history
+func orderReason(o *Order) string {
+	return fmt.Sprintf("shopify order %d updated at %s", o.ID, o.UpdatedAt.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,65 @@
+package shopify
+
+import "testing"
+
+func TestToOrderAmounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		order Order
+		// want is the stored subtotal, discount, shipping, tax and total
+		want [5]int64
+	}{
+		{
+			name: "shipping total",
+			order: Order{
+				SubtotalPrice: "90.00", TotalDiscounts: "10.00", TotalTax: "17.10", TotalPrice: "112.10",
+				TotalShippingPriceSet: &MoneySet{ShopMoney: Money{Amount: "5.00", CurrencyCode: "EUR"}},
+			},
+			want: [5]int64{10000, 1000, 500, 1710, 11210},
+		},
+		{
+			name: "taxes included",
+			order: Order{
+				SubtotalPrice: "119.00", TotalTax: "19.95", TotalPrice: "124.95",
+				TotalShippingPriceSet: &MoneySet{ShopMoney: Money{Amount: "5.95", CurrencyCode: "EUR"}},
+			},
+			want: [5]int64{11900, 0, 595, 1995, 12495},
+		},
+		{
+			name: "shipping discounted away",
+			order: Order{
+				SubtotalPrice: "50.00", TotalDiscounts: "4.90", TotalPrice: "50.00",
+				TotalShippingPriceSet: &MoneySet{ShopMoney: Money{Amount: "4.90", CurrencyCode: "EUR"}},
+			},
+			want: [5]int64{5490, 490, 490, 0, 5000},
+		},
+		{
+			name: "shipping lines only",
+			order: Order{
+				SubtotalPrice: "20.00", TotalPrice: "27.50",
+				ShippingLines: []ShippingLine{{ID: 1, Price: "4.00"}, {ID: 2, Price: "3.50"}},
+			},
+			want: [5]int64{2000, 0, 750, 0, 2750},
+		},
+		{
+			name:  "no shipping",
+			order: Order{SubtotalPrice: "20.00", TotalTax: "3.80", TotalPrice: "23.80"},
+			want:  [5]int64{2000, 0, 0, 380, 2380},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.order.ID = 1001
+			tt.order.Currency = "EUR"
+			stored, err := tt.order.ToOrder("example.myshopify.com")
+			if err != nil {
+				t.Fatalf("ToOrder: %v", err)
+			}
+			got := [5]int64{stored.Subtotal, stored.Discount, stored.Shipping, stored.Tax, stored.Total}
+			if got != tt.want {
+				t.Fatalf("subtotal, discount, shipping, tax, total = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package shopify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linkNextPattern extracts the URL of the rel="next" entry of a Link header
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListOptions filters the list endpoints
+type ListOptions struct {
+	// Limit is the page size, at most 250
+	Limit        int
+	UpdatedAtMin time.Time
+	CreatedAtMin time.Time
+	// Status filters by resource status, e.g. "active" for products or "any" for orders
+	Status string
+	// Fields restricts the returned fields
+	Fields []string
+}
+
+// query encodes the options as the first page's query string
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(o.pageSize()))
+	if !o.UpdatedAtMin.IsZero() {
+		query.Set("updated_at_min", o.UpdatedAtMin.UTC().Format(time.RFC3339))
+	}
+	if !o.CreatedAtMin.IsZero() {
+		query.Set("created_at_min", o.CreatedAtMin.UTC().Format(time.RFC3339))
+	}
+	if o.Status != "" {
+		query.Set("status", o.Status)
+	}
+	if len(o.Fields) > 0 {
+		query.Set("fields", strings.Join(o.Fields, ","))
+	}
+	return query
+}
+
+// cursorQuery builds the query of a follow-up page; Shopify rejects filters next to page_info
+func (o ListOptions) cursorQuery(pageInfo string) url.Values {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(o.pageSize()))
+	query.Set("page_info", pageInfo)
+	if len(o.Fields) > 0 {
+		query.Set("fields", strings.Join(o.Fields, ","))
+	}
+	return query
+}
+
+// pageSize returns the configured page size bounded to Shopify's limits
+func (o ListOptions) pageSize() int {
+	if o.Limit <= 0 || o.Limit > 250 {
+		return 250
+	}
+	return o.Limit
+}
+
+// ListProducts calls fn for every product matching the options, following page_info cursors
+func (c *Client) ListProducts(ctx context.Context, opts ListOptions, fn func(Product) error) error {
+	return listAll(ctx, c, "products.json", "products", opts, fn)
+}
+
+// ListOrders calls fn for every order matching the options, following page_info cursors
+func (c *Client) ListOrders(ctx context.Context, opts ListOptions, fn func(Order) error) error {
+	return listAll(ctx, c, "orders.json", "orders", opts, fn)
+}
+
+// ListCustomers calls fn for every customer matching the options, following page_info cursors
+func (c *Client) ListCustomers(ctx context.Context, opts ListOptions, fn func(Customer) error) error {
+	return listAll(ctx, c, "customers.json", "customers", opts, fn)
+}
+
+// Stream runs a list method in the background and delivers its items on a channel.
+// The error channel receives the list result once the item channel is closed.
+func Stream[T any](ctx context.Context, list func(context.Context, func(T) error) error) (<-chan T, <-chan error) {
+	items := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(items)
+
+		errs <- list(ctx, func(item T) error {
+			select {
+			case items <- item:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	return items, errs
+}
+
+// listAll fetches every page of a list endpoint and calls fn for each item
+func listAll[T any](ctx context.Context, c *Client, path, resource string, opts ListOptions, fn func(T) error) error {
+	query := opts.query()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var page map[string][]T
+		resp, err := c.Do(ctx, http.MethodGet, path, query, nil, &page)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", resource, err)
+		}
+
+		for _, item := range page[resource] {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+		pageInfo := nextPageInfo(resp.Header)
+		if pageInfo == "" {
+			return nil
+		}
+		query = opts.cursorQuery(pageInfo)
+	}
+}
+
+// nextPageInfo returns the page_info cursor of the next page, or "" on the last page
+func nextPageInfo(header http.Header) string {
+	match := linkNextPattern.FindStringSubmatch(header.Get("Link"))
+	if match == nil {
+		return ""
+	}
+
+	next, err := url.Parse(match[1])
+	if err != nil {
+		return ""
+	}
+	return next.Query().Get("page_info")
+}
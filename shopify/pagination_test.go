@@ -0,0 +1,137 @@
+package shopify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNextPageInfo(t *testing.T) {
+	const base = "https://example.myshopify.com/admin/api/2024-07/products.json"
+
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{name: "next only", link: `<` + base + `?limit=50&page_info=abc>; rel="next"`, want: "abc"},
+		{name: "previous and next", link: `<` + base + `?limit=50&page_info=prev>; rel="previous", <` + base + `?limit=50&page_info=next>; rel="next"`, want: "next"},
+		{name: "previous only", link: `<` + base + `?limit=50&page_info=prev>; rel="previous"`, want: ""},
+		{name: "escaped cursor", link: `<` + base + `?page_info=a%2Bb%3D>; rel="next"`, want: "a+b="},
+		{name: "no header", link: "", want: ""},
+		{name: "no cursor", link: `<` + base + `?limit=50>; rel="next"`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.link != "" {
+				header.Set("Link", tt.link)
+			}
+			if got := nextPageInfo(header); got != tt.want {
+				t.Fatalf("nextPageInfo = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListOptionsQuery(t *testing.T) {
+	since := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	tests := []struct {
+		name   string
+		opts   ListOptions
+		first  string
+		cursor string
+	}{
+		{name: "defaults", opts: ListOptions{}, first: "limit=250", cursor: "limit=250&page_info=c1"},
+		{name: "limit above maximum", opts: ListOptions{Limit: 500}, first: "limit=250", cursor: "limit=250&page_info=c1"},
+		{
+			name:   "filters only on the first page",
+			opts:   ListOptions{Limit: 50, UpdatedAtMin: since, Status: "active", Fields: []string{"id", "title"}},
+			first:  "fields=id%2Ctitle&limit=50&status=active&updated_at_min=2024-03-01T11%3A00%3A00Z",
+			cursor: "fields=id%2Ctitle&limit=50&page_info=c1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.query().Encode(); got != tt.first {
+				t.Fatalf("first page query = %s, want %s", got, tt.first)
+			}
+			if got := tt.opts.cursorQuery("c1").Encode(); got != tt.cursor {
+				t.Fatalf("cursor query = %s, want %s", got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestListProductsFollowsCursors(t *testing.T) {
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		next := func(pageInfo string) {
+			w.Header().Set("Link", fmt.Sprintf(`<https://example.myshopify.com%s?limit=2&page_info=%s>; rel="next"`, r.URL.Path, pageInfo))
+		}
+		switch r.URL.Query().Get("page_info") {
+		case "":
+			next("c2")
+			fmt.Fprint(w, `{"products":[{"id":1},{"id":2}]}`)
+		case "c2":
+			next("c3")
+			fmt.Fprint(w, `{"products":[{"id":3}]}`)
+		case "c3":
+			fmt.Fprint(w, `{"products":[{"id":4}]}`)
+		}
+	}))
+	defer server.Close()
+	client := NewClient("example.myshopify.com", "shpat_token", WithBaseURL(server.URL))
+
+	var ids []int64
+	err := client.ListProducts(context.Background(), ListOptions{Limit: 2, Status: "active"}, func(p Product) error {
+		ids = append(ids, p.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListProducts: %v", err)
+	}
+
+	if fmt.Sprint(ids) != "[1 2 3 4]" {
+		t.Fatalf("listed products %v, want [1 2 3 4]", ids)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("fetched %d pages, want 3", len(queries))
+	}
+	if queries[0].Get("status") != "active" || queries[1].Get("status") != "" {
+		t.Fatalf("status filter sent as %q and %q, want it on the first page only", queries[0].Get("status"), queries[1].Get("status"))
+	}
+}
+
+func TestListProductsStopsOnCallbackError(t *testing.T) {
+	pages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages++
+		w.Header().Set("Link", `<https://example.myshopify.com/admin/api/2024-07/products.json?page_info=next>; rel="next"`)
+		fmt.Fprint(w, `{"products":[{"id":1},{"id":2}]}`)
+	}))
+	defer server.Close()
+	client := NewClient("example.myshopify.com", "shpat_token", WithBaseURL(server.URL))
+
+	stop := errors.New("stop")
+	calls := 0
+	err := client.ListProducts(context.Background(), ListOptions{}, func(p Product) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("ListProducts = %v, want the callback error", err)
+	}
+	if calls != 1 || pages != 1 {
+		t.Fatalf("callback ran %d times over %d pages, want 1 and 1", calls, pages)
+	}
+}
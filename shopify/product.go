@@ -0,0 +1,160 @@
+package shopify
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Product is a Shopify product as delivered by the products/* webhooks and the Admin API
+type Product struct {
+	ID          int64            `json:"id"`
+	Title       string           `json:"title"`
+	BodyHTML    string           `json:"body_html"`
+	Vendor      string           `json:"vendor"`
+	ProductType string           `json:"product_type"`
+	Handle      string           `json:"handle"`
+	Status      string           `json:"status"`
+	Tags        string           `json:"tags"`
+	Variants    []ProductVariant `json:"variants"`
+	Options     []ProductOption  `json:"options"`
+	Images      []ProductImage   `json:"images"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	PublishedAt *time.Time       `json:"published_at"`
+}
+
+// ProductVariant is a purchasable variant of a product
+type ProductVariant struct {
+	ID                int64   `json:"id"`
+	ProductID         int64   `json:"product_id"`
+	Title             string  `json:"title"`
+	SKU               string  `json:"sku"`
+	Price             string  `json:"price"`
+	CompareAtPrice    *string `json:"compare_at_price"`
+	Position          int     `json:"position"`
+	Option1           *string `json:"option1"`
+	Option2           *string `json:"option2"`
+	Option3           *string `json:"option3"`
+	Barcode           string  `json:"barcode"`
+	InventoryItemID   int64   `json:"inventory_item_id"`
+	InventoryQuantity int     `json:"inventory_quantity"`
+	InventoryPolicy   string  `json:"inventory_policy"`
+	ImageID           *int64  `json:"image_id"`
+}
+
+// ProductOption is a named option such as size or color
+type ProductOption struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Position int      `json:"position"`
+	Values   []string `json:"values"`
+}
+
+// ProductImage is an image attached to a product
+type ProductImage struct {
+	ID         int64   `json:"id"`
+	Position   int     `json:"position"`
+	Src        string  `json:"src"`
+	Alt        *string `json:"alt"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	VariantIDs []int64 `json:"variant_ids"`
+}
+
+// ProductRecord is the normalized product representation stored in Redis and DynamoDB
+type ProductRecord struct {
+	ProductID   string          `json:"product_id"`
+	Title       string          `json:"title"`
+	Vendor      string          `json:"vendor"`
+	ProductType string          `json:"product_type"`
+	Handle      string          `json:"handle"`
+	Status      string          `json:"status"`
+	Tags        []string        `json:"tags"`
+	Options     []ProductOption `json:"options"`
+	Variants    []VariantRecord `json:"variants"`
+	Images      []string        `json:"images"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// VariantRecord is the normalized variant representation
+type VariantRecord struct {
+	VariantID         string   `json:"variant_id"`
+	Title             string   `json:"title"`
+	SKU               string   `json:"sku"`
+	Price             string   `json:"price"`
+	Options           []string `json:"options"`
+	InventoryItemID   string   `json:"inventory_item_id"`
+	InventoryQuantity int      `json:"inventory_quantity"`
+}
+
+// DecodeProduct parses a product webhook payload
+func DecodeProduct(body []byte) (*Product, error) {
+	var product Product
+	if err := json.Unmarshal(body, &product); err != nil {
+		return nil, &PayloadError{Resource: "product", Err: err}
+	}
+	if product.ID == 0 {
+		return nil, &PayloadError{Resource: "product", Err: errors.New("missing id")}
+	}
+	return &product, nil
+}
+
+// Normalize converts the product into the record stored by CartLoom
+func (p *Product) Normalize() ProductRecord {
+	record := ProductRecord{
+		ProductID:   strconv.FormatInt(p.ID, 10),
+		Title:       p.Title,
+		Vendor:      p.Vendor,
+		ProductType: p.ProductType,
+		Handle:      p.Handle,
+		Status:      p.Status,
+		Tags:        splitTags(p.Tags),
+		Options:     p.Options,
+		Variants:    make([]VariantRecord, 0, len(p.Variants)),
+		Images:      make([]string, 0, len(p.Images)),
+		UpdatedAt:   p.UpdatedAt,
+	}
+
+	for _, v := range p.Variants {
+		record.Variants = append(record.Variants, VariantRecord{
+			VariantID:         strconv.FormatInt(v.ID, 10),
+			Title:             v.Title,
+			SKU:               v.SKU,
+			Price:             v.Price,
+			Options:           variantOptions(v),
+			InventoryItemID:   strconv.FormatInt(v.InventoryItemID, 10),
+			InventoryQuantity: v.InventoryQuantity,
+		})
+	}
+
+	for _, img := range p.Images {
+		record.Images = append(record.Images, img.Src)
+	}
+
+	return record
+}
+
+// splitTags turns Shopify's comma separated tag string into a list
+func splitTags(tags string) []string {
+	result := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// variantOptions collects the non-empty option values of a variant
+func variantOptions(v ProductVariant) []string {
+	options := []string{}
+	for _, opt := range []*string{v.Option1, v.Option2, v.Option3} {
+		if opt != nil && *opt != "" {
+			options = append(options, *opt)
+		}
+	}
+	return options
+}
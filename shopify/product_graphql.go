@@ -0,0 +1,210 @@
+package shopify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProductFetcher fetches a single product; it is implemented by the REST Client and the GraphQLClient
+type ProductFetcher interface {
+	FetchProductDetails(ctx context.Context, productID int64) (*Product, error)
+}
+
+// productFields selects the product fields mapped onto Product
+const productFields = `
+	id
+	title
+	descriptionHtml
+	vendor
+	productType
+	handle
+	status
+	tags
+	createdAt
+	updatedAt
+	publishedAt
+	options { id name position values }
+	variants(first: 100) {
+		nodes {
+			id
+			title
+			sku
+			price
+			compareAtPrice
+			position
+			barcode
+			inventoryQuantity
+			inventoryPolicy
+			selectedOptions { value }
+			inventoryItem { id }
+			image { id }
+		}
+	}
+	images(first: 50) {
+		nodes { id url altText width height }
+	}
+`
+
+// productQuery fetches one product by global ID
+const productQuery = `query Product($id: ID!) {
+	product(id: $id) {` + productFields + `}
+}`
+
+// graphQLProduct is the GraphQL shape of productFields
+type graphQLProduct struct {
+	ID              string     `json:"id"`
+	Title           string     `json:"title"`
+	DescriptionHTML string     `json:"descriptionHtml"`
+	Vendor          string     `json:"vendor"`
+	ProductType     string     `json:"productType"`
+	Handle          string     `json:"handle"`
+	Status          string     `json:"status"`
+	Tags            []string   `json:"tags"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+	PublishedAt     *time.Time `json:"publishedAt"`
+	Options         []struct {
+		ID       string   `json:"id"`
+		Name     string   `json:"name"`
+		Position int      `json:"position"`
+		Values   []string `json:"values"`
+	} `json:"options"`
+	Variants struct {
+		Nodes []graphQLVariant `json:"nodes"`
+	} `json:"variants"`
+	Images struct {
+		Nodes []graphQLImage `json:"nodes"`
+	} `json:"images"`
+}
+
+// graphQLImage is the GraphQL shape of a product image
+type graphQLImage struct {
+	ID      string  `json:"id"`
+	URL     string  `json:"url"`
+	AltText *string `json:"altText"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+}
+
+// graphQLVariant is the GraphQL shape of a product variant
+type graphQLVariant struct {
+	ID                string  `json:"id"`
+	Title             string  `json:"title"`
+	SKU               string  `json:"sku"`
+	Price             string  `json:"price"`
+	CompareAtPrice    *string `json:"compareAtPrice"`
+	Position          int     `json:"position"`
+	Barcode           string  `json:"barcode"`
+	InventoryQuantity int     `json:"inventoryQuantity"`
+	InventoryPolicy   string  `json:"inventoryPolicy"`
+	SelectedOptions   []struct {
+		Value string `json:"value"`
+	} `json:"selectedOptions"`
+	InventoryItem struct {
+		ID string `json:"id"`
+	} `json:"inventoryItem"`
+	Image *struct {
+		ID string `json:"id"`
+	} `json:"image"`
+}
+
+// FetchProductDetails fetches a product through the GraphQL Admin API
+func (g *GraphQLClient) FetchProductDetails(ctx context.Context, productID int64) (*Product, error) {
+	var data struct {
+		Product *graphQLProduct `json:"product"`
+	}
+	if err := g.Query(ctx, productQuery, map[string]interface{}{"id": GID("Product", productID)}, &data); err != nil {
+		return nil, fmt.Errorf("failed to fetch product %d: %w", productID, err)
+	}
+	if data.Product == nil {
+		return nil, &APIError{StatusCode: http.StatusNotFound, Body: fmt.Sprintf("product %d not found", productID)}
+	}
+	return data.Product.toProduct(), nil
+}
+
+// toProduct maps the GraphQL product onto the REST shaped Product
+func (gp *graphQLProduct) toProduct() *Product {
+	productID, _ := ParseGID(gp.ID)
+	product := &Product{
+		ID:          productID,
+		Title:       gp.Title,
+		BodyHTML:    gp.DescriptionHTML,
+		Vendor:      gp.Vendor,
+		ProductType: gp.ProductType,
+		Handle:      gp.Handle,
+		Status:      strings.ToLower(gp.Status),
+		Tags:        strings.Join(gp.Tags, ", "),
+		CreatedAt:   gp.CreatedAt,
+		UpdatedAt:   gp.UpdatedAt,
+		PublishedAt: gp.PublishedAt,
+	}
+
+	for _, opt := range gp.Options {
+		optionID, _ := ParseGID(opt.ID)
+		product.Options = append(product.Options, ProductOption{
+			ID:       optionID,
+			Name:     opt.Name,
+			Position: opt.Position,
+			Values:   opt.Values,
+		})
+	}
+
+	for _, v := range gp.Variants.Nodes {
+		product.Variants = append(product.Variants, v.toVariant(productID))
+	}
+
+	for i, img := range gp.Images.Nodes {
+		imageID, _ := ParseGID(img.ID)
+		product.Images = append(product.Images, ProductImage{
+			ID:       imageID,
+			Position: i + 1,
+			Src:      img.URL,
+			Alt:      img.AltText,
+			Width:    img.Width,
+			Height:   img.Height,
+		})
+	}
+	return product
+}
+
+// toVariant maps the GraphQL variant onto the REST shaped ProductVariant
+func (gv *graphQLVariant) toVariant(productID int64) ProductVariant {
+	variantID, _ := ParseGID(gv.ID)
+	inventoryItemID, _ := ParseGID(gv.InventoryItem.ID)
+
+	variant := ProductVariant{
+		ID:                variantID,
+		ProductID:         productID,
+		Title:             gv.Title,
+		SKU:               gv.SKU,
+		Price:             gv.Price,
+		CompareAtPrice:    gv.CompareAtPrice,
+		Position:          gv.Position,
+		Barcode:           gv.Barcode,
+		InventoryItemID:   inventoryItemID,
+		InventoryQuantity: gv.InventoryQuantity,
+		InventoryPolicy:   strings.ToLower(gv.InventoryPolicy),
+	}
+
+	for i, opt := range gv.SelectedOptions {
+		value := opt.Value
+		switch i {
+		case 0:
+			variant.Option1 = &value
+		case 1:
+			variant.Option2 = &value
+		case 2:
+			variant.Option3 = &value
+		}
+	}
+
+	if gv.Image != nil {
+		if imageID, err := ParseGID(gv.Image.ID); err == nil {
+			variant.ImageID = &imageID
+		}
+	}
+	return variant
+}
@@ -0,0 +1,106 @@
+package shopify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka headers carried by published webhook events
+const (
+	HeaderShopDomain = "shopify-shop-domain"
+	HeaderTopic      = "shopify-topic"
+	HeaderWebhookID  = "shopify-webhook-id"
+	HeaderAPIVersion = "shopify-api-version"
+)
+
+// WebhookPublisher validates incoming webhooks and publishes them to Kafka for asynchronous processing
+type WebhookPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewWebhookPublisher creates a publisher on top of a Kafka writer without a fixed topic
+func NewWebhookPublisher(writer *kafka.Writer) *WebhookPublisher {
+	return &WebhookPublisher{writer: writer}
+}
+
+// KafkaTopic returns the Kafka topic that carries events of a Shopify webhook topic
+func KafkaTopic(topic string) string {
+	return "shopify." + strings.ReplaceAll(topic, "/", ".")
+}
+
+// HandleWebhook validates the webhook, publishes the raw event and acknowledges it
+func (p *WebhookPublisher) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		log.Printf("Error reading webhook request body: %v", err)
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	topic := r.Header.Get("X-Shopify-Topic")
+	shop := r.Header.Get("X-Shopify-Shop-Domain")
+	if shop == "" {
+		http.Error(w, "Missing shop domain", http.StatusBadRequest)
+		return
+	}
+
+	key, err := webhookEventKey(topic, body)
+	if err != nil {
+		log.Printf("Rejected %s webhook from %s: %v", topic, shop, err)
+		http.Error(w, "Malformed webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	msg := kafka.Message{
+		Topic: KafkaTopic(topic),
+		Key:   []byte(shop + "/" + key),
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: HeaderShopDomain, Value: []byte(shop)},
+			{Key: HeaderTopic, Value: []byte(topic)},
+			{Key: HeaderWebhookID, Value: []byte(r.Header.Get("X-Shopify-Webhook-Id"))},
+			{Key: HeaderAPIVersion, Value: []byte(r.Header.Get("X-Shopify-API-Version"))},
+		},
+	}
+
+	if err := p.writer.WriteMessages(r.Context(), msg); err != nil {
+		log.Printf("Failed to publish %s webhook to Kafka: %v", topic, err)
+		http.Error(w, "Failed to enqueue webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Webhook accepted"))
+}
+
+// webhookEventKey checks that the payload is well formed and returns the ID of the
+// resource it describes, so events of the same resource keep their order in Kafka
+func webhookEventKey(topic string, body []byte) (string, error) {
+	var payload struct {
+		ID              json.Number `json:"id"`
+		InventoryItemID json.Number `json:"inventory_item_id"`
+		LocationID      json.Number `json:"location_id"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	switch {
+	case topic == TopicInventoryLevelsUpdate:
+		if payload.InventoryItemID == "" || payload.LocationID == "" {
+			return "", fmt.Errorf("missing inventory item or location")
+		}
+		return fmt.Sprintf("%s/%s", payload.InventoryItemID, payload.LocationID), nil
+	case topic == TopicAppUninstalled:
+		return "app", nil
+	case payload.ID == "":
+		return "", fmt.Errorf("missing id")
+	default:
+		return payload.ID.String(), nil
+	}
+}
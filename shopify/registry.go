@@ -0,0 +1,315 @@
+package shopify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-redis/redis/v8"
+)
+
+// Shop statuses stored in the registry
+const (
+	ShopStatusActive      = "active"
+	ShopStatusUninstalled = "uninstalled"
+)
+
+// shopsTable is the DynamoDB table backing the registry
+const shopsTable = "Shops"
+
+// ErrShopNotFound is returned when a shop is not in the registry
+var ErrShopNotFound = errors.New("shop not found")
+
+// Shop is an installed shop and its credentials
+type Shop struct {
+	Domain      string
+	AccessToken string
+	Scopes      []string
+	InstalledAt time.Time
+	Plan        string
+	Status      string
+}
+
+// Active reports whether the shop has the app installed
+func (s *Shop) Active() bool {
+	return s.Status == ShopStatusActive && s.AccessToken != ""
+}
+
+// shopItem is the persisted form of a shop, with the token encrypted
+type shopItem struct {
+	Domain         string    `json:"domain"`
+	EncryptedToken string    `json:"encrypted_token"`
+	Scopes         string    `json:"scopes"`
+	InstalledAt    time.Time `json:"installed_at"`
+	Plan           string    `json:"plan"`
+	Status         string    `json:"status"`
+}
+
+// ShopRegistry stores installed shops in DynamoDB and caches them in Redis
+type ShopRegistry struct {
+	rdb        *redis.Client
+	db         *dynamodb.Client
+	cipher     *TokenCipher
+	cacheTTL   time.Duration
+	clientOpts []ClientOption
+
+	mu sync.Mutex
+	// clients holds one API client per shop domain so its rate limit is shared by every caller
+	clients map[string]*Client
+}
+
+// NewShopRegistry creates a registry; tokens are encrypted with the cipher before they leave the process.
+// The options configure the API clients handed out by Client.
+func NewShopRegistry(rdb *redis.Client, db *dynamodb.Client, cipher *TokenCipher, cacheTTL time.Duration, clientOpts ...ClientOption) *ShopRegistry {
+	return &ShopRegistry{
+		rdb:        rdb,
+		db:         db,
+		cipher:     cipher,
+		cacheTTL:   cacheTTL,
+		clientOpts: clientOpts,
+		clients:    make(map[string]*Client),
+	}
+}
+
+// Client returns the Admin API client of the shop, creating it on first use. Every caller of a
+// shop shares the client and with it the leaky bucket tracking the shop's REST rate limit. A new
+// client replaces the cached one when the shop was reinstalled with another token.
+func (sr *ShopRegistry) Client(shop *Shop) *Client {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if c, ok := sr.clients[shop.Domain]; ok && c.AccessToken == shop.AccessToken {
+		return c
+	}
+	c := NewClient(shop.Domain, shop.AccessToken, sr.clientOpts...)
+	sr.clients[shop.Domain] = c
+	return c
+}
+
+// dropClient forgets the cached API client of the shop
+func (sr *ShopRegistry) dropClient(domain string) {
+	sr.mu.Lock()
+	delete(sr.clients, domain)
+	sr.mu.Unlock()
+}
+
+// shopCacheKey returns the Redis key caching a shop record
+func shopCacheKey(domain string) string {
+	return fmt.Sprintf("shop:%s", domain)
+}
+
+// Save creates or replaces the shop in the registry
+func (sr *ShopRegistry) Save(ctx context.Context, shop *Shop) error {
+	encrypted, err := sr.cipher.Encrypt(shop.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	item := shopItem{
+		Domain:         shop.Domain,
+		EncryptedToken: encrypted,
+		Scopes:         strings.Join(shop.Scopes, ","),
+		InstalledAt:    shop.InstalledAt,
+		Plan:           shop.Plan,
+		Status:         shop.Status,
+	}
+
+	_, err = sr.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(shopsTable),
+		Item:      marshalShopItem(item),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save shop %s: %v", shop.Domain, err)
+	}
+
+	sr.invalidate(ctx, shop.Domain)
+	sr.dropClient(shop.Domain)
+	log.Printf("Shop %s saved to registry with status %s", shop.Domain, shop.Status)
+	return nil
+}
+
+// Get returns the shop with its decrypted access token
+func (sr *ShopRegistry) Get(ctx context.Context, domain string) (*Shop, error) {
+	item, err := sr.cachedItem(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		if item, err = sr.loadItem(ctx, domain); err != nil {
+			return nil, err
+		}
+		sr.cacheItem(ctx, item)
+	}
+	return sr.decryptItem(item)
+}
+
+// ActiveShops returns every shop that currently has the app installed
+func (sr *ShopRegistry) ActiveShops(ctx context.Context) ([]*Shop, error) {
+	var shops []*Shop
+	paginator := dynamodb.NewScanPaginator(sr.db, &dynamodb.ScanInput{
+		TableName:                aws.String(shopsTable),
+		FilterExpression:         aws.String("#status = :active"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: ShopStatusActive},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan shops: %v", err)
+		}
+		for _, av := range page.Items {
+			shop, err := sr.decryptItem(unmarshalShopItem(av))
+			if err != nil {
+				return nil, err
+			}
+			shops = append(shops, shop)
+		}
+	}
+	return shops, nil
+}
+
+// Deactivate marks the shop as uninstalled and purges its credentials
+func (sr *ShopRegistry) Deactivate(ctx context.Context, domain string) error {
+	_, err := sr.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(shopsTable),
+		Key: map[string]types.AttributeValue{
+			"ShopDomain": &types.AttributeValueMemberS{Value: domain},
+		},
+		UpdateExpression:         aws.String("SET #status = :uninstalled REMOVE EncryptedToken"),
+		ConditionExpression:      aws.String("attribute_exists(ShopDomain)"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uninstalled": &types.AttributeValueMemberS{Value: ShopStatusUninstalled},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrShopNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to deactivate shop %s: %v", domain, err)
+	}
+
+	sr.invalidate(ctx, domain)
+	sr.dropClient(domain)
+	log.Printf("Shop %s deactivated and credentials purged", domain)
+	return nil
+}
+
+// cachedItem reads the shop from Redis, returning nil on a cache miss
+func (sr *ShopRegistry) cachedItem(ctx context.Context, domain string) (*shopItem, error) {
+	data, err := sr.rdb.Get(ctx, shopCacheKey(domain)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read shop %s from cache: %v", domain, err)
+		return nil, nil
+	}
+
+	var item shopItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		log.Printf("Discarding corrupt cache entry for shop %s: %v", domain, err)
+		return nil, nil
+	}
+	return &item, nil
+}
+
+// loadItem reads the shop from DynamoDB
+func (sr *ShopRegistry) loadItem(ctx context.Context, domain string) (*shopItem, error) {
+	out, err := sr.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(shopsTable),
+		Key: map[string]types.AttributeValue{
+			"ShopDomain": &types.AttributeValueMemberS{Value: domain},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shop %s: %v", domain, err)
+	}
+	if out.Item == nil {
+		return nil, ErrShopNotFound
+	}
+	return unmarshalShopItem(out.Item), nil
+}
+
+// cacheItem stores the encrypted shop record in Redis
+func (sr *ShopRegistry) cacheItem(ctx context.Context, item *shopItem) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	if err := sr.rdb.Set(ctx, shopCacheKey(item.Domain), data, sr.cacheTTL).Err(); err != nil {
+		log.Printf("Failed to cache shop %s: %v", item.Domain, err)
+	}
+}
+
+// invalidate drops the cached shop record
+func (sr *ShopRegistry) invalidate(ctx context.Context, domain string) {
+	if err := sr.rdb.Del(ctx, shopCacheKey(domain)).Err(); err != nil {
+		log.Printf("Failed to invalidate cached shop %s: %v", domain, err)
+	}
+}
+
+// decryptItem converts the persisted record into a Shop with a plaintext token
+func (sr *ShopRegistry) decryptItem(item *shopItem) (*Shop, error) {
+	shop := &Shop{
+		Domain:      item.Domain,
+		Scopes:      splitTags(item.Scopes),
+		InstalledAt: item.InstalledAt,
+		Plan:        item.Plan,
+		Status:      item.Status,
+	}
+
+	if item.EncryptedToken != "" {
+		token, err := sr.cipher.Decrypt(item.EncryptedToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt token for shop %s: %v", item.Domain, err)
+		}
+		shop.AccessToken = token
+	}
+	return shop, nil
+}
+
+// marshalShopItem converts the record into DynamoDB attributes
+func marshalShopItem(item shopItem) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ShopDomain":     &types.AttributeValueMemberS{Value: item.Domain},
+		"EncryptedToken": &types.AttributeValueMemberS{Value: item.EncryptedToken},
+		"Scopes":         &types.AttributeValueMemberS{Value: item.Scopes},
+		"InstalledAt":    &types.AttributeValueMemberS{Value: item.InstalledAt.UTC().Format(time.RFC3339)},
+		"Plan":           &types.AttributeValueMemberS{Value: item.Plan},
+		"Status":         &types.AttributeValueMemberS{Value: item.Status},
+	}
+}
+
+// unmarshalShopItem converts DynamoDB attributes into the record
+func unmarshalShopItem(av map[string]types.AttributeValue) *shopItem {
+	installedAt, _ := time.Parse(time.RFC3339, stringAttr(av, "InstalledAt"))
+	return &shopItem{
+		Domain:         stringAttr(av, "ShopDomain"),
+		EncryptedToken: stringAttr(av, "EncryptedToken"),
+		Scopes:         stringAttr(av, "Scopes"),
+		InstalledAt:    installedAt,
+		Plan:           stringAttr(av, "Plan"),
+		Status:         stringAttr(av, "Status"),
+	}
+}
+
+// stringAttr returns the string value of an attribute, or "" when absent
+func stringAttr(av map[string]types.AttributeValue, name string) string {
+	if v, ok := av[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
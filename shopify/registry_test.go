@@ -0,0 +1,29 @@
+package shopify
+
+import "testing"
+
+func TestShopRegistryClient(t *testing.T) {
+	registry := NewShopRegistry(nil, nil, nil, 0, WithMaxRetries(1))
+	shop := &Shop{Domain: "example.myshopify.com", AccessToken: "shpat_first"}
+
+	first := registry.Client(shop)
+	if first.MaxRetries != 1 {
+		t.Fatalf("client has %d retries, want the registry's option of 1", first.MaxRetries)
+	}
+	if registry.Client(&Shop{Domain: shop.Domain, AccessToken: shop.AccessToken}) != first {
+		t.Fatal("second lookup of the shop created another client")
+	}
+	if other := registry.Client(&Shop{Domain: "other.myshopify.com", AccessToken: "shpat_other"}); other == first {
+		t.Fatal("shops share a client")
+	}
+
+	reinstalled := registry.Client(&Shop{Domain: shop.Domain, AccessToken: "shpat_second"})
+	if reinstalled == first || reinstalled.AccessToken != "shpat_second" {
+		t.Fatal("client was not replaced after the token changed")
+	}
+
+	registry.dropClient(shop.Domain)
+	if registry.Client(&Shop{Domain: shop.Domain, AccessToken: "shpat_second"}) == reinstalled {
+		t.Fatal("dropped client was handed out again")
+	}
+}
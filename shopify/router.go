@@ -0,0 +1,64 @@
+package shopify
+
+import (
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Webhook topics CartLoom subscribes to
+const (
+	TopicProductsCreate        = "products/create"
+	TopicProductsUpdate        = "products/update"
+	TopicProductsDelete        = "products/delete"
+	TopicOrdersCreate          = "orders/create"
+	TopicOrdersUpdated         = "orders/updated"
+	TopicOrdersPaid            = "orders/paid"
+	TopicOrdersCancelled       = "orders/cancelled"
+	TopicOrdersFulfilled       = "orders/fulfilled"
+	TopicInventoryLevelsUpdate = "inventory_levels/update"
+	TopicAppUninstalled        = "app/uninstalled"
+)
+
+// WebhookRouter dispatches Shopify webhooks to handlers based on the X-Shopify-Topic header
+type WebhookRouter struct {
+	handlers map[string]http.HandlerFunc
+}
+
+// NewWebhookRouter creates an empty webhook router
+func NewWebhookRouter() *WebhookRouter {
+	return &WebhookRouter{handlers: make(map[string]http.HandlerFunc)}
+}
+
+// Handle registers the handler for a webhook topic, replacing any previous one
+func (wr *WebhookRouter) Handle(topic string, handler http.HandlerFunc) {
+	wr.handlers[topic] = handler
+}
+
+// Topics returns the registered topics in sorted order
+func (wr *WebhookRouter) Topics() []string {
+	topics := make([]string, 0, len(wr.handlers))
+	for topic := range wr.handlers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// ServeHTTP dispatches the webhook to the handler registered for its topic
+func (wr *WebhookRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.Header.Get("X-Shopify-Topic")
+	handler, ok := wr.handlers[topic]
+	if !ok {
+		log.Printf("No handler registered for webhook topic %q", topic)
+		http.Error(w, "Unknown webhook topic", http.StatusNotFound)
+		return
+	}
+
+	handler(w, r)
+}
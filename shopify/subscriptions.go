@@ -0,0 +1,90 @@
+package shopify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// WebhookSubscription is a webhook subscription registered with Shopify
+type WebhookSubscription struct {
+	ID      int64  `json:"id,omitempty"`
+	Topic   string `json:"topic"`
+	Address string `json:"address"`
+	Format  string `json:"format"`
+}
+
+// RegisterWebhook subscribes the address to a webhook topic for the shop
+func (c *Client) RegisterWebhook(ctx context.Context, topic, address string) error {
+	body := map[string]WebhookSubscription{
+		"webhook": {Topic: topic, Address: address, Format: "json"},
+	}
+	if _, err := c.Do(ctx, http.MethodPost, "webhooks.json", nil, body, nil); err != nil {
+		return fmt.Errorf("failed to register webhook %s: %w", topic, err)
+	}
+
+	log.Printf("Webhook %s registered successfully for shop %s", topic, c.BaseURL)
+	return nil
+}
+
+// ListWebhooks returns the webhook subscriptions the app has registered for the shop
+func (c *Client) ListWebhooks(ctx context.Context) ([]WebhookSubscription, error) {
+	var payload struct {
+		Webhooks []WebhookSubscription `json:"webhooks"`
+	}
+	if _, err := c.Do(ctx, http.MethodGet, "webhooks.json", nil, nil, &payload); err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	return payload.Webhooks, nil
+}
+
+// DeleteWebhook removes a webhook subscription from the shop
+func (c *Client) DeleteWebhook(ctx context.Context, webhookID int64) error {
+	_, err := c.Do(ctx, http.MethodDelete, fmt.Sprintf("webhooks/%d.json", webhookID), nil, nil, nil)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to delete webhook %d: %w", webhookID, err)
+	}
+
+	log.Printf("Webhook %d deleted for shop %s", webhookID, c.BaseURL)
+	return nil
+}
+
+// ReconcileWebhooks makes the shop's subscriptions match the given topics at the address.
+// Missing subscriptions are created and any other subscription of the app is deleted,
+// so it can run on every startup.
+func (c *Client) ReconcileWebhooks(ctx context.Context, address string, topics []string) error {
+	existing, err := c.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		wanted[topic] = true
+	}
+
+	registered := make(map[string]bool, len(existing))
+	for _, sub := range existing {
+		if wanted[sub.Topic] && sub.Address == address && !registered[sub.Topic] {
+			registered[sub.Topic] = true
+			continue
+		}
+
+		if err := c.DeleteWebhook(ctx, sub.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, topic := range topics {
+		if registered[topic] {
+			continue
+		}
+		if err := c.RegisterWebhook(ctx, topic, address); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Webhooks reconciled for shop %s: %d topics", c.BaseURL, len(topics))
+	return nil
+}
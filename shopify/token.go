@@ -0,0 +1,65 @@
+package shopify
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// TokenCipher encrypts shop access tokens with AES-256-GCM before they are persisted
+type TokenCipher struct {
+	aead cipher.AEAD
+}
+
+// NewTokenCipher creates a cipher from a base64 encoded 32-byte key
+func NewTokenCipher(encodedKey string) (*TokenCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token key encoding: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("token key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCipher{aead: aead}, nil
+}
+
+// Encrypt seals the plaintext and returns nonce and ciphertext base64 encoded
+func (c *TokenCipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt
+func (c *TokenCipher) Decrypt(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted token encoding: %v", err)
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("encrypted token too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %v", err)
+	}
+	return string(plaintext), nil
+}
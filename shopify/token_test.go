@@ -0,0 +1,88 @@
+package shopify
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// testTokenKey returns a base64 encoded key of the given length
+func testTokenKey(length int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, length))
+}
+
+func TestNewTokenCipher(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{name: "32 bytes", key: testTokenKey(32), ok: true},
+		{name: "16 bytes", key: testTokenKey(16), ok: false},
+		{name: "33 bytes", key: testTokenKey(33), ok: false},
+		{name: "empty", key: "", ok: false},
+		{name: "not base64", key: "not a key!", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTokenCipher(tt.key)
+			if (err == nil) != tt.ok {
+				t.Fatalf("NewTokenCipher = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTokenCipherDecrypt(t *testing.T) {
+	c, err := NewTokenCipher(testTokenKey(32))
+	if err != nil {
+		t.Fatalf("NewTokenCipher: %v", err)
+	}
+	other, err := NewTokenCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if err != nil {
+		t.Fatalf("NewTokenCipher: %v", err)
+	}
+
+	encrypted, err := c.Encrypt("shpat_secret_token")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	again, err := c.Encrypt("shpat_secret_token")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if encrypted == again {
+		t.Fatal("encrypting twice gave the same ciphertext, the nonce is reused")
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		cipher  *TokenCipher
+		encoded string
+		want    string
+		ok      bool
+	}{
+		{name: "round trip", cipher: c, encoded: encrypted, want: "shpat_secret_token", ok: true},
+		{name: "tampered", cipher: c, encoded: base64.StdEncoding.EncodeToString(flipped), ok: false},
+		{name: "other key", cipher: other, encoded: encrypted, ok: false},
+		{name: "truncated", cipher: c, encoded: base64.StdEncoding.EncodeToString(sealed[:8]), ok: false},
+		{name: "not base64", cipher: c, encoded: "plaintext token", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cipher.Decrypt(tt.encoded)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Decrypt = %v, want ok %v", err, tt.ok)
+			}
+			if got != tt.want {
+				t.Fatalf("Decrypt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package shopify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sign returns the base64 HMAC-SHA256 of the body, as Shopify sends it
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	const secret = "shpss_secret"
+	const body = `{"id":123,"title":"Mug"}`
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		signature string
+		want      int
+	}{
+		{name: "valid", secret: secret, body: body, signature: sign(secret, body), want: http.StatusOK},
+		{name: "missing", secret: secret, body: body, signature: "", want: http.StatusUnauthorized},
+		{name: "tampered body", secret: secret, body: `{"id":123,"title":"Free mug"}`, signature: sign(secret, body), want: http.StatusUnauthorized},
+		{name: "other secret", secret: secret, body: body, signature: sign("other", body), want: http.StatusUnauthorized},
+		{name: "not base64", secret: secret, body: body, signature: "not base64!", want: http.StatusUnauthorized},
+		{name: "hex encoded", secret: secret, body: body, signature: "6a6b", want: http.StatusUnauthorized},
+		{name: "no secret configured", secret: "", body: body, signature: sign("", body), want: http.StatusUnauthorized},
+		{name: "body too large", secret: secret, body: strings.Repeat("x", maxWebhookBodySize+1), signature: "", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			handler := VerifyWebhook(tt.secret, func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				received = string(data)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhooks/products/update", strings.NewReader(tt.body))
+			if tt.signature != "" {
+				req.Header.Set("X-Shopify-Hmac-Sha256", tt.signature)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && received != tt.body {
+				t.Fatalf("handler read %q, want the verified body %q", received, tt.body)
+			}
+			if tt.want != http.StatusOK && received != "" {
+				t.Fatal("handler ran for a rejected webhook")
+			}
+		})
+	}
+}
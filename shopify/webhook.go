@@ -2,11 +2,14 @@ package shopify
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -14,125 +17,166 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
-// RegisterProductUpdateWebhook registers a product update webhook for Shopify
-func RegisterProductUpdateWebhook(shop, accessToken, webhookURL string) error {
-	webhookData := buildWebhookData(webhookURL)
-	url := buildWebhookURL(shop)
+// ErrUnsupportedTopic is returned for webhook topics CartLoom does not handle
+var ErrUnsupportedTopic = errors.New("unsupported webhook topic")
 
-	req, err := buildWebhookRequest(url, webhookData, accessToken)
-	if err != nil {
-		return fmt.Errorf("failed to build webhook request: %v", err)
-	}
-
-	resp, err := sendWebhookRequest(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to register webhook: %s", string(body))
-	}
-
-	log.Printf("Product update webhook registered successfully for shop %s", shop)
-	return nil
+// PayloadError is returned when a webhook payload cannot be decoded; delivering it again cannot help
+type PayloadError struct {
+	Resource string
+	Err      error
 }
 
-// HandleProductUpdateWebhook processes product update webhooks from Shopify
-func HandleProductUpdateWebhook(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *dynamodb.Client) {
-	body, err := readRequestBody(r)
-	if err != nil {
-		log.Printf("Error reading webhook request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-		return
-	}
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("invalid %s payload: %v", e.Resource, e.Err)
+}
 
-	log.Printf("Received product update webhook: %s", string(body))
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
 
-	ctx := context.Background()
+// ApplyWebhook applies a webhook event of the given topic to Redis, DynamoDB, the stock levels and
+// the shop registry. Order status changes commit the records built by outbox, and orders CartLoom
+// placed in Shopify acknowledge the stock committed to them.
+func ApplyWebhook(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, registry *ShopRegistry, stock StockLevels, outbox OrderOutbox, topic, shop string, body []byte) error {
+	switch topic {
+	case TopicProductsCreate, TopicProductsUpdate:
+		product, err := DecodeProduct(body)
+		if err != nil {
+			return err
+		}
+		return StoreProduct(ctx, rdb, db, stock, product)
 
-	if err := updateProductInRedis(ctx, rdb, "product-id-123", "updated-product-data"); err != nil {
-		log.Printf("Error updating product in Redis: %v", err)
-	}
+	case TopicProductsDelete:
+		product, err := DecodeProduct(body)
+		if err != nil {
+			return err
+		}
+		return DeleteProduct(ctx, rdb, db, strconv.FormatInt(product.ID, 10))
 
-	if err := updateProductInDynamoDB(ctx, db, "123", "updated-product-data"); err != nil {
-		log.Printf("Error updating product in DynamoDB: %v", err)
-	}
+	case TopicOrdersCreate, TopicOrdersUpdated, TopicOrdersPaid, TopicOrdersCancelled, TopicOrdersFulfilled:
+		order, err := DecodeOrder(body)
+		if err != nil {
+			return err
+		}
+		if err := StoreOrder(ctx, rdb, db, outbox, shop, order); err != nil {
+			return err
+		}
+		if order.SourceIdentifier == "" {
+			return nil
+		}
+		// Shopify's levels exclude the order's units from now on
+		return stock.AcknowledgeOrder(ctx, order.SourceIdentifier, order.CreatedAt)
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Product update processed"))
-}
+	case TopicInventoryLevelsUpdate:
+		level, err := DecodeInventoryLevel(body)
+		if err != nil {
+			return err
+		}
+		return StoreInventoryLevel(ctx, rdb, db, stock, level)
 
-// buildWebhookData creates the JSON payload for the webhook
-func buildWebhookData(webhookURL string) string {
-	return fmt.Sprintf(`{
-		"webhook": {
-			"topic": "products/update",
-			"address": "%s",
-			"format": "json"
+	case TopicAppUninstalled:
+		log.Printf("App uninstalled from shop %s", shop)
+		if err := registry.Deactivate(ctx, shop); err != nil && err != ErrShopNotFound {
+			return err
 		}
-	}`, webhookURL)
-}
+		return nil
 
-// buildWebhookURL constructs the Shopify webhook URL
-func buildWebhookURL(shop string) string {
-	return fmt.Sprintf("https://%s.myshopify.com/admin/api/2023-01/webhooks.json", shop)
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedTopic, topic)
+	}
 }
 
-// buildWebhookRequest creates a POST request for the webhook
-func buildWebhookRequest(url, webhookData, accessToken string) (*http.Request, error) {
-	req, err := http.NewRequest("POST", url, strings.NewReader(webhookData))
+// readRequestBody reads and returns the body of an HTTP request
+func readRequestBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-Shopify-Access-Token", accessToken)
-	req.Header.Set("Content-Type", "application/json")
-	return req, nil
+	defer r.Body.Close()
+	return body, nil
 }
 
-// sendWebhookRequest sends the webhook request to Shopify
-func sendWebhookRequest(req *http.Request) (*http.Response, error) {
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send webhook request: %v", err)
+// ProductCacheKey returns the Redis key holding the cached product record
+func ProductCacheKey(productID string) string {
+	return fmt.Sprintf("product:%s", productID)
+}
+
+// StoreProduct writes the normalized product to Redis and DynamoDB and links its variants to their
+// inventory items in the stock levels
+func StoreProduct(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, stock StockLevels, product *Product) error {
+	record := product.Normalize()
+
+	if err := updateProductInRedis(ctx, rdb, record); err != nil {
+		return err
 	}
-	return resp, nil
+	if err := updateProductInDynamoDB(ctx, db, record); err != nil {
+		return err
+	}
+
+	for _, v := range product.Variants {
+		if v.InventoryItemID == 0 {
+			continue
+		}
+		if err := stock.LinkItem(ctx, strconv.FormatInt(v.InventoryItemID, 10), strconv.FormatInt(v.ID, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// readRequestBody reads and returns the body of an HTTP request
-func readRequestBody(r *http.Request) ([]byte, error) {
-	body, err := io.ReadAll(r.Body)
+// DeleteProduct removes the product from Redis and DynamoDB
+func DeleteProduct(ctx context.Context, rdb *redis.Client, db *dynamodb.Client, productID string) error {
+	if err := rdb.Del(ctx, ProductCacheKey(productID)).Err(); err != nil {
+		return fmt.Errorf("failed to delete product from Redis: %v", err)
+	}
+
+	_, err := db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("Products"),
+		Key: map[string]types.AttributeValue{
+			"ProductID": &types.AttributeValueMemberS{Value: productID},
+		},
+	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to delete product from DynamoDB: %v", err)
 	}
-	defer r.Body.Close()
-	return body, nil
+	log.Printf("Product %s deleted", productID)
+	return nil
 }
 
-// updateProductInRedis simulates updating a product in Redis
-func updateProductInRedis(ctx context.Context, rdb *redis.Client, productID, data string) error {
-	err := rdb.Set(ctx, productID, data, 0).Err()
+// updateProductInRedis caches the normalized product record in Redis
+func updateProductInRedis(ctx context.Context, rdb *redis.Client, record ProductRecord) error {
+	data, err := json.Marshal(record)
 	if err != nil {
+		return fmt.Errorf("failed to encode product %s: %v", record.ProductID, err)
+	}
+
+	if err := rdb.Set(ctx, ProductCacheKey(record.ProductID), data, 0).Err(); err != nil {
 		return fmt.Errorf("failed to update product in Redis: %v", err)
 	}
-	log.Printf("Product %s updated in Redis successfully", productID)
+	log.Printf("Product %s updated in Redis successfully", record.ProductID)
 	return nil
 }
 
-// updateProductInDynamoDB simulates updating a product in DynamoDB
-func updateProductInDynamoDB(ctx context.Context, db *dynamodb.Client, productID, data string) error {
-	_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
+// updateProductInDynamoDB persists the normalized product record in DynamoDB
+func updateProductInDynamoDB(ctx context.Context, db *dynamodb.Client, record ProductRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode product %s: %v", record.ProductID, err)
+	}
+
+	_, err = db.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String("Products"),
 		Item: map[string]types.AttributeValue{
-			"ProductID": &types.AttributeValueMemberS{Value: productID},
-			"Data":      &types.AttributeValueMemberS{Value: data},
+			"ProductID": &types.AttributeValueMemberS{Value: record.ProductID},
+			"Title":     &types.AttributeValueMemberS{Value: record.Title},
+			"Status":    &types.AttributeValueMemberS{Value: record.Status},
+			"UpdatedAt": &types.AttributeValueMemberS{Value: record.UpdatedAt.UTC().Format(time.RFC3339)},
+			"Data":      &types.AttributeValueMemberS{Value: string(data)},
 		},
 	})
 	if err != nil {
 		return fmt.Errorf("failed to update product in DynamoDB: %v", err)
 	}
-	log.Printf("Product %s updated in DynamoDB successfully", productID)
+	log.Printf("Product %s updated in DynamoDB successfully", record.ProductID)
 	return nil
 }
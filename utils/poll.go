@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Poll calls poll every interval until the context is cancelled and returns the context's error.
+// poll reports how many items it handled; when that is a full batch there is probably more
+// waiting, so the next call follows immediately and a backlog drains without waiting for the
+// interval. A batch size of zero always waits. Errors are logged under name and retried on the
+// next interval.
+func Poll(ctx context.Context, name string, interval time.Duration, batchSize int, poll func(ctx context.Context) (int, error)) error {
+	for {
+		handled, err := poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("%s error: %v", name, err)
+		}
+		if err == nil && batchSize > 0 && handled >= batchSize {
+			continue
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}